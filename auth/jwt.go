@@ -17,13 +17,22 @@ var ERR_INVALID_TOKEN = fmt.Errorf("Invalid token.\n")
 var signingMethod = jwt.SigningMethodHS256
 
 func CreateToken(user *models.User, expiry time.Time) (string, error) {
+	return createToken(user, expiry, jwt.MapClaims{})
+}
+
+// CreateTokenWithRoles signs the version of the user's roles into the token, see
+// models.RoleVersion, so requests made with it once the roles changed can be told apart.
+func CreateTokenWithRoles(user *models.User, roles []*models.Role, expiry time.Time) (string, error) {
+	return createToken(user, expiry, jwt.MapClaims{"roleVersion": models.RoleVersion(roles)})
+}
+
+func createToken(user *models.User, expiry time.Time, claims jwt.MapClaims) (string, error) {
 	if user.ObjectId() == "" {
 		return "", ERR_MISSING_ID
 	}
-	token := jwt.NewWithClaims(signingMethod, jwt.MapClaims{
-		"userId": user.ObjectId(),
-		"exp":    expiry.Unix(),
-	})
+	claims["userId"] = user.ObjectId()
+	claims["exp"] = expiry.Unix()
+	token := jwt.NewWithClaims(signingMethod, claims)
 
 	tokenString, err := token.SignedString(signingKey)
 
@@ -31,6 +40,13 @@ func CreateToken(user *models.User, expiry time.Time) (string, error) {
 }
 
 func VerifyToken(tokenString string) (*models.User, error) {
+	user, _, err := VerifyTokenWithRoles(tokenString)
+	return user, err
+}
+
+// VerifyTokenWithRoles also returns the version of the roles signed into the token, empty
+// for tokens made without them.
+func VerifyTokenWithRoles(tokenString string) (*models.User, string, error) {
 
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 
@@ -43,18 +59,19 @@ func VerifyToken(tokenString string) (*models.User, error) {
 	})
 
 	if err != nil || !token.Valid {
-		return nil, ERR_INVALID_TOKEN
+		return nil, "", ERR_INVALID_TOKEN
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
 		if userId, ok := claims["userId"].(string); ok {
-			return models.NewUser(userId), nil
+			roleVersion, _ := claims["roleVersion"].(string)
+			return models.NewUser(userId), roleVersion, nil
 		} else {
-			return nil, ERR_INVALID_TOKEN
+			return nil, "", ERR_INVALID_TOKEN
 		}
 
 	}
 
-	return nil, err
+	return nil, "", err
 
 }
@@ -0,0 +1,46 @@
+// Command indexes creates the indexes declared by the models and reports any drift between
+// the declared and actual indexes. Run it after deploying model changes:
+//
+//	DB_CONNECTION_URL=mongodb://... go run ./cmd/indexes [-check]
+//
+// With -check nothing is created and the command exits with status 1 when indexes are
+// missing or differ from their declaration.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/nidhik/backend/db"
+	_ "github.com/nidhik/backend/models"
+)
+
+func main() {
+	uri := flag.String("uri", os.Getenv("DB_CONNECTION_URL"), "mongo connection url")
+	check := flag.Bool("check", false, "only report drift, do not create missing indexes")
+	flag.Parse()
+
+	db.Connect(*uri)
+	session := db.MasterSession.Copy()
+	defer session.Close()
+
+	ensure := db.EnsureIndexes
+	if *check {
+		ensure = db.CheckIndexes
+	}
+
+	drift, err := ensure(session.DB(db.Mongo.Database))
+	if err != nil {
+		fmt.Printf("Error checking indexes: %s \n", err)
+		os.Exit(1)
+	}
+
+	for _, d := range drift {
+		fmt.Println(d)
+	}
+
+	if len(drift) > 0 && *check {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,73 @@
+// Command migrate applies or reverts the migrations in the migrations package:
+//
+//	DB_CONNECTION_URL=mongodb://... go run ./cmd/migrate [-dry-run] [-down n] [-status]
+//
+// Without flags every pending migration is applied. To apply them when the server starts
+// instead, import the migrations package and call migrate.Up after db.Connect.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/migrate"
+	_ "github.com/nidhik/backend/migrations"
+	"github.com/nidhik/backend/query"
+)
+
+func main() {
+	uri := flag.String("uri", os.Getenv("DB_CONNECTION_URL"), "mongo connection url")
+	dryRun := flag.Bool("dry-run", false, "only list the migrations that would run")
+	down := flag.Int("down", 0, "revert this many of the last applied migrations")
+	status := flag.Bool("status", false, "list registered and applied migrations")
+	flag.Parse()
+
+	db.Connect(*uri)
+	ds := db.GetDataStore(query.NewMongoQueryBuilder())
+	defer ds.Close()
+
+	if *status {
+		statuses, err := migrate.Statuses(ds)
+		exitOnError(err)
+
+		for _, s := range statuses {
+			switch {
+			case !s.Registered:
+				fmt.Printf("%s applied %s, not registered\n", s.Name, s.AppliedAt)
+			case s.AppliedAt != nil:
+				fmt.Printf("%s applied %s\n", s.Name, s.AppliedAt)
+			default:
+				fmt.Printf("%s pending\n", s.Name)
+			}
+		}
+		return
+	}
+
+	opts := migrate.Options{DryRun: *dryRun}
+
+	var names []string
+	var err error
+	if *down > 0 {
+		names, err = migrate.Down(ds, *down, opts)
+	} else {
+		names, err = migrate.Up(ds, opts)
+	}
+
+	if *dryRun {
+		for _, name := range names {
+			fmt.Println("Would run", name)
+		}
+	}
+	exitOnError(err)
+
+	fmt.Printf("Done, %d migrations run.\n", len(names))
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Printf("Error running migrations: %s \n", err)
+		os.Exit(1)
+	}
+}
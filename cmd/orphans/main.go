@@ -0,0 +1,43 @@
+// Command orphans lists the references to objects that don't exist anymore: pointers and
+// relation entries left by deletions that didn't apply the delete rules of the classes
+// referring to them. With -fix, the rules are applied to them:
+//
+//	DB_CONNECTION_URL=mongodb://... go run ./cmd/orphans -fix
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/files"
+	_ "github.com/nidhik/backend/models"
+	"github.com/nidhik/backend/query"
+)
+
+func main() {
+	uri := flag.String("uri", os.Getenv("DB_CONNECTION_URL"), "mongo connection url")
+	fix := flag.Bool("fix", false, "apply the delete rules to the orphans found")
+	flag.Parse()
+
+	db.Connect(*uri)
+	// Objects deleted by the rules have their files removed
+	ds := files.NewFileDataStore(db.GetDataStore(query.NewMongoQueryBuilder()), db.GetDataStore(query.NewMongoQueryBuilder()), files.DefaultStorage)
+	defer ds.Close()
+
+	orphans, err := db.ScanOrphans(ds, *fix)
+	for _, o := range orphans {
+		missing := o.Target
+		if o.OwnerMissing {
+			missing = o.ClassName + "$" + o.ObjectId
+		}
+		fmt.Printf("%s$%s %s -> %s: %s missing, fixed: %t \n", o.ClassName, o.ObjectId, o.Key, o.Target, missing, o.Fixed)
+	}
+
+	if err != nil {
+		fmt.Printf("Error scanning for orphans: %s \n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Found %d orphans. \n", len(orphans))
+}
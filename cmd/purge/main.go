@@ -0,0 +1,38 @@
+// Command purge permanently removes objects that were deleted longer ago than the
+// retention of their class, and the stored files nothing refers to anymore. Run it daily,
+// from cron or the scheduler:
+//
+//	DB_CONNECTION_URL=mongodb://... go run ./cmd/purge
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/files"
+	_ "github.com/nidhik/backend/models"
+	"github.com/nidhik/backend/query"
+)
+
+func main() {
+	uri := flag.String("uri", os.Getenv("DB_CONNECTION_URL"), "mongo connection url")
+	flag.Parse()
+
+	db.Connect(*uri)
+	server := db.GetDataStore(query.NewMongoQueryBuilder())
+	ds := files.NewFileDataStore(db.GetDataStore(query.NewMongoQueryBuilder()), server, files.DefaultStorage)
+	defer ds.Close()
+
+	if err := db.PurgeDeleted(ds, time.Now()); err != nil {
+		fmt.Printf("Error purging deleted objects: %s \n", err)
+		os.Exit(1)
+	}
+
+	if _, err := files.PurgeUnattached(server, files.DefaultStorage, time.Now()); err != nil {
+		fmt.Printf("Error removing unattached files: %s \n", err)
+		os.Exit(1)
+	}
+}
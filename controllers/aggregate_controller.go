@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Internal keys of aggregation results, returned under their Parse names
+var resultKeys = map[string]string{
+	"_id":         "objectId",
+	"_created_at": "createdAt",
+	"_updated_at": "updatedAt",
+}
+
+// Aggregate answers a Parse style aggregation of a class, built from the match, group,
+// project, sort and limit parameters, see query.Aggregation. Responds with
+// {"results": [...]}, where the group key of each result is its objectId. Served from a
+// restricted DataStore only the objects the user may find are aggregated.
+func Aggregate(c *gin.Context) {
+	ds := c.MustGet("ds").(db.DataStore)
+	collection := c.Param("collection")
+
+	if _, err := db.LookupClass(collection); err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	var a query.Aggregation
+	params := map[string]*map[string]interface{}{
+		"match":   &a.Match,
+		"group":   &a.Group,
+		"project": &a.Project,
+	}
+	for param, v := range params {
+		if s := c.Query(param); len(s) > 0 {
+			if err := json.Unmarshal([]byte(s), v); err != nil {
+				c.JSON(http.StatusBadRequest, "Invalid "+param+".")
+				return
+			}
+		}
+	}
+
+	limit, err := intParam(c, "limit", DEFAULT_RESULTS_LIMIT)
+	if err != nil || limit == 0 || limit > db.DEFAULT_QUERY_LIMIT {
+		c.JSON(http.StatusBadRequest, "Invalid limit.")
+		return
+	}
+	a.Limit = limit
+	a.Sort = c.Query("sort")
+
+	pipeline, err := a.Pipeline()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if match, ok := pipeline[0][db.StageMatch].(bson.M); ok {
+		if pipeline[0][db.StageMatch], ok = resolveWhere(c, collection, match); !ok {
+			return
+		}
+	}
+
+	results := []bson.M{}
+	err = ds.Aggregate(collection, pipeline, func(doc bson.M) {
+		result := bson.M{}
+		for k, v := range doc {
+			if name, ok := resultKeys[k]; ok {
+				k = name
+			}
+			result[k] = v
+		}
+		results = append(results, result)
+	})
+
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"results": results})
+	case query.ERR_ACCESS_DENIED:
+		c.JSON(http.StatusForbidden, err.Error())
+	case db.ERR_INVALID_STAGE, db.ERR_UNSUPPORTED_STAGE, db.ERR_UNSUPPORTED_EXPRESSION:
+		c.JSON(http.StatusBadRequest, err.Error())
+	default:
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
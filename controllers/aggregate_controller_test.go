@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"github.com/nidhik/backend/routes"
+)
+
+// Test Cases
+
+type AggregateTest struct {
+	desc         string
+	collection   string
+	params       url.Values
+	responseCode int
+	results      []map[string]interface{}
+}
+
+func (t *AggregateTest) description() string {
+	return t.desc
+}
+
+var aggregateTests []TestCase
+
+// Test Info
+type AggregateControllerTest struct{}
+
+func (c *AggregateControllerTest) routeAndHandler(method int) (string, gin.HandlerFunc) {
+	switch method {
+	case GET:
+		return routes.AGGREGATE, Aggregate
+	default:
+		return "", nil
+	}
+}
+
+func (c *AggregateControllerTest) testCases(method int) []TestCase {
+	switch method {
+	case GET:
+		return aggregateTests
+	default:
+		return nil
+	}
+}
+
+func (c *AggregateControllerTest) setupDataStore(t *testing.T, ds db.DataStore) {
+
+	owner := models.NewEmptyUser()
+	if err := owner.Save(ds); err != nil {
+		t.Fatal("Could not setup test database:", err)
+	}
+
+	for i, status := range []string{"NEW", "DONE", "NEW", "DELETED"} {
+		task := models.NewTaskForUser(owner, models.TaskTypeEmail, models.HandleEmail)
+		task.Set("Status", status)
+		task.Set("Claimed", i)
+		if err := task.Save(ds); err != nil {
+			t.Fatal("Could not setup test database:", err)
+		}
+		if status == "DELETED" {
+			if err := task.Delete(ds); err != nil {
+				t.Fatal("Could not setup test database:", err)
+			}
+		}
+	}
+
+	aggregateTests = []TestCase{
+		&AggregateTest{"that tasks are counted by status, leaving out deleted ones", models.CollectionTask, url.Values{"group": {`{"objectId":"$taskStatus","count":{"$sum":1}}`}, "sort": {"-count"}}, 200, []map[string]interface{}{
+			{"objectId": "NEW", "count": 2.0},
+			{"objectId": "DONE", "count": 1.0},
+		}},
+		&AggregateTest{"that match, project and limit are applied", models.CollectionTask, url.Values{"match": {`{"taskStatus":"NEW"}`}, "project": {`{"objectId":0,"claimed":"$taskClaimed"}`}, "sort": {"-claimed"}, "limit": {"1"}}, 200, []map[string]interface{}{
+			{"claimed": 2.0},
+		}},
+		&AggregateTest{"that unknown accumulators are rejected", models.CollectionTask, url.Values{"group": {`{"objectId":null,"all":{"$function":"x"}}`}}, 400, nil},
+		&AggregateTest{"that malformed groups are rejected", models.CollectionTask, url.Values{"group": {`{"objectId":`}}, 400, nil},
+		&AggregateTest{"that unknown collections are not found", "NotAClass", nil, 404, nil},
+	}
+}
+
+func (c *AggregateControllerTest) runGetTest(t *testing.T, test interface{}, router *gin.Engine) {
+	testCase := test.(*AggregateTest)
+	resp := recordGet(router, "/aggregate/"+testCase.collection+"?"+testCase.params.Encode(), nil)
+
+	if resp.Code != testCase.responseCode {
+		t.Fatal("Expected: ", testCase.responseCode, "got: ", resp.Code, resp.Body.String())
+	}
+
+	if resp.Code == 200 {
+		var r QueryResult
+		json.Unmarshal(resp.Body.Bytes(), &r)
+
+		if !reflect.DeepEqual(r.Results, testCase.results) {
+			t.Fatal("Expected: ", testCase.results, "got: ", r.Results)
+		}
+	}
+}
+
+// Not used
+
+func (c *AggregateControllerTest) runPostTest(t *testing.T, test interface{}, router *gin.Engine) {}
+
+func (c *AggregateControllerTest) runDeleteTest(t *testing.T, test interface{}, router *gin.Engine) {}
+
+func (c *AggregateControllerTest) runUpdateTest(t *testing.T, test interface{}, router *gin.Engine) {}
@@ -0,0 +1,29 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/nidhik/backend/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Query parameters QueryAudit filters on, and the audit fields they match
+var auditFilters = map[string]string{
+	"className": "className",
+	"objectId":  "objectId",
+	"actor":     "actor",
+	"operation": "operation",
+}
+
+// QueryAudit lists audit records, optionally for one class, object, actor or operation,
+// with the same paging parameters as collection queries. Only serve it to admins, from a
+// DataStore that is not restricted by ACLs.
+func QueryAudit(c *gin.Context) {
+	where := bson.M{}
+	for param, field := range auditFilters {
+		if v := c.Query(param); len(v) > 0 {
+			where[field] = v
+		}
+	}
+
+	findInCollection(c, models.CollectionAudit, where, models.NewEmptyAudit())
+}
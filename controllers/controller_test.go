@@ -21,6 +21,22 @@ func TestControllers(t *testing.T) {
 	fmt.Println("Testing: Role Controller:")
 	testCRUD(t, &RolesControllerTest{})
 
+	fmt.Println()
+	fmt.Println("Testing: Object Controller:")
+	testCRUD(t, &ObjectControllerTest{})
+
+	fmt.Println()
+	fmt.Println("Testing: Aggregate Controller:")
+	testCRUD(t, &AggregateControllerTest{})
+
+	fmt.Println()
+	fmt.Println("Testing: File Controller:")
+	testCRUD(t, &FileControllerTest{})
+
+	fmt.Println()
+	fmt.Println("Testing: Relation Controller:")
+	testCRUD(t, &RelationControllerTest{})
+
 }
 
 const (
@@ -112,6 +128,14 @@ func recordPost(router *gin.Engine, url string, body io.Reader) *httptest.Respon
 	return resp
 }
 
+func recordPut(router *gin.Engine, url string, body io.Reader) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("PUT", url, body)
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	return resp
+}
+
 func getDateFromTime(t time.Time) time.Time {
 	y, m, d := t.Date()
 	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/files"
+	"github.com/nidhik/backend/models"
+	"gopkg.in/mgo.v2"
+)
+
+// UploadFile stores the request body as a file, Parse style: POST /files/avatar.png with
+// the contents as the body. The name in the url only gives the file its extension. Responds
+// with 201 and the File to set on objects, {"__type": "File", "name": "...", "url": "..."}.
+func UploadFile(c *gin.Context) {
+	server := c.MustGet("server").(db.DataStore)
+
+	if c.Request.ContentLength > files.MaxFileSize {
+		c.JSON(http.StatusRequestEntityTooLarge, files.ERR_FILE_TOO_LARGE.Error())
+		return
+	}
+
+	info, err := files.Upload(server, files.DefaultStorage, c.Param("name"), c.Request.Body)
+	switch err {
+	case nil:
+		file := models.File{Name: info.Name}
+		c.Header("Location", models.FileURL(file.Name))
+		c.JSON(http.StatusCreated, file)
+	case files.ERR_FILE_TOO_LARGE:
+		c.JSON(http.StatusRequestEntityTooLarge, err.Error())
+	case files.ERR_EMPTY_FILE:
+		c.JSON(http.StatusBadRequest, err.Error())
+	default:
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
+
+// DownloadFile serves a stored file by name. Files are named after their contents, so they
+// can be cached forever. Only images, media, pdfs and plain text are shown in browsers,
+// anything else is downloaded, so an upload can't run scripts on the server's origin.
+func DownloadFile(c *gin.Context) {
+	server := c.MustGet("server").(db.DataStore)
+	name := c.Param("name")
+
+	if !models.ValidFileName(name) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	info, err := files.FindFile(server, name)
+	if err == mgo.ErrNotFound {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	} else if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if c.GetHeader("If-None-Match") == strconv.Quote(name) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	contents, err := files.DefaultStorage.Open(name)
+	if err == files.ERR_FILE_NOT_FOUND {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	} else if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer contents.Close()
+
+	headers := map[string]string{
+		"ETag":                   strconv.Quote(name),
+		"Cache-Control":          "public, max-age=31536000, immutable",
+		"X-Content-Type-Options": "nosniff",
+	}
+	if !files.Inline(info.ContentType) {
+		headers["Content-Disposition"] = "attachment; filename=" + strconv.Quote(name)
+	}
+
+	c.DataFromReader(http.StatusOK, info.Size, info.ContentType, contents, headers)
+}
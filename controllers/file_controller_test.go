@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/files"
+	"github.com/nidhik/backend/routes"
+)
+
+// Test Cases
+
+type FileTest struct {
+	desc         string
+	name         string
+	body         string
+	ifNoneMatch  string
+	responseCode int
+	contentType  string
+	attachment   bool
+}
+
+func (t *FileTest) description() string {
+	return t.desc
+}
+
+var downloadTests []TestCase
+var uploadTests []TestCase
+
+// Test Info
+type FileControllerTest struct{}
+
+func (c *FileControllerTest) routeAndHandler(method int) (string, gin.HandlerFunc) {
+	switch method {
+	case GET:
+		return routes.FILE, DownloadFile
+	case POST:
+		return routes.FILE, UploadFile
+	default:
+		return "", nil
+	}
+}
+
+func (c *FileControllerTest) testCases(method int) []TestCase {
+	switch method {
+	case GET:
+		return downloadTests
+	case POST:
+		return uploadTests
+	default:
+		return nil
+	}
+}
+
+func (c *FileControllerTest) setupDataStore(t *testing.T, ds db.DataStore) {
+	files.DefaultStorage = files.NewLocalStorage(t.TempDir())
+
+	image, err := files.Upload(ds, files.DefaultStorage, "me.png", strings.NewReader("\x89PNG\x0D\x0A\x1A\x0A"))
+	if err != nil {
+		t.Fatal("Could not setup test database:", err)
+	}
+	page, err := files.Upload(ds, files.DefaultStorage, "page.txt", strings.NewReader("<html><script>alert(1)</script>"))
+	if err != nil {
+		t.Fatal("Could not setup test database:", err)
+	}
+
+	missing := strings.Repeat("0", 64) + ".png"
+	downloadTests = []TestCase{
+		&FileTest{"that images are shown", image.Name, "", "", 200, "image/png", false},
+		&FileTest{"that html is downloaded rather than shown", page.Name, "", "", 200, "text/html; charset=utf-8", true},
+		&FileTest{"that cached files aren't sent again", image.Name, "", `"` + image.Name + `"`, 304, "", false},
+		&FileTest{"that missing files are not found", missing, "", "", 404, "", false},
+		&FileTest{"that invalid names are not found", "..%2Fsecret", "", "", 404, "", false},
+	}
+
+	uploadTests = []TestCase{
+		&FileTest{"that files are uploaded", "export.csv", "a,b\n1,2\n", "", 201, "", false},
+		&FileTest{"that empty files are refused", "empty.txt", "", "", 400, "", false},
+	}
+}
+
+func (c *FileControllerTest) runGetTest(t *testing.T, test interface{}, router *gin.Engine) {
+	tc := test.(*FileTest)
+
+	req, _ := http.NewRequest("GET", "/files/"+tc.name, nil)
+	if len(tc.ifNoneMatch) > 0 {
+		req.Header.Set("If-None-Match", tc.ifNoneMatch)
+	}
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if resp.Code != tc.responseCode {
+		t.Fatal("Expected response code", tc.responseCode, "Got:", resp.Code)
+	}
+	if resp.Code != http.StatusOK {
+		return
+	}
+
+	if actual := resp.Header().Get("Content-Type"); actual != tc.contentType {
+		t.Fatal("Expected content type:", tc.contentType, "Actual:", actual)
+	}
+	if attachment := strings.HasPrefix(resp.Header().Get("Content-Disposition"), "attachment"); attachment != tc.attachment {
+		t.Fatal("Expected attachment:", tc.attachment, "Actual:", attachment)
+	}
+	if resp.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatal("Expected: nosniff", "Actual:", resp.Header())
+	}
+}
+
+func (c *FileControllerTest) runPostTest(t *testing.T, test interface{}, router *gin.Engine) {
+	tc := test.(*FileTest)
+
+	resp := recordPost(router, "/files/"+tc.name, strings.NewReader(tc.body))
+	if resp.Code != tc.responseCode {
+		t.Fatal("Expected response code", tc.responseCode, "Got:", resp.Code, resp.Body)
+	}
+	if resp.Code != http.StatusCreated {
+		return
+	}
+
+	var file map[string]interface{}
+	if err := json.Unmarshal(resp.Body.Bytes(), &file); err != nil {
+		t.Fatal("Could not read response:", err)
+	}
+
+	name, _ := file["name"].(string)
+	if file["__type"] != "File" || !strings.HasSuffix(name, ".csv") || file["url"] != routes.V1_API+"/files/"+name {
+		t.Fatal("Unexpected file:", file)
+	}
+
+	// The uploaded file can be downloaded
+	resp = recordGet(router, "/files/"+name, nil)
+	if resp.Code != http.StatusOK || resp.Body.String() != tc.body || resp.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Fatal("Expected:", tc.body, "Actual:", resp.Code, resp.Body, resp.Header())
+	}
+}
+
+func (c *FileControllerTest) runDeleteTest(t *testing.T, test interface{}, router *gin.Engine) {}
+
+func (c *FileControllerTest) runUpdateTest(t *testing.T, test interface{}, router *gin.Engine) {}
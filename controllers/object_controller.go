@@ -1,38 +1,133 @@
 package controllers
 
 import (
+	"encoding/json"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/nidhik/backend/db"
 	"github.com/nidhik/backend/models"
+	"github.com/nidhik/backend/query"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
+const DEFAULT_RESULTS_LIMIT = 100
+
+// Fields that are always returned, whatever keys were requested
+var alwaysReturnedKeys = []string{"id", "createdAt", "updatedAt"}
+
 func QueryCollection(c *gin.Context) {
 	collection := c.Param("collection")
-	switch collection {
-	default:
+	result := emptyModel(collection)
+	if result == nil {
 		c.AbortWithStatus(http.StatusNotFound)
 		return
 	}
+
+	where := bson.M{}
+	if w := c.Query("where"); len(w) > 0 {
+		var clause map[string]interface{}
+		if err := json.Unmarshal([]byte(w), &clause); err != nil {
+			c.JSON(http.StatusBadRequest, query.ERR_INVALID_WHERE.Error())
+			return
+		}
+
+		var err error
+		if where, err = query.ParseWhere(clause); err != nil {
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var ok bool
+		if where, ok = resolveWhere(c, collection, where); !ok {
+			return
+		}
+	}
+
+	findInCollection(c, collection, where, result)
 }
 
 func GetAll(c *gin.Context) {
 	collection := c.Param("collection")
-	switch collection {
-	default:
+	result := emptyModel(collection)
+	if result == nil {
 		c.AbortWithStatus(http.StatusNotFound)
 		return
 	}
+
+	findInCollection(c, collection, bson.M{}, result)
 }
 
+// UpdateModel applies a Parse style update, see query.ApplyUpdate, to an object. Objects of
+// classes that use optimistic locking are only updated at the "version" the client read.
+// Roles are updated by UpdateRole; other internal classes have their own endpoints.
 func UpdateModel(c *gin.Context) {
 	collection := c.Param("collection")
 	switch collection {
-	default:
+	case models.CollectionRole:
+		UpdateRole(c)
+		return
+	}
+
+	model := emptyModel(collection)
+	if model == nil || strings.HasPrefix(collection, "_") {
 		c.AbortWithStatus(http.StatusNotFound)
 		return
 	}
+
+	var update map[string]json.RawMessage
+	if err := json.NewDecoder(c.Request.Body).Decode(&update); err != nil {
+		c.JSON(http.StatusBadRequest, "Bad request.")
+		return
+	}
+
+	// The version isn't a field the update can set
+	rawVersion, versioned := update["version"]
+	delete(update, "version")
+
+	var version int
+	if versioned && json.Unmarshal(rawVersion, &version) != nil {
+		c.JSON(http.StatusBadRequest, query.ERR_INVALID_UPDATE.Error())
+		return
+	}
+
+	ds := c.MustGet("ds").(db.DataStore)
+	model.SetObjectId(c.Param("id"))
+
+	err := ds.Fetch(model)
+	if err == nil && model.UsesOptimisticLocking() {
+		if !versioned {
+			c.JSON(http.StatusBadRequest, db.ERR_VERSION_REQUIRED.Error())
+			return
+		}
+		if version != model.ObjectVersion() {
+			err = db.ERR_VERSION_CONFLICT
+		}
+	}
+
+	if err == nil {
+		if err = query.ApplyUpdate(model, update); err != nil {
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+		err = ds.UpdateObject(model)
+	}
+
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, model)
+	case query.ERR_ACCESS_DENIED:
+		c.JSON(http.StatusForbidden, err.Error())
+	case db.ERR_VERSION_CONFLICT:
+		c.JSON(http.StatusConflict, err.Error())
+	case mgo.ErrNotFound:
+		c.AbortWithStatus(http.StatusNotFound)
+	default:
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
 }
 
 func GetModel(c *gin.Context) {
@@ -62,8 +157,277 @@ func getModelFromPointer(c *gin.Context) {
 
 	if err != nil {
 		c.AbortWithError(http.StatusNotFound, err)
-	} else {
+		return
+	}
+
+	switch err := include(c, ds, []db.Model{model}); err {
+	case nil:
+		c.JSON(http.StatusOK, model)
+	case db.ERR_UNKNOWN_INCLUDE:
+		c.JSON(http.StatusBadRequest, err.Error())
+	default:
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+
+}
+
+// RestoreModel brings back a deleted object of a class that soft deletes.
+func RestoreModel(c *gin.Context) {
+	ds := c.MustGet("ds").(db.DataStore)
+	collection := c.Param("collection")
+
+	model := emptyModel(collection)
+	if model == nil || !db.SoftDeletes(collection) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	q := db.TrashQuery()
+	q["_id"] = c.Param("id")
+
+	err := ds.FindObject(collection, q, model)
+	if err == nil {
+		err = ds.RestoreObject(model)
+	}
+
+	switch err {
+	case nil:
 		c.JSON(http.StatusOK, model)
+	case query.ERR_ACCESS_DENIED:
+		c.JSON(http.StatusForbidden, err.Error())
+	case mgo.ErrNotFound:
+		c.AbortWithStatus(http.StatusNotFound)
+	default:
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
+
+// Queries
+
+func emptyModel(collection string) db.Model {
+	model, err := db.NewObject(collection, "")
+	if err != nil {
+		return nil
 	}
+	return model
+}
+
+// resolveWhere runs the sub-queries of a where clause, see query.ResolveWhere, responding
+// with the error when they fail.
+func resolveWhere(c *gin.Context, collection string, where bson.M) (bson.M, bool) {
+	ds := c.MustGet("ds").(db.DataStore)
+
+	resolved, err := query.ResolveWhere(ds, collection, where)
+	switch err {
+	case nil:
+		return resolved, true
+	case query.ERR_ACCESS_DENIED:
+		c.JSON(http.StatusForbidden, err.Error())
+	case query.ERR_INVALID_QUERY_VALUE, query.ERR_SUBQUERY_TOO_LARGE, db.ERR_NO_TEXT_INDEX:
+		c.JSON(http.StatusBadRequest, err.Error())
+	default:
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+	return nil, false
+}
+
+// include expands the keys listed in the include parameter, like include=user,user.roles,
+// on objects that were read.
+func include(c *gin.Context, ds db.DataStore, objects []db.Model) error {
+	paths := c.Query("include")
+	if len(paths) == 0 || len(objects) == 0 {
+		return nil
+	}
+	return db.Include(ds, objects, strings.Split(paths, ",")...)
+}
+
+// findInCollection answers a Parse style query, honoring the order, limit, skip, cursor,
+// keys, include and count parameters. Responds with {"results": [...], "count": n, "next": cursor},
+// where next is only present when there are more results to fetch. With deleted=1 the
+// deleted objects of the class are searched instead. Text searches without an order are
+// ranked, best match first, and each result has its "score". Ranked results can't be paged
+// with a cursor, and skip and limit together may not pass db.DEFAULT_QUERY_LIMIT.
+func findInCollection(c *gin.Context, collection string, where bson.M, result db.Model) {
+	ds := c.MustGet("ds").(db.DataStore)
+
+	if c.Query("deleted") == "1" {
+		where = copyQuery(where)
+		for k, v := range db.TrashQuery() {
+			where[k] = v
+		}
+	}
+
+	order, err := query.ParseOrder(c.Query("order"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit, err := intParam(c, "limit", DEFAULT_RESULTS_LIMIT)
+	if err != nil || limit > db.DEFAULT_QUERY_LIMIT {
+		c.JSON(http.StatusBadRequest, "Invalid limit.")
+		return
+	}
+
+	skip, err := intParam(c, "skip", 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, "Invalid skip.")
+		return
+	}
+
+	var keys []string
+	if k := c.Query("keys"); len(k) > 0 {
+		keys = append(strings.Split(k, ","), alwaysReturnedKeys...)
+	}
+
+	response := gin.H{}
+
+	if c.Query("count") == "1" {
+		n, err := ds.Count(collection, copyQuery(where))
+		if err == query.ERR_ACCESS_DENIED {
+			c.JSON(http.StatusForbidden, err.Error())
+			return
+		}
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		response["count"] = n
+	}
+
+	results := []map[string]interface{}{}
+	if limit > 0 {
+		var objects []db.Model
+		var scores []float64
+		var copyErr error
+		keep := func(model db.Model) {
+			object, err := db.CopyModel(model)
+			if err != nil {
+				copyErr = err
+			}
+			objects = append(objects, object)
+		}
 
+		var next string
+		var err error
+		if len(order) == 0 && db.TextOf(where) != nil {
+			// Text searches are ranked by relevance unless ordered otherwise, reading every
+			// result up to the page
+			if len(c.Query("cursor")) > 0 || skip+limit > db.DEFAULT_QUERY_LIMIT {
+				c.JSON(http.StatusBadRequest, db.ERR_RANKED_PAGE.Error())
+				return
+			}
+
+			err = ds.Search(collection, copyQuery(where), skip+limit, func(model db.Model, score float64) {
+				keep(model)
+				scores = append(scores, score)
+			}, result)
+
+			if len(objects) > skip {
+				objects, scores = objects[skip:], scores[skip:]
+			} else {
+				objects, scores = nil, nil
+			}
+		} else {
+			page := db.Page{Limit: limit, Skip: skip, Cursor: c.Query("cursor"), Sort: order}
+			next, err = ds.FindPage(collection, where, page, keep, result)
+		}
+
+		if err == db.ERR_INVALID_CURSOR || err == db.ERR_LIMIT_EXCEEDED || err == db.ERR_INVALID_LIMIT || err == db.ERR_NO_TEXT_INDEX {
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err == query.ERR_ACCESS_DENIED {
+			c.JSON(http.StatusForbidden, err.Error())
+			return
+		}
+
+		if err == nil {
+			err = copyErr
+		}
+
+		if err == nil {
+			err = include(c, ds, objects)
+		}
+
+		if err == db.ERR_UNKNOWN_INCLUDE {
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err == nil {
+			for i, model := range objects {
+				var object map[string]interface{}
+				if object, err = toJSONObject(model, keys); err != nil {
+					break
+				}
+				if scores != nil {
+					object["score"] = scores[i]
+				}
+				results = append(results, object)
+			}
+		}
+
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		if len(next) > 0 {
+			response["next"] = next
+		}
+	}
+
+	response["results"] = results
+	c.JSON(http.StatusOK, response)
+}
+
+func intParam(c *gin.Context, name string, defaultValue int) (int, error) {
+	s := c.Query(name)
+	if len(s) == 0 {
+		return defaultValue, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err == nil && n < 0 {
+		return 0, strconv.ErrRange
+	}
+	return n, err
+}
+
+// The restricted query builder adds its checks to the query it is given, so a query used
+// more than once needs a copy per use.
+func copyQuery(q bson.M) bson.M {
+	res := bson.M{}
+	for k, v := range q {
+		res[k] = v
+	}
+	return res
+}
+
+// toJSONObject renders a model the way c.JSON would, keeping only keys when given.
+func toJSONObject(model db.Model, keys []string) (map[string]interface{}, error) {
+	data, err := json.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+
+	if keys == nil {
+		return object, nil
+	}
+
+	selected := make(map[string]interface{})
+	for _, key := range keys {
+		key = strings.SplitN(strings.TrimSpace(key), ".", 2)[0]
+		if v, ok := object[key]; ok {
+			selected[key] = v
+		}
+	}
+	return selected, nil
 }
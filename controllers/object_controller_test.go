@@ -0,0 +1,243 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"github.com/nidhik/backend/routes"
+)
+
+// Test Cases
+
+type QueryCollectionTest struct {
+	desc         string
+	collection   string
+	params       url.Values
+	responseCode int
+	statuses     []string
+	count        int
+}
+
+func (t *QueryCollectionTest) description() string {
+	return t.desc
+}
+
+type QueryResult struct {
+	Results []map[string]interface{} `json:"results"`
+	Count   *int                     `json:"count"`
+}
+
+var queryCollectionTests []TestCase
+
+type RestoreTest struct {
+	desc         string
+	collection   string
+	id           string
+	responseCode int
+}
+
+func (t *RestoreTest) description() string {
+	return t.desc
+}
+
+var restoreTests []TestCase
+
+type UpdateModelTest struct {
+	desc         string
+	collection   string
+	id           string
+	payload      string
+	responseCode int
+	field        string
+	expected     interface{}
+}
+
+func (t *UpdateModelTest) description() string {
+	return t.desc
+}
+
+var updateModelTests []TestCase
+
+// Test Info
+type ObjectControllerTest struct{}
+
+func (c *ObjectControllerTest) routeAndHandler(method int) (string, gin.HandlerFunc) {
+
+	switch method {
+	case GET:
+		return routes.GET_COLLECTION, QueryCollection
+	case POST:
+		return routes.RESTORE_MODEL, RestoreModel
+	case PUT:
+		return routes.GET_MODEL, UpdateModel
+	default:
+		return "", nil
+	}
+}
+
+func (c *ObjectControllerTest) testCases(method int) []TestCase {
+
+	switch method {
+	case GET:
+		return queryCollectionTests
+	case POST:
+		return restoreTests
+	case PUT:
+		return updateModelTests
+	default:
+		return nil
+	}
+}
+
+func (c *ObjectControllerTest) setupDataStore(t *testing.T, ds db.DataStore) {
+
+	owner := models.NewEmptyUser()
+	if err := owner.Save(ds); err != nil {
+		t.Fatal("Could not setup test database:", err)
+	}
+
+	var first *models.Task
+	for i, status := range []string{"NEW", "DONE", "NEW", "ERROR"} {
+		task := models.NewTaskForUser(owner, models.TaskTypeEmail, models.HandleEmail, "a")
+		task.Set("Status", status)
+		task.Set("Claimed", i)
+		if err := task.Save(ds); err != nil {
+			t.Fatal("Could not setup test database:", err)
+		}
+		if first == nil {
+			first = task
+		}
+	}
+
+	deleted := models.NewTaskForUser(owner, models.TaskTypeEmail, models.HandleEmail)
+	deleted.Set("Status", "DELETED")
+	deleted.Set("Claimed", 4)
+	if err := deleted.Save(ds); err != nil {
+		t.Fatal("Could not setup test database:", err)
+	}
+	if err := deleted.Delete(ds); err != nil {
+		t.Fatal("Could not setup test database:", err)
+	}
+
+	record := models.NewEmailRecordForUser(owner, models.TaskTypeEmail, "template", "Welcome", nil)
+	if err := record.Save(ds); err != nil {
+		t.Fatal("Could not setup test database:", err)
+	}
+
+	queryCollectionTests = []TestCase{
+		&QueryCollectionTest{"that all tasks are returned without a where clause", models.CollectionTask, url.Values{"order": {"taskClaimed"}}, 200, []string{"NEW", "DONE", "NEW", "ERROR"}, -1},
+		&QueryCollectionTest{"that where filters tasks", models.CollectionTask, url.Values{"where": {`{"taskStatus":"NEW"}`}}, 200, []string{"NEW", "NEW"}, -1},
+		&QueryCollectionTest{"that comparison operators, order, skip and limit are applied", models.CollectionTask, url.Values{"where": {`{"taskClaimed":{"$gte":1}}`}, "order": {"-taskClaimed"}, "skip": {"2"}, "limit": {"1"}}, 200, []string{"DONE"}, -1},
+		&QueryCollectionTest{"that $or and $in are supported", models.CollectionTask, url.Values{"where": {`{"$or":[{"taskStatus":{"$in":["ERROR"]}},{"taskClaimed":0}]}`}, "order": {"taskClaimed"}}, 200, []string{"NEW", "ERROR"}, -1},
+		&QueryCollectionTest{"that pointers can be queried", models.CollectionTask, url.Values{"where": {`{"user":{"__type":"Pointer","className":"_User","objectId":"` + owner.ObjectId() + `"}}`}, "limit": {"0"}, "count": {"1"}}, 200, nil, 4},
+		&QueryCollectionTest{"that count is returned with results", models.CollectionTask, url.Values{"where": {`{"taskStatus":{"$ne":"NEW"}}`}, "count": {"1"}, "order": {"taskClaimed"}}, 200, []string{"DONE", "ERROR"}, 2},
+		&QueryCollectionTest{"that protected fields cannot be queried", models.CollectionUser, url.Values{"where": {`{"_hashed_password":{"$exists":true}}`}}, 400, nil, -1},
+		&QueryCollectionTest{"that unknown operators are rejected", models.CollectionTask, url.Values{"where": {`{"taskStatus":{"$where":"1"}}`}}, 400, nil, -1},
+		&QueryCollectionTest{"that malformed where clauses are rejected", models.CollectionTask, url.Values{"where": {`{"taskStatus":`}}, 400, nil, -1},
+		&QueryCollectionTest{"that classes without a text index can't be searched", models.CollectionTask, url.Values{"where": {`{"$text":{"$search":"new"}}`}}, 400, nil, -1},
+		&QueryCollectionTest{"that ranked searches can't skip past the query limit", models.CollectionUser, url.Values{"where": {`{"$text":{"$search":"new"}}`}, "skip": {"1000"}}, 400, nil, -1},
+		&QueryCollectionTest{"that ranked searches can't be paged with a cursor", models.CollectionUser, url.Values{"where": {`{"$text":{"$search":"new"}}`}, "cursor": {"abc"}}, 400, nil, -1},
+		&QueryCollectionTest{"that unknown collections are not found", "NotAClass", nil, 404, nil, -1},
+		&QueryCollectionTest{"that pointers can be included", models.CollectionTask, url.Values{"where": {`{"taskStatus":"ERROR"}`}, "include": {"user.roles"}}, 200, []string{"ERROR"}, -1},
+		&QueryCollectionTest{"that unknown keys can't be included", models.CollectionTask, url.Values{"include": {"owner"}}, 400, nil, -1},
+		&QueryCollectionTest{"that pointers can be matched with a sub-query", models.CollectionTask, url.Values{"where": {`{"user":{"$inQuery":{"className":"_User","where":{"objectId":"` + owner.ObjectId() + `"}}},"taskStatus":{"$ne":"NEW"}}`}, "order": {"taskClaimed"}}, 200, []string{"DONE", "ERROR"}, -1},
+		&QueryCollectionTest{"that sub-queries of unknown classes are rejected", models.CollectionTask, url.Values{"where": {`{"user":{"$inQuery":{"className":"NotAClass"}}}`}}, 400, nil, -1},
+		&QueryCollectionTest{"that deleted tasks are listed separately", models.CollectionTask, url.Values{"deleted": {"1"}, "count": {"1"}}, 200, []string{"DELETED"}, 1},
+	}
+
+	restoreTests = []TestCase{
+		&RestoreTest{"that deleted tasks can be restored", models.CollectionTask, deleted.ObjectId(), 200},
+		&RestoreTest{"that tasks that are not deleted can't be restored", models.CollectionTask, deleted.ObjectId(), 404},
+		&RestoreTest{"that classes that don't soft delete can't be restored", models.CollectionUser, owner.ObjectId(), 404},
+	}
+
+	updateModelTests = []TestCase{
+		&UpdateModelTest{"that fields are set", models.CollectionTask, first.ObjectId(), `{"taskMessage":"hi"}`, 200, "taskMessage", "hi"},
+		&UpdateModelTest{"that values are added to arrays", models.CollectionTask, first.ObjectId(), `{"taskParameters":{"__op":"Add","objects":["b","a"]}}`, 200, "taskParameters", []interface{}{"a", "b", "a"}},
+		&UpdateModelTest{"that values are added to arrays once", models.CollectionTask, first.ObjectId(), `{"taskParameters":{"__op":"AddUnique","objects":["b","c"]}}`, 200, "taskParameters", []interface{}{"a", "b", "a", "c"}},
+		&UpdateModelTest{"that values are removed from arrays", models.CollectionTask, first.ObjectId(), `{"taskParameters":{"__op":"Remove","objects":["a"]}}`, 200, "taskParameters", []interface{}{"b", "c"}},
+		&UpdateModelTest{"that counters are incremented", models.CollectionTask, first.ObjectId(), `{"taskClaimed":{"__op":"Increment","amount":3}}`, 200, "taskClaimed", float64(3)},
+		&UpdateModelTest{"that unknown operators are rejected", models.CollectionTask, first.ObjectId(), `{"taskParameters":{"__op":"Batch"}}`, 400, "", nil},
+		&UpdateModelTest{"that internal fields can't be updated", models.CollectionTask, first.ObjectId(), `{"_wperm":[]}`, 400, "", nil},
+		&UpdateModelTest{"that missing objects are not found", models.CollectionTask, "missing", `{"taskMessage":"hi"}`, 404, "", nil},
+		&UpdateModelTest{"that internal classes are not found", models.CollectionUser, owner.ObjectId(), `{"name":"hi"}`, 404, "", nil},
+		&UpdateModelTest{"that versioned objects need a version", models.CollectionEmailRecord, record.ObjectId(), `{"subject":"hi"}`, 400, "", nil},
+		&UpdateModelTest{"that versioned objects are updated at their version", models.CollectionEmailRecord, record.ObjectId(), `{"version":1,"subject":"hi"}`, 200, "version", float64(2)},
+		&UpdateModelTest{"that versioned objects aren't updated at an older version", models.CollectionEmailRecord, record.ObjectId(), `{"version":1,"subject":"again"}`, 409, "", nil},
+	}
+}
+
+func (c *ObjectControllerTest) runGetTest(t *testing.T, test interface{}, router *gin.Engine) {
+	testCase := test.(*QueryCollectionTest)
+	resp := recordGet(router, "/model/"+testCase.collection+"?"+testCase.params.Encode(), nil)
+	verifyQueryCollectionResponse(t, testCase, resp)
+}
+
+func verifyQueryCollectionResponse(t *testing.T, test *QueryCollectionTest, resp *httptest.ResponseRecorder) {
+
+	if resp.Code != test.responseCode {
+		t.Fatal("Expected: ", test.responseCode, "got: ", resp.Code, resp.Body.String())
+	}
+
+	if resp.Code == 200 {
+		var r QueryResult
+		json.Unmarshal(resp.Body.Bytes(), &r)
+
+		if len(r.Results) != len(test.statuses) {
+			t.Fatal("Expected # results:", len(test.statuses), "got:", len(r.Results))
+		}
+
+		for i, status := range test.statuses {
+			if r.Results[i]["taskStatus"] != status {
+				t.Fatal("Expected status:", status, "at index:", i, "got:", r.Results[i]["taskStatus"])
+			}
+		}
+
+		if test.count >= 0 && (r.Count == nil || *r.Count != test.count) {
+			t.Fatal("Expected count:", test.count, "got:", r.Count)
+		}
+	}
+}
+
+func (c *ObjectControllerTest) runPostTest(t *testing.T, test interface{}, router *gin.Engine) {
+	testCase := test.(*RestoreTest)
+	resp := recordPost(router, "/model/"+testCase.collection+"/"+testCase.id+"/restore", nil)
+
+	if resp.Code != testCase.responseCode {
+		t.Fatal("Expected: ", testCase.responseCode, "got: ", resp.Code, resp.Body.String())
+	}
+
+	if resp.Code == 200 {
+		resp = recordGet(router, "/model/"+testCase.collection+"?"+url.Values{"where": {`{"taskStatus":"DELETED"}`}}.Encode(), nil)
+		verifyQueryCollectionResponse(t, &QueryCollectionTest{testCase.desc, testCase.collection, nil, 200, []string{"DELETED"}, -1}, resp)
+	}
+}
+
+func (c *ObjectControllerTest) runUpdateTest(t *testing.T, test interface{}, router *gin.Engine) {
+	testCase := test.(*UpdateModelTest)
+	resp := recordPut(router, "/model/"+testCase.collection+"/"+testCase.id, strings.NewReader(testCase.payload))
+
+	if resp.Code != testCase.responseCode {
+		t.Fatal("Expected: ", testCase.responseCode, "got: ", resp.Code, resp.Body.String())
+	}
+
+	if resp.Code == 200 {
+		var object map[string]interface{}
+		json.Unmarshal(resp.Body.Bytes(), &object)
+
+		if !reflect.DeepEqual(object[testCase.field], testCase.expected) {
+			t.Fatal("Expected:", testCase.expected, "Actual:", object[testCase.field])
+		}
+	}
+}
+
+// Not used
+
+func (c *ObjectControllerTest) runDeleteTest(t *testing.T, test interface{}, router *gin.Engine) {}
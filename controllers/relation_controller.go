@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/query"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// RelationUpdateInfo lists the ids of the objects to add to and remove from a relation
+type RelationUpdateInfo struct {
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// GetRelation lists the objects in a relation of an object, with the same paging parameters
+// as collection queries. The object has to be readable, and only the related objects the
+// requester may read are listed.
+func GetRelation(c *gin.Context) {
+	owner, relation, ok := relationOwner(c)
+	if !ok {
+		return
+	}
+
+	where := bson.M{"$relatedTo": bson.M{
+		"className": owner.Collection(),
+		"objectId":  owner.ObjectId(),
+		"key":       relation.Name,
+	}}
+
+	where, ok = resolveWhere(c, relation.RelatedClass, where)
+	if !ok {
+		return
+	}
+
+	findInCollection(c, relation.RelatedClass, where, emptyModel(relation.RelatedClass))
+}
+
+// UpdateRelation adds objects to and removes them from a relation of an object, responding
+// with the number of objects in the relation after. Changing a relation requires write
+// access to its owner. Objects already in the relation are not added twice.
+func UpdateRelation(c *gin.Context) {
+	var json RelationUpdateInfo
+	if c.BindJSON(&json) != nil || len(json.Add)+len(json.Remove) == 0 {
+		c.JSON(http.StatusBadRequest, "Bad request.")
+		return
+	}
+
+	owner, info, ok := relationOwner(c)
+	if !ok {
+		return
+	}
+
+	ds := c.MustGet("ds").(db.DataStore)
+
+	members := make(map[string]bool)
+	err := ds.FindJoins(info.JoinCollection, bson.M{"owningId": owner.ObjectId()}, func(j db.Join) {
+		members[j.RelatedId()] = true
+	})
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	relation := info.New(owner)
+	for _, id := range json.Add {
+		if len(id) == 0 {
+			c.JSON(http.StatusBadRequest, "Bad request.")
+			return
+		}
+		if !members[id] {
+			related, _ := db.NewObject(info.RelatedClass, id)
+			relation.Add(related)
+			members[id] = true
+		}
+	}
+
+	for _, id := range json.Remove {
+		if members[id] {
+			related, _ := db.NewObject(info.RelatedClass, id)
+			relation.Remove(related)
+			delete(members, id)
+		}
+	}
+
+	switch err := ds.SaveRelatedObjects(relation); err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"count": len(members)})
+	case query.ERR_ACCESS_DENIED:
+		c.JSON(http.StatusForbidden, err.Error())
+	default:
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
+
+// relationOwner fetches the object whose relation is addressed, responding with 404 when
+// the class, the relation or the object is not found.
+func relationOwner(c *gin.Context) (db.Model, *db.RelationInfo, bool) {
+	ds := c.MustGet("ds").(db.DataStore)
+
+	info, err := db.LookupClass(c.Param("collection"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	relation, err := info.Relation(c.Param("name"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	owner := info.New(c.Param("id"))
+	switch err := ds.Fetch(owner); err {
+	case nil:
+		return owner, relation, true
+	case query.ERR_ACCESS_DENIED:
+		c.JSON(http.StatusForbidden, err.Error())
+	case mgo.ErrNotFound:
+		c.AbortWithStatus(http.StatusNotFound)
+	default:
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+	return nil, nil, false
+}
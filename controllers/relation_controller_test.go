@@ -0,0 +1,174 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"github.com/nidhik/backend/routes"
+)
+
+// Test Cases
+
+type GetRelationTest struct {
+	desc         string
+	path         string
+	params       url.Values
+	responseCode int
+	ids          []string
+}
+
+type UpdateRelationTest struct {
+	desc         string
+	path         string
+	payload      string
+	responseCode int
+	count        int
+}
+
+func (t *GetRelationTest) description() string {
+	return t.desc
+}
+
+func (t *UpdateRelationTest) description() string {
+	return t.desc
+}
+
+var getRelationTests []TestCase
+var updateRelationTests []TestCase
+
+// Test Info
+type RelationControllerTest struct{}
+
+func (c *RelationControllerTest) routeAndHandler(method int) (string, gin.HandlerFunc) {
+
+	switch method {
+	case GET:
+		return routes.RELATION, GetRelation
+	case PUT:
+		return routes.RELATION, UpdateRelation
+	default:
+		return "", nil
+	}
+}
+
+func (c *RelationControllerTest) testCases(method int) []TestCase {
+
+	switch method {
+	case GET:
+		return getRelationTests
+	case PUT:
+		return updateRelationTests
+	default:
+		return nil
+	}
+}
+
+func (c *RelationControllerTest) setupDataStore(t *testing.T, ds db.DataStore) {
+
+	role := models.NewEmptyRole()
+	role.Set("Name", "relationControllerTest")
+	role.SetAccessControlList(db.NewACL())
+	if err := role.Save(ds); err != nil {
+		t.Fatal("Could not setup test database:", err)
+	}
+
+	var users []*models.User
+	for i := 0; i < 3; i++ {
+		user := models.NewEmptyUser()
+		if err := user.Save(ds); err != nil {
+			t.Fatal("Could not setup test database:", err)
+		}
+		users = append(users, user)
+	}
+
+	role.Users.Add(users[0])
+	if err := ds.SaveRelatedObjects(role.Users); err != nil {
+		t.Fatal("Could not setup test database:", err)
+	}
+
+	path := "/model/" + models.CollectionRole + "/" + role.ObjectId() + "/relation/"
+
+	getRelationTests = []TestCase{
+		&GetRelationTest{"that related objects are listed", path + "users", url.Values{"count": {"1"}}, 200, []string{users[0].ObjectId()}},
+		&GetRelationTest{"that empty relations are listed", path + "roles", nil, 200, []string{}},
+		&GetRelationTest{"that unknown relations are not found", path + "members", nil, 404, nil},
+		&GetRelationTest{"that relations of missing objects are not found", "/model/" + models.CollectionRole + "/missing/relation/users", nil, 404, nil},
+		&GetRelationTest{"that relations of unknown classes are not found", "/model/NotAClass/" + role.ObjectId() + "/relation/users", nil, 404, nil},
+	}
+
+	updateRelationTests = []TestCase{
+		&UpdateRelationTest{"that objects are added", path + "users", `{"add":["` + users[1].ObjectId() + `","` + users[2].ObjectId() + `"]}`, 200, 3},
+		&UpdateRelationTest{"that objects are added once", path + "users", `{"add":["` + users[0].ObjectId() + `"]}`, 200, 3},
+		&UpdateRelationTest{"that objects are removed", path + "users", `{"remove":["` + users[0].ObjectId() + `","missing"]}`, 200, 2},
+		&UpdateRelationTest{"that objects are added and removed at once", path + "users", `{"add":["` + users[0].ObjectId() + `"],"remove":["` + users[1].ObjectId() + `"]}`, 200, 2},
+		&UpdateRelationTest{"that empty updates are rejected", path + "users", `{}`, 400, 0},
+		&UpdateRelationTest{"that empty ids are rejected", path + "users", `{"add":[""]}`, 400, 0},
+		&UpdateRelationTest{"that unknown relations are not found", path + "members", `{"add":["` + users[0].ObjectId() + `"]}`, 404, 0},
+	}
+}
+
+func (c *RelationControllerTest) runGetTest(t *testing.T, test interface{}, router *gin.Engine) {
+	testCase := test.(*GetRelationTest)
+	resp := recordGet(router, testCase.path+"?"+testCase.params.Encode(), nil)
+
+	if resp.Code != testCase.responseCode {
+		t.Fatal("Expected: ", testCase.responseCode, "got: ", resp.Code, resp.Body.String())
+	}
+
+	if resp.Code == 200 {
+		var r QueryResult
+		json.Unmarshal(resp.Body.Bytes(), &r)
+
+		if len(r.Results) != len(testCase.ids) {
+			t.Fatal("Expected # results:", len(testCase.ids), "got:", len(r.Results))
+		}
+
+		for i, id := range testCase.ids {
+			if r.Results[i]["id"] != id {
+				t.Fatal("Expected:", id, "at index:", i, "Actual:", r.Results[i]["id"])
+			}
+		}
+
+		if testCase.params.Get("count") == "1" && (r.Count == nil || *r.Count != len(testCase.ids)) {
+			t.Fatal("Expected count:", len(testCase.ids), "got:", r.Count)
+		}
+	}
+}
+
+func (c *RelationControllerTest) runUpdateTest(t *testing.T, test interface{}, router *gin.Engine) {
+	testCase := test.(*UpdateRelationTest)
+	resp := recordPut(router, testCase.path, strings.NewReader(testCase.payload))
+
+	if resp.Code != testCase.responseCode {
+		t.Fatal("Expected: ", testCase.responseCode, "got: ", resp.Code, resp.Body.String())
+	}
+
+	if resp.Code == 200 {
+		var r struct {
+			Count int `json:"count"`
+		}
+		json.Unmarshal(resp.Body.Bytes(), &r)
+
+		if r.Count != testCase.count {
+			t.Fatal("Expected count:", testCase.count, "Actual:", r.Count)
+		}
+
+		listed := recordGet(router, testCase.path+"?count=1", nil)
+		var q QueryResult
+		json.Unmarshal(listed.Body.Bytes(), &q)
+		if q.Count == nil || *q.Count != testCase.count {
+			t.Fatal("Expected listed count:", testCase.count, "Actual:", q.Count)
+		}
+	}
+}
+
+// Not used
+
+func (c *RelationControllerTest) runPostTest(t *testing.T, test interface{}, router *gin.Engine) {}
+
+func (c *RelationControllerTest) runDeleteTest(t *testing.T, test interface{}, router *gin.Engine) {}
@@ -15,14 +15,19 @@ type RoleInfo struct {
 type RoleWithUsers struct {
 	*models.Role `json:",inline"`
 	Users        []db.Model `json:"users"`
+	// The roles whose users have this role too
+	Roles []db.Model `json:"roles"`
 }
 
 type RoleUpdateInfo struct {
-	Name   string   `json:"name"`
-	Add    []string `json:"addUsers"`
-	Remove []string `json:"removeUsers"`
-	Read   []string `json:"readAccess"`
-	Write  []string `json:"writeAccess"`
+	Version     int      `json:"version"`
+	Name        string   `json:"name"`
+	Add         []string `json:"addUsers"`
+	Remove      []string `json:"removeUsers"`
+	AddRoles    []string `json:"addRoles"`
+	RemoveRoles []string `json:"removeRoles"`
+	Read        []string `json:"readAccess"`
+	Write       []string `json:"writeAccess"`
 }
 
 func GetRole(c *gin.Context) {
@@ -42,8 +47,15 @@ func GetRole(c *gin.Context) {
 			return
 		}
 
+		roles, err3 := role.Roles.Find(ds)
+		if err3 != nil {
+			c.AbortWithError(http.StatusInternalServerError, err3)
+			return
+		}
+
 		roleAndUsers.Role = role
 		roleAndUsers.Users = models
+		roleAndUsers.Roles = roles
 
 		c.JSON(http.StatusOK, roleAndUsers)
 	}
@@ -86,6 +98,12 @@ func UpdateRole(c *gin.Context) {
 
 	var json RoleUpdateInfo
 	if c.BindJSON(&json) == nil {
+		// Only apply the changes to the version the client saw, if it told us which one
+		if json.Version > 0 && json.Version != role.ObjectVersion() {
+			c.JSON(http.StatusConflict, db.ERR_VERSION_CONFLICT.Error())
+			return
+		}
+
 		if len(json.Name) > 0 {
 			role.Set("Name", json.Name)
 		}
@@ -98,6 +116,14 @@ func UpdateRole(c *gin.Context) {
 			role.Users.Remove(models.NewUser(userId))
 		}
 
+		for _, roleId := range json.AddRoles {
+			role.Roles.Add(models.NewRole(roleId))
+		}
+
+		for _, roleId := range json.RemoveRoles {
+			role.Roles.Remove(models.NewRole(roleId))
+		}
+
 		for _, reader := range json.Read {
 			role.ACL.AddRead(reader)
 		}
@@ -106,13 +132,24 @@ func UpdateRole(c *gin.Context) {
 			role.ACL.AddWrite(writer)
 		}
 
-		var err error
+		uow := db.NewUnitOfWork(ds)
+		uow.SaveRelation(role.Users)
+		uow.SaveRelation(role.Roles)
+		uow.Update(role)
 
-		if err = ds.SaveRelatedObjects(role.Users); err == nil {
-			if err = role.Save(ds); err == nil {
-				c.JSON(http.StatusOK, role)
-				return
+		err := uow.Commit()
+		if err == nil {
+			// Users have roles by name, which the role cache isn't told changed
+			if len(json.Name) > 0 {
+				models.ClearRoleCache()
 			}
+			c.JSON(http.StatusOK, role)
+			return
+		}
+
+		if err == db.ERR_VERSION_CONFLICT {
+			c.JSON(http.StatusConflict, err.Error())
+			return
 		}
 
 		c.AbortWithError(http.StatusInternalServerError, err)
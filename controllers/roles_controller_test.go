@@ -24,6 +24,7 @@ type GetRoleTest struct {
 	name         string
 	acl          *db.ACL
 	users        []*models.User
+	roles        []*models.Role
 	responseCode int
 }
 type PostRoleTest struct {
@@ -34,6 +35,18 @@ type PostRoleTest struct {
 	responseCode int
 }
 
+type UpdateRoleTest struct {
+	desc         string
+	id_param     string
+	payload      []byte
+	name         string
+	responseCode int
+}
+
+func (t *UpdateRoleTest) description() string {
+	return t.desc
+}
+
 func (t *GetRoleTest) description() string {
 	return t.desc
 }
@@ -55,6 +68,7 @@ var testACLC = &db.ACL{ACL: map[string]db.Permission{"ldsfniruneo": db.Permissio
 
 var getRoleTests []TestCase
 var postRoleTests []TestCase
+var updateRoleTests []TestCase
 
 // Test Info
 type RolesControllerTest struct{}
@@ -66,6 +80,8 @@ func (c *RolesControllerTest) routeAndHandler(method int) (string, gin.HandlerFu
 		return routes.GET_ROLE, GetRole
 	case POST:
 		return routes.ROLES, CreateRole
+	case PUT:
+		return routes.GET_ROLE, UpdateRole
 	default:
 		return "", nil
 	}
@@ -79,6 +95,8 @@ func (c *RolesControllerTest) testCases(method int) []TestCase {
 		return getRoleTests
 	case POST:
 		return postRoleTests
+	case PUT:
+		return updateRoleTests
 	default:
 		return nil
 	}
@@ -119,15 +137,28 @@ func (c *RolesControllerTest) setupDataStore(t *testing.T, ds db.DataStore) {
 		t.Fatal("Could not setup test database:", err)
 	}
 
+	roleWithUsers.Roles.Add(roleA)
+	if err := ds.SaveRelatedObjects(roleWithUsers.Roles); err != nil {
+		t.Fatal("Could not setup test database:", err)
+	}
+
 	getRoleTests = []TestCase{
-		&GetRoleTest{"that existing role is found", roleA.ObjectId(), roleA.ObjectId(), roleA.Name, testACLA, nil, 200},
-		&GetRoleTest{"that invalid role is not found", "some_invalid_id", roleB.ObjectId(), roleB.Name, testACLB, nil, 404},
-		&GetRoleTest{"that existing role with users is found and users are returned", roleWithUsers.ObjectId(), roleWithUsers.ObjectId(), roleWithUsers.Name, testACLC, []*models.User{userFoo, userBar}, 200}}
+		&GetRoleTest{"that existing role is found", roleA.ObjectId(), roleA.ObjectId(), roleA.Name, testACLA, nil, nil, 200},
+		&GetRoleTest{"that invalid role is not found", "some_invalid_id", roleB.ObjectId(), roleB.Name, testACLB, nil, nil, 404},
+		&GetRoleTest{"that existing role with users is found and users are returned", roleWithUsers.ObjectId(), roleWithUsers.ObjectId(), roleWithUsers.Name, testACLC, []*models.User{userFoo, userBar}, []*models.Role{roleA}, 200}}
 
 	postRoleTests = []TestCase{
 		&PostRoleTest{"that a role is created from a valid request", []byte(`{"name":"activeProUser_lkjsdnlksjan"}`), "activeProUser_lkjsdnlksjan", db.NewACL(), 200},
 		&PostRoleTest{"that a bad request returns a 400", []byte(`{"foo":"bar"}`), "", nil, 400},
 	}
+
+	updateRoleTests = []TestCase{
+		&UpdateRoleTest{"that a role is updated from the version it was loaded at", roleB.ObjectId(), []byte(`{"version":1,"name":"roleB2"}`), "roleB2", 200},
+		&UpdateRoleTest{"that an update from a stale version is a conflict", roleB.ObjectId(), []byte(`{"version":1,"name":"roleB3"}`), "", 409},
+		&UpdateRoleTest{"that an update without a version is applied", roleB.ObjectId(), []byte(`{"name":"roleB4"}`), "roleB4", 200},
+		&UpdateRoleTest{"that roles are added to a role", roleB.ObjectId(), []byte(`{"addRoles":["` + roleA.ObjectId() + `"]}`), "roleB4", 200},
+		&UpdateRoleTest{"that roles are removed from a role", roleB.ObjectId(), []byte(`{"removeRoles":["` + roleA.ObjectId() + `"]}`), "roleB4", 200},
+	}
 }
 
 func (c *RolesControllerTest) runGetTest(t *testing.T, test interface{}, router *gin.Engine) {
@@ -142,9 +173,28 @@ func (c *RolesControllerTest) runPostTest(t *testing.T, test interface{}, router
 	verifyPostRoleResponse(t, testCase, resp)
 }
 
+func (c *RolesControllerTest) runUpdateTest(t *testing.T, test interface{}, router *gin.Engine) {
+	testCase := test.(*UpdateRoleTest)
+	resp := recordPut(router, routes.ROLES+"/"+testCase.id_param, bytes.NewBuffer(testCase.payload))
+
+	if resp.Code != testCase.responseCode {
+		t.Fatal("Expected: ", testCase.responseCode, "got: ", resp.Code)
+	}
+
+	if resp.Code == 200 {
+		var r models.Role
+		json.Unmarshal(resp.Body.Bytes(), &r)
+
+		if r.Name != testCase.name {
+			t.Fatal("Expected Name:", testCase.name, "got:", r.Name)
+		}
+	}
+}
+
 type GetRoleResult struct {
 	models.Role `json:",inline"`
 	Users       []*models.User `json:"users"`
+	Roles       []*models.Role `json:"roles"`
 }
 
 func verifyGetRoleResponse(t *testing.T, test *GetRoleTest, resp *httptest.ResponseRecorder) {
@@ -188,6 +238,16 @@ func verifyGetRoleResponse(t *testing.T, test *GetRoleTest, resp *httptest.Respo
 			}
 
 		}
+
+		if len(r.Roles) != len(test.roles) {
+			t.Fatal("Expected # related roles:", len(test.roles), "got:", len(r.Roles))
+		}
+
+		for i, expectedRole := range test.roles {
+			if expectedRole.ObjectId() != r.Roles[i].ObjectId() {
+				t.Fatal("Expected role:", expectedRole.ObjectId(), "at index: ", i, "got:", r.Roles[i].ObjectId())
+			}
+		}
 	}
 }
 
@@ -235,5 +295,3 @@ func verifyPostRoleResponse(t *testing.T, test *PostRoleTest, resp *httptest.Res
 // Not used
 
 func (c *RolesControllerTest) runDeleteTest(t *testing.T, test interface{}, router *gin.Engine) {}
-
-func (c *RolesControllerTest) runUpdateTest(t *testing.T, test interface{}, router *gin.Engine) {}
@@ -51,6 +51,8 @@ func (acl *ACL) SetPublicReadWrite() {
 	acl.SetPublicWrite()
 }
 
+// CanRead and CanWrite look a single key up in the _acl map. Requests are checked with
+// Access, which considers all of the requester's keys as the database queries do.
 func (acl *ACL) CanRead(name string) bool {
 	return acl.ACL[name].Read || acl.ACL[PUBLIC_KEY].Read
 }
@@ -58,3 +60,46 @@ func (acl *ACL) CanRead(name string) bool {
 func (acl *ACL) CanWrite(name string) bool {
 	return acl.ACL[name].Write || acl.ACL[PUBLIC_KEY].Write
 }
+
+// ProtectedFields lists, by access key (a user id, "role:<name>" or "*"), the fields that
+// are left out of the objects a requester reads. A requester matching several keys only
+// misses the fields every one of them protects, so {"*": ["email"], "role:admin": []}
+// shows email to admins alone. Requesters matching no key see every field.
+type ProtectedFields map[string][]string
+
+// For lists the fields protected from a requester with the given access keys.
+func (p ProtectedFields) For(access []interface{}) []string {
+	var protected []string
+	matched := false
+
+	for _, key := range access {
+		k, _ := key.(string)
+		fields, ok := p[k]
+		if !ok {
+			continue
+		}
+
+		if !matched {
+			protected = append([]string{}, fields...)
+			matched = true
+			continue
+		}
+
+		protected = intersect(protected, fields)
+	}
+
+	return protected
+}
+
+func intersect(a []string, b []string) []string {
+	var result []string
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				result = append(result, x)
+				break
+			}
+		}
+	}
+	return result
+}
@@ -180,3 +180,27 @@ func TestBuildACL(t *testing.T) {
 	}
 
 }
+
+func TestProtectedFieldsFor(t *testing.T) {
+	protected := ProtectedFields{
+		"*":          {"email", "gender"},
+		"role:admin": {},
+		"role:staff": {"gender", "phone"},
+	}
+
+	tests := []struct {
+		access   []interface{}
+		expected []string
+	}{
+		{[]interface{}{"me", "*"}, []string{"email", "gender"}},
+		{[]interface{}{"me", "*", "role:admin"}, nil},
+		{[]interface{}{"me", "*", "role:staff"}, []string{"gender"}},
+		{[]interface{}{"me"}, nil},
+	}
+
+	for _, test := range tests {
+		if actual := protected.For(test.access); fmt.Sprint(actual) != fmt.Sprint(test.expected) {
+			t.Fatal("Expected:", test.expected, "Actual:", actual)
+		}
+	}
+}
@@ -0,0 +1,487 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var ERR_UNSUPPORTED_STAGE = errors.New("Unsupported aggregation stage.")
+var ERR_INVALID_STAGE = errors.New("Invalid aggregation stage.")
+var ERR_UNSUPPORTED_EXPRESSION = errors.New("Unsupported aggregation expression.")
+
+// Aggregation stages the datastores support, see DataStore.Aggregate. Each stage of a
+// pipeline is a document with a single key, like {"$limit": 10}. $sort takes a bson.D, as
+// the order of its keys matters.
+const (
+	StageMatch   = "$match"
+	StageGroup   = "$group"
+	StageSort    = "$sort"
+	StageLimit   = "$limit"
+	StageProject = "$project"
+)
+
+// Stage returns the name and argument of a pipeline stage.
+func Stage(stage bson.M) (string, interface{}, error) {
+	if len(stage) != 1 {
+		return "", nil, ERR_INVALID_STAGE
+	}
+
+	for name, arg := range stage {
+		switch name {
+		case StageMatch, StageGroup, StageSort, StageLimit, StageProject:
+			return name, arg, nil
+		}
+	}
+	return "", nil, ERR_UNSUPPORTED_STAGE
+}
+
+// SplitMatch returns the query of the first stage of a pipeline when it is a $match, and
+// the stages after it. Query builders add their own constraints to that query.
+func SplitMatch(pipeline []bson.M) (bson.M, []bson.M, error) {
+	if len(pipeline) == 0 {
+		return bson.M{}, nil, nil
+	}
+
+	name, arg, err := Stage(pipeline[0])
+	if err != nil || name != StageMatch {
+		return bson.M{}, pipeline, err
+	}
+
+	switch q := arg.(type) {
+	case bson.M:
+		return q, pipeline[1:], nil
+	case map[string]interface{}:
+		return q, pipeline[1:], nil
+	}
+	return nil, nil, ERR_INVALID_STAGE
+}
+
+// In memory aggregation, supporting the stages above with the expressions aggregate
+// evaluates.
+
+func aggregate(docs []bson.M, pipeline []bson.M) ([]bson.M, error) {
+	for _, stage := range pipeline {
+		name, arg, err := Stage(stage)
+		if err != nil {
+			return nil, err
+		}
+
+		// Sort keys are read as given, as converting a bson.D to a document loses their order
+		if name == StageSort {
+			fields, err := sortFields(arg)
+			if err != nil {
+				return nil, err
+			}
+			sortDocuments(docs, fields)
+			continue
+		}
+
+		doc, err := ToDocument(bson.M{"arg": arg})
+		if err != nil {
+			return nil, err
+		}
+		arg = doc["arg"]
+
+		switch name {
+		case StageMatch:
+			q, ok := arg.(bson.M)
+			if !ok {
+				return nil, ERR_INVALID_STAGE
+			}
+			var matched []bson.M
+			for _, d := range docs {
+				ok, err := matchDocument(d, q)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					matched = append(matched, d)
+				}
+			}
+			docs = matched
+
+		case StageLimit:
+			n, ok := toFloat(arg)
+			if !ok || n < 0 {
+				return nil, ERR_INVALID_STAGE
+			}
+			if int(n) < len(docs) {
+				docs = docs[:int(n)]
+			}
+
+		case StageGroup:
+			spec, ok := arg.(bson.M)
+			if !ok {
+				return nil, ERR_INVALID_STAGE
+			}
+			if docs, err = group(docs, spec); err != nil {
+				return nil, err
+			}
+
+		case StageProject:
+			spec, ok := arg.(bson.M)
+			if !ok {
+				return nil, ERR_INVALID_STAGE
+			}
+			if docs, err = project(docs, spec); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return docs, nil
+}
+
+func sortFields(arg interface{}) ([]string, error) {
+	var keys bson.D
+	switch s := arg.(type) {
+	case bson.D:
+		keys = s
+	case bson.M:
+		// Without an order, only a single key is meaningful
+		if len(s) > 1 {
+			return nil, ERR_INVALID_STAGE
+		}
+		for k, v := range s {
+			keys = append(keys, bson.DocElem{Name: k, Value: v})
+		}
+	default:
+		return nil, ERR_INVALID_STAGE
+	}
+
+	var fields []string
+	for _, key := range keys {
+		direction, ok := toFloat(key.Value)
+		switch {
+		case !ok:
+			return nil, ERR_INVALID_STAGE
+		case direction < 0:
+			fields = append(fields, "-"+key.Name)
+		default:
+			fields = append(fields, key.Name)
+		}
+	}
+	return fields, nil
+}
+
+type accumulator struct {
+	op    string
+	count int
+	value interface{}
+	// Whether $sum added anything but ints, which makes its result a float as in mongo
+	floats bool
+}
+
+func (a *accumulator) add(v interface{}) {
+	switch a.op {
+	case "$sum", "$avg":
+		if n, ok := toFloat(v); ok {
+			current, _ := toFloat(a.value)
+			a.value = current + n
+			a.count++
+
+			switch v.(type) {
+			case int, int64:
+			default:
+				a.floats = true
+			}
+		}
+	case "$min":
+		if v != nil && (a.value == nil || compareForSort(v, a.value) < 0) {
+			a.value = v
+		}
+	case "$max":
+		if v != nil && (a.value == nil || compareForSort(v, a.value) > 0) {
+			a.value = v
+		}
+	case "$first":
+		if a.count == 0 {
+			a.value = v
+		}
+		a.count++
+	case "$last":
+		a.value = v
+	case "$push":
+		list, _ := a.value.([]interface{})
+		a.value = append(list, v)
+	case "$addToSet":
+		list, _ := a.value.([]interface{})
+		if !anyEqual(list, v) {
+			list = append(list, v)
+		}
+		a.value = list
+	}
+}
+
+func (a *accumulator) result() interface{} {
+	switch a.op {
+	case "$sum":
+		if a.value == nil {
+			return 0
+		}
+		if a.floats {
+			return a.value
+		}
+		return int(a.value.(float64))
+	case "$avg":
+		if a.count == 0 {
+			return nil
+		}
+		return a.value.(float64) / float64(a.count)
+	case "$push", "$addToSet":
+		if a.value == nil {
+			return []interface{}{}
+		}
+	}
+	return a.value
+}
+
+func group(docs []bson.M, spec bson.M) ([]bson.M, error) {
+	id, ok := spec["_id"]
+	if !ok {
+		return nil, ERR_INVALID_STAGE
+	}
+
+	type bucket struct {
+		id     interface{}
+		fields map[string]*accumulator
+	}
+
+	var buckets []*bucket
+	for _, doc := range docs {
+		key, err := evaluate(doc, id)
+		if err != nil {
+			return nil, err
+		}
+
+		var b *bucket
+		for _, existing := range buckets {
+			if equalValues(existing.id, key) {
+				b = existing
+				break
+			}
+		}
+		if b == nil {
+			b = &bucket{id: key, fields: make(map[string]*accumulator)}
+			buckets = append(buckets, b)
+		}
+
+		for field, acc := range spec {
+			if field == "_id" {
+				continue
+			}
+
+			op, expr, err := accumulatorOf(acc)
+			if err != nil {
+				return nil, err
+			}
+
+			v, err := evaluate(doc, expr)
+			if err != nil {
+				return nil, err
+			}
+
+			if _, ok := b.fields[field]; !ok {
+				b.fields[field] = &accumulator{op: op}
+			}
+			b.fields[field].add(v)
+		}
+	}
+
+	var result []bson.M
+	for _, b := range buckets {
+		doc := bson.M{"_id": b.id}
+		for field, acc := range b.fields {
+			doc[field] = acc.result()
+		}
+		result = append(result, doc)
+	}
+	return result, nil
+}
+
+func accumulatorOf(acc interface{}) (string, interface{}, error) {
+	doc, ok := acc.(bson.M)
+	if !ok || len(doc) != 1 {
+		return "", nil, ERR_INVALID_STAGE
+	}
+
+	for op, expr := range doc {
+		switch op {
+		case "$sum", "$avg", "$min", "$max", "$first", "$last", "$push", "$addToSet":
+			return op, expr, nil
+		}
+	}
+	return "", nil, ERR_UNSUPPORTED_EXPRESSION
+}
+
+func project(docs []bson.M, spec bson.M) ([]bson.M, error) {
+	// Either every field listed is excluded, or only the listed fields are kept. _id is kept
+	// unless excluded.
+	excluding := true
+	for field, v := range spec {
+		if field != "_id" && !isExclusion(v) {
+			excluding = false
+		}
+	}
+
+	var result []bson.M
+	for _, doc := range docs {
+		out := bson.M{}
+		if excluding {
+			out = copyDocument(doc)
+		} else if id, ok := doc["_id"]; ok {
+			out["_id"] = id
+		}
+
+		for field, v := range spec {
+			switch {
+			case isExclusion(v):
+				unsetPath(out, field)
+			case isInclusion(v):
+				if values := lookup(doc, strings.Split(field, ".")); len(values) > 0 {
+					setPath(out, field, values[0])
+				}
+			default:
+				value, err := evaluate(doc, v)
+				if err != nil {
+					return nil, err
+				}
+				setPath(out, field, value)
+			}
+		}
+		result = append(result, out)
+	}
+	return result, nil
+}
+
+func isExclusion(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return !b
+	}
+	n, ok := toFloat(v)
+	return ok && n == 0
+}
+
+func isInclusion(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	n, ok := toFloat(v)
+	return ok && n != 0
+}
+
+// evaluate computes an aggregation expression against doc: "$field" paths, documents of
+// expressions, the date operators below and literals.
+func evaluate(doc bson.M, expr interface{}) (interface{}, error) {
+	switch e := expr.(type) {
+	case string:
+		if !strings.HasPrefix(e, "$") {
+			return e, nil
+		}
+		values := lookup(doc, strings.Split(e[1:], "."))
+		switch len(values) {
+		case 0:
+			return nil, nil
+		case 1:
+			return values[0], nil
+		}
+		return values, nil
+
+	case bson.M:
+		if len(e) == 1 {
+			for op, arg := range e {
+				if strings.HasPrefix(op, "$") {
+					return evaluateOperator(doc, op, arg)
+				}
+			}
+		}
+
+		result := bson.M{}
+		for k, sub := range e {
+			v, err := evaluate(doc, sub)
+			if err != nil {
+				return nil, err
+			}
+			result[k] = v
+		}
+		return result, nil
+
+	case []interface{}:
+		var result []interface{}
+		for _, sub := range e {
+			v, err := evaluate(doc, sub)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, v)
+		}
+		return result, nil
+	}
+
+	return expr, nil
+}
+
+// Mongo's $dateToString format specifiers, as Go layouts
+var dateFormats = strings.NewReplacer(
+	"%Y", "2006",
+	"%m", "01",
+	"%d", "02",
+	"%H", "15",
+	"%M", "04",
+	"%S", "05",
+	"%%", "%",
+)
+
+func evaluateOperator(doc bson.M, op string, arg interface{}) (interface{}, error) {
+	switch op {
+	case "$literal":
+		return arg, nil
+
+	case "$year", "$month", "$dayOfMonth", "$hour":
+		v, err := evaluate(doc, arg)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		t, ok := v.(time.Time)
+		if !ok {
+			return nil, fmt.Errorf("%s needs a date, got %v", op, v)
+		}
+
+		t = t.UTC()
+		switch op {
+		case "$year":
+			return t.Year(), nil
+		case "$month":
+			return int(t.Month()), nil
+		case "$dayOfMonth":
+			return t.Day(), nil
+		}
+		return t.Hour(), nil
+
+	case "$dateToString":
+		spec, ok := arg.(bson.M)
+		if !ok {
+			return nil, ERR_INVALID_STAGE
+		}
+		format, ok := spec["format"].(string)
+		if !ok {
+			return nil, ERR_INVALID_STAGE
+		}
+
+		v, err := evaluate(doc, spec["date"])
+		if err != nil || v == nil {
+			return nil, err
+		}
+		t, ok := v.(time.Time)
+		if !ok {
+			return nil, fmt.Errorf("%s needs a date, got %v", op, v)
+		}
+		return t.UTC().Format(dateFormats.Replace(format)), nil
+	}
+
+	return nil, ERR_UNSUPPORTED_EXPRESSION
+}
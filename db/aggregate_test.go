@@ -0,0 +1,80 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var aggregateDocs = []bson.M{
+	{"_id": "a", "status": "NEW", "tries": 1, "_created_at": time.Date(2016, 2, 8, 6, 0, 0, 0, time.UTC)},
+	{"_id": "b", "status": "DONE", "tries": 3, "_created_at": time.Date(2016, 2, 8, 9, 0, 0, 0, time.UTC)},
+	{"_id": "c", "status": "NEW", "tries": 2, "_created_at": time.Date(2016, 2, 9, 6, 0, 0, 0, time.UTC)},
+}
+
+var aggregateTests = []struct {
+	pipeline []bson.M
+	expected []bson.M
+}{
+	{
+		[]bson.M{{"$match": bson.M{"status": "NEW"}}, {"$project": bson.M{"tries": 1}}},
+		[]bson.M{{"_id": "a", "tries": 1}, {"_id": "c", "tries": 2}},
+	},
+	{
+		[]bson.M{{"$group": bson.M{"_id": "$status", "count": bson.M{"$sum": 1}, "tries": bson.M{"$avg": "$tries"}}}},
+		[]bson.M{{"_id": "NEW", "count": 2, "tries": 1.5}, {"_id": "DONE", "count": 1, "tries": 3.0}},
+	},
+	{
+		[]bson.M{
+			{"$group": bson.M{"_id": bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$_created_at"}}, "ids": bson.M{"$push": "$_id"}}},
+			{"$sort": bson.D{{Name: "_id", Value: -1}}},
+			{"$limit": 1},
+		},
+		[]bson.M{{"_id": "2016-02-09", "ids": []interface{}{"c"}}},
+	},
+	{
+		[]bson.M{
+			{"$group": bson.M{"_id": nil, "most": bson.M{"$max": "$tries"}, "statuses": bson.M{"$addToSet": "$status"}}},
+			{"$project": bson.M{"_id": 0, "most": 1, "statuses": 1}},
+		},
+		[]bson.M{{"most": 3, "statuses": []interface{}{"NEW", "DONE"}}},
+	},
+	{
+		[]bson.M{{"$project": bson.M{"_created_at": 0, "tries": false}}, {"$sort": bson.M{"_id": -1}}, {"$limit": 1}},
+		[]bson.M{{"_id": "c", "status": "NEW"}},
+	},
+}
+
+func TestAggregate(t *testing.T) {
+	for _, test := range aggregateTests {
+		result, err := aggregate(aggregateDocs, test.pipeline)
+		if err != nil {
+			t.Fatal("Could not aggregate:", err)
+		}
+
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Fatal("Pipeline:", test.pipeline, "Expected:", test.expected, "Actual:", result)
+		}
+	}
+}
+
+func TestAggregateErrors(t *testing.T) {
+	tests := []struct {
+		pipeline []bson.M
+		err      error
+	}{
+		{[]bson.M{{"$out": "copy"}}, ERR_UNSUPPORTED_STAGE},
+		{[]bson.M{{"$match": bson.M{}, "$limit": 1}}, ERR_INVALID_STAGE},
+		{[]bson.M{{"$group": bson.M{"count": bson.M{"$sum": 1}}}}, ERR_INVALID_STAGE},
+		{[]bson.M{{"$group": bson.M{"_id": nil, "all": bson.M{"$mergeObjects": "$status"}}}}, ERR_UNSUPPORTED_EXPRESSION},
+		{[]bson.M{{"$sort": bson.M{"status": 1, "tries": -1}}}, ERR_INVALID_STAGE},
+	}
+
+	for _, test := range tests {
+		if _, err := aggregate(aggregateDocs, test.pipeline); err != test.err {
+			t.Fatal("Pipeline:", test.pipeline, "Expected:", test.err, "Actual:", err)
+		}
+	}
+}
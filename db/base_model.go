@@ -1,6 +1,7 @@
 package db
 
 import (
+	"reflect"
 	"strings"
 	"time"
 
@@ -13,6 +14,8 @@ type BaseModel struct {
 	CollectionName string     `json:"collectionName" bson:"-"`
 	CreatedAt      *time.Time `json:"createdAt,omitempty" bson:"_created_at"`
 	UpdatedAt      *time.Time `json:"updatedAt,omitempty" bson:"_updated_at"`
+	Version        int        `json:"version,omitempty" bson:"_version,omitempty"`
+	DeletedAt      *time.Time `json:"deletedAt,omitempty" bson:"_deleted_at,omitempty"`
 	changes        bson.M     `json:"-" bson:"-"`
 	New            bool       `json:"isNew" bson:"-"`
 	ACL            `bson:",inline"`
@@ -40,6 +43,15 @@ func (model *BaseModel) IsNew() bool {
 	return model.New
 }
 
+func (model *BaseModel) ObjectVersion() int {
+	return model.Version
+}
+
+// Updates only apply to the version that was fetched by default, see ERR_VERSION_CONFLICT.
+func (model *BaseModel) UsesOptimisticLocking() bool {
+	return true
+}
+
 func (model *BaseModel) AccessControlList() *ACL {
 	return &model.ACL
 }
@@ -64,6 +76,10 @@ func (model *BaseModel) SetUpdatedDate(date time.Time) {
 	model.UpdatedAt = &date
 }
 
+func (model *BaseModel) SetObjectVersion(version int) {
+	model.Version = version
+}
+
 func (model *BaseModel) SetAccessControlList(acl *ACL) {
 	model.ACL = *acl
 	model.setOnUpdate("_acl", acl.ACL)
@@ -81,6 +97,10 @@ func (model *BaseModel) Update(t time.Time) map[string]interface{} {
 	return model.changes
 }
 
+func (model *BaseModel) Changes() map[string]interface{} {
+	return model.changes
+}
+
 func (model *BaseModel) Upsert(t time.Time, id string) map[string]interface{} {
 	model.setOnInsert("_updated_at", t.UTC())
 	model.setOnInsert("_created_at", t.UTC())
@@ -96,7 +116,12 @@ func (model *BaseModel) Fetch(object Model, ds DataStore) error {
 
 func (model *BaseModel) Save(object Model, ds DataStore) error {
 	if len(object.ObjectId()) == 0 {
-		return ds.InsertObject(object)
+		err := ds.InsertObject(object)
+		if err == nil {
+			// The whole object was written. Updates reload it, which clears the changes.
+			model.changes = nil
+		}
+		return err
 	}
 	return ds.UpdateObject(object)
 }
@@ -128,6 +153,41 @@ func (model *BaseModel) Increment(object Model, fieldName string, amount int) {
 
 }
 
+// Array fields are changed with $push, $addToSet and $pull, so writes by others in between
+// are kept. Changing a field in more than one way before saving sets it to its value here.
+
+// Add appends values to an array field.
+func (model *BaseModel) Add(object Model, fieldName string, values ...interface{}) {
+	model.changeArray(object, fieldName, "$push", values, func(list []reflect.Value, v reflect.Value) []reflect.Value {
+		return append(list, v)
+	})
+}
+
+// AddUnique appends the values an array field doesn't hold yet.
+func (model *BaseModel) AddUnique(object Model, fieldName string, values ...interface{}) {
+	model.changeArray(object, fieldName, "$addToSet", values, func(list []reflect.Value, v reflect.Value) []reflect.Value {
+		for _, e := range list {
+			if reflect.DeepEqual(e.Interface(), v.Interface()) {
+				return list
+			}
+		}
+		return append(list, v)
+	})
+}
+
+// Remove takes every occurrence of values out of an array field.
+func (model *BaseModel) Remove(object Model, fieldName string, values ...interface{}) {
+	model.changeArray(object, fieldName, "$pull", values, func(list []reflect.Value, v reflect.Value) []reflect.Value {
+		var kept []reflect.Value
+		for _, e := range list {
+			if !reflect.DeepEqual(e.Interface(), v.Interface()) {
+				kept = append(kept, e)
+			}
+		}
+		return kept
+	})
+}
+
 // Private methods, useful only from within BaseModel
 
 func (model *BaseModel) change(key string, tagValue string, value interface{}) {
@@ -151,11 +211,79 @@ func (model *BaseModel) setOnInsert(tagValue string, value interface{}) {
 func (model *BaseModel) setOnUpdate(tagValue string, value interface{}) {
 	model.change("$set", tagValue, value)
 	model.deleteChange("$unset", tagValue)
+	model.deleteArrayChanges(tagValue)
 }
 
 func (model *BaseModel) unset(tagValue string) {
 	model.change("$unset", tagValue, "")
 	model.deleteChange("$set", tagValue)
+	model.deleteArrayChanges(tagValue)
+}
+
+// The operators of array changes, and the key of the values they are given in
+var arrayOperators = map[string]string{
+	"$push":     "$each",
+	"$addToSet": "$each",
+	"$pull":     "$in",
+}
+
+// changeArray applies an array change to the field and records it as op, unless the field
+// was already changed some other way.
+func (model *BaseModel) changeArray(object Model, fieldName string, op string, values []interface{}, apply func([]reflect.Value, reflect.Value) []reflect.Value) {
+	tag, _ := getBSONTagAndField(object, fieldName)
+	field := reflect.ValueOf(object).Elem().FieldByName(fieldName)
+
+	list := make([]reflect.Value, field.Len())
+	for i := range list {
+		list[i] = field.Index(i)
+	}
+	for _, v := range values {
+		list = apply(list, arrayElement(field.Type().Elem(), v))
+	}
+
+	result := reflect.MakeSlice(field.Type(), 0, len(list))
+	field.Set(reflect.Append(result, list...))
+
+	pending := model.changedWith(tag)
+	switch {
+	case len(pending) == 0:
+		model.change(op, tag, bson.M{arrayOperators[op]: values})
+	case len(pending) == 1 && pending[0] == op:
+		existing := model.changes[op].(bson.M)[tag].(bson.M)
+		existing[arrayOperators[op]] = append(existing[arrayOperators[op]].([]interface{}), values...)
+	default:
+		model.setOnUpdate(tag, field.Interface())
+	}
+}
+
+func arrayElement(t reflect.Type, v interface{}) reflect.Value {
+	value := reflect.ValueOf(v)
+	if !value.IsValid() {
+		return reflect.Zero(t)
+	}
+	if !value.Type().AssignableTo(t) && value.Type().ConvertibleTo(t) {
+		return value.Convert(t)
+	}
+	return value
+}
+
+// changedWith lists the operators changing a field
+func (model *BaseModel) changedWith(tagValue string) []string {
+	var ops []string
+	for op, fields := range model.changes {
+		if _, ok := fields.(bson.M)[tagValue]; ok {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+func (model *BaseModel) deleteArrayChanges(tagValue string) {
+	for op := range arrayOperators {
+		if _, ok := model.changes[op]; ok {
+			model.deleteChange(op, tagValue)
+		}
+	}
 }
 
 func (model *BaseModel) incOnUpdate(tagValue string, amount int) {
@@ -0,0 +1,149 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// ChangeEvent describes a write to an object, with the stored document before and after
+// it. Before is nil for creates and After for deletes. Soft deletes and restores are
+// updates that set or unset _deleted_at.
+type ChangeEvent struct {
+	Type       string
+	Collection string
+	Id         string
+	Before     bson.M
+	After      bson.M
+}
+
+// ChangeFeed passes the writes made through the DataStores of this process to whoever is
+// listening, like live queries. Writes are only read back for the feed while someone
+// listens. mgo.v2 can't follow change streams, so writes made by other processes are not
+// seen; a reader of change streams can Publish them to the same feed.
+type ChangeFeed struct {
+	mu        sync.RWMutex
+	listeners map[int]func(ChangeEvent)
+	next      int
+}
+
+func NewChangeFeed() *ChangeFeed {
+	return &ChangeFeed{listeners: make(map[int]func(ChangeEvent))}
+}
+
+// Changes is the feed DataStores publish to.
+var Changes = NewChangeFeed()
+
+// RelationChanges is told of every relation saved through the DataStores of this process,
+// by join collection and owner id, so what is derived from relations can be refreshed.
+// Nothing is read back for it, unlike Changes.
+var RelationChanges = NewChangeFeed()
+
+// Listen calls f with every change published from now on, until stop is called. f is
+// called on the goroutine that made the write, so it must not block.
+func (feed *ChangeFeed) Listen(f func(ChangeEvent)) (stop func()) {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	id := feed.next
+	feed.next++
+	feed.listeners[id] = f
+
+	return func() {
+		feed.mu.Lock()
+		defer feed.mu.Unlock()
+		delete(feed.listeners, id)
+	}
+}
+
+func (feed *ChangeFeed) Listening() bool {
+	feed.mu.RLock()
+	defer feed.mu.RUnlock()
+	return len(feed.listeners) > 0
+}
+
+func (feed *ChangeFeed) Publish(e ChangeEvent) {
+	feed.mu.RLock()
+	defer feed.mu.RUnlock()
+
+	for _, f := range feed.listeners {
+		f(e)
+	}
+}
+
+// publishChange publishes a write to Changes. Either document may be nil.
+func publishChange(kind string, collectionName string, before bson.M, after bson.M) {
+	if !Changes.Listening() {
+		return
+	}
+
+	e := ChangeEvent{Type: kind, Collection: collectionName, Before: before, After: after}
+
+	for _, doc := range []bson.M{after, before} {
+		if doc != nil {
+			e.Id = fmt.Sprint(doc["_id"])
+			break
+		}
+	}
+
+	Changes.Publish(e)
+}
+
+func firstDocument(docs []bson.M) bson.M {
+	if len(docs) == 0 {
+		return nil
+	}
+	return docs[0]
+}
+
+// publishModel publishes a write whose result was loaded into model.
+func publishModel(kind string, model Model, before bson.M) {
+	if !Changes.Listening() {
+		return
+	}
+
+	after, err := ToDocument(model)
+	if err != nil {
+		fmt.Printf("Error publishing change to %s: %s \n", model.Collection(), err)
+		return
+	}
+	publishChange(kind, model.Collection(), before, after)
+}
+
+// publishRemoved publishes the removal, or soft deletion, of docs.
+func publishRemoved(collectionName string, docs []bson.M, deletedAt interface{}) {
+	if !Changes.Listening() {
+		return
+	}
+
+	for _, doc := range docs {
+		if !SoftDeletes(collectionName) {
+			publishChange(ChangeDelete, collectionName, doc, nil)
+			continue
+		}
+
+		after := copyDocument(doc)
+		after[DELETED_AT] = deletedAt
+		publishChange(ChangeUpdate, collectionName, doc, after)
+	}
+}
+
+// publishRelation publishes the saving of a relation that added or removed objects.
+func publishRelation(relation Relation) {
+	if len(relation.Inserting()) == 0 && len(relation.Removing()) == 0 {
+		return
+	}
+
+	RelationChanges.Publish(ChangeEvent{
+		Type:       ChangeUpdate,
+		Collection: relation.JoinCollection(),
+		Id:         relation.Owner().ObjectId(),
+	})
+}
@@ -2,6 +2,8 @@ package db
 
 import (
 	"time"
+
+	"gopkg.in/mgo.v2/bson"
 )
 
 type Model interface {
@@ -11,21 +13,31 @@ type Model interface {
 	UpdatedDate() time.Time
 	AccessControlList() *ACL
 	IsNew() bool
+	ObjectVersion() int
+	// Models that return false are updated without checking their version. The others are
+	// only updated at the version they were fetched at, so must be fetched before being saved.
+	UsesOptimisticLocking() bool
 	// https://godoc.org/gopkg.in/mgo.v2#Change
 	Update(t time.Time) map[string]interface{}
 	Upsert(t time.Time, id string) map[string]interface{}
+	// The changes Update would return, without stamping the update time
+	Changes() map[string]interface{}
 
 	SetObjectId(id string)
 	SetIsNew(isNew bool)
 	SetCollection(name string)
 	SetCreatedDate(date time.Time)
 	SetUpdatedDate(date time.Time)
+	SetObjectVersion(version int)
 	SetAccessControlList(acl *ACL)
 
 	Unset(fieldName string)
 	Set(fieldName string, value interface{})
 	Get(fieldName string) interface{}
 	Increment(fieldName string, amount int)
+	Add(fieldName string, values ...interface{})
+	AddUnique(fieldName string, values ...interface{})
+	Remove(fieldName string, values ...interface{})
 
 	Fetch(ds DataStore) error
 	Save(ds DataStore) error
@@ -48,6 +60,8 @@ type Relation interface {
 type RelationalDataStore interface {
 	FindRelatedObjects(relation Relation, f func(Model), result Model, sortFields ...string) error
 	FindOwningObjects(joinCollection string, relatedModel Model, f func(Model), result Model) error
+	// FindJoins calls f with each entry of a join collection that matches query
+	FindJoins(joinCollection string, query map[string]interface{}, f func(Join)) error
 
 	SaveRelatedObjects(relation Relation) error
 }
@@ -68,5 +82,15 @@ type DataStore interface {
 	Fetch(result Model) error
 	FindObject(collectionName string, query map[string]interface{}, result Model) error
 	FindEach(collectionName string, query map[string]interface{}, f func(Model), result Model, sortFields ...string) error
+	FindPage(collectionName string, query map[string]interface{}, page Page, f func(Model), result Model) (string, error)
+	// Search calls f with the objects matching a query with a $text clause and their score,
+	// best match first. At most limit objects are found when limit is above 0.
+	Search(collectionName string, query map[string]interface{}, limit int, f func(Model, float64), result Model) error
 	UpsertObject(model Model, query map[string]interface{}) error
+	// Aggregate runs an aggregation pipeline, see Stage, and calls f with each resulting document
+	Aggregate(collectionName string, pipeline []bson.M, f func(bson.M)) error
+
+	// Soft deletion, see SoftDeletes
+	RestoreObject(model Model) error
+	PurgeObjects(collectionName string, deletedBefore time.Time) (int, error)
 }
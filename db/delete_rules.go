@@ -0,0 +1,498 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var ERR_DELETE_RESTRICTED = errors.New("Object is still referred to and can't be deleted.")
+
+// What happens to the objects referring to an object that is deleted
+const (
+	// The referring objects are deleted too
+	DeleteCascade = "cascade"
+	// The reference is removed: the pointer unset, or the object taken out of the relation
+	DeleteNullify = "nullify"
+	// The object can't be deleted while anything refers to it
+	DeleteRestrict = "restrict"
+)
+
+// DeleteRule says what happens to the objects of a class when an object they refer to is
+// deleted, see ReferentialDataStore. Objects refer either through Field, which holds
+// "<Class>$<objectId>" unless TargetField names the field of the object it holds the value
+// of, or by holding the object in the class's relation named Relation.
+type DeleteRule struct {
+	Field       string
+	Class       string
+	TargetField string
+	Relation    string
+	OnDelete    string
+}
+
+// reference is a DeleteRule of className
+type reference struct {
+	className string
+	rule      DeleteRule
+	relation  *RelationInfo
+}
+
+// checkDeleteRules makes sure the DeleteRules of a class can be applied, so mistakes show
+// when it's registered rather than when objects are deleted.
+func checkDeleteRules(info *ClassInfo) error {
+	for _, rule := range info.DeleteRules {
+		switch rule.OnDelete {
+		case DeleteCascade, DeleteNullify, DeleteRestrict:
+		default:
+			return fmt.Errorf("db: DeleteRule of %s with unknown OnDelete %q", info.Name, rule.OnDelete)
+		}
+
+		if len(rule.Relation) > 0 {
+			if _, err := info.Relation(rule.Relation); err != nil {
+				return fmt.Errorf("db: DeleteRule for unknown relation %s.%s", info.Name, rule.Relation)
+			}
+			continue
+		}
+
+		if len(rule.Class) == 0 {
+			return fmt.Errorf("db: DeleteRule for %s.%s without a Class", info.Name, rule.Field)
+		}
+		if _, ok := fieldForKey(info.New(""), rule.Field); !ok {
+			return fmt.Errorf("db: DeleteRule for unknown field %s.%s", info.Name, rule.Field)
+		}
+	}
+	return nil
+}
+
+// references lists the rules of every class for objects of className
+func references(className string) []reference {
+	var refs []reference
+	for _, name := range RegisteredClasses() {
+		info, _ := LookupClass(name)
+		for _, rule := range info.DeleteRules {
+			if len(rule.Relation) > 0 {
+				// Checked when the class was registered
+				relation, err := info.Relation(rule.Relation)
+				if err == nil && relation.RelatedClass == className {
+					refs = append(refs, reference{className: name, rule: rule, relation: relation})
+				}
+			} else if rule.Class == className {
+				refs = append(refs, reference{className: name, rule: rule})
+			}
+		}
+	}
+	return refs
+}
+
+// query matches the objects referring to target through a field, nil when target can't be
+// referred to that way.
+func (r reference) query(target Model) bson.M {
+	var value interface{} = target.Collection() + "$" + target.ObjectId()
+	if len(r.rule.TargetField) > 0 {
+		doc, err := ToDocument(target)
+		if err != nil {
+			return nil
+		}
+		// Objects without the value, like users without an email, are referred to by nothing
+		if value = doc[r.rule.TargetField]; value == nil || value == "" {
+			return nil
+		}
+	}
+	return bson.M{r.rule.Field: value}
+}
+
+// each calls f with a copy of every object referring to target
+func (r reference) each(ds DataStore, target Model, f func(Model)) error {
+	result, err := NewObject(r.className, "")
+	if err != nil {
+		return err
+	}
+
+	var copyErr error
+	keep := func(model Model) {
+		c, err := CopyModel(model)
+		if err != nil {
+			copyErr = err
+			return
+		}
+		f(c)
+	}
+
+	if r.relation != nil {
+		err = ds.FindOwningObjects(r.relation.JoinCollection, target, keep, result)
+	} else if q := r.query(target); q != nil {
+		err = ds.FindEach(r.className, q, keep, result)
+	}
+
+	if err == nil {
+		err = copyErr
+	}
+	return err
+}
+
+// ReferentialDataStore applies the DeleteRules of registered classes to the objects deleted
+// through it: the objects referring to them are deleted too, their references removed, or
+// the deletion refused with ERR_DELETE_RESTRICTED. Deleting an object also takes everything
+// out of its own relations. server finds the referring objects and changes them, and should
+// not be restricted by ACLs; wrap it in a models.AuditedDataStore for its writes to be
+// recorded like the requester's, and a files.FileDataStore for the files of the objects
+// deleted to be removed. Everything else is passed straight through.
+//
+// Everything the rules write is worked out before the requester's delete, then written as a
+// UnitOfWork. When that fails its writes are undone and the deleted objects restored, which
+// only classes that soft delete can be.
+//
+// Rules are applied when an object is deleted, soft deleted included, and restoring it
+// doesn't undo them. Use ScanOrphans for references left by deletions made otherwise.
+type ReferentialDataStore struct {
+	DataStore
+	server DataStore
+}
+
+func NewReferentialDataStore(ds DataStore, server DataStore) *ReferentialDataStore {
+	return &ReferentialDataStore{DataStore: ds, server: server}
+}
+
+func (r *ReferentialDataStore) Close() {
+	r.DataStore.Close()
+	r.server.Close()
+}
+
+func (r *ReferentialDataStore) RemoveObject(model Model) error {
+	// Unregistered classes have no rules, and missing objects nothing to apply them for
+	target, err := NewObject(model.Collection(), model.ObjectId())
+	if err != nil {
+		return r.DataStore.RemoveObject(model)
+	}
+	switch err := r.server.Fetch(target); err {
+	case nil:
+	case mgo.ErrNotFound:
+		return r.DataStore.RemoveObject(model)
+	default:
+		return err
+	}
+
+	writes, err := planDelete(r.server, []Model{target})
+	if err != nil {
+		return err
+	}
+
+	if err := r.DataStore.RemoveObject(model); err != nil {
+		return err
+	}
+
+	return commitDelete(r.server, writes, []Model{target})
+}
+
+// RemoveAll applies the rules to each object removed. The objects the query matches are
+// found through server before and after, as the ones the requester may remove need not be
+// ones they may read. A restrict rule refuses the removal when any of them is referred to.
+func (r *ReferentialDataStore) RemoveAll(collectionName string, query map[string]interface{}) error {
+	info, err := LookupClass(collectionName)
+	if err != nil || (len(references(collectionName)) == 0 && len(info.Relations) == 0) {
+		return r.DataStore.RemoveAll(collectionName, query)
+	}
+
+	targets, err := r.matching(info, query)
+	if err != nil {
+		return err
+	}
+
+	if _, err := cascade(r.server, targets); err != nil {
+		return err
+	}
+
+	if err := r.DataStore.RemoveAll(collectionName, query); err != nil {
+		return err
+	}
+
+	remaining, err := r.matching(info, query)
+	if err != nil {
+		return err
+	}
+
+	kept := make(map[string]bool)
+	for _, model := range remaining {
+		kept[model.ObjectId()] = true
+	}
+
+	var removed []Model
+	for _, model := range targets {
+		if !kept[model.ObjectId()] {
+			removed = append(removed, model)
+		}
+	}
+
+	writes, err := planDelete(r.server, removed)
+	if err != nil {
+		return err
+	}
+	return commitDelete(r.server, writes, removed)
+}
+
+// matching finds copies of the objects a query matches, whoever may read them
+func (r *ReferentialDataStore) matching(info *ClassInfo, query map[string]interface{}) ([]Model, error) {
+	var models []Model
+	var copyErr error
+	err := r.server.FindEach(info.Name, copyDocument(bson.M(query)), func(model Model) {
+		c, err := CopyModel(model)
+		if err != nil {
+			copyErr = err
+			return
+		}
+		models = append(models, c)
+	}, info.New(""))
+	if err == nil {
+		err = copyErr
+	}
+	return models, err
+}
+
+// planDelete works out what deleting targets writes, failing when a restrict rule refuses
+// any of them. Nothing is written until the UnitOfWork is committed.
+func planDelete(server DataStore, targets []Model) (*UnitOfWork, error) {
+	deleted, err := cascade(server, targets)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &deleteWrites{
+		seen:      make(map[string]bool),
+		updates:   make(map[string]Model),
+		relations: make(map[string]Relation),
+	}
+	for _, model := range deleted {
+		w.seen[objectKey(model)] = true
+	}
+
+	for _, model := range deleted {
+		if err := w.nullify(server, model); err != nil {
+			return nil, err
+		}
+		if err := w.clearRelations(server, model); err != nil {
+			return nil, err
+		}
+	}
+
+	u := NewUnitOfWork(server)
+	for _, model := range w.updated {
+		u.Update(model)
+	}
+	for _, key := range w.relationKeys {
+		u.SaveRelation(w.relations[key])
+	}
+
+	// Objects that soft delete can be restored if a later write fails, so they go first
+	cascaded := deleted[len(targets):]
+	for _, model := range cascaded {
+		if SoftDeletes(model.Collection()) {
+			u.Remove(model)
+		}
+	}
+	for _, model := range cascaded {
+		if !SoftDeletes(model.Collection()) {
+			u.Remove(model)
+		}
+	}
+	return u, nil
+}
+
+// cascade lists the objects deleting targets deletes, targets first
+func cascade(server DataStore, targets []Model) ([]Model, error) {
+	seen := make(map[string]bool)
+	deleted := append([]Model{}, targets...)
+	for _, t := range targets {
+		seen[objectKey(t)] = true
+	}
+
+	for i := 0; i < len(deleted); i++ {
+		for _, ref := range references(deleted[i].Collection()) {
+			if ref.rule.OnDelete != DeleteCascade && ref.rule.OnDelete != DeleteRestrict {
+				continue
+			}
+
+			restricted := false
+			err := ref.each(server, deleted[i], func(model Model) {
+				key := objectKey(model)
+				switch {
+				case ref.rule.OnDelete == DeleteRestrict:
+					restricted = restricted || !seen[key]
+				case !seen[key]:
+					seen[key] = true
+					deleted = append(deleted, model)
+				}
+			})
+
+			if err != nil {
+				return nil, err
+			}
+			if restricted {
+				return nil, ERR_DELETE_RESTRICTED
+			}
+		}
+	}
+	return deleted, nil
+}
+
+// commitDelete writes what the deletion of targets planned. When that fails the targets,
+// already deleted by the requester, are restored too.
+func commitDelete(server DataStore, writes *UnitOfWork, targets []Model) error {
+	err := writes.Commit()
+	if err == nil {
+		return nil
+	}
+
+	var rollbackErrors []error
+	if commitErr, ok := err.(*CommitError); ok {
+		err, rollbackErrors = commitErr.Err, commitErr.RollbackErrors
+	}
+
+	for _, target := range targets {
+		if !SoftDeletes(target.Collection()) {
+			rollbackErrors = append(rollbackErrors, fmt.Errorf("%s can't be restored", objectKey(target)))
+		} else if rerr := server.RestoreObject(target); rerr != nil {
+			rollbackErrors = append(rollbackErrors, rerr)
+		}
+	}
+
+	fmt.Printf("Error applying delete rules: %s \n", err)
+	if len(rollbackErrors) > 0 {
+		return &CommitError{err, rollbackErrors}
+	}
+	return err
+}
+
+// deleteWrites collects the updates and relation changes removing the references to deleted
+// objects, one per object changed.
+type deleteWrites struct {
+	seen         map[string]bool
+	updates      map[string]Model
+	updated      []Model
+	relations    map[string]Relation
+	relationKeys []string
+}
+
+func objectKey(model Model) string {
+	return model.Collection() + "$" + model.ObjectId()
+}
+
+func (w *deleteWrites) nullify(server DataStore, target Model) error {
+	for _, ref := range references(target.Collection()) {
+		if ref.rule.OnDelete != DeleteNullify {
+			continue
+		}
+
+		var fieldErr error
+		err := ref.each(server, target, func(model Model) {
+			key := objectKey(model)
+			if w.seen[key] {
+				return
+			}
+
+			if ref.relation != nil {
+				w.remove(ref.className, ref.relation, model.ObjectId(), target.ObjectId())
+				return
+			}
+
+			name, ok := fieldForKey(model, ref.rule.Field)
+			if !ok {
+				fieldErr = fmt.Errorf("db: DeleteRule for unknown field %s.%s", ref.className, ref.rule.Field)
+				return
+			}
+
+			if _, ok := w.updates[key]; !ok {
+				w.updates[key] = model
+				w.updated = append(w.updated, model)
+			}
+			w.updates[key].Unset(name)
+		})
+
+		if err == nil {
+			err = fieldErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearRelations takes every object out of the relations the model owns
+func (w *deleteWrites) clearRelations(server DataStore, model Model) error {
+	info, err := LookupClass(model.Collection())
+	if err != nil {
+		return nil
+	}
+
+	for i := range info.Relations {
+		r := &info.Relations[i]
+		if err := server.FindJoins(r.JoinCollection, bson.M{"owningId": model.ObjectId()}, func(j Join) {
+			w.remove(info.Name, r, model.ObjectId(), j.RelatedId())
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove takes the related object out of the relation of the owner, of className, once
+func (w *deleteWrites) remove(className string, r *RelationInfo, owningId string, relatedId string) {
+	key := r.JoinCollection + "$" + owningId
+	if w.seen[key+"$"+relatedId] {
+		return
+	}
+	w.seen[key+"$"+relatedId] = true
+
+	relation, ok := w.relations[key]
+	if !ok {
+		owner, _ := NewObject(className, owningId)
+		relation = r.New(owner)
+		w.relations[key] = relation
+		w.relationKeys = append(w.relationKeys, key)
+	}
+
+	related, _ := NewObject(r.RelatedClass, relatedId)
+	relation.Remove(related)
+}
+
+// removeJoins takes the related objects out of the relation of the owner, of className
+func removeJoins(server DataStore, className string, r *RelationInfo, owningId string, relatedIds []string) error {
+	if len(relatedIds) == 0 {
+		return nil
+	}
+
+	owner, err := NewObject(className, owningId)
+	if err != nil {
+		return err
+	}
+
+	relation := r.New(owner)
+	for _, id := range relatedIds {
+		related, err := NewObject(r.RelatedClass, id)
+		if err != nil {
+			return err
+		}
+		relation.Remove(related)
+	}
+	return server.SaveRelatedObjects(relation)
+}
+
+// fieldForKey finds the name of the model's field stored under key
+func fieldForKey(model Model, key string) (string, bool) {
+	t := reflect.TypeOf(model)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if strings.Split(f.Tag.Get("bson"), ",")[0] == key && !f.Anonymous {
+			return f.Name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,189 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Locations are stored as GeoJSON points, {"type": "Point", "coordinates": [lng, lat]}, and
+// declared with a 2dsphere index: Index{Key: []string{GEO_KEY + "location"}}.
+const GEO_KEY = "$2dsphere:"
+
+// The mean radius of the earth, to convert between distances and radians
+const EarthRadiusKilometers = 6371.0
+const EarthRadiusMiles = 3958.8
+
+// GeoJSON returns the GeoJSON point stored for a location.
+func GeoJSON(latitude float64, longitude float64) bson.M {
+	return bson.M{"type": "Point", "coordinates": []interface{}{longitude, latitude}}
+}
+
+// geoJSONPoint reads the coordinates of a stored GeoJSON point.
+func geoJSONPoint(v interface{}) (lng float64, lat float64, ok bool) {
+	doc, isDoc := v.(bson.M)
+	if !isDoc || doc["type"] != "Point" {
+		return 0, 0, false
+	}
+
+	coordinates, isArray := doc["coordinates"].([]interface{})
+	if !isArray || len(coordinates) != 2 {
+		return 0, 0, false
+	}
+
+	lng, ok1 := toFloat(coordinates[0])
+	lat, ok2 := toFloat(coordinates[1])
+	return lng, lat, ok1 && ok2
+}
+
+// geoDistance is the distance in meters between two points along the earth's surface.
+func geoDistance(lng1, lat1, lng2, lat2 float64) float64 {
+	toRadians := func(d float64) float64 { return d * math.Pi / 180 }
+
+	dLat := toRadians(lat2 - lat1)
+	dLng := toRadians(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+
+	return 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a)) * EarthRadiusKilometers * 1000
+}
+
+// inRing reports whether a point lies inside a closed ring of [lng, lat] coordinates, on a
+// flat projection, which is close enough for the areas queries cover.
+func inRing(lng, lat float64, ring []interface{}) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi, ok1 := coordinates(ring[i])
+		xj, yj, ok2 := coordinates(ring[j])
+		if !ok1 || !ok2 {
+			return false
+		}
+
+		if (yi > lat) != (yj > lat) && lng < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func coordinates(v interface{}) (float64, float64, bool) {
+	pair, ok := v.([]interface{})
+	if !ok || len(pair) != 2 {
+		return 0, 0, false
+	}
+	x, ok1 := toFloat(pair[0])
+	y, ok2 := toFloat(pair[1])
+	return x, y, ok1 && ok2
+}
+
+// geometry reads the point or polygon of a $nearSphere or $geoWithin operator.
+func geometry(arg interface{}, kind string) (bson.M, error) {
+	spec, ok := arg.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("$nearSphere and $geoWithin expect a document")
+	}
+
+	g, ok := spec["$geometry"].(bson.M)
+	if !ok || g["type"] != kind {
+		return nil, fmt.Errorf("expected a %s $geometry", kind)
+	}
+	return g, nil
+}
+
+// matchNearSphere matches the points within $maxDistance meters of the $geometry point.
+func matchNearSphere(values []interface{}, arg interface{}) (bool, error) {
+	point, err := geometry(arg, "Point")
+	if err != nil {
+		return false, err
+	}
+
+	lng, lat, ok := geoJSONPoint(point)
+	if !ok {
+		return false, fmt.Errorf("invalid $nearSphere point")
+	}
+
+	maxDistance, limited := toFloat(arg.(bson.M)["$maxDistance"])
+	for _, v := range values {
+		if vlng, vlat, ok := geoJSONPoint(v); ok {
+			if !limited || geoDistance(lng, lat, vlng, vlat) <= maxDistance {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// matchGeoWithin matches the points inside the $geometry polygon.
+func matchGeoWithin(values []interface{}, arg interface{}) (bool, error) {
+	polygon, err := geometry(arg, "Polygon")
+	if err != nil {
+		return false, err
+	}
+
+	rings, ok := polygon["coordinates"].([]interface{})
+	if !ok || len(rings) == 0 {
+		return false, fmt.Errorf("invalid $geoWithin polygon")
+	}
+	outer, ok := rings[0].([]interface{})
+	if !ok {
+		return false, fmt.Errorf("invalid $geoWithin polygon")
+	}
+
+	for _, v := range values {
+		if lng, lat, ok := geoJSONPoint(v); ok && inRing(lng, lat, outer) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// nearQuery finds the $nearSphere condition of a query, which mongo sorts results by.
+func nearQuery(query map[string]interface{}) (field string, lng float64, lat float64, ok bool) {
+	for key, cond := range query {
+		ops, isOps := cond.(bson.M)
+		if !isOps {
+			if m, isMap := cond.(map[string]interface{}); isMap {
+				ops, isOps = bson.M(m), true
+			}
+		}
+		if !isOps || strings.HasPrefix(key, "$") {
+			continue
+		}
+
+		near, found := ops["$nearSphere"]
+		if !found {
+			continue
+		}
+
+		doc, err := ToDocument(bson.M{"near": near})
+		if err != nil {
+			continue
+		}
+		if point, err := geometry(doc["near"], "Point"); err == nil {
+			if lng, lat, ok := geoJSONPoint(point); ok {
+				return key, lng, lat, true
+			}
+		}
+	}
+	return "", 0, 0, false
+}
+
+// sortByDistance orders documents closest to the point first, like mongo does for
+// $nearSphere queries without a sort.
+func sortByDistance(docs []bson.M, field string, lng float64, lat float64) {
+	distance := func(doc bson.M) float64 {
+		for _, v := range lookup(doc, strings.Split(field, ".")) {
+			if vlng, vlat, ok := geoJSONPoint(v); ok {
+				return geoDistance(lng, lat, vlng, vlat)
+			}
+		}
+		return math.Inf(1)
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool {
+		return distance(docs[i]) < distance(docs[j])
+	})
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// New York, with Newark about 14km away and Philadelphia about 130km away
+var (
+	newYork      = GeoJSON(40.7128, -74.0060)
+	newark       = GeoJSON(40.7357, -74.1724)
+	philadelphia = GeoJSON(39.9526, -75.1652)
+)
+
+var geoTests = []struct {
+	query   bson.M
+	matches bool
+}{
+	{bson.M{"location": bson.M{"$nearSphere": bson.M{"$geometry": newYork}}}, true},
+	{bson.M{"location": bson.M{"$nearSphere": bson.M{"$geometry": newYork, "$maxDistance": 20000}}}, true},
+	{bson.M{"location": bson.M{"$nearSphere": bson.M{"$geometry": philadelphia, "$maxDistance": 20000}}}, false},
+	{bson.M{"location": bson.M{"$geoWithin": bson.M{"$geometry": bson.M{"type": "Polygon", "coordinates": []interface{}{[]interface{}{
+		[]interface{}{-75.0, 40.0}, []interface{}{-73.0, 40.0}, []interface{}{-73.0, 41.0}, []interface{}{-75.0, 41.0}, []interface{}{-75.0, 40.0}}}}}}}, true},
+	{bson.M{"location": bson.M{"$geoWithin": bson.M{"$geometry": bson.M{"type": "Polygon", "coordinates": []interface{}{[]interface{}{
+		[]interface{}{-76.0, 39.0}, []interface{}{-75.0, 39.0}, []interface{}{-75.0, 40.0}, []interface{}{-76.0, 39.0}}}}}}}, false},
+	{bson.M{"missing": bson.M{"$nearSphere": bson.M{"$geometry": newYork}}}, false},
+}
+
+func TestGeoQueries(t *testing.T) {
+	doc := bson.M{"_id": "abc", "location": newark}
+	for _, test := range geoTests {
+		matches, err := matchDocument(doc, test.query)
+		if err != nil {
+			t.Fatal("Unexpected error for", test.query, err)
+		}
+		if matches != test.matches {
+			t.Fatal("Expected", test.query, "to match:", test.matches, "Actual:", matches)
+		}
+	}
+
+	if _, err := matchDocument(doc, bson.M{"location": bson.M{"$nearSphere": newYork}}); err == nil {
+		t.Fatal("Expected: an error for a $nearSphere without a $geometry", "Actual:", err)
+	}
+
+	d := geoDistance(-74.0060, 40.7128, -75.1652, 39.9526)
+	if d < 125000 || d > 135000 {
+		t.Fatal("Expected: about 130km", "Actual:", d)
+	}
+
+	docs := []bson.M{{"_id": "phl", "location": philadelphia}, {"_id": "none"}, {"_id": "ewr", "location": newark}}
+	sortByDistance(docs, "location", -74.0060, 40.7128)
+	if docs[0]["_id"] != "ewr" || docs[1]["_id"] != "phl" || docs[2]["_id"] != "none" {
+		t.Fatal("Expected: ewr, phl, none", "Actual:", docs)
+	}
+}
@@ -0,0 +1,191 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var ERR_UNKNOWN_INCLUDE = errors.New("Unknown key to include.")
+
+// IncludeInfo describes a key of a class that reads can expand into full objects, see
+// Include. The objects are either pointed to from Field, which holds
+// "<className>$<objectId>", or own the object through a relation stored in JoinCollection,
+// like the roles of a user. Set is called with each object included for an owner.
+type IncludeInfo struct {
+	Name           string
+	Class          string
+	Field          string
+	JoinCollection string
+	Set            func(owner Model, included Model)
+}
+
+func (c *ClassInfo) Include(name string) (*IncludeInfo, error) {
+	for i := range c.Includes {
+		if c.Includes[i].Name == name {
+			return &c.Includes[i], nil
+		}
+	}
+	return nil, ERR_UNKNOWN_INCLUDE
+}
+
+// Include expands the keys named by paths, like "user" or "user.roles", on objects that
+// were already read. The included objects are read from ds with one query per class and
+// key, so ACLs apply to them as to any other read; objects that can't be read are left
+// out. Including a nested path includes every key along it.
+func Include(ds DataStore, objects []Model, paths ...string) error {
+	tree := make(map[string][]string)
+	for _, path := range paths {
+		parts := strings.SplitN(strings.TrimSpace(path), ".", 2)
+		if len(parts[0]) == 0 {
+			continue
+		}
+
+		rest := tree[parts[0]]
+		if len(parts) > 1 {
+			rest = append(rest, parts[1])
+		}
+		tree[parts[0]] = rest
+	}
+
+	var keys []string
+	for key := range tree {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		for _, group := range byClass(objects) {
+			info, err := LookupClass(group[0].Collection())
+			if err != nil {
+				return err
+			}
+
+			include, err := info.Include(key)
+			if err != nil {
+				return err
+			}
+
+			included, err := include.load(ds, group)
+			if err != nil {
+				return err
+			}
+
+			if len(tree[key]) > 0 && len(included) > 0 {
+				if err := Include(ds, included, tree[key]...); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func byClass(objects []Model) [][]Model {
+	var groups [][]Model
+	index := make(map[string]int)
+
+	for _, object := range objects {
+		i, ok := index[object.Collection()]
+		if !ok {
+			i = len(groups)
+			index[object.Collection()] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], object)
+	}
+	return groups
+}
+
+// load sets the included objects on owners, returning each included object once.
+func (include *IncludeInfo) load(ds DataStore, owners []Model) ([]Model, error) {
+	// Which owners each included object goes to, by its id
+	targets := make(map[string][]Model)
+	var ids []string
+
+	add := func(id string, owner Model) {
+		if _, ok := targets[id]; !ok {
+			ids = append(ids, id)
+		}
+		targets[id] = append(targets[id], owner)
+	}
+
+	if len(include.JoinCollection) > 0 {
+		byId := make(map[string]Model)
+		var related []string
+		for _, owner := range owners {
+			byId[owner.ObjectId()] = owner
+			related = append(related, owner.ObjectId())
+		}
+
+		err := ds.FindJoins(include.JoinCollection, bson.M{"relatedId": bson.M{"$in": related}}, func(j Join) {
+			add(j.OwningId(), byId[j.RelatedId()])
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, owner := range owners {
+			doc, err := ToDocument(owner)
+			if err != nil {
+				return nil, err
+			}
+
+			ptr, _ := doc[include.Field].(string)
+			if parts := strings.SplitN(ptr, "$", 2); len(parts) == 2 && parts[0] == include.Class {
+				add(parts[1], owner)
+			}
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	result, err := NewObject(include.Class, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var included []Model
+	var copyErr error
+	err = ds.FindEach(include.Class, bson.M{"_id": bson.M{"$in": ids}}, func(m Model) {
+		object, err := CopyModel(m)
+		if err != nil {
+			copyErr = err
+			return
+		}
+
+		included = append(included, object)
+		for _, owner := range targets[object.ObjectId()] {
+			include.Set(owner, object)
+		}
+	}, result)
+
+	if err == nil {
+		err = copyErr
+	}
+	return included, err
+}
+
+// CopyModel returns a copy of a model that was read, which doesn't share anything with it.
+// FindEach and FindPage read every result into the same model, so copy the ones to keep.
+func CopyModel(model Model) (Model, error) {
+	data, err := bson.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+
+	c := reflect.New(reflect.TypeOf(model).Elem()).Interface().(Model)
+	if err := bson.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+
+	c.SetCollection(model.Collection())
+	c.CustomUnmarshall()
+	return c, nil
+}
@@ -0,0 +1,241 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Index declares an index a class needs. Prefix a key field with "-" for descending order.
+// Sparse indexes skip objects without the fields, which lets a unique index allow any number
+// of objects that leave the field unset. ExpireAfter makes a TTL index on a date field.
+type Index struct {
+	Key         []string
+	Unique      bool
+	Sparse      bool
+	ExpireAfter time.Duration
+}
+
+// Join collections are looked up by owner, by related object and by both.
+var joinIndexes = []Index{
+	{Key: []string{"owningId", "relatedId"}},
+	{Key: []string{"relatedId"}},
+}
+
+// IndexDrift describes how the indexes of a collection differ from the declared ones.
+// Missing indexes are created by EnsureIndexes. Changed indexes exist with different
+// options and Unexpected ones are not declared at all; both are left for someone to look at.
+type IndexDrift struct {
+	Collection string
+	Missing    []Index
+	Changed    []Index
+	Unexpected []mgo.Index
+}
+
+func (d IndexDrift) String() string {
+	var parts []string
+	for _, i := range d.Missing {
+		parts = append(parts, "missing "+i.String())
+	}
+	for _, i := range d.Changed {
+		parts = append(parts, "changed "+i.String())
+	}
+	for _, i := range d.Unexpected {
+		parts = append(parts, "unexpected "+i.Name)
+	}
+	return d.Collection + ": " + strings.Join(parts, ", ")
+}
+
+func (i Index) String() string {
+	s := "(" + strings.Join(i.Key, ", ") + ")"
+	if i.Unique {
+		s += " unique"
+	}
+	if i.Sparse {
+		s += " sparse"
+	}
+	if i.ExpireAfter > 0 {
+		s += " expires after " + i.ExpireAfter.String()
+	}
+	return s
+}
+
+func (i Index) mgoIndex() mgo.Index {
+	return mgo.Index{Key: i.Key, Unique: i.Unique, Sparse: i.Sparse, ExpireAfter: i.ExpireAfter, Background: true}
+}
+
+func (i Index) sameKey(existing mgo.Index) bool {
+	return reflect.DeepEqual(i.Key, existing.Key)
+}
+
+func (i Index) sameOptions(existing mgo.Index) bool {
+	return i.Unique == existing.Unique && i.Sparse == existing.Sparse && i.ExpireAfter == existing.ExpireAfter
+}
+
+// DeclaredIndexes returns the indexes of every registered class and of the join
+// collections of their relations, by collection name.
+func DeclaredIndexes() map[string][]Index {
+	indexes := make(map[string][]Index)
+
+	for _, name := range RegisteredClasses() {
+		info, _ := LookupClass(name)
+		if len(info.Indexes) > 0 {
+			indexes[name] = append(indexes[name], info.Indexes...)
+		}
+
+		for _, r := range info.Relations {
+			if _, done := indexes[r.JoinCollection]; !done {
+				indexes[r.JoinCollection] = joinIndexes
+			}
+		}
+	}
+
+	return indexes
+}
+
+// CheckIndexes compares the declared indexes with the ones in database, without changing
+// anything.
+func CheckIndexes(database *mgo.Database) ([]IndexDrift, error) {
+	return syncIndexes(database, false)
+}
+
+// EnsureIndexes creates the declared indexes that are missing from database and reports
+// any drift it could not fix. It is safe to run any number of times.
+func EnsureIndexes(database *mgo.Database) ([]IndexDrift, error) {
+	return syncIndexes(database, true)
+}
+
+func syncIndexes(database *mgo.Database, create bool) ([]IndexDrift, error) {
+	declared := DeclaredIndexes()
+
+	var names []string
+	for name := range declared {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var drift []IndexDrift
+	for _, name := range names {
+		c := database.C(name)
+
+		existing, err := c.Indexes()
+		if err != nil && !isNamespaceNotFound(err) {
+			return drift, err
+		}
+
+		d := diffIndexes(name, declared[name], existing)
+
+		if create {
+			for _, index := range d.Missing {
+				fmt.Printf("Creating index %s on %s\n", index, name)
+				if err := c.EnsureIndex(index.mgoIndex()); err != nil {
+					return drift, err
+				}
+			}
+			d.Missing = nil
+		}
+
+		if len(d.Missing) > 0 || len(d.Changed) > 0 || len(d.Unexpected) > 0 {
+			drift = append(drift, d)
+		}
+	}
+
+	return drift, nil
+}
+
+func diffIndexes(collection string, declared []Index, existing []mgo.Index) IndexDrift {
+	d := IndexDrift{Collection: collection}
+
+	for _, index := range declared {
+		found := false
+		for _, e := range existing {
+			if index.sameKey(e) {
+				found = true
+				if !index.sameOptions(e) {
+					d.Changed = append(d.Changed, index)
+				}
+				break
+			}
+		}
+		if !found {
+			d.Missing = append(d.Missing, index)
+		}
+	}
+
+	for _, e := range existing {
+		if e.Name == "_id_" {
+			continue
+		}
+
+		found := false
+		for _, index := range declared {
+			found = found || index.sameKey(e)
+		}
+		if !found {
+			d.Unexpected = append(d.Unexpected, e)
+		}
+	}
+
+	return d
+}
+
+// Collections that were never written to have no indexes yet
+func isNamespaceNotFound(err error) bool {
+	if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == 26 {
+		return true
+	}
+	return strings.Contains(err.Error(), "ns not found") || strings.Contains(err.Error(), "doesn't exist")
+}
+
+// duplicateKey finds a document other than doc, at index skip, that a unique index of
+// indexes says doc must not coexist with.
+func duplicateKey(indexes []Index, docs []bson.M, doc bson.M, skip int) *Index {
+	for i := range indexes {
+		index := &indexes[i]
+		if !index.Unique {
+			continue
+		}
+
+		key, ok := indexKey(index, doc)
+		if !ok {
+			continue
+		}
+
+		for j, other := range docs {
+			if j == skip {
+				continue
+			}
+			if otherKey, ok := indexKey(index, other); ok && equalValues(key, otherKey) {
+				return index
+			}
+		}
+	}
+	return nil
+}
+
+// indexKey returns the values doc has for the index fields; ok is false when a sparse index
+// leaves doc out.
+func indexKey(index *Index, doc bson.M) ([]interface{}, bool) {
+	var key []interface{}
+	present := false
+
+	for _, field := range index.Key {
+		values := lookup(doc, strings.Split(strings.TrimPrefix(field, "-"), "."))
+		if len(values) == 0 {
+			key = append(key, nil)
+			continue
+		}
+		present = true
+		key = append(key, values[0])
+	}
+
+	if index.Sparse && !present {
+		return nil, false
+	}
+	return key, true
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDiffIndexes(t *testing.T) {
+	declared := []Index{
+		{Key: []string{"name"}, Unique: true},
+		{Key: []string{"owner", "-created"}},
+		{Key: []string{"email"}, Unique: true, Sparse: true},
+	}
+
+	existing := []mgo.Index{
+		{Name: "_id_", Key: []string{"_id"}},
+		{Name: "name_1", Key: []string{"name"}},
+		{Name: "owner_1_created_-1", Key: []string{"owner", "-created"}},
+		{Name: "legacy_1", Key: []string{"legacy"}},
+	}
+
+	d := diffIndexes("Test", declared, existing)
+
+	if len(d.Missing) != 1 || d.Missing[0].Key[0] != "email" {
+		t.Fatal("Expected: missing (email)", "Actual:", d.Missing)
+	}
+	if len(d.Changed) != 1 || d.Changed[0].Key[0] != "name" {
+		t.Fatal("Expected: changed (name)", "Actual:", d.Changed)
+	}
+	if len(d.Unexpected) != 1 || d.Unexpected[0].Name != "legacy_1" {
+		t.Fatal("Expected: unexpected legacy_1", "Actual:", d.Unexpected)
+	}
+}
+
+func TestDuplicateKey(t *testing.T) {
+	unique := []Index{{Key: []string{"name"}, Unique: true}}
+	sparse := []Index{{Key: []string{"auth.id"}, Unique: true, Sparse: true}}
+
+	var tests = []struct {
+		indexes   []Index
+		docs      []bson.M
+		doc       bson.M
+		duplicate bool
+	}{
+		{unique, []bson.M{{"name": "a"}}, bson.M{"name": "b"}, false},
+		{unique, []bson.M{{"name": "a"}}, bson.M{"name": "a"}, true},
+		{unique, []bson.M{{"other": 1}}, bson.M{"other": 2}, true},
+		{sparse, []bson.M{{"other": 1}}, bson.M{"other": 2}, false},
+		{sparse, []bson.M{{"auth": bson.M{"id": "1"}}}, bson.M{"auth": bson.M{"id": "2"}}, false},
+		{sparse, []bson.M{{"auth": bson.M{"id": "1"}}}, bson.M{"auth": bson.M{"id": "1"}}, true},
+	}
+
+	for _, test := range tests {
+		if actual := duplicateKey(test.indexes, test.docs, test.doc, -1) != nil; actual != test.duplicate {
+			t.Fatal("Expected:", test.duplicate, "Actual:", actual, test.doc)
+		}
+	}
+}
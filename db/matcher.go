@@ -0,0 +1,753 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var ERR_UNSUPPORTED_OPERATOR = errors.New("Unsupported query operator.")
+
+// Documents
+
+// ToDocument converts a model, query or change document into the bson.M form mongo
+// would store it in, so values can be compared the same way the server compares them.
+func ToDocument(v interface{}) (bson.M, error) {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := bson.M{}
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// FromDocument loads a stored document into result, the reverse of ToDocument.
+func FromDocument(doc bson.M, result interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, result)
+}
+
+func copyValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case bson.M:
+		res := bson.M{}
+		for k, e := range val {
+			res[k] = copyValue(e)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(val))
+		for i, e := range val {
+			res[i] = copyValue(e)
+		}
+		return res
+	default:
+		return v
+	}
+}
+
+func copyDocument(doc bson.M) bson.M {
+	return copyValue(doc).(bson.M)
+}
+
+// Matching
+
+// MatchDocument reports whether a stored document satisfies a mongo query. It understands
+// the operators our query builders generate: $or/$and/$nor, $in/$nin, $exists, $eq/$ne,
+// $gt/$gte/$lt/$lte, $regex, $all, $size, $elemMatch and $not.
+func MatchDocument(doc bson.M, query map[string]interface{}) (bool, error) {
+	q, err := ToDocument(query)
+	if err != nil {
+		return false, err
+	}
+	return matchDocument(doc, q)
+}
+
+func matchDocument(doc bson.M, query bson.M) (bool, error) {
+	for key, cond := range query {
+		if ok, err := matchKey(doc, key, cond); err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchKey(doc bson.M, key string, cond interface{}) (bool, error) {
+	switch key {
+	case "$or", "$and", "$nor":
+		clauses, ok := cond.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("%s expects an array", key)
+		}
+
+		matched := 0
+		for _, c := range clauses {
+			clause, ok := c.(bson.M)
+			if !ok {
+				return false, fmt.Errorf("%s expects an array of documents", key)
+			}
+			ok, err := matchDocument(doc, clause)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				matched++
+			}
+		}
+
+		switch key {
+		case "$or":
+			return matched > 0, nil
+		case "$and":
+			return matched == len(clauses), nil
+		default:
+			return matched == 0, nil
+		}
+	}
+
+	if strings.HasPrefix(key, "$") {
+		return false, ERR_UNSUPPORTED_OPERATOR
+	}
+
+	values := lookup(doc, strings.Split(key, "."))
+	return matchCondition(values, cond)
+}
+
+// lookup resolves a dotted path, fanning out over arrays of documents the way mongo does.
+func lookup(value interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		return []interface{}{value}
+	}
+
+	switch v := value.(type) {
+	case bson.M:
+		child, ok := v[path[0]]
+		if !ok {
+			return nil
+		}
+		return lookup(child, path[1:])
+	case []interface{}:
+		if i, err := strconv.Atoi(path[0]); err == nil {
+			if i >= 0 && i < len(v) {
+				return lookup(v[i], path[1:])
+			}
+			return nil
+		}
+
+		var res []interface{}
+		for _, e := range v {
+			if _, ok := e.(bson.M); ok {
+				res = append(res, lookup(e, path)...)
+			}
+		}
+		return res
+	}
+
+	return nil
+}
+
+func isOperatorDocument(cond interface{}) (bson.M, bool) {
+	doc, ok := cond.(bson.M)
+	if !ok || len(doc) == 0 {
+		return nil, false
+	}
+
+	for k := range doc {
+		if !strings.HasPrefix(k, "$") {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+func matchCondition(values []interface{}, cond interface{}) (bool, error) {
+	ops, ok := isOperatorDocument(cond)
+	if !ok {
+		return anyEqual(values, cond), nil
+	}
+
+	for op, arg := range ops {
+		ok, err := matchOperator(values, op, arg, ops)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchOperator(values []interface{}, op string, arg interface{}, ops bson.M) (bool, error) {
+	switch op {
+	case "$eq":
+		return anyEqual(values, arg), nil
+	case "$ne":
+		return !anyEqual(values, arg), nil
+	case "$in", "$nin":
+		list, ok := arg.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("%s expects an array", op)
+		}
+
+		found := false
+		for _, e := range list {
+			if anyEqual(values, e) {
+				found = true
+				break
+			}
+		}
+		return found == (op == "$in"), nil
+	case "$exists":
+		return truthy(arg) == (len(values) > 0), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		for _, v := range expand(values) {
+			if c, ok := compareValues(v, arg); ok {
+				switch {
+				case op == "$gt" && c > 0, op == "$gte" && c >= 0, op == "$lt" && c < 0, op == "$lte" && c <= 0:
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "$regex":
+		re, err := compileRegex(arg, ops["$options"])
+		if err != nil {
+			return false, err
+		}
+		return anyRegex(values, re), nil
+	case "$options":
+		return true, nil // consumed by $regex
+	case "$all":
+		list, ok := arg.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("$all expects an array")
+		}
+		for _, e := range list {
+			if !anyEqual(values, e) {
+				return false, nil
+			}
+		}
+		return len(list) > 0, nil
+	case "$size":
+		n, ok := toFloat(arg)
+		if !ok {
+			return false, fmt.Errorf("$size expects a number")
+		}
+		for _, v := range values {
+			if arr, ok := v.([]interface{}); ok && float64(len(arr)) == n {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$elemMatch":
+		sub, ok := arg.(bson.M)
+		if !ok {
+			return false, fmt.Errorf("$elemMatch expects a document")
+		}
+		for _, v := range values {
+			arr, ok := v.([]interface{})
+			if !ok {
+				continue
+			}
+			for _, e := range arr {
+				var matched bool
+				var err error
+				if _, isOps := isOperatorDocument(sub); isOps {
+					matched, err = matchCondition([]interface{}{e}, sub)
+				} else if d, isDoc := e.(bson.M); isDoc {
+					matched, err = matchDocument(d, sub)
+				}
+				if err != nil {
+					return false, err
+				}
+				if matched {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "$nearSphere":
+		return matchNearSphere(values, arg)
+	case "$geoWithin":
+		return matchGeoWithin(values, arg)
+	case "$not":
+		if re, ok := arg.(bson.RegEx); ok {
+			r, err := compileRegex(re, nil)
+			if err != nil {
+				return false, err
+			}
+			return !anyRegex(values, r), nil
+		}
+		ok, err := matchCondition(values, arg)
+		return !ok, err
+	}
+
+	return false, ERR_UNSUPPORTED_OPERATOR
+}
+
+// expand adds the elements of array values so operators can match any of them.
+func expand(values []interface{}) []interface{} {
+	var res []interface{}
+	for _, v := range values {
+		res = append(res, v)
+		if arr, ok := v.([]interface{}); ok {
+			res = append(res, arr...)
+		}
+	}
+	return res
+}
+
+func anyEqual(values []interface{}, x interface{}) bool {
+	if x == nil && len(values) == 0 {
+		return true
+	}
+
+	for _, v := range expand(values) {
+		if equalValues(v, x) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyRegex(values []interface{}, re *regexp.Regexp) bool {
+	for _, v := range expand(values) {
+		if s, ok := v.(string); ok && re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileRegex(pattern interface{}, options interface{}) (*regexp.Regexp, error) {
+	var expr, opts string
+	switch p := pattern.(type) {
+	case string:
+		expr = p
+	case bson.RegEx:
+		expr, opts = p.Pattern, p.Options
+	default:
+		return nil, fmt.Errorf("$regex expects a string")
+	}
+
+	if o, ok := options.(string); ok {
+		opts += o
+	}
+
+	var flags string
+	for _, o := range opts {
+		switch o {
+		case 'i', 'm', 's':
+			flags += string(o)
+		}
+	}
+
+	if len(flags) > 0 {
+		expr = "(?" + flags + ")" + expr
+	}
+	return regexp.Compile(expr)
+}
+
+func truthy(v interface{}) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case nil:
+		return false
+	}
+
+	if f, ok := toFloat(v); ok {
+		return f != 0
+	}
+	return true
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func equalValues(a, b interface{}) bool {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		return ok && fa == fb
+	}
+
+	switch av := a.(type) {
+	case time.Time:
+		bv, ok := b.(time.Time)
+		return ok && av.Equal(bv)
+	case bson.M:
+		bv, ok := b.(bson.M)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, e := range av {
+			if o, ok := bv[k]; !ok || !equalValues(e, o) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !equalValues(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// compareValues orders two values of the same BSON type. ok is false when the types differ.
+func compareValues(a, b interface{}) (int, bool) {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		return compareFloats(fa, fb), true
+	}
+
+	switch av := a.(type) {
+	case string:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av, bv), true
+		}
+	case bson.ObjectId:
+		if bv, ok := b.(bson.ObjectId); ok {
+			return strings.Compare(av.Hex(), bv.Hex()), true
+		}
+	case time.Time:
+		if bv, ok := b.(time.Time); ok {
+			switch {
+			case av.Before(bv):
+				return -1, true
+			case av.After(bv):
+				return 1, true
+			}
+			return 0, true
+		}
+	case bool:
+		if bv, ok := b.(bool); ok {
+			switch {
+			case av == bv:
+				return 0, true
+			case !av:
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+
+	return 0, false
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Sorting
+
+// typeRank follows mongo's comparison order for values of different types.
+func typeRank(v interface{}) int {
+	if _, ok := toFloat(v); ok {
+		return 1
+	}
+
+	switch v.(type) {
+	case nil:
+		return 0
+	case string:
+		return 2
+	case bson.M:
+		return 3
+	case []interface{}:
+		return 4
+	case []byte:
+		return 5
+	case bson.ObjectId:
+		return 6
+	case bool:
+		return 7
+	case time.Time:
+		return 8
+	}
+	return 9
+}
+
+func compareForSort(a, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+
+	c, _ := compareValues(a, b)
+	return c
+}
+
+func sortDocuments(docs []bson.M, sortFields []string) {
+	if len(sortFields) == 0 {
+		return
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, field := range sortFields {
+			desc := strings.HasPrefix(field, "-")
+			path := strings.Split(strings.TrimLeft(field, "+-"), ".")
+
+			var a, b interface{}
+			if v := lookup(docs[i], path); len(v) > 0 {
+				a = v[0]
+			}
+			if v := lookup(docs[j], path); len(v) > 0 {
+				b = v[0]
+			}
+
+			if c := compareForSort(a, b); c != 0 {
+				return (c < 0) != desc
+			}
+		}
+		return false
+	})
+}
+
+// Updates
+
+// applyUpdate applies a change document to doc. inserting is true when the change
+// creates the document through an upsert, which is when $setOnInsert takes effect.
+func applyUpdate(doc bson.M, update bson.M, inserting bool) error {
+	replacement := true
+	for op := range update {
+		if strings.HasPrefix(op, "$") {
+			replacement = false
+		}
+	}
+
+	if replacement {
+		id := doc["_id"]
+		for k := range doc {
+			delete(doc, k)
+		}
+		for k, v := range update {
+			doc[k] = copyValue(v)
+		}
+		if id != nil {
+			doc["_id"] = id
+		}
+		return nil
+	}
+
+	for op, arg := range update {
+		fields, ok := arg.(bson.M)
+		if !ok {
+			return fmt.Errorf("%s expects a document", op)
+		}
+
+		switch op {
+		case "$set":
+			for path, v := range fields {
+				setPath(doc, path, copyValue(v))
+			}
+		case "$setOnInsert":
+			if inserting {
+				for path, v := range fields {
+					setPath(doc, path, copyValue(v))
+				}
+			}
+		case "$unset":
+			for path := range fields {
+				unsetPath(doc, path)
+			}
+		case "$inc":
+			for path, v := range fields {
+				cur := lookup(doc, strings.Split(path, "."))
+				var current interface{}
+				if len(cur) > 0 {
+					current = cur[0]
+				}
+				sum, err := addNumbers(current, v)
+				if err != nil {
+					return err
+				}
+				setPath(doc, path, sum)
+			}
+		case "$push", "$addToSet", "$pull":
+			for path, v := range fields {
+				if err := updateArray(doc, op, path, v); err != nil {
+					return err
+				}
+			}
+		default:
+			return ERR_UNSUPPORTED_OPERATOR
+		}
+	}
+
+	return nil
+}
+
+// updateArray applies $push or $addToSet, with a value or {$each: [values]}, or $pull, with
+// a value, {$in: [values]} or a query on the elements, to the array at path.
+func updateArray(doc bson.M, op string, path string, arg interface{}) error {
+	var list []interface{}
+	if cur := lookup(doc, strings.Split(path, ".")); len(cur) > 0 && cur[0] != nil {
+		l, ok := cur[0].([]interface{})
+		if !ok {
+			return fmt.Errorf("%s needs an array at %s", op, path)
+		}
+		list = l
+	}
+
+	values := []interface{}{arg}
+	spec, isSpec := arg.(bson.M)
+	if each, ok := spec["$each"]; isSpec && ok && op != "$pull" {
+		if values, ok = each.([]interface{}); !ok {
+			return fmt.Errorf("$each expects an array")
+		}
+	}
+	if in, ok := spec["$in"]; isSpec && ok && op == "$pull" && len(spec) == 1 {
+		if values, ok = in.([]interface{}); !ok {
+			return fmt.Errorf("$in expects an array")
+		}
+		isSpec = false
+	}
+
+	result := []interface{}{}
+	switch op {
+	case "$push":
+		result = append(append(result, list...), copyValues(values)...)
+	case "$addToSet":
+		result = append(result, list...)
+		for _, v := range values {
+			if !anyEqual(result, v) {
+				result = append(result, copyValue(v))
+			}
+		}
+	case "$pull":
+		for _, e := range list {
+			var pulled bool
+			if isSpec && len(spec) > 0 {
+				if element, ok := e.(bson.M); ok {
+					matched, err := matchDocument(element, spec)
+					if err != nil {
+						return err
+					}
+					pulled = matched
+				}
+			} else {
+				pulled = anyEqual(values, e)
+			}
+			if !pulled {
+				result = append(result, e)
+			}
+		}
+	}
+
+	setPath(doc, path, result)
+	return nil
+}
+
+func copyValues(values []interface{}) []interface{} {
+	var result []interface{}
+	for _, v := range values {
+		result = append(result, copyValue(v))
+	}
+	return result
+}
+
+func addNumbers(current interface{}, amount interface{}) (interface{}, error) {
+	if current == nil {
+		return amount, nil
+	}
+
+	a, ok1 := toFloat(current)
+	b, ok2 := toFloat(amount)
+	if !ok1 || !ok2 {
+		return nil, errors.New("Cannot apply $inc to a non-numeric value.")
+	}
+
+	switch current.(type) {
+	case int, int32, int64:
+		switch amount.(type) {
+		case int, int32, int64:
+			return int(a + b), nil
+		}
+	}
+	return a + b, nil
+}
+
+func setPath(doc bson.M, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+	current := doc
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := current[k].(bson.M)
+		if !ok {
+			next = bson.M{}
+			current[k] = next
+		}
+		current = next
+	}
+	current[keys[len(keys)-1]] = value
+}
+
+func unsetPath(doc bson.M, path string) {
+	keys := strings.Split(path, ".")
+	current := doc
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := current[k].(bson.M)
+		if !ok {
+			return
+		}
+		current = next
+	}
+	delete(current, keys[len(keys)-1])
+}
+
+// upsertDocument seeds a new document from the equality conditions of an upsert query.
+func upsertDocument(query bson.M) bson.M {
+	doc := bson.M{}
+	for k, v := range query {
+		if strings.HasPrefix(k, "$") {
+			continue
+		}
+		if _, isOps := isOperatorDocument(v); isOps {
+			continue
+		}
+		setPath(doc, k, copyValue(v))
+	}
+	return doc
+}
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var matchTime = time.Date(2016, 2, 8, 6, 33, 4, 0, time.UTC)
+
+var matchDoc = bson.M{
+	"_id":         "abc",
+	"name":        "Nidhi",
+	"taskClaimed": 2,
+	"category":    []interface{}{"transactional", "SIGN_UP"},
+	"_rperm":      []interface{}{"*", "role:admin"},
+	"_created_at": matchTime,
+	"_auth_data_facebook": bson.M{
+		"id": "1234",
+	},
+	"substitutions": []interface{}{
+		bson.M{"tag": "name", "val": "Nidhi"},
+	},
+}
+
+var matchTests = []struct {
+	query   bson.M
+	matches bool
+}{
+	{bson.M{}, true},
+	{bson.M{"_id": "abc"}, true},
+	{bson.M{"_id": "xyz"}, false},
+	{bson.M{"_auth_data_facebook.id": "1234"}, true},
+	{bson.M{"category": "SIGN_UP"}, true},
+	{bson.M{"category": bson.M{"$all": []string{"SIGN_UP", "transactional"}}}, true},
+	{bson.M{"category": bson.M{"$size": 3}}, false},
+	{bson.M{"substitutions.tag": "name"}, true},
+	{bson.M{"substitutions": bson.M{"$elemMatch": bson.M{"tag": "name", "val": "Bob"}}}, false},
+	{bson.M{"taskClaimed": bson.M{"$gt": 1, "$lte": 2}}, true},
+	{bson.M{"taskClaimed": bson.M{"$lt": 2}}, false},
+	{bson.M{"taskClaimed": 2.0}, true},
+	{bson.M{"_created_at": bson.M{"$gte": matchTime}}, true},
+	{bson.M{"_created_at": bson.M{"$gt": "2016-02-08T06:33:04.074Z"}}, false},
+	{bson.M{"name": bson.M{"$regex": "^nid", "$options": "i"}}, true},
+	{bson.M{"name": bson.M{"$not": bson.M{"$regex": "^Nid"}}}, false},
+	{bson.M{"name": bson.M{"$ne": "Bob"}}, true},
+	{bson.M{"name": bson.M{"$nin": []string{"Nidhi", "Bob"}}}, false},
+	{bson.M{"email": bson.M{"$exists": false}}, true},
+	{bson.M{"email": nil}, true},
+	{bson.M{"$or": []bson.M{
+		bson.M{READ_PERM: bson.M{"$exists": false}},
+		bson.M{READ_PERM: bson.M{"$in": []interface{}{"someuser", "role:admin"}}}}}, true},
+	{bson.M{"$or": []bson.M{
+		bson.M{READ_PERM: bson.M{"$exists": false}},
+		bson.M{READ_PERM: bson.M{"$in": []interface{}{"someuser"}}}}}, false},
+	{bson.M{"$and": []bson.M{bson.M{"name": "Nidhi"}, bson.M{"_id": "xyz"}}}, false},
+	{bson.M{"$nor": []bson.M{bson.M{"name": "Bob"}}}, true},
+}
+
+func TestMatchDocument(t *testing.T) {
+	for _, test := range matchTests {
+		ok, err := MatchDocument(matchDoc, test.query)
+		if err != nil {
+			t.Fatal("Unexpected error matching", test.query, err)
+		}
+
+		if ok != test.matches {
+			t.Fatal("Expected", test.query, "to match:", test.matches, "Actual:", ok)
+		}
+	}
+}
+
+func TestUnsupportedOperator(t *testing.T) {
+	if _, err := MatchDocument(matchDoc, bson.M{"$where": "this.name == 'Nidhi'"}); err != ERR_UNSUPPORTED_OPERATOR {
+		t.Fatal("Expected:", ERR_UNSUPPORTED_OPERATOR, "Actual:", err)
+	}
+}
+
+func TestApplyUpdate(t *testing.T) {
+	doc := bson.M{"_id": "abc", "taskClaimed": 1, "taskStatus": "NEW"}
+
+	update, _ := ToDocument(bson.M{
+		"$set":         bson.M{"taskMessage": "hi", "customFields.tier": "pro"},
+		"$unset":       bson.M{"taskStatus": ""},
+		"$inc":         bson.M{"taskClaimed": 2},
+		"$setOnInsert": bson.M{"_created_at": matchTime},
+	})
+
+	if err := applyUpdate(doc, update, false); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	expected := bson.M{"_id": "abc", "taskClaimed": 3, "taskMessage": "hi", "customFields": bson.M{"tier": "pro"}}
+	if !equalValues(doc, expected) {
+		t.Fatal("Expected:", expected, "Actual:", doc)
+	}
+}
+
+func TestUpsertDocument(t *testing.T) {
+	q, _ := ToDocument(bson.M{"_auth_data_facebook.id": "1234", WRITE_PERM: bson.M{"$in": []string{"*"}}})
+	doc := upsertDocument(q)
+
+	expected := bson.M{"_auth_data_facebook": bson.M{"id": "1234"}}
+	if !equalValues(doc, expected) {
+		t.Fatal("Expected:", expected, "Actual:", doc)
+	}
+}
+
+func TestSortDocuments(t *testing.T) {
+	docs := []bson.M{
+		bson.M{"_id": "a", "n": 2, "s": "b"},
+		bson.M{"_id": "b", "n": 1, "s": "b"},
+		bson.M{"_id": "c", "s": "a"},
+	}
+
+	sortDocuments(docs, []string{"-s", "n"})
+
+	for i, id := range []string{"b", "a", "c"} {
+		if docs[i]["_id"] != id {
+			t.Fatal("Expected", id, "at index", i, "Actual:", docs[i]["_id"])
+		}
+	}
+}
+
+func TestApplyArrayUpdate(t *testing.T) {
+	tests := []struct {
+		update   bson.M
+		field    string
+		expected []interface{}
+	}{
+		{bson.M{"$push": bson.M{"tags": bson.M{"$each": []string{"a", "d"}}}}, "tags", []interface{}{"a", "b", "c", "a", "d"}},
+		{bson.M{"$push": bson.M{"tags": "d"}}, "tags", []interface{}{"a", "b", "c", "d"}},
+		{bson.M{"$push": bson.M{"missing": "a"}}, "missing", []interface{}{"a"}},
+		{bson.M{"$addToSet": bson.M{"tags": bson.M{"$each": []string{"a", "d", "d"}}}}, "tags", []interface{}{"a", "b", "c", "d"}},
+		{bson.M{"$pull": bson.M{"tags": bson.M{"$in": []string{"a", "c"}}}}, "tags", []interface{}{"b"}},
+		{bson.M{"$pull": bson.M{"tags": "b"}}, "tags", []interface{}{"a", "c"}},
+	}
+
+	for _, test := range tests {
+		doc := bson.M{"_id": "abc", "tags": []interface{}{"a", "b", "c"}}
+		update, _ := ToDocument(test.update)
+		if err := applyUpdate(doc, update, false); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+
+		if !equalValues(doc[test.field], test.expected) {
+			t.Fatal("Expected:", test.expected, "Actual:", doc[test.field])
+		}
+	}
+
+	// Documents are pulled by the query they match
+	doc := bson.M{"_id": "abc", "items": []interface{}{bson.M{"n": 1}, bson.M{"n": 5}}}
+	update, _ := ToDocument(bson.M{"$pull": bson.M{"items": bson.M{"n": bson.M{"$gt": 2}}}})
+	if err := applyUpdate(doc, update, false); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if expected := []interface{}{bson.M{"n": 1}}; !equalValues(doc["items"], expected) {
+		t.Fatal("Expected:", expected, "Actual:", doc["items"])
+	}
+
+	doc = bson.M{"_id": "abc", "tags": "a"}
+	update, _ = ToDocument(bson.M{"$push": bson.M{"tags": "b"}})
+	if err := applyUpdate(doc, update, false); err == nil {
+		t.Fatal("Expected: an error pushing to a field that isn't an array")
+	}
+}
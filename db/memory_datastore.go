@@ -0,0 +1,841 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MemoryStore holds every collection of an in-memory database. Data stores created from
+// the same MemoryStore share its documents, the way mgo session copies share a server.
+type MemoryStore struct {
+	mu          sync.RWMutex
+	txMu        sync.Mutex
+	collections map[string][]bson.M
+	indexes     map[string][]Index
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{collections: make(map[string][]bson.M)}
+}
+
+// UseMemoryDataStore replaces GetDataStore so every request is served from a fresh
+// in-memory store instead of mongo. Useful for unit tests and offline development.
+func UseMemoryDataStore() *MemoryStore {
+	store := NewMemoryStore()
+	store.EnsureIndexes()
+	GetDataStore = func(qb DataStoreQueryBuilder) DataStore {
+		return store.NewDataStore(qb)
+	}
+	return store
+}
+
+func (s *MemoryStore) NewDataStore(qb DataStoreQueryBuilder) *MemoryDataStore {
+	ds := &MemoryDataStore{store: s}
+	ds.SetQueryBuilder(qb)
+	return ds
+}
+
+// EnsureIndexes makes the store enforce the unique indexes declared by the registered
+// classes. Other indexes only matter for speed and are ignored.
+func (s *MemoryStore) EnsureIndexes() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.indexes = DeclaredIndexes()
+}
+
+func duplicateKeyError(collectionName string, index *Index) error {
+	name := "_id_"
+	if index != nil {
+		name = strings.Join(index.Key, "_")
+	}
+	return &mgo.LastError{Code: 11000, Err: fmt.Sprintf("E11000 duplicate key error collection: %s index: %s", collectionName, name)}
+}
+
+// snapshot copies the collections so they can be restored. Documents are never changed in
+// place, so the documents themselves can be shared.
+func (s *MemoryStore) snapshot() map[string][]bson.M {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	collections := make(map[string][]bson.M, len(s.collections))
+	for name, docs := range s.collections {
+		collections[name] = append([]bson.M(nil), docs...)
+	}
+	return collections
+}
+
+func (s *MemoryStore) restore(collections map[string][]bson.M) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.collections = collections
+}
+
+func (s *MemoryStore) find(collectionName string, query bson.M, sortFields []string) ([]bson.M, error) {
+	// There are no text indexes in memory
+	query, err := regexText(collectionName, query)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var docs []bson.M
+	for _, doc := range s.collections[collectionName] {
+		ok, err := matchDocument(doc, query)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			docs = append(docs, copyDocument(doc))
+		}
+	}
+
+	sortDocuments(docs, sortFields)
+	if len(sortFields) == 0 {
+		if field, lng, lat, ok := nearQuery(query); ok {
+			sortByDistance(docs, field, lng, lat)
+		}
+	}
+	return docs, nil
+}
+
+func (s *MemoryStore) insert(collectionName string, docs ...bson.M) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing := s.collections[collectionName]
+	for _, doc := range docs {
+		for _, e := range existing {
+			if equalValues(e["_id"], doc["_id"]) {
+				return duplicateKeyError(collectionName, nil)
+			}
+		}
+		if index := duplicateKey(s.indexes[collectionName], existing, doc, -1); index != nil {
+			return duplicateKeyError(collectionName, index)
+		}
+		existing = append(existing, copyDocument(doc))
+	}
+
+	s.collections[collectionName] = existing
+	return nil
+}
+
+func (s *MemoryStore) remove(collectionName string, query bson.M, all bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var kept []bson.M
+	removed := 0
+	for _, doc := range s.collections[collectionName] {
+		if all || removed == 0 {
+			ok, err := matchDocument(doc, query)
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				removed++
+				continue
+			}
+		}
+		kept = append(kept, doc)
+	}
+
+	s.collections[collectionName] = kept
+	return removed, nil
+}
+
+// apply is the in-memory equivalent of findAndModify.
+func (s *MemoryStore) apply(collectionName string, query bson.M, change mgo.Change) (bson.M, *mgo.ChangeInfo, error) {
+	update, err := ToDocument(change.Update)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	docs := s.collections[collectionName]
+	for i, doc := range docs {
+		ok, err := matchDocument(doc, query)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		if change.Remove {
+			s.collections[collectionName] = append(docs[:i:i], docs[i+1:]...)
+			return copyDocument(doc), &mgo.ChangeInfo{Removed: 1}, nil
+		}
+
+		updated := copyDocument(doc)
+		if err := applyUpdate(updated, update, false); err != nil {
+			return nil, nil, err
+		}
+		if index := duplicateKey(s.indexes[collectionName], docs, updated, i); index != nil {
+			return nil, nil, duplicateKeyError(collectionName, index)
+		}
+		docs[i] = updated
+
+		info := &mgo.ChangeInfo{Updated: 1, Matched: 1}
+		if change.ReturnNew {
+			return copyDocument(updated), info, nil
+		}
+		return copyDocument(doc), info, nil
+	}
+
+	if !change.Upsert {
+		return nil, nil, mgo.ErrNotFound
+	}
+
+	doc := upsertDocument(query)
+	if err := applyUpdate(doc, update, true); err != nil {
+		return nil, nil, err
+	}
+	if doc["_id"] == nil {
+		doc["_id"] = bson.NewObjectId().Hex()
+	}
+	if index := duplicateKey(s.indexes[collectionName], docs, doc, -1); index != nil {
+		return nil, nil, duplicateKeyError(collectionName, index)
+	}
+
+	s.collections[collectionName] = append(docs, doc)
+	return copyDocument(doc), &mgo.ChangeInfo{UpsertedId: doc["_id"]}, nil
+}
+
+// updateAll applies update to every document matching query.
+func (s *MemoryStore) updateAll(collectionName string, query bson.M, update bson.M) (int, error) {
+	u, err := ToDocument(update)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	docs := s.collections[collectionName]
+	n := 0
+	for i, doc := range docs {
+		ok, err := matchDocument(doc, query)
+		if err != nil {
+			return n, err
+		}
+		if !ok {
+			continue
+		}
+
+		updated := copyDocument(doc)
+		if err := applyUpdate(updated, u, false); err != nil {
+			return n, err
+		}
+		if index := duplicateKey(s.indexes[collectionName], docs, updated, i); index != nil {
+			return n, duplicateKeyError(collectionName, index)
+		}
+		docs[i] = updated
+		n++
+	}
+
+	return n, nil
+}
+
+// MemoryDataStore implements DataStore on top of a MemoryStore. Queries still go through
+// the configured DataStoreQueryBuilder, so ACL restrictions behave as they do with mongo.
+type MemoryDataStore struct {
+	store   *MemoryStore
+	builder DataStoreQueryBuilder
+}
+
+func (m *MemoryDataStore) Close() {
+	// nothing to release
+}
+
+func (m *MemoryDataStore) SetQueryBuilder(qb DataStoreQueryBuilder) {
+	m.builder = qb
+}
+
+// DataStore Interface
+
+func (m *MemoryDataStore) Count(collectionName string, query map[string]interface{}) (int, error) {
+	cq, err := m.builder.MakeCountQuery(collectionName, query)
+	if err != nil {
+		return -1, err
+	}
+
+	q, err := ToDocument(cq)
+	if err != nil {
+		return -1, err
+	}
+
+	docs, err := m.store.find(collectionName, q, nil)
+	if err != nil {
+		return -1, err
+	}
+
+	return len(docs), nil
+}
+
+func (m *MemoryDataStore) Fetch(result Model) error {
+	id := result.ObjectId()
+	collectionName := result.Collection()
+
+	if len(id) == 0 {
+		return ERR_MISSING_ID
+	}
+
+	q, qerr := m.builder.MakeFindByIdQuery(result)
+
+	if qerr != nil {
+		return qerr
+	}
+
+	if err := m.findOne(collectionName, q, result); err != nil {
+		return err
+	}
+
+	result.CustomUnmarshall()
+	m.builder.ProtectFields(result)
+	return nil
+}
+
+func (m *MemoryDataStore) FindObject(collectionName string, query map[string]interface{}, result Model) error {
+	q, err := m.builder.MakeFindQuery(collectionName, query)
+	if err != nil {
+		return err
+	}
+
+	if err := m.findOne(collectionName, q, result); err != nil {
+		return err
+	}
+
+	result.CustomUnmarshall()
+	m.builder.ProtectFields(result)
+	return nil
+}
+
+func (m *MemoryDataStore) findOne(collectionName string, query bson.M, result Model) error {
+	q, err := ToDocument(query)
+	if err != nil {
+		return err
+	}
+
+	docs, err := m.store.find(collectionName, q, nil)
+	if err != nil {
+		return err
+	}
+
+	if len(docs) == 0 {
+		return mgo.ErrNotFound
+	}
+
+	return FromDocument(docs[0], result)
+}
+
+func (m *MemoryDataStore) InsertAll(collectionName string, models []Model) error {
+	var docs []bson.M
+	for _, model := range models {
+		if len(model.ObjectId()) > 0 {
+			return ERR_OBJECT_EXISTS
+		}
+
+		d, qerr := m.builder.MakeInsertDocument(model, time.Now(), bson.NewObjectId().Hex())
+		if qerr != nil {
+			return qerr
+		}
+
+		doc, err := ToDocument(d)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, doc)
+	}
+
+	if err := m.store.insert(collectionName, docs...); err != nil {
+		return err
+	}
+
+	for i, model := range models {
+		model.SetIsNew(true)
+		model.CustomUnmarshall()
+		publishChange(ChangeCreate, collectionName, nil, docs[i])
+	}
+
+	return nil
+}
+
+func (m *MemoryDataStore) InsertObject(model Model) error {
+
+	if len(model.ObjectId()) > 0 {
+		return ERR_OBJECT_EXISTS
+	}
+
+	d, qerr := m.builder.MakeInsertDocument(model, time.Now(), bson.NewObjectId().Hex())
+	if qerr != nil {
+		return qerr
+	}
+
+	doc, err := ToDocument(d)
+	if err != nil {
+		return err
+	}
+
+	if err := m.store.insert(model.Collection(), doc); err != nil {
+		return err
+	}
+
+	d.SetIsNew(true)
+	d.CustomUnmarshall()
+	publishChange(ChangeCreate, model.Collection(), nil, doc)
+	return nil
+}
+
+func (m *MemoryDataStore) UpsertObject(model Model, query map[string]interface{}) error {
+	q, change, qerr := m.builder.MakeUpsertDocument(model, query, time.Now(), bson.NewObjectId().Hex())
+
+	if qerr != nil {
+		return qerr
+	}
+
+	before := firstDocument(m.current(model.Collection(), q, false))
+
+	info, err := m.applyChange(model.Collection(), q, change, model)
+	if err != nil {
+		return err
+	}
+
+	if info.UpsertedId != nil {
+		model.SetIsNew(true)
+	}
+
+	model.CustomUnmarshall()
+
+	if model.IsNew() {
+		publishModel(ChangeCreate, model, nil)
+	} else {
+		publishModel(ChangeUpdate, model, before)
+	}
+	return nil
+}
+
+func (m *MemoryDataStore) UpdateObject(model Model) error {
+
+	if len(model.ObjectId()) == 0 {
+		return ERR_MISSING_ID
+	}
+
+	q, change, qerr := m.builder.MakeChangeDocument(model, time.Now())
+
+	if qerr != nil {
+		return qerr
+	}
+
+	before := firstDocument(m.current(model.Collection(), q, false))
+
+	if _, err := m.applyChange(model.Collection(), q, change, model); err != nil {
+		if err == mgo.ErrNotFound && model.UsesOptimisticLocking() {
+			return m.versionConflict(model, err)
+		}
+		return err
+	}
+
+	model.CustomUnmarshall()
+	publishModel(ChangeUpdate, model, before)
+	return nil
+}
+
+// current reads the documents a write is about to change, for the change feed.
+func (m *MemoryDataStore) current(collectionName string, query bson.M, all bool) []bson.M {
+	if !Changes.Listening() {
+		return nil
+	}
+
+	q, err := ToDocument(query)
+	if err != nil {
+		return nil
+	}
+
+	docs, err := m.store.find(collectionName, q, nil)
+	if err != nil {
+		fmt.Printf("Error reading %s for the change feed: %s \n", collectionName, err)
+		return nil
+	}
+
+	if !all && len(docs) > 1 {
+		return docs[:1]
+	}
+	return docs
+}
+
+func (m *MemoryDataStore) versionConflict(model Model, err error) error {
+	fq, qerr := m.builder.MakeFindQuery(model.Collection(), versionConflictQuery(model))
+	if qerr != nil {
+		return err
+	}
+
+	q, qerr := ToDocument(fq)
+	if qerr != nil {
+		return err
+	}
+
+	if docs, ferr := m.store.find(model.Collection(), q, nil); ferr == nil && len(docs) > 0 {
+		return ERR_VERSION_CONFLICT
+	}
+	return err
+}
+
+func (m *MemoryDataStore) applyChange(collectionName string, query bson.M, change mgo.Change, result Model) (*mgo.ChangeInfo, error) {
+	q, err := ToDocument(query)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, info, err := m.store.apply(collectionName, q, change)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, FromDocument(doc, result)
+}
+
+func (m *MemoryDataStore) RemoveObject(model Model) error {
+	q, qerr := m.builder.MakeRemoveQuery(model)
+
+	if qerr != nil {
+		return qerr
+	}
+
+	if len(model.ObjectId()) == 0 {
+		return ERR_MISSING_ID
+	}
+
+	before := firstDocument(m.current(model.Collection(), q, false))
+
+	if SoftDeletes(model.Collection()) {
+		change := mgo.Change{Update: deleteUpdate(model.Collection(), time.Now()), ReturnNew: true}
+		if _, err := m.applyChange(model.Collection(), q, change, model); err != nil {
+			return err
+		}
+		model.CustomUnmarshall()
+		publishModel(ChangeUpdate, model, before)
+		return nil
+	}
+
+	doc, err := ToDocument(q)
+	if err != nil {
+		return err
+	}
+
+	n, err := m.store.remove(model.Collection(), doc, false)
+	if err == nil && n == 0 {
+		return mgo.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if before != nil {
+		publishChange(ChangeDelete, model.Collection(), before, nil)
+	}
+	return nil
+}
+
+func (m *MemoryDataStore) RemoveAll(collectionName string, query map[string]interface{}) error {
+	q, err := m.builder.MakeRemoveAllQuery(collectionName, query)
+	if err != nil {
+		return err
+	}
+
+	doc, err := ToDocument(q)
+	if err != nil {
+		return err
+	}
+
+	before := m.current(collectionName, q, true)
+	t := time.Now()
+
+	if SoftDeletes(collectionName) {
+		_, err = m.store.updateAll(collectionName, doc, deleteUpdate(collectionName, t))
+	} else {
+		_, err = m.store.remove(collectionName, doc, true)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	publishRemoved(collectionName, before, t)
+	return nil
+}
+
+func (m *MemoryDataStore) RestoreObject(model Model) error {
+	q, qerr := m.builder.MakeRestoreQuery(model)
+	if qerr != nil {
+		return qerr
+	}
+
+	before := firstDocument(m.current(model.Collection(), q, false))
+
+	change := mgo.Change{Update: restoreUpdate(model.Collection(), time.Now()), ReturnNew: true}
+	if _, err := m.applyChange(model.Collection(), q, change, model); err != nil {
+		return err
+	}
+
+	model.CustomUnmarshall()
+	publishModel(ChangeUpdate, model, before)
+	return nil
+}
+
+func (m *MemoryDataStore) PurgeObjects(collectionName string, deletedBefore time.Time) (int, error) {
+	q, qerr := m.builder.MakePurgeQuery(collectionName, deletedBefore)
+	if qerr != nil {
+		return 0, qerr
+	}
+
+	doc, err := ToDocument(q)
+	if err != nil {
+		return 0, err
+	}
+
+	return m.store.remove(collectionName, doc, true)
+}
+
+func (m *MemoryDataStore) FindEach(collectionName string, query map[string]interface{}, f func(Model), result Model, sortFields ...string) error {
+	fq, err := m.builder.MakeFindQuery(collectionName, query)
+	if err != nil {
+		return err
+	}
+
+	q, err := ToDocument(fq)
+	if err != nil {
+		return err
+	}
+
+	docs, err := m.store.find(collectionName, q, sortFields)
+	if err != nil {
+		fmt.Printf("Error %s, collection name: %s", err.Error(), collectionName)
+		return err
+	}
+
+	for _, doc := range docs {
+		if err := FromDocument(doc, result); err != nil {
+			return err
+		}
+		result.CustomUnmarshall()
+		m.builder.ProtectFields(result)
+		f(result)
+	}
+
+	return nil
+}
+
+func (m *MemoryDataStore) FindPage(collectionName string, query map[string]interface{}, page Page, f func(Model), result Model) (string, error) {
+	plan, err := planPage(query, page)
+	if err != nil {
+		return "", err
+	}
+
+	if plan.sort, err = m.builder.MakeSort(collectionName, plan.sort); err != nil {
+		return "", err
+	}
+
+	fq, err := m.builder.MakeFindQuery(collectionName, plan.query)
+	if err != nil {
+		return "", err
+	}
+
+	q, err := ToDocument(fq)
+	if err != nil {
+		return "", err
+	}
+
+	docs, err := m.store.find(collectionName, q, plan.sort)
+	if err != nil {
+		fmt.Printf("Error %s, collection name: %s", err.Error(), collectionName)
+		return "", err
+	}
+
+	if plan.skip >= len(docs) {
+		return "", nil
+	}
+	docs = docs[plan.skip:]
+
+	more := len(docs) > plan.limit
+	if more {
+		docs = docs[:plan.limit]
+	}
+
+	var last pageKey
+	for _, doc := range docs {
+		if err := FromDocument(doc, result); err != nil {
+			return "", err
+		}
+		if err := FromDocument(doc, &last); err != nil {
+			return "", err
+		}
+		result.CustomUnmarshall()
+		m.builder.ProtectFields(result)
+		f(result)
+	}
+
+	return plan.nextCursor(more, len(docs), &last), nil
+}
+
+func (m *MemoryDataStore) Search(collectionName string, query map[string]interface{}, limit int, f func(Model, float64), result Model) error {
+	text := TextOf(query)
+	if text == nil {
+		return ERR_NO_TEXT_SEARCH
+	}
+
+	fields, err := textFields(collectionName)
+	if err != nil {
+		return err
+	}
+
+	find := func(each func(Model)) error {
+		return m.FindEach(collectionName, query, each, result)
+	}
+	return searchByScore(find, text, fields, limit, f)
+}
+
+func (m *MemoryDataStore) Aggregate(collectionName string, pipeline []bson.M, f func(bson.M)) error {
+	p, err := m.builder.MakeAggregatePipeline(collectionName, pipeline)
+	if err == nil {
+		p, err = textPipeline(collectionName, p, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	docs, err := m.store.find(collectionName, bson.M{}, nil)
+	if err != nil {
+		return err
+	}
+
+	docs, err = aggregate(docs, p)
+	if err != nil {
+		fmt.Printf("Error %s, collection name: %s", err.Error(), collectionName)
+		return err
+	}
+
+	for _, doc := range docs {
+		f(doc)
+	}
+
+	return nil
+}
+
+// RunTransaction undoes every write made while f ran if f fails. Transactions run one at a
+// time, but writes made outside of one while it runs are undone with it.
+func (m *MemoryDataStore) RunTransaction(f func() error) error {
+	m.store.txMu.Lock()
+	defer m.store.txMu.Unlock()
+
+	saved := m.store.snapshot()
+	if err := f(); err != nil {
+		m.store.restore(saved)
+		return err
+	}
+	return nil
+}
+
+func (m *MemoryDataStore) join(joinCollection string, query map[string]interface{}, f func(Join), j Join) error {
+	q, err := ToDocument(query)
+	if err != nil {
+		return err
+	}
+
+	docs, err := m.store.find(joinCollection, q, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		if err := FromDocument(doc, j); err != nil {
+			return err
+		}
+		f(j)
+	}
+
+	return nil
+}
+
+func (m *MemoryDataStore) FindJoins(joinCollection string, query map[string]interface{}, f func(Join)) error {
+	return m.join(joinCollection, query, f, &JoinEntry{})
+}
+
+func (m *MemoryDataStore) FindRelatedObjects(relation Relation, f func(Model), result Model, sortFields ...string) error {
+	q := m.builder.QueryByOwningModels(relation.JoinCollection(), []Model{relation.Owner()})
+
+	var ids []string
+	err := m.join(relation.JoinCollection(), q, func(j Join) {
+		ids = append(ids, j.RelatedId())
+	}, &JoinEntry{})
+
+	if err != nil {
+		return err
+	}
+
+	qRelated := m.builder.QueryByIds(result.Collection(), ids)
+	return m.FindEach(result.Collection(), qRelated, f, result, sortFields...)
+}
+
+func (m *MemoryDataStore) FindOwningObjects(joinCollection string, relatedModel Model, f func(Model), result Model) error {
+	q := m.builder.QueryByRelatedModels(joinCollection, []Model{relatedModel})
+
+	var ids []string
+	err := m.join(joinCollection, q, func(j Join) {
+		ids = append(ids, j.OwningId())
+	}, &JoinEntry{})
+
+	if err != nil {
+		return err
+	}
+
+	qOwning := m.builder.QueryByIds(result.Collection(), ids)
+	return m.FindEach(result.Collection(), qOwning, f, result)
+}
+
+func (m *MemoryDataStore) SaveRelatedObjects(relation Relation) error {
+
+	toAdd, toDelete, err := m.builder.MakeRelationUpdateDocuments(relation)
+	if err != nil {
+		return err
+	}
+
+	// Add Related
+	if toAdd != nil {
+		var docs []bson.M
+		for _, join := range toAdd {
+			doc, err := ToDocument(join)
+			if err != nil {
+				return err
+			}
+			docs = append(docs, doc)
+		}
+
+		if err = m.store.insert(relation.JoinCollection(), docs...); err != nil {
+			return err
+		}
+	}
+
+	// Delete Related
+	if toDelete != nil {
+		doc, err := ToDocument(toDelete)
+		if err != nil {
+			return err
+		}
+
+		if _, err = m.store.remove(relation.JoinCollection(), doc, true); err != nil {
+			return err
+		}
+	}
+
+	publishRelation(relation)
+	return nil
+}
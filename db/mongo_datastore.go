@@ -33,7 +33,13 @@ func (m *MongoDataStore) SetQueryBuilder(qb DataStoreQueryBuilder) {
 
 func (m *MongoDataStore) Count(collectionName string, query map[string]interface{}) (int, error) {
 
-	q := m.builder.MakeCountQuery(collectionName, query)
+	q, qerr := m.builder.MakeCountQuery(collectionName, query)
+	if qerr == nil {
+		q, qerr = textQuery(collectionName, q)
+	}
+	if qerr != nil {
+		return -1, qerr
+	}
 
 	db := m.Session.DB(Mongo.Database)
 	n, err := db.C(collectionName).Find(q).Count()
@@ -59,16 +65,24 @@ func (m *MongoDataStore) Fetch(result Model) error {
 		return qerr
 	}
 
-	if err := m.FindObject(collectionName, q, result); err != nil {
+	db := m.Session.DB(Mongo.Database)
+	if err := db.C(collectionName).Find(q).One(result); err != nil {
 		return err
 	}
 
 	result.CustomUnmarshall()
+	m.builder.ProtectFields(result)
 	return nil
 }
 
 func (m *MongoDataStore) FindObject(collectionName string, query map[string]interface{}, result Model) error {
-	q := m.builder.MakeFindQuery(collectionName, query)
+	q, qerr := m.builder.MakeFindQuery(collectionName, query)
+	if qerr == nil {
+		q, qerr = textQuery(collectionName, q)
+	}
+	if qerr != nil {
+		return qerr
+	}
 
 	// Creating this value is a very lightweight operation, and involves no network communication.
 	db := m.Session.DB(Mongo.Database)
@@ -77,6 +91,7 @@ func (m *MongoDataStore) FindObject(collectionName string, query map[string]inte
 	}
 
 	result.CustomUnmarshall()
+	m.builder.ProtectFields(result)
 	return nil
 }
 
@@ -104,6 +119,7 @@ func (m *MongoDataStore) InsertAll(collectionName string, models []Model) error
 	for _, model := range models {
 		model.SetIsNew(true)
 		model.CustomUnmarshall()
+		publishModel(ChangeCreate, model, nil)
 	}
 
 	return nil
@@ -129,6 +145,7 @@ func (m *MongoDataStore) InsertObject(model Model) error {
 
 	doc.SetIsNew(true)
 	doc.CustomUnmarshall()
+	publishModel(ChangeCreate, doc, nil)
 	return nil
 }
 
@@ -142,6 +159,8 @@ func (m *MongoDataStore) UpsertObject(model Model, query map[string]interface{})
 		return qerr
 	}
 
+	before := firstDocument(m.current(collectionName, q, false))
+
 	if info, err := db.C(collectionName).Find(q).Apply(change, model); err != nil {
 		return err
 	} else {
@@ -151,6 +170,12 @@ func (m *MongoDataStore) UpsertObject(model Model, query map[string]interface{})
 	}
 
 	model.CustomUnmarshall()
+
+	if model.IsNew() {
+		publishModel(ChangeCreate, model, nil)
+	} else {
+		publishModel(ChangeUpdate, model, before)
+	}
 	return nil
 
 }
@@ -170,14 +195,61 @@ func (m *MongoDataStore) UpdateObject(model Model) error {
 		return qerr
 	}
 
+	before := firstDocument(m.current(collectionName, q, false))
+
 	if _, err := db.C(collectionName).Find(q).Apply(change, model); err != nil {
+		if err == mgo.ErrNotFound && model.UsesOptimisticLocking() {
+			return m.versionConflict(model, err)
+		}
 		return err
 	}
 
 	model.CustomUnmarshall()
+	publishModel(ChangeUpdate, model, before)
 	return nil
 }
 
+// current reads the documents a write is about to change, for the change feed. Nothing is
+// read when nobody listens.
+func (m *MongoDataStore) current(collectionName string, q bson.M, all bool) []bson.M {
+	if !Changes.Listening() {
+		return nil
+	}
+
+	c := m.Session.DB(Mongo.Database).C(collectionName)
+
+	var docs []bson.M
+	var err error
+	if all {
+		err = c.Find(q).All(&docs)
+	} else {
+		var doc bson.M
+		if err = c.Find(q).One(&doc); err == nil {
+			docs = []bson.M{doc}
+		}
+	}
+
+	if err != nil && err != mgo.ErrNotFound {
+		fmt.Printf("Error reading %s for the change feed: %s \n", collectionName, err)
+	}
+	return docs
+}
+
+// versionConflict tells apart an update that matched nothing because the object changed
+// since it was loaded from one that matched nothing for any other reason.
+func (m *MongoDataStore) versionConflict(model Model, err error) error {
+	db := m.Session.DB(Mongo.Database)
+	q, qerr := m.builder.MakeFindQuery(model.Collection(), versionConflictQuery(model))
+	if qerr != nil {
+		return err
+	}
+
+	if n, cerr := db.C(model.Collection()).Find(q).Count(); cerr == nil && n > 0 {
+		return ERR_VERSION_CONFLICT
+	}
+	return err
+}
+
 func (m *MongoDataStore) RemoveObject(model Model) error {
 	collectionName := model.Collection()
 	id := model.ObjectId()
@@ -193,8 +265,26 @@ func (m *MongoDataStore) RemoveObject(model Model) error {
 		return ERR_MISSING_ID
 	}
 
-	err := db.C(collectionName).Remove(q)
-	return err
+	before := firstDocument(m.current(collectionName, q, false))
+
+	if SoftDeletes(collectionName) {
+		change := mgo.Change{Update: deleteUpdate(collectionName, time.Now()), ReturnNew: true}
+		if _, err := db.C(collectionName).Find(q).Apply(change, model); err != nil {
+			return err
+		}
+		model.CustomUnmarshall()
+		publishModel(ChangeUpdate, model, before)
+		return nil
+	}
+
+	if err := db.C(collectionName).Remove(q); err != nil {
+		return err
+	}
+
+	if before != nil {
+		publishChange(ChangeDelete, collectionName, before, nil)
+	}
+	return nil
 }
 
 func (m *MongoDataStore) RemoveAll(collectionName string, query map[string]interface{}) error {
@@ -204,17 +294,75 @@ func (m *MongoDataStore) RemoveAll(collectionName string, query map[string]inter
 	}
 
 	db := m.Session.DB(Mongo.Database)
-	_, err = db.C(collectionName).RemoveAll(q)
-	return err
+	before := m.current(collectionName, q, true)
+	t := time.Now()
+
+	if SoftDeletes(collectionName) {
+		_, err = db.C(collectionName).UpdateAll(q, deleteUpdate(collectionName, t))
+	} else {
+		_, err = db.C(collectionName).RemoveAll(q)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	publishRemoved(collectionName, before, t)
+	return nil
+}
+
+// RestoreObject brings back a deleted object, which must have been loaded with a query
+// that includes deleted objects, see ExcludeDeleted.
+func (m *MongoDataStore) RestoreObject(model Model) error {
+	collectionName := model.Collection()
+	q, qerr := m.builder.MakeRestoreQuery(model)
+	if qerr != nil {
+		return qerr
+	}
+
+	db := m.Session.DB(Mongo.Database)
+	before := firstDocument(m.current(collectionName, q, false))
+
+	change := mgo.Change{Update: restoreUpdate(collectionName, time.Now()), ReturnNew: true}
+	if _, err := db.C(collectionName).Find(q).Apply(change, model); err != nil {
+		return err
+	}
+
+	model.CustomUnmarshall()
+	publishModel(ChangeUpdate, model, before)
+	return nil
+}
+
+// PurgeObjects permanently removes the objects deleted before deletedBefore.
+func (m *MongoDataStore) PurgeObjects(collectionName string, deletedBefore time.Time) (int, error) {
+	q, qerr := m.builder.MakePurgeQuery(collectionName, deletedBefore)
+	if qerr != nil {
+		return 0, qerr
+	}
+
+	db := m.Session.DB(Mongo.Database)
+	info, err := db.C(collectionName).RemoveAll(q)
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
 }
 
 func (m *MongoDataStore) FindEach(collectionName string, query map[string]interface{}, f func(Model), result Model, sortFields ...string) error {
+	q, qerr := m.builder.MakeFindQuery(collectionName, query)
+	if qerr == nil {
+		q, qerr = textQuery(collectionName, q)
+	}
+	if qerr != nil {
+		return qerr
+	}
+
 	db := m.Session.DB(Mongo.Database)
-	q := m.builder.MakeFindQuery(collectionName, query)
 	iter := db.C(collectionName).Find(q).Sort(sortFields...).Iter()
 
 	for iter.Next(result) {
 		result.CustomUnmarshall()
+		m.builder.ProtectFields(result)
 		f(result)
 	}
 
@@ -231,6 +379,160 @@ func (m *MongoDataStore) FindEach(collectionName string, query map[string]interf
 	return nil
 }
 
+// FindPage calls f for each object in one page of results and returns the cursor for the
+// next page, or "" when there are no more results.
+func (m *MongoDataStore) FindPage(collectionName string, query map[string]interface{}, page Page, f func(Model), result Model) (string, error) {
+	plan, err := planPage(query, page)
+	if err != nil {
+		return "", err
+	}
+
+	if plan.sort, err = m.builder.MakeSort(collectionName, plan.sort); err != nil {
+		return "", err
+	}
+
+	q, err := m.builder.MakeFindQuery(collectionName, plan.query)
+	if err == nil {
+		q, err = textQuery(collectionName, q)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	db := m.Session.DB(Mongo.Database)
+
+	// Ask for one more than the page holds to find out if there is a next page
+	iter := db.C(collectionName).Find(q).Sort(plan.sort...).Skip(plan.skip).Limit(plan.limit + 1).Iter()
+
+	var raw bson.Raw
+	var last pageKey
+	returned := 0
+	more := false
+
+	for iter.Next(&raw) {
+		if returned == plan.limit {
+			more = true
+			break
+		}
+
+		if err := raw.Unmarshal(result); err != nil {
+			iter.Close()
+			return "", err
+		}
+		if err := raw.Unmarshal(&last); err != nil {
+			iter.Close()
+			return "", err
+		}
+
+		result.CustomUnmarshall()
+		m.builder.ProtectFields(result)
+		f(result)
+		returned++
+	}
+
+	if err := iter.Close(); err != nil {
+		fmt.Printf("Error %s, collection name: %s", err.Error(), collectionName)
+		return "", err
+	}
+
+	return plan.nextCursor(more, returned, &last), nil
+}
+
+// textQuery searches for $text clauses with regexes when RegexTextSearch is set.
+func textQuery(collectionName string, q bson.M) (bson.M, error) {
+	if !RegexTextSearch {
+		return q, nil
+	}
+	return regexText(collectionName, q)
+}
+
+func (m *MongoDataStore) Search(collectionName string, query map[string]interface{}, limit int, f func(Model, float64), result Model) error {
+	text := TextOf(query)
+	if text == nil {
+		return ERR_NO_TEXT_SEARCH
+	}
+
+	// Query builders may add to the query they are given, and query may be used again below
+	q, qerr := m.builder.MakeFindQuery(collectionName, copyDocument(query))
+	if qerr != nil {
+		return qerr
+	}
+
+	// Without a text index to score them, or when the query builder searched with regexes
+	// itself, the results are scored here
+	if RegexTextSearch || TextOf(q) == nil {
+		fields, err := textFields(collectionName)
+		if err != nil {
+			return err
+		}
+
+		find := func(each func(Model)) error {
+			return m.FindEach(collectionName, query, each, result)
+		}
+		return searchByScore(find, text, fields, limit, f)
+	}
+
+	db := m.Session.DB(Mongo.Database)
+	find := db.C(collectionName).Find(q).Select(bson.M{"_score": bson.M{"$meta": "textScore"}}).Sort("$textScore:_score")
+	if limit > 0 {
+		find = find.Limit(limit)
+	}
+	iter := find.Iter()
+
+	var raw bson.Raw
+	var score struct {
+		Score float64 `bson:"_score"`
+	}
+
+	for iter.Next(&raw) {
+		if err := raw.Unmarshal(result); err != nil {
+			iter.Close()
+			return err
+		}
+		if err := raw.Unmarshal(&score); err != nil {
+			iter.Close()
+			return err
+		}
+
+		result.CustomUnmarshall()
+		m.builder.ProtectFields(result)
+		f(result, score.Score)
+	}
+
+	if err := iter.Close(); err != nil {
+		fmt.Printf("Error %s, collection name: %s", err.Error(), collectionName)
+		return err
+	}
+
+	return nil
+}
+
+func (m *MongoDataStore) Aggregate(collectionName string, pipeline []bson.M, f func(bson.M)) error {
+	p, qerr := m.builder.MakeAggregatePipeline(collectionName, pipeline)
+	if qerr == nil {
+		p, qerr = textPipeline(collectionName, p, RegexTextSearch)
+	}
+	if qerr != nil {
+		return qerr
+	}
+
+	db := m.Session.DB(Mongo.Database)
+	iter := db.C(collectionName).Pipe(p).Iter()
+
+	var doc bson.M
+	for iter.Next(&doc) {
+		f(doc)
+		doc = nil
+	}
+
+	if err := iter.Close(); err != nil {
+		fmt.Printf("Error %s, collection name: %s", err.Error(), collectionName)
+		return err
+	}
+
+	return nil
+}
+
 func (m *MongoDataStore) join(joinCollection string, query map[string]interface{}, f func(Join), j Join) error {
 	db := m.Session.DB(Mongo.Database)
 	iter := db.C(joinCollection).Find(query).Iter()
@@ -252,6 +554,10 @@ func (m *MongoDataStore) join(joinCollection string, query map[string]interface{
 	return nil
 }
 
+func (m *MongoDataStore) FindJoins(joinCollection string, query map[string]interface{}, f func(Join)) error {
+	return m.join(joinCollection, query, f, &JoinEntry{})
+}
+
 func (m *MongoDataStore) FindRelatedObjects(relation Relation, f func(Model), result Model, sortFields ...string) error {
 	q := m.builder.QueryByOwningModels(relation.JoinCollection(), []Model{relation.Owner()})
 
@@ -320,6 +626,7 @@ func (m *MongoDataStore) SaveRelatedObjects(relation Relation) error {
 		}
 	}
 
+	publishRelation(relation)
 	return nil
 
 }
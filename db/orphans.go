@@ -0,0 +1,234 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Orphan is a reference to an object that doesn't exist: a field, or the entry of a
+// relation. ClassName and ObjectId are the object referring, Key the field or relation it
+// refers through and Target the object referred to, "<Class>$<objectId>", or
+// "<Class>.<field>=<value>" for fields holding the value of a TargetField. Target is the
+// missing object, unless OwnerMissing says the relation's owner is.
+type Orphan struct {
+	ClassName    string
+	ObjectId     string
+	Key          string
+	Target       string
+	OwnerMissing bool
+	Fixed        bool
+}
+
+// ScanOrphans finds the references to objects that don't exist, left by deletions made
+// without a ReferentialDataStore. Fields are scanned for every DeleteRule of a field; those
+// holding the value of a TargetField refer to a missing object when no object of the class
+// has the value. Every relation is scanned. Deleted objects of classes that soft delete
+// count as missing.
+//
+// With fix, orphans are resolved as if the object had been deleted through a
+// ReferentialDataStore: cascade deletes the referring object, nullify removes the reference
+// and restrict leaves it to be resolved by hand. Relation entries of missing owners, and of
+// missing objects without a rule, are removed. Run it with a DataStore that is not
+// restricted by ACLs.
+func ScanOrphans(ds DataStore, fix bool) ([]Orphan, error) {
+	s := &orphanScan{ds: ds, fix: fix, exists: make(map[string]bool)}
+
+	for _, name := range RegisteredClasses() {
+		info, _ := LookupClass(name)
+
+		for _, rule := range info.DeleteRules {
+			if len(rule.Relation) == 0 {
+				if err := s.scanFields(info, rule); err != nil {
+					return s.orphans, err
+				}
+			}
+		}
+
+		for i := range info.Relations {
+			if err := s.scanRelation(info, &info.Relations[i]); err != nil {
+				return s.orphans, err
+			}
+		}
+	}
+	return s.orphans, nil
+}
+
+type orphanScan struct {
+	ds      DataStore
+	fix     bool
+	exists  map[string]bool
+	orphans []Orphan
+}
+
+func (s *orphanScan) scanFields(info *ClassInfo, rule DeleteRule) error {
+	var referring []Model
+	var copyErr error
+	err := s.ds.FindEach(info.Name, bson.M{rule.Field: bson.M{"$exists": true}}, func(model Model) {
+		c, err := CopyModel(model)
+		if err != nil {
+			copyErr = err
+			return
+		}
+		referring = append(referring, c)
+	}, info.New(""))
+	if err == nil {
+		err = copyErr
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, model := range referring {
+		doc, err := ToDocument(model)
+		if err != nil {
+			return err
+		}
+
+		target, missing, err := s.missingField(rule, doc[rule.Field])
+		if err != nil {
+			return err
+		}
+		if !missing {
+			continue
+		}
+
+		orphan := Orphan{ClassName: info.Name, ObjectId: model.ObjectId(), Key: rule.Field, Target: target}
+		if s.fix {
+			switch rule.OnDelete {
+			case DeleteCascade:
+				err = deleteWithRules(s.ds, model)
+				orphan.Fixed = err == nil
+			case DeleteNullify:
+				name, _ := fieldForKey(model, rule.Field)
+				model.Unset(name)
+				err = s.ds.UpdateObject(model)
+				orphan.Fixed = err == nil
+			}
+		}
+
+		s.orphans = append(s.orphans, orphan)
+		if err != nil && err != ERR_DELETE_RESTRICTED {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *orphanScan) scanRelation(info *ClassInfo, r *RelationInfo) error {
+	var joins []Join
+	if err := s.ds.FindJoins(r.JoinCollection, bson.M{}, func(j Join) {
+		joins = append(joins, &JoinEntry{Related: j.RelatedId(), Owning: j.OwningId()})
+	}); err != nil {
+		return err
+	}
+
+	onDelete := ""
+	for _, rule := range info.DeleteRules {
+		if rule.Relation == r.Name {
+			onDelete = rule.OnDelete
+		}
+	}
+
+	for _, j := range joins {
+		ownerMissing, err := s.missing(info.Name, j.OwningId())
+		if err != nil {
+			return err
+		}
+		relatedMissing, err := s.missing(r.RelatedClass, j.RelatedId())
+		if err != nil {
+			return err
+		}
+
+		if !ownerMissing && !relatedMissing {
+			continue
+		}
+
+		orphan := Orphan{
+			ClassName:    info.Name,
+			ObjectId:     j.OwningId(),
+			Key:          r.Name,
+			Target:       r.RelatedClass + "$" + j.RelatedId(),
+			OwnerMissing: ownerMissing,
+		}
+
+		if s.fix {
+			switch {
+			case !ownerMissing && onDelete == DeleteRestrict:
+			case !ownerMissing && onDelete == DeleteCascade:
+				owner := info.New(j.OwningId())
+				if err = s.ds.Fetch(owner); err == nil {
+					err = deleteWithRules(s.ds, owner)
+				}
+				orphan.Fixed = err == nil
+			default:
+				err = removeJoins(s.ds, info.Name, r, j.OwningId(), []string{j.RelatedId()})
+				orphan.Fixed = err == nil
+			}
+		}
+
+		s.orphans = append(s.orphans, orphan)
+		if err != nil && err != ERR_DELETE_RESTRICTED {
+			return err
+		}
+	}
+	return nil
+}
+
+// missingField reports whether the object a field's value refers to doesn't exist, and
+// which it is. Empty values and pointers to other classes refer to nothing.
+func (s *orphanScan) missingField(rule DeleteRule, value interface{}) (string, bool, error) {
+	if value == nil || value == "" {
+		return "", false, nil
+	}
+
+	if len(rule.TargetField) > 0 {
+		target := fmt.Sprintf("%s.%s=%v", rule.Class, rule.TargetField, value)
+		missing, err := s.missingWhere(target, rule.Class, bson.M{rule.TargetField: value})
+		return target, missing, err
+	}
+
+	pointer, _ := value.(string)
+	parts := strings.SplitN(pointer, "$", 2)
+	if len(parts) != 2 || parts[0] != rule.Class {
+		return "", false, nil
+	}
+
+	missing, err := s.missing(rule.Class, parts[1])
+	return pointer, missing, err
+}
+
+// missing reports whether an object doesn't exist
+func (s *orphanScan) missing(className string, id string) (bool, error) {
+	return s.missingWhere(className+"$"+id, className, bson.M{"_id": id})
+}
+
+// missingWhere reports whether no object matches the query, asking once per key
+func (s *orphanScan) missingWhere(key string, className string, query bson.M) (bool, error) {
+	if exists, ok := s.exists[key]; ok {
+		return !exists, nil
+	}
+
+	n, err := s.ds.Count(className, query)
+	if err != nil {
+		return false, err
+	}
+
+	s.exists[key] = n > 0
+	return n == 0, nil
+}
+
+// deleteWithRules deletes a model through server, applying the DeleteRules for it
+func deleteWithRules(server DataStore, model Model) error {
+	writes, err := planDelete(server, []Model{model})
+	if err != nil {
+		return err
+	}
+
+	if err := server.RemoveObject(model); err != nil {
+		return err
+	}
+
+	return commitDelete(server, writes, []Model{model})
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var ERR_INVALID_CURSOR = errors.New("Invalid page cursor.")
+var ERR_INVALID_LIMIT = errors.New("Invalid page limit.")
+
+// Page selects a window of query results for FindPage. Limit defaults to, and may not
+// exceed, DEFAULT_QUERY_LIMIT.
+//
+// Without Sort (or when sorting on _created_at only) pages are ordered by _created_at
+// then _id and the cursor records the last object returned, so paging stays stable while
+// objects are inserted. With any other Sort, or none on a $nearSphere query whose results
+// come closest first, the cursor records an offset instead. Skip is only used for the first
+// page; afterwards pass the cursor returned by FindPage.
+type Page struct {
+	Limit  int
+	Skip   int
+	Cursor string
+	Sort   []string
+}
+
+type pageCursor struct {
+	CreatedAt *time.Time `json:"t,omitempty"`
+	Id        string     `json:"i,omitempty"`
+	Offset    int        `json:"o,omitempty"`
+}
+
+// The fields of a document needed to continue after it
+type pageKey struct {
+	CreatedAt time.Time `bson:"_created_at"`
+	Id        string    `bson:"_id"`
+}
+
+type pagePlan struct {
+	query      bson.M
+	sort       []string
+	skip       int
+	limit      int
+	keyset     bool
+	descending bool
+}
+
+func encodeCursor(c pageCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ERR_INVALID_CURSOR
+	}
+
+	var c pageCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, ERR_INVALID_CURSOR
+	}
+	return &c, nil
+}
+
+// planPage works out the query, sort, skip and limit needed to read a page.
+func planPage(query map[string]interface{}, page Page) (*pagePlan, error) {
+	if page.Limit < 0 || page.Skip < 0 {
+		return nil, ERR_INVALID_LIMIT
+	}
+
+	if page.Limit > DEFAULT_QUERY_LIMIT {
+		return nil, ERR_LIMIT_EXCEEDED
+	}
+
+	plan := &pagePlan{query: query, limit: page.Limit, skip: page.Skip}
+	if plan.limit == 0 {
+		plan.limit = DEFAULT_QUERY_LIMIT
+	}
+
+	_, _, _, near := nearQuery(query)
+
+	switch {
+	case len(page.Sort) == 0 && near:
+		// Left in order of distance, which only an offset can continue
+	case len(page.Sort) == 0, len(page.Sort) == 1 && page.Sort[0] == "_created_at":
+		plan.keyset = true
+		plan.sort = []string{"_created_at", "_id"}
+	case len(page.Sort) == 1 && page.Sort[0] == "-_created_at":
+		plan.keyset = true
+		plan.descending = true
+		plan.sort = []string{"-_created_at", "-_id"}
+	default:
+		plan.sort = page.Sort
+	}
+
+	if len(page.Cursor) == 0 {
+		return plan, nil
+	}
+
+	cursor, err := decodeCursor(page.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	if !plan.keyset {
+		if cursor.CreatedAt != nil {
+			return nil, ERR_INVALID_CURSOR
+		}
+		plan.skip = cursor.Offset
+		return plan, nil
+	}
+
+	if cursor.CreatedAt == nil {
+		return nil, ERR_INVALID_CURSOR
+	}
+
+	op := "$gt"
+	if plan.descending {
+		op = "$lt"
+	}
+
+	after := bson.M{"$or": []bson.M{
+		bson.M{"_created_at": bson.M{op: *cursor.CreatedAt}},
+		bson.M{"_created_at": *cursor.CreatedAt, "_id": bson.M{op: cursor.Id}},
+	}}
+
+	// Mongo only runs text searches at the top level of a query, where the builders check them
+	rest := bson.M{}
+	for k, v := range query {
+		if k != "$text" {
+			rest[k] = v
+		}
+	}
+
+	plan.skip = 0
+	plan.query = bson.M{"$and": []bson.M{rest, after}}
+	if text, ok := query["$text"]; ok {
+		plan.query["$text"] = text
+	}
+	return plan, nil
+}
+
+// nextCursor returns the cursor for the page after one ending at last, or "" when the
+// page was the last one.
+func (p *pagePlan) nextCursor(more bool, returned int, last *pageKey) string {
+	if !more {
+		return ""
+	}
+
+	if p.keyset {
+		t := last.CreatedAt
+		return encodeCursor(pageCursor{CreatedAt: &t, Id: last.Id})
+	}
+
+	return encodeCursor(pageCursor{Offset: p.skip + returned})
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const ROLE_PREFIX = "role:"
+
+// RoleKey is the access key of a role, "role:<name>". Names given with the prefix are kept.
+func RoleKey(name string) string {
+	if strings.HasPrefix(name, ROLE_PREFIX) {
+		return name
+	}
+	return ROLE_PREFIX + name
+}
+
+// Access evaluates object permissions for a requester, both against the ACL of an object in
+// memory and as the query clauses that restrict what the database returns, so the two can't
+// disagree. The rules, for the _rperm and _wperm lists of an ACL:
+//
+//	master access           may read and write every object
+//	read                    the object has no _rperm, or lists one of the requester's keys
+//	write                   the object lists one of the requester's keys as a writer
+//
+// The keys are the requester's user id, "role:<name>" for each of their roles and "*". Objects
+// stored without _rperm, as those saved before ACLs were set are, are readable by everyone.
+// An ACL set with no readers is stored as an empty _rperm, and read back as an empty rather
+// than a nil list: only master access reads those objects.
+type Access struct {
+	Master bool
+	keys   []string
+}
+
+func NewAccess(userId string, roles ...string) *Access {
+	var keys []string
+	if len(userId) > 0 {
+		keys = append(keys, userId)
+	}
+	keys = append(keys, PUBLIC_KEY)
+	for _, r := range roles {
+		keys = append(keys, RoleKey(r))
+	}
+	return &Access{keys: keys}
+}
+
+func NewMasterAccess() *Access {
+	return &Access{Master: true}
+}
+
+// Keys lists the keys objects are shared with the requester by, for lookups like
+// ProtectedFields.For.
+func (a *Access) Keys() []interface{} {
+	keys := make([]interface{}, len(a.keys))
+	for i, k := range a.keys {
+		keys[i] = k
+	}
+	return keys
+}
+
+// Decision is the outcome of a permission check, with the reason it was reached.
+type Decision struct {
+	Allowed bool
+	Reason  string
+}
+
+func allowed(reason string) Decision {
+	return Decision{Allowed: true, Reason: reason}
+}
+
+func denied(reason string) Decision {
+	return Decision{Allowed: false, Reason: reason}
+}
+
+func (a *Access) CanRead(acl *ACL) Decision {
+	if a.Master {
+		return allowed("master access")
+	}
+	if acl == nil || acl.ReadAccess == nil {
+		return allowed("the object has no readers list")
+	}
+	if key, ok := a.match(acl.ReadAccess); ok {
+		return allowed("readable by " + key)
+	}
+	return denied("not readable by the user, their roles or the public")
+}
+
+func (a *Access) CanWrite(acl *ACL) Decision {
+	if a.Master {
+		return allowed("master access")
+	}
+	if acl == nil || len(acl.WriteAccess) == 0 {
+		return denied("the object lists no writers")
+	}
+	if key, ok := a.match(acl.WriteAccess); ok {
+		return allowed("writable by " + key)
+	}
+	return denied("not writable by the user, their roles or the public")
+}
+
+// ReadQuery matches the objects CanRead allows, nil for master access.
+func (a *Access) ReadQuery() bson.M {
+	if a.Master {
+		return nil
+	}
+	return bson.M{"$or": []bson.M{
+		bson.M{READ_PERM: bson.M{"$exists": false}},
+		bson.M{READ_PERM: bson.M{"$in": a.Keys()}},
+	}}
+}
+
+// WriteQuery matches the objects CanWrite allows, nil for master access.
+func (a *Access) WriteQuery() bson.M {
+	if a.Master {
+		return nil
+	}
+	return bson.M{WRITE_PERM: bson.M{"$in": a.Keys()}}
+}
+
+func (a *Access) match(list []string) (string, bool) {
+	for _, key := range a.keys {
+		for _, k := range list {
+			if k == key {
+				return key, true
+			}
+		}
+	}
+	return "", false
+}
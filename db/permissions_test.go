@@ -0,0 +1,107 @@
+package db
+
+import (
+	"testing"
+)
+
+func testACL(readers []string, writers []string) *ACL {
+	acl := NewACL()
+	for _, r := range readers {
+		acl.AddRead(r)
+	}
+	for _, w := range writers {
+		acl.AddWrite(w)
+	}
+	return acl
+}
+
+// storedACL is an ACL as read back after being set on an update, which stores its lists even
+// when empty
+func storedACL(readers []string, writers []string) *ACL {
+	acl := testACL(readers, writers)
+	acl.ReadAccess = append([]string{}, acl.ReadAccess...)
+	return acl
+}
+
+func storedList(keys []string) []interface{} {
+	list := []interface{}{}
+	for _, k := range keys {
+		list = append(list, k)
+	}
+	return list
+}
+
+var permissionTests = []struct {
+	name     string
+	acl      *ACL
+	access   *Access
+	canRead  bool
+	canWrite bool
+}{
+	{"no ACL", NewACL(), NewAccess("u1"), true, false},
+	{"user", testACL([]string{"u1"}, []string{"u1"}), NewAccess("u1"), true, true},
+	{"other user", testACL([]string{"u2"}, []string{"u2"}), NewAccess("u1"), false, false},
+	{"public read", testACL([]string{PUBLIC_KEY}, []string{"u2"}), NewAccess("u1"), true, false},
+	{"public write", testACL([]string{"u2"}, []string{PUBLIC_KEY}), NewAccess("u1"), false, true},
+	{"anonymous", testACL([]string{PUBLIC_KEY}, []string{PUBLIC_KEY}), NewAccess(""), true, true},
+	{"role", testACL([]string{"role:admin"}, []string{"role:admin"}), NewAccess("u1", "admin"), true, true},
+	{"prefixed role", testACL([]string{"role:admin"}, []string{"role:admin"}), NewAccess("u1", "role:admin"), true, true},
+	{"other role", testACL([]string{"role:admin"}, []string{"role:admin"}), NewAccess("u1", "member"), false, false},
+	{"role name as user", testACL([]string{"admin"}, []string{"admin"}), NewAccess("u1", "admin"), false, false},
+	{"writers only", testACL(nil, []string{"u2"}), NewAccess("u1"), true, false},
+	{"stored without readers", storedACL(nil, []string{"u2"}), NewAccess("u1"), false, false},
+	{"stored without readers for the public", storedACL(nil, nil), NewAccess(""), false, false},
+	{"master", testACL([]string{"u2"}, []string{"u2"}), NewMasterAccess(), true, true},
+	{"master without ACL", NewACL(), NewMasterAccess(), true, true},
+	{"master without readers", storedACL(nil, nil), NewMasterAccess(), true, true},
+}
+
+// The checks of objects in memory and the queries for them agree
+func TestAccess(t *testing.T) {
+	for _, test := range permissionTests {
+		if d := test.access.CanRead(test.acl); d.Allowed != test.canRead {
+			t.Fatal(test.name, "Expected:", test.canRead, "Actual:", d.Allowed, d.Reason)
+		}
+		if d := test.access.CanWrite(test.acl); d.Allowed != test.canWrite {
+			t.Fatal(test.name, "Expected:", test.canWrite, "Actual:", d.Allowed, d.Reason)
+		}
+
+		doc, err := ToDocument(test.acl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.acl.ReadAccess != nil {
+			doc[READ_PERM] = storedList(test.acl.ReadAccess)
+		}
+
+		read, err := MatchDocument(doc, test.access.ReadQuery())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read != test.canRead {
+			t.Fatal(test.name, "Expected read query to match:", test.canRead, "Actual:", read)
+		}
+
+		write, err := MatchDocument(doc, test.access.WriteQuery())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if write != test.canWrite {
+			t.Fatal(test.name, "Expected write query to match:", test.canWrite, "Actual:", write)
+		}
+	}
+}
+
+func TestAccessReasons(t *testing.T) {
+	acl := testACL([]string{"u2"}, []string{"role:admin"})
+
+	if d := NewAccess("u1", "admin").CanWrite(acl); d.Reason != "writable by role:admin" {
+		t.Fatal("Expected:", "writable by role:admin", "Actual:", d.Reason)
+	}
+	if d := NewAccess("u1").CanRead(acl); d.Allowed || len(d.Reason) == 0 {
+		t.Fatal("Expected a reason for the denial. Actual:", d)
+	}
+	if d := NewAccess("u1").CanWrite(NewACL()); d.Reason != "the object lists no writers" {
+		t.Fatal("Expected:", "the object lists no writers", "Actual:", d.Reason)
+	}
+}
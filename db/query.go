@@ -19,9 +19,14 @@ type DataStoreQueryBuilder interface {
 	RelationalDataStoreQueryBuilder
 
 	// Read
-	MakeCountQuery(collectionName string, query map[string]interface{}) bson.M
-	MakeFindQuery(collectionName string, query map[string]interface{}) bson.M
+	MakeCountQuery(collectionName string, query map[string]interface{}) (bson.M, error)
+	MakeFindQuery(collectionName string, query map[string]interface{}) (bson.M, error)
 	MakeFindByIdQuery(model Model) (bson.M, error)
+	MakeAggregatePipeline(collectionName string, pipeline []bson.M) ([]bson.M, error)
+	// The fields pages are sorted by, see FindPage
+	MakeSort(collectionName string, sort []string) ([]string, error)
+	// Clears the fields of a result the requester may not see, see ProtectedFields
+	ProtectFields(model Model)
 
 	// Write
 	MakeRemoveQuery(model Model) (bson.M, error)
@@ -31,4 +36,8 @@ type DataStoreQueryBuilder interface {
 	// See findAndModify() https://docs.mongodb.com/manual/reference/method/db.collection.findAndModify/
 	MakeChangeDocument(model Model, t time.Time) (bson.M, mgo.Change, error)
 	MakeUpsertDocument(model Model, query map[string]interface{}, t time.Time, id string) (bson.M, mgo.Change, error)
+
+	// Soft deletion, see SoftDeletes
+	MakeRestoreQuery(model Model) (bson.M, error)
+	MakePurgeQuery(collectionName string, deletedBefore time.Time) (bson.M, error)
 }
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ERR_UNKNOWN_CLASS = errors.New("Unknown object className")
+var ERR_UNKNOWN_RELATION = errors.New("Unknown relation.")
+
+// RelationInfo describes a relation a class owns, stored in JoinCollection.
+type RelationInfo struct {
+	Name           string
+	JoinCollection string
+	RelatedClass   string
+	New            func(owner Model) Relation
+}
+
+// ClassInfo describes a model type: the collection its objects are stored in, how to make
+// one, the relations it owns and the indexes its collection needs. New is given an empty id
+// for a new object. Join collections get their indexes without declaring them.
+//
+// Objects of classes with SoftDelete are kept for RetainDeleted (DefaultRetention when not
+// set) after they are deleted, so they can be restored. See PurgeDeleted.
+//
+// ProtectedFields are hidden from requesters restricted by ACLs unless the class's schema
+// protects fields itself. Includes are the keys reads can expand, see Include. DeleteRules
+// say what happens to the class's objects when objects they refer to are deleted.
+type ClassInfo struct {
+	Name            string
+	New             func(id string) Model
+	Relations       []RelationInfo
+	Indexes         []Index
+	SoftDelete      bool
+	RetainDeleted   time.Duration
+	ProtectedFields ProtectedFields
+	Includes        []IncludeInfo
+	DeleteRules     []DeleteRule
+}
+
+var registry = struct {
+	sync.RWMutex
+	classes map[string]*ClassInfo
+}{classes: make(map[string]*ClassInfo)}
+
+// RegisterClass makes a class known to pointers and the generic endpoints. Models register
+// themselves from init. Registering the same name twice, or with DeleteRules that can't be
+// applied, panics.
+func RegisterClass(info ClassInfo) {
+	if info.New == nil {
+		panic("db: RegisterClass without a constructor for " + info.Name)
+	}
+	if err := checkDeleteRules(&info); err != nil {
+		panic(err.Error())
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, dup := registry.classes[info.Name]; dup {
+		panic("db: RegisterClass called twice for " + info.Name)
+	}
+
+	registry.classes[info.Name] = &info
+}
+
+func LookupClass(name string) (*ClassInfo, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	if info, ok := registry.classes[name]; ok {
+		return info, nil
+	}
+	return nil, ERR_UNKNOWN_CLASS
+}
+
+// RegisteredClasses returns the names of all registered classes, sorted.
+func RegisteredClasses() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	var names []string
+	for name := range registry.classes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewObject makes an object of the named class, with id set.
+func NewObject(className string, id string) (Model, error) {
+	info, err := LookupClass(className)
+	if err != nil {
+		return nil, err
+	}
+	return info.New(id), nil
+}
+
+func (c *ClassInfo) Relation(name string) (*RelationInfo, error) {
+	for i := range c.Relations {
+		if c.Relations[i].Name == name {
+			return &c.Relations[i], nil
+		}
+	}
+	return nil, ERR_UNKNOWN_RELATION
+}
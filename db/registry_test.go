@@ -0,0 +1,70 @@
+package db
+
+import (
+	"testing"
+)
+
+type registryTestModel struct {
+	BaseModel `bson:",inline"`
+}
+
+func (model *registryTestModel) Fetch(ds DataStore) error                          { return nil }
+func (model *registryTestModel) Save(ds DataStore) error                           { return nil }
+func (model *registryTestModel) Delete(ds DataStore) error                         { return nil }
+func (model *registryTestModel) Set(fieldName string, value interface{})           {}
+func (model *registryTestModel) Unset(fieldName string)                            {}
+func (model *registryTestModel) Get(fieldName string) interface{}                  { return nil }
+func (model *registryTestModel) Increment(fieldName string, amount int)            {}
+func (model *registryTestModel) Add(fieldName string, values ...interface{})       {}
+func (model *registryTestModel) AddUnique(fieldName string, values ...interface{}) {}
+func (model *registryTestModel) Remove(fieldName string, values ...interface{})    {}
+
+func TestRegistry(t *testing.T) {
+	RegisterClass(ClassInfo{
+		Name: "RegistryTest",
+		New: func(id string) Model {
+			return &registryTestModel{BaseModel{Id: id, CollectionName: "RegistryTest"}}
+		},
+		Relations: []RelationInfo{{Name: "friends", JoinCollection: "_Join:friends:RegistryTest", RelatedClass: "RegistryTest"}},
+	})
+
+	model, err := NewObject("RegistryTest", "123")
+	if err != nil || model.ObjectId() != "123" || model.Collection() != "RegistryTest" {
+		t.Fatal("Expected: RegistryTest 123", "Actual:", model, err)
+	}
+
+	if _, err := NewObject("NotRegistered", "123"); err != ERR_UNKNOWN_CLASS {
+		t.Fatal("Expected:", ERR_UNKNOWN_CLASS, "Actual:", err)
+	}
+
+	info, _ := LookupClass("RegistryTest")
+	if r, err := info.Relation("friends"); err != nil || r.JoinCollection != "_Join:friends:RegistryTest" {
+		t.Fatal("Expected: relation friends", "Actual:", r, err)
+	}
+
+	if _, err := info.Relation("enemies"); err != ERR_UNKNOWN_RELATION {
+		t.Fatal("Expected:", ERR_UNKNOWN_RELATION, "Actual:", err)
+	}
+
+	// Delete rules that can't be applied are refused
+	for _, rule := range []DeleteRule{
+		{Relation: "enemies", OnDelete: DeleteNullify},
+		{Field: "_p_owner", Class: "RegistryTest", OnDelete: DeleteCascade},
+		{Field: "_id", OnDelete: DeleteCascade},
+		{Relation: "friends", OnDelete: "forget"},
+	} {
+		if err := checkDeleteRules(&ClassInfo{Name: "RegistryTest", New: info.New, Relations: info.Relations, DeleteRules: []DeleteRule{rule}}); err == nil {
+			t.Fatal("Expected: an error for", rule, "Actual:", err)
+		}
+	}
+	if err := checkDeleteRules(&ClassInfo{Name: "RegistryTest", New: info.New, Relations: info.Relations, DeleteRules: []DeleteRule{{Relation: "friends", OnDelete: DeleteNullify}}}); err != nil {
+		t.Fatal("Expected:", nil, "Actual:", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected registering a class twice to panic")
+		}
+	}()
+	RegisterClass(ClassInfo{Name: "RegistryTest", New: info.New})
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Objects of classes registered with SoftDelete are not removed, they are marked with the
+// time they were deleted and left out of queries until restored or purged.
+const DELETED_AT = "_deleted_at"
+
+// How long deleted objects are kept when their class doesn't say
+var DefaultRetention = 30 * 24 * time.Hour
+
+// SoftDeletes reports whether objects of the collection are kept when deleted.
+func SoftDeletes(collectionName string) bool {
+	info, err := LookupClass(collectionName)
+	return err == nil && info.SoftDelete
+}
+
+// ExcludeDeleted returns the query, leaving out deleted objects when the collection soft
+// deletes. Queries that constrain _deleted_at themselves see deleted objects, which is how
+// the trash is listed.
+func ExcludeDeleted(collectionName string, query bson.M) bson.M {
+	if !SoftDeletes(collectionName) {
+		return query
+	}
+
+	if _, ok := query[DELETED_AT]; ok {
+		return query
+	}
+
+	result := bson.M{DELETED_AT: bson.M{"$exists": false}}
+	for k, v := range query {
+		result[k] = v
+	}
+	return result
+}
+
+// TrashQuery matches the deleted objects of a collection.
+func TrashQuery() bson.M {
+	return bson.M{DELETED_AT: bson.M{"$exists": true}}
+}
+
+func deleteUpdate(collectionName string, t time.Time) bson.M {
+	return softDeleteUpdate(collectionName, bson.M{"$set": bson.M{DELETED_AT: t, "_updated_at": t}})
+}
+
+func restoreUpdate(collectionName string, t time.Time) bson.M {
+	return softDeleteUpdate(collectionName, bson.M{"$set": bson.M{"_updated_at": t}, "$unset": bson.M{DELETED_AT: ""}})
+}
+
+// Deleting or restoring an object changes it, so anyone holding a copy gets a version
+// conflict if they try to save it.
+func softDeleteUpdate(collectionName string, update bson.M) bson.M {
+	if info, err := LookupClass(collectionName); err == nil && info.New("").UsesOptimisticLocking() {
+		return VersionedUpdate(update)
+	}
+	return update
+}
+
+// PurgeDeleted permanently removes the objects deleted longer ago than the retention of
+// their class. Run it regularly, with a DataStore that is not restricted by ACLs.
+func PurgeDeleted(ds DataStore, now time.Time) error {
+	for _, name := range RegisteredClasses() {
+		info, _ := LookupClass(name)
+		if !info.SoftDelete {
+			continue
+		}
+
+		retention := info.RetainDeleted
+		if retention == 0 {
+			retention = DefaultRetention
+		}
+
+		n, err := ds.PurgeObjects(name, now.Add(-retention))
+		if err != nil {
+			return err
+		}
+
+		if n > 0 {
+			fmt.Printf("Purged %d deleted objects from %s \n", n, name)
+		}
+	}
+
+	return nil
+}
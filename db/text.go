@@ -0,0 +1,270 @@
+package db
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var ERR_NO_TEXT_SEARCH = errors.New("Search needs a $text clause.")
+var ERR_NO_TEXT_INDEX = errors.New("Text search needs a text index.")
+var ERR_RANKED_PAGE = errors.New("Ranked text searches are paged with skip, up to the query limit.")
+
+// Text indexes are declared with the fields they cover prefixed, the way mgo reads them
+// back: Index{Key: []string{TEXT_KEY + "name", TEXT_KEY + "username"}}. List the fields in
+// alphabetical order, which is how mongo stores them.
+const TEXT_KEY = "$text:"
+
+// Mongo has text indexes, set RegexTextSearch for backends that don't, like some hosted
+// ones. $text clauses are then searched for with case insensitive regexes on the indexed
+// fields and scored by the server. The in memory datastore always searches this way.
+var RegexTextSearch = false
+
+// TextFields lists the fields of the class's text index.
+func (c *ClassInfo) TextFields() []string {
+	for _, index := range c.Indexes {
+		var fields []string
+		for _, key := range index.Key {
+			if strings.HasPrefix(key, TEXT_KEY) {
+				fields = append(fields, strings.TrimPrefix(key, TEXT_KEY))
+			}
+		}
+		if len(fields) > 0 {
+			return fields
+		}
+	}
+	return nil
+}
+
+// TextSearch is the $text clause of a query: {"$text": {"$search": "..."}}. Like mongo,
+// a search matches any of its words or "quoted phrases" and none of its -negated ones.
+type TextSearch struct {
+	Terms   []string
+	Negated []string
+}
+
+// TextOf returns the $text clause of query, or nil when it has none.
+func TextOf(query map[string]interface{}) *TextSearch {
+	var search string
+	switch text := query["$text"].(type) {
+	case bson.M:
+		search, _ = text["$search"].(string)
+	case map[string]interface{}:
+		search, _ = text["$search"].(string)
+	default:
+		return nil
+	}
+
+	t := &TextSearch{}
+	for len(search) > 0 {
+		search = strings.TrimLeftFunc(search, unicode.IsSpace)
+		if len(search) == 0 {
+			break
+		}
+
+		negated := strings.HasPrefix(search, "-")
+		if negated {
+			search = search[1:]
+		}
+
+		var term string
+		if strings.HasPrefix(search, `"`) {
+			end := strings.Index(search[1:], `"`)
+			if end < 0 {
+				term, search = search[1:], ""
+			} else {
+				term, search = search[1:end+1], search[end+2:]
+			}
+		} else {
+			end := strings.IndexFunc(search, unicode.IsSpace)
+			if end < 0 {
+				end = len(search)
+			}
+			term, search = search[:end], search[end:]
+		}
+
+		term = strings.ToLower(strings.TrimSpace(term))
+		switch {
+		case len(term) == 0:
+		case negated:
+			t.Negated = append(t.Negated, term)
+		default:
+			t.Terms = append(t.Terms, term)
+		}
+	}
+	return t
+}
+
+// Regex returns the query matching the search on fields, to replace the $text clause with.
+func (t *TextSearch) Regex(fields []string) bson.M {
+	var matches, excludes []interface{}
+	for _, field := range fields {
+		for _, term := range t.Terms {
+			matches = append(matches, bson.M{field: bson.M{"$regex": regexp.QuoteMeta(term), "$options": "i"}})
+		}
+		for _, term := range t.Negated {
+			excludes = append(excludes, bson.M{field: bson.M{"$regex": regexp.QuoteMeta(term), "$options": "i"}})
+		}
+	}
+
+	q := bson.M{}
+	if len(matches) == 0 {
+		// Nothing to look for matches nothing, as in mongo
+		q["_id"] = bson.M{"$exists": false}
+	} else {
+		q["$or"] = matches
+	}
+	if len(excludes) > 0 {
+		q["$nor"] = excludes
+	}
+	return q
+}
+
+// Score rates how well doc matches the search on fields: how often the terms appear, 0 when
+// it doesn't match.
+func (t *TextSearch) Score(doc bson.M, fields []string) float64 {
+	var texts []string
+	for _, field := range fields {
+		for _, v := range expand(lookup(doc, strings.Split(field, "."))) {
+			if s, ok := v.(string); ok {
+				texts = append(texts, strings.ToLower(s))
+			}
+		}
+	}
+
+	score := 0.0
+	for _, text := range texts {
+		for _, term := range t.Negated {
+			if strings.Contains(text, term) {
+				return 0
+			}
+		}
+		for _, term := range t.Terms {
+			score += float64(strings.Count(text, term))
+		}
+	}
+	return score
+}
+
+// WithoutText replaces the $text clause of query with replacement, keeping any $or or
+// $and of the query.
+func WithoutText(query map[string]interface{}, replacement bson.M) bson.M {
+	result := bson.M{}
+	for k, v := range query {
+		if k != "$text" {
+			result[k] = v
+		}
+	}
+
+	var clauses []interface{}
+	switch and := result["$and"].(type) {
+	case []bson.M:
+		for _, c := range and {
+			clauses = append(clauses, c)
+		}
+	case []interface{}:
+		clauses = append(clauses, and...)
+	}
+	result["$and"] = append(clauses, replacement)
+	return result
+}
+
+// regexText replaces the $text clause of query with regexes on the text fields of the
+// collection, for backends without text indexes.
+func regexText(collectionName string, query bson.M) (bson.M, error) {
+	text := TextOf(query)
+	if text == nil {
+		return query, nil
+	}
+
+	fields, err := textFields(collectionName)
+	if err != nil {
+		return nil, err
+	}
+	return WithoutText(query, text.Regex(fields)), nil
+}
+
+// textPipeline searches for a $text clause in the first $match of a pipeline with regexes
+// when regex is set. Only the first stage may search text.
+func textPipeline(collectionName string, pipeline []bson.M, regex bool) ([]bson.M, error) {
+	if !regex || len(pipeline) == 0 {
+		return pipeline, nil
+	}
+
+	match, rest, err := SplitMatch(pipeline)
+	if err != nil || len(rest) == len(pipeline) {
+		return pipeline, err
+	}
+
+	if match, err = regexText(collectionName, match); err != nil {
+		return nil, err
+	}
+	return append([]bson.M{bson.M{StageMatch: match}}, rest...), nil
+}
+
+func textFields(collectionName string) ([]string, error) {
+	info, err := LookupClass(collectionName)
+	if err != nil {
+		return nil, ERR_NO_TEXT_INDEX
+	}
+
+	fields := info.TextFields()
+	if len(fields) == 0 {
+		return nil, ERR_NO_TEXT_INDEX
+	}
+	return fields, nil
+}
+
+// searchByScore scores every object find reads and calls f with the best limit of them,
+// for searches without a text index.
+func searchByScore(find func(func(Model)) error, text *TextSearch, fields []string, limit int, f func(Model, float64)) error {
+	var results []scoredModel
+	var copyErr error
+
+	err := find(func(m Model) {
+		// Scored as returned, so protected fields don't count
+		doc, err := ToDocument(m)
+		if err == nil {
+			m, err = CopyModel(m)
+		}
+		if err != nil {
+			copyErr = err
+			return
+		}
+		results = append(results, scoredModel{m, text.Score(doc, fields)})
+	})
+
+	if err == nil {
+		err = copyErr
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rankResults(results, limit) {
+		f(r.model, r.score)
+	}
+	return nil
+}
+
+// scoredModel is a search result the server scored.
+type scoredModel struct {
+	model Model
+	score float64
+}
+
+// rankResults sorts results by score, best first, keeping at most limit of them.
+func rankResults(results []scoredModel, limit int) []scoredModel {
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].score > results[j].score
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
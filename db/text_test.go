@@ -0,0 +1,48 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTextSearch(t *testing.T) {
+	doc := bson.M{"_id": "a", "name": "Jane Austen", "username": "jane", "tags": []interface{}{"novelist", "Author"}}
+	fields := []string{"name", "username", "tags"}
+
+	tests := []struct {
+		search  string
+		terms   []string
+		negated []string
+		score   float64
+	}{
+		{"jane", []string{"jane"}, nil, 2},
+		{"  Austen   author ", []string{"austen", "author"}, nil, 2},
+		{`"jane austen" bronte`, []string{"jane austen", "bronte"}, nil, 1},
+		{"jane -novelist", []string{"jane"}, []string{"novelist"}, 0},
+		{`-"jane doe" jane`, []string{"jane"}, []string{"jane doe"}, 2},
+		{"", nil, nil, 0},
+	}
+
+	for _, test := range tests {
+		text := TextOf(bson.M{"$text": bson.M{"$search": test.search}})
+		if !reflect.DeepEqual(text.Terms, test.terms) || !reflect.DeepEqual(text.Negated, test.negated) {
+			t.Fatal("Search:", test.search, "Expected:", test.terms, test.negated, "Actual:", text.Terms, text.Negated)
+		}
+
+		if score := text.Score(doc, fields); score != test.score {
+			t.Fatal("Search:", test.search, "Expected:", test.score, "Actual:", score)
+		}
+
+		// Searching with regexes matches the documents that score
+		matches, err := MatchDocument(doc, WithoutText(bson.M{}, text.Regex(fields)))
+		if err != nil || matches != (test.score > 0) {
+			t.Fatal("Search:", test.search, "Expected:", test.score > 0, "Actual:", matches, err)
+		}
+	}
+
+	if TextOf(bson.M{"name": "jane"}) != nil {
+		t.Fatal("Expected: no text search")
+	}
+}
@@ -0,0 +1,309 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var ERR_MISSING_BASE_MODEL = errors.New("Model does not embed db.BaseModel.")
+var ERR_UNSUPPORTED_OPERATION = errors.New("Operation is not supported.")
+
+// Transactional is implemented by DataStores that can apply several writes atomically. f
+// makes its writes through the DataStore itself; if it returns an error none of them are
+// kept.
+type Transactional interface {
+	RunTransaction(f func() error) error
+}
+
+// CommitError is returned when a unit of work failed and some of the writes it had already
+// made could not be undone.
+type CommitError struct {
+	Err            error
+	RollbackErrors []error
+}
+
+func (e *CommitError) Error() string {
+	var errs []string
+	for _, err := range e.RollbackErrors {
+		errs = append(errs, err.Error())
+	}
+	return fmt.Sprintf("%s (rollback failed: %s)", e.Err.Error(), strings.Join(errs, "; "))
+}
+
+const (
+	opInsert = iota
+	opCreate
+	opUpdate
+	opRelation
+	opRemove
+)
+
+type unitOperation struct {
+	kind     int
+	model    Model
+	build    func() Model
+	mutate   []func()
+	relation Relation
+}
+
+// UnitOfWork queues inserts, updates, removals and relation changes and writes them together
+// on Commit, in the order they were queued. On a Transactional DataStore the writes are made
+// in a transaction. Otherwise every write made before a failure is undone: inserts are
+// removed, updated fields are set back to the values they had before Commit, removed objects
+// are restored and relation changes are reversed.
+//
+// Models keep the values they were given when a commit is rolled back, so fetch them again
+// before retrying. Inserts into classes that soft delete are rolled back into the trash,
+// where PurgeDeleted removes them. Only objects of classes that soft delete can be restored,
+// so queue the removal of others last.
+type UnitOfWork struct {
+	ds  DataStore
+	ops []*unitOperation
+}
+
+func NewUnitOfWork(ds DataStore) *UnitOfWork {
+	return &UnitOfWork{ds: ds}
+}
+
+func (u *UnitOfWork) Insert(model Model) {
+	u.ops = append(u.ops, &unitOperation{kind: opInsert, model: model})
+}
+
+// Create inserts the model returned by build, which is only called once the operations
+// queued before it have been written. Use it for objects that point to something inserted
+// by the same unit of work, like tasks for a new user.
+func (u *UnitOfWork) Create(build func() Model) {
+	u.ops = append(u.ops, &unitOperation{kind: opCreate, build: build})
+}
+
+// Update saves the model's changes. The mutate functions are called just before the write,
+// once the operations queued before it have been written.
+func (u *UnitOfWork) Update(model Model, mutate ...func()) {
+	u.ops = append(u.ops, &unitOperation{kind: opUpdate, model: model, mutate: mutate})
+}
+
+func (u *UnitOfWork) Remove(model Model) {
+	u.ops = append(u.ops, &unitOperation{kind: opRemove, model: model})
+}
+
+func (u *UnitOfWork) SaveRelation(relation Relation) {
+	u.ops = append(u.ops, &unitOperation{kind: opRelation, relation: relation})
+}
+
+func (u *UnitOfWork) Commit() error {
+	if tx, ok := u.ds.(Transactional); ok {
+		return tx.RunTransaction(func() error {
+			_, err := u.apply(false)
+			return err
+		})
+	}
+
+	undo, err := u.apply(true)
+	if err == nil {
+		return nil
+	}
+
+	var rollbackErrors []error
+	for i := len(undo) - 1; i >= 0; i-- {
+		if rerr := undo[i](); rerr != nil {
+			fmt.Printf("Error rolling back unit of work: %s \n", rerr)
+			rollbackErrors = append(rollbackErrors, rerr)
+		}
+	}
+
+	if len(rollbackErrors) > 0 {
+		return &CommitError{err, rollbackErrors}
+	}
+	return err
+}
+
+// apply makes the queued writes, returning a function to undo each write that was made when
+// compensate is true.
+func (u *UnitOfWork) apply(compensate bool) ([]func() error, error) {
+	var undo []func() error
+
+	for _, op := range u.ops {
+		var rollback func() error
+		var err error
+
+		switch op.kind {
+		case opInsert:
+			rollback, err = u.insert(op.model)
+		case opCreate:
+			rollback, err = u.insert(op.build())
+		case opUpdate:
+			rollback, err = u.update(op.model, op.mutate, compensate)
+		case opRelation:
+			rollback, err = u.saveRelation(op.relation, compensate)
+		case opRemove:
+			rollback, err = u.remove(op.model)
+		}
+
+		if err != nil {
+			return undo, err
+		}
+		undo = append(undo, rollback)
+	}
+
+	return undo, nil
+}
+
+func (u *UnitOfWork) insert(model Model) (func() error, error) {
+	if err := u.ds.InsertObject(model); err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		return u.ds.RemoveObject(model)
+	}, nil
+}
+
+func (u *UnitOfWork) remove(model Model) (func() error, error) {
+	if err := u.ds.RemoveObject(model); err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		if !SoftDeletes(model.Collection()) {
+			return ERR_UNSUPPORTED_OPERATION
+		}
+		return u.ds.RestoreObject(model)
+	}, nil
+}
+
+func (u *UnitOfWork) update(model Model, mutate []func(), compensate bool) (func() error, error) {
+	for _, f := range mutate {
+		f()
+	}
+
+	var snapshot Model
+	if compensate {
+		snapshot = emptyCopy(model)
+		if err := u.ds.Fetch(snapshot); err != nil {
+			return nil, err
+		}
+	}
+
+	// The fields this update is about to write
+	var fields []string
+	for _, changes := range model.Update(time.Now()) {
+		if m, ok := changes.(bson.M); ok {
+			for field := range m {
+				if field != "_updated_at" && field != versionKey {
+					fields = append(fields, field)
+				}
+			}
+		}
+	}
+
+	if err := u.ds.UpdateObject(model); err != nil {
+		return nil, err
+	}
+
+	if !compensate {
+		return nil, nil
+	}
+
+	return func() error {
+		return u.restore(snapshot, fields, model.ObjectVersion())
+	}, nil
+}
+
+// restore writes the values snapshot has for fields back, as long as nobody else changed
+// the object after this unit of work did.
+func (u *UnitOfWork) restore(snapshot Model, fields []string, version int) error {
+	doc, err := ToDocument(snapshot)
+	if err != nil {
+		return err
+	}
+
+	base := embeddedBaseModel(snapshot)
+	if base == nil {
+		return ERR_MISSING_BASE_MODEL
+	}
+
+	for _, field := range fields {
+		if v, ok := doc[field]; ok {
+			base.setOnUpdate(field, v)
+		} else {
+			base.unset(field)
+		}
+	}
+
+	snapshot.SetObjectVersion(version)
+	return u.ds.UpdateObject(snapshot)
+}
+
+func (u *UnitOfWork) saveRelation(relation Relation, compensate bool) (func() error, error) {
+	inverse := &inverseRelation{NewBaseRelation(relation.Owner(), relation.JoinCollection(), relation.RelatedCollection())}
+
+	// Only reverse what actually changes: adding an object that was already related or
+	// removing one that was not leaves the join collection as it was.
+	if compensate {
+		for _, model := range relation.Inserting() {
+			if n, err := u.countJoins(relation, model); err != nil {
+				return nil, err
+			} else if n == 0 {
+				inverse.Remove(model)
+			}
+		}
+
+		for _, model := range relation.Removing() {
+			if n, err := u.countJoins(relation, model); err != nil {
+				return nil, err
+			} else if n > 0 {
+				inverse.Add(model)
+			}
+		}
+	}
+
+	if err := u.ds.SaveRelatedObjects(relation); err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		if len(inverse.operations) == 0 {
+			return nil
+		}
+		return u.ds.SaveRelatedObjects(inverse)
+	}, nil
+}
+
+func (u *UnitOfWork) countJoins(relation Relation, model Model) (int, error) {
+	return u.ds.Count(relation.JoinCollection(), bson.M{"owningId": relation.Owner().ObjectId(), "relatedId": model.ObjectId()})
+}
+
+// inverseRelation undoes the changes made through another relation
+type inverseRelation struct {
+	BaseRelation
+}
+
+func (r *inverseRelation) Find(rds RelationalDataStore) ([]Model, error) {
+	return nil, ERR_UNSUPPORTED_OPERATION
+}
+
+// emptyCopy returns a new model of the same type, with only its id and collection set.
+func emptyCopy(model Model) Model {
+	c := reflect.New(reflect.TypeOf(model).Elem()).Interface().(Model)
+	c.SetObjectId(model.ObjectId())
+	c.SetCollection(model.Collection())
+	return c
+}
+
+func embeddedBaseModel(model Model) *BaseModel {
+	v := reflect.ValueOf(model)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+
+	field := v.Elem().FieldByName("BaseModel")
+	if !field.IsValid() || field.Type() != reflect.TypeOf(BaseModel{}) {
+		return nil
+	}
+	return field.Addr().Interface().(*BaseModel)
+}
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"errors"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var ERR_VERSION_CONFLICT = errors.New("Object was changed by someone else. Fetch it and try again.")
+var ERR_VERSION_REQUIRED = errors.New("Give the version of the object to update.")
+
+// Objects saved before versioning was added have no _version and are treated as version 0.
+const versionKey = "_version"
+
+// VersionCondition matches the version of the object that was loaded into model. Objects are
+// inserted at version 1, so a model built from an id and saved without being fetched first
+// conflicts; models that are updated that way have to opt out of UsesOptimisticLocking.
+func VersionCondition(model Model) interface{} {
+	if model.ObjectVersion() == 0 {
+		return bson.M{"$exists": false}
+	}
+	return model.ObjectVersion()
+}
+
+// VersionedUpdate returns a copy of update that also bumps the object's version. The copy
+// keeps the model's pending changes intact if the update has to be retried.
+func VersionedUpdate(update map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(update)+1)
+	for k, v := range update {
+		result[k] = v
+	}
+
+	inc := bson.M{}
+	if existing, ok := update["$inc"].(bson.M); ok {
+		for k, v := range existing {
+			inc[k] = v
+		}
+	}
+	inc[versionKey] = 1
+	result["$inc"] = inc
+
+	return result
+}
+
+// versionConflictQuery finds model's object if it exists with a version other than the one
+// that was loaded.
+func versionConflictQuery(model Model) bson.M {
+	if model.ObjectVersion() == 0 {
+		return bson.M{"_id": model.ObjectId(), versionKey: bson.M{"$exists": true}}
+	}
+	return bson.M{"_id": model.ObjectId(), versionKey: bson.M{"$ne": model.ObjectVersion()}}
+}
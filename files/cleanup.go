@@ -0,0 +1,196 @@
+package files
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Files uploaded or uploaded again more recently than this are kept even when nothing refers
+// to them, to give clients time to attach them
+var UploadGracePeriod = time.Hour
+
+var fileType = reflect.TypeOf(models.File{})
+
+// fileField is a File field of a class: where it is in the struct and its bson key
+type fileField struct {
+	index []int
+	key   string
+}
+
+var fileFieldCache = struct {
+	sync.RWMutex
+	classes map[string][]fileField
+}{classes: make(map[string][]fileField)}
+
+// fileFields lists the File and *File fields of a class's model.
+func fileFields(collectionName string) []fileField {
+	fileFieldCache.RLock()
+	fields, ok := fileFieldCache.classes[collectionName]
+	fileFieldCache.RUnlock()
+	if ok {
+		return fields
+	}
+
+	if model, err := db.NewObject(collectionName, ""); err == nil {
+		fields = structFileFields(reflect.TypeOf(model).Elem(), nil)
+	}
+
+	fileFieldCache.Lock()
+	fileFieldCache.classes[collectionName] = fields
+	fileFieldCache.Unlock()
+	return fields
+}
+
+func structFileFields(t reflect.Type, index []int) []fileField {
+	var fields []fileField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("bson"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+
+		at := append(append([]int{}, index...), i)
+		switch {
+		case f.Type == fileType || f.Type == reflect.PtrTo(fileType):
+			key := tag[0]
+			if len(key) == 0 {
+				key = strings.ToLower(f.Name)
+			}
+			fields = append(fields, fileField{index: at, key: key})
+		case f.Anonymous && f.Type.Kind() == reflect.Struct:
+			fields = append(fields, structFileFields(f.Type, at)...)
+		}
+	}
+	return fields
+}
+
+// filesOf returns the names of the files model refers to.
+func filesOf(model db.Model) []string {
+	v := reflect.ValueOf(model).Elem()
+
+	var names []string
+	for _, field := range fileFields(model.Collection()) {
+		f := v.FieldByIndex(field.index)
+		if f.Kind() == reflect.Ptr {
+			if f.IsNil() {
+				continue
+			}
+			f = f.Elem()
+		}
+		if name := f.Interface().(models.File).Name; len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// findFiles returns the names of the files the objects matching query refer to.
+func findFiles(ds db.DataStore, collectionName string, query map[string]interface{}) ([]string, error) {
+	if len(fileFields(collectionName)) == 0 {
+		return nil, nil
+	}
+
+	result, err := db.NewObject(collectionName, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	err = ds.FindEach(collectionName, query, func(model db.Model) {
+		names = append(names, filesOf(model)...)
+	}, result)
+	return names, err
+}
+
+// Referenced reports whether any object refers to the named file, deleted objects that may
+// still be restored included.
+func Referenced(ds db.DataStore, name string) (bool, error) {
+	for _, class := range db.RegisteredClasses() {
+		for _, field := range fileFields(class) {
+			queries := []bson.M{{field.key: name}}
+			if db.SoftDeletes(class) {
+				trash := db.TrashQuery()
+				trash[field.key] = name
+				queries = append(queries, trash)
+			}
+
+			for _, q := range queries {
+				n, err := ds.Count(class, q)
+				if err != nil {
+					return false, err
+				}
+				if n > 0 {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// Cleanup removes the named files from storage and the _File collection of ds when no
+// object refers to them and they weren't uploaded within the UploadGracePeriod. ds should
+// not be restricted by ACLs. Returns the number of files removed.
+func Cleanup(ds db.DataStore, storage Storage, names []string, now time.Time) (int, error) {
+	removed := 0
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		info, err := FindFile(ds, name)
+		if err != nil {
+			// Not uploaded through Upload, or already removed
+			continue
+		}
+		if info.UpdatedDate().After(now.Add(-UploadGracePeriod)) {
+			continue
+		}
+
+		referenced, err := Referenced(ds, name)
+		if err != nil {
+			return removed, err
+		}
+		if referenced {
+			continue
+		}
+
+		// The record goes last, so a file that failed to be removed is tried again
+		if err := storage.Delete(name); err != nil {
+			return removed, err
+		}
+		if err := info.Delete(ds); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// PurgeUnattached removes the stored files nothing refers to, like uploads that were never
+// attached to an object. Run it regularly, with a DataStore that is not restricted by ACLs.
+func PurgeUnattached(ds db.DataStore, storage Storage, now time.Time) (int, error) {
+	var names []string
+	q := bson.M{"_updated_at": bson.M{"$lt": now.Add(-UploadGracePeriod)}}
+	if err := ds.FindEach(models.CollectionFile, q, func(model db.Model) {
+		names = append(names, model.(*models.FileInfo).Name)
+	}, models.NewEmptyFileInfo()); err != nil {
+		return 0, err
+	}
+
+	n, err := Cleanup(ds, storage, names, now)
+	if n > 0 {
+		fmt.Printf("Removed %d unattached files \n", n)
+	}
+	return n, err
+}
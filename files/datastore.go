@@ -0,0 +1,100 @@
+package files
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nidhik/backend/db"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// FileDataStore removes the stored files objects referred to once they are deleted, purged
+// or changed to refer to other files, unless other objects still refer to them. server
+// finds the files and checks the references, and should not be restricted by ACLs.
+// Everything else is passed straight through.
+//
+// Soft deleted objects keep their files until they are purged. Failing to remove a file is
+// logged but doesn't fail the write; PurgeUnattached catches it later.
+type FileDataStore struct {
+	db.DataStore
+	server  db.DataStore
+	storage Storage
+}
+
+func NewFileDataStore(ds db.DataStore, server db.DataStore, storage Storage) *FileDataStore {
+	return &FileDataStore{DataStore: ds, server: server, storage: storage}
+}
+
+func (f *FileDataStore) Close() {
+	f.DataStore.Close()
+	f.server.Close()
+}
+
+func (f *FileDataStore) UpdateObject(model db.Model) error {
+	names := f.find(model.Collection(), bson.M{"_id": model.ObjectId()})
+	if err := f.DataStore.UpdateObject(model); err != nil {
+		return err
+	}
+
+	f.cleanup(names)
+	return nil
+}
+
+func (f *FileDataStore) RemoveObject(model db.Model) error {
+	names := f.find(model.Collection(), bson.M{"_id": model.ObjectId()})
+	if err := f.DataStore.RemoveObject(model); err != nil {
+		return err
+	}
+
+	f.cleanup(names)
+	return nil
+}
+
+// RemoveAll finds the files of every object the query matches for the server, some of which
+// the requester may not remove. The files those still refer to are kept.
+func (f *FileDataStore) RemoveAll(collectionName string, query map[string]interface{}) error {
+	names := f.find(collectionName, copyQuery(query))
+	if err := f.DataStore.RemoveAll(collectionName, query); err != nil {
+		return err
+	}
+
+	f.cleanup(names)
+	return nil
+}
+
+func (f *FileDataStore) PurgeObjects(collectionName string, deletedBefore time.Time) (int, error) {
+	names := f.find(collectionName, bson.M{db.DELETED_AT: bson.M{"$lt": deletedBefore}})
+	n, err := f.DataStore.PurgeObjects(collectionName, deletedBefore)
+	if err != nil || n == 0 {
+		return n, err
+	}
+
+	f.cleanup(names)
+	return n, nil
+}
+
+func (f *FileDataStore) find(collectionName string, query bson.M) []string {
+	names, err := findFiles(f.server, collectionName, query)
+	if err != nil {
+		fmt.Printf("Error finding the files of %s: %s \n", collectionName, err)
+	}
+	return names
+}
+
+func (f *FileDataStore) cleanup(names []string) {
+	if len(names) == 0 {
+		return
+	}
+
+	if _, err := Cleanup(f.server, f.storage, names, time.Now()); err != nil {
+		fmt.Printf("Error removing files %v: %s \n", names, err)
+	}
+}
+
+func copyQuery(q map[string]interface{}) bson.M {
+	result := bson.M{}
+	for k, v := range q {
+		result[k] = v
+	}
+	return result
+}
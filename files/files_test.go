@@ -0,0 +1,246 @@
+package files
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"github.com/nidhik/backend/query"
+	"gopkg.in/mgo.v2"
+)
+
+// A PNG header is enough for the sniffer
+var png = []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR")
+
+var contentTypeTests = []struct {
+	data     string
+	filename string
+	expected string
+}{
+	{string(png), "me.jpg", "image/png"},
+	{"a,b\n1,2\n", "export.csv", "text/csv; charset=utf-8"},
+	{"plain words", "notes.txt", "text/plain; charset=utf-8"},
+	{"plain words", "page.html", "text/plain; charset=utf-8"},
+	{"<html><script>alert(1)</script>", "notes.txt", "text/html; charset=utf-8"},
+	{"\x00\x01\x02", "data.bin", "application/octet-stream"},
+}
+
+func TestContentType(t *testing.T) {
+	for _, test := range contentTypeTests {
+		if actual := ContentType([]byte(test.data), test.filename); actual != test.expected {
+			t.Fatal("Expected", test.filename, "to be:", test.expected, "Actual:", actual)
+		}
+	}
+
+	if Inline("text/html; charset=utf-8") || Inline("image/svg+xml") || !Inline("image/png") {
+		t.Fatal("Expected: only safe types shown inline")
+	}
+}
+
+// s3StandIn is a bucket of an S3 compatible service that checks request signatures
+type s3StandIn struct {
+	sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *s3StandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	if !VerifyS3Request(r, body, "access", "secret") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		s.objects[r.URL.Path] = body
+	case http.MethodGet:
+		data, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func testStorage(t *testing.T, storage Storage) {
+	if err := storage.Put("a.txt", strings.NewReader("first")); err != nil {
+		t.Fatal("Could not store file:", err)
+	}
+	if err := storage.Put("a.txt", strings.NewReader("second")); err != nil {
+		t.Fatal("Could not replace file:", err)
+	}
+
+	r, err := storage.Open("a.txt")
+	if err != nil {
+		t.Fatal("Could not open file:", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "second" {
+		t.Fatal("Expected:", "second", "Actual:", string(data))
+	}
+
+	if err := storage.Delete("a.txt"); err != nil {
+		t.Fatal("Could not delete file:", err)
+	}
+	if err := storage.Delete("a.txt"); err != nil {
+		t.Fatal("Expected deleting a missing file to succeed. Actual:", err)
+	}
+	if _, err := storage.Open("a.txt"); err != ERR_FILE_NOT_FOUND {
+		t.Fatal("Expected:", ERR_FILE_NOT_FOUND, "Actual:", err)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	testStorage(t, NewLocalStorage(t.TempDir()))
+
+	server := httptest.NewServer(&s3StandIn{objects: make(map[string][]byte)})
+	defer server.Close()
+	testStorage(t, NewS3Storage(server.URL, "bucket", "", "access", "secret"))
+
+	if err := NewS3Storage(server.URL, "bucket", "", "access", "wrong").Put("a.txt", strings.NewReader("x")); err == nil {
+		t.Fatal("Expected: a request with the wrong secret to be refused")
+	}
+}
+
+func TestUpload(t *testing.T) {
+	query.RunTest(t, func(t *testing.T, ds db.DataStore) {
+		storage := NewLocalStorage(t.TempDir())
+
+		info, err := Upload(ds, storage, "Me.PNG", bytes.NewReader(png))
+		if err != nil {
+			t.Fatal("Could not upload file:", err)
+		}
+		if info.Name != sha256Hex(png)+".png" || info.ContentType != "image/png" || info.Size != int64(len(png)) {
+			t.Fatal("Unexpected file:", info.Name, info.ContentType, info.Size)
+		}
+
+		// The same contents are stored once
+		again, err := Upload(ds, storage, "other.png", bytes.NewReader(png))
+		if err != nil || again.Name != info.Name {
+			t.Fatal("Expected:", info.Name, "Actual:", again, err)
+		}
+		if n, _ := ds.Count(models.CollectionFile, map[string]interface{}{}); n != 1 {
+			t.Fatal("Expected:", 1, "Actual:", n)
+		}
+
+		// Without a usable extension, one is taken from the content type
+		info, err = Upload(ds, storage, "export", strings.NewReader("%PDF-1.4"))
+		if err != nil || !strings.HasSuffix(info.Name, ".pdf") {
+			t.Fatal("Expected: a pdf", "Actual:", info, err)
+		}
+
+		if _, err := Upload(ds, storage, "empty.txt", strings.NewReader("")); err != ERR_EMPTY_FILE {
+			t.Fatal("Expected:", ERR_EMPTY_FILE, "Actual:", err)
+		}
+
+		previous := MaxFileSize
+		defer func() { MaxFileSize = previous }()
+		MaxFileSize = 4
+		if _, err := Upload(ds, storage, "big.txt", strings.NewReader("12345")); err != ERR_FILE_TOO_LARGE {
+			t.Fatal("Expected:", ERR_FILE_TOO_LARGE, "Actual:", err)
+		}
+	})
+}
+
+func TestCleanup(t *testing.T) {
+	query.RunTest(t, func(t *testing.T, ds db.DataStore) {
+		storage := NewLocalStorage(t.TempDir())
+		fds := NewFileDataStore(ds, ds, storage)
+
+		previous := UploadGracePeriod
+		defer func() { UploadGracePeriod = previous }()
+		UploadGracePeriod = 0
+
+		upload := func(contents string) *models.File {
+			info, err := Upload(ds, storage, "avatar.txt", strings.NewReader(contents))
+			if err != nil {
+				t.Fatal("Could not upload file:", err)
+			}
+			return &models.File{Name: info.Name}
+		}
+
+		stored := func(file *models.File) bool {
+			r, err := storage.Open(file.Name)
+			if err == nil {
+				r.Close()
+			}
+			_, ferr := FindFile(ds, file.Name)
+			if (err == nil) != (ferr == nil) {
+				t.Fatal("Expected the file and its record to be removed together:", err, ferr)
+			}
+			return err == nil
+		}
+
+		shared, own, replaced := upload("shared"), upload("own"), upload("replaced")
+
+		first := models.NewEmptyUser()
+		first.Set("Username", "first")
+		first.Set("Avatar", replaced)
+		second := models.NewEmptyUser()
+		second.Set("Username", "second")
+		second.Set("Avatar", shared)
+		for _, u := range []*models.User{first, second} {
+			if err := u.Save(fds); err != nil {
+				t.Fatal("Could not save user:", err)
+			}
+		}
+
+		// Replacing an avatar removes the old one
+		first.Set("Avatar", own)
+		if err := first.Save(fds); err != nil {
+			t.Fatal("Could not save user:", err)
+		}
+		if stored(replaced) || !stored(own) {
+			t.Fatal("Expected: the replaced avatar removed")
+		}
+
+		first.Set("Avatar", shared)
+		if err := first.Save(fds); err != nil {
+			t.Fatal("Could not save user:", err)
+		}
+
+		// Files other objects refer to are kept
+		if err := second.Delete(fds); err != nil {
+			t.Fatal("Could not delete user:", err)
+		}
+		if !stored(shared) {
+			t.Fatal("Expected: the shared avatar kept")
+		}
+
+		if err := first.Delete(fds); err != nil {
+			t.Fatal("Could not delete user:", err)
+		}
+		if stored(shared) || stored(own) {
+			t.Fatal("Expected: all avatars removed")
+		}
+
+		if err := first.Fetch(ds); err != mgo.ErrNotFound {
+			t.Fatal("Expected:", mgo.ErrNotFound, "Actual:", err)
+		}
+
+		// Files are kept for the grace period, then purged when never attached
+		unattached := upload("unattached")
+		UploadGracePeriod = time.Hour
+		if n, err := PurgeUnattached(ds, storage, time.Now()); err != nil || n != 0 || !stored(unattached) {
+			t.Fatal("Expected: the new upload kept", "Actual:", n, err)
+		}
+		if n, err := PurgeUnattached(ds, storage, time.Now().Add(2*time.Hour)); err != nil || n != 1 || stored(unattached) {
+			t.Fatal("Expected: the unattached file purged", "Actual:", n, err)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package files
+
+import (
+	"io"
+
+	"github.com/nidhik/backend/db"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const DefaultGridFSPrefix = "fs"
+
+// GridFSStorage keeps files in the GridFS of the database db.Connect connected to, in the
+// collections Prefix.files and Prefix.chunks.
+type GridFSStorage struct {
+	Prefix string
+}
+
+func NewGridFSStorage(prefix string) *GridFSStorage {
+	return &GridFSStorage{Prefix: prefix}
+}
+
+// Put replaces any file stored under name once the new one is written.
+func (s *GridFSStorage) Put(name string, r io.Reader) error {
+	session := db.MasterSession.Copy()
+	defer session.Close()
+	gfs := session.DB(db.Mongo.Database).GridFS(s.Prefix)
+
+	file, err := gfs.Create(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, r); err != nil {
+		file.Abort()
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	var old struct {
+		Id interface{} `bson:"_id"`
+	}
+	iter := gfs.Find(bson.M{"filename": name, "_id": bson.M{"$ne": file.Id()}}).Iter()
+	for iter.Next(&old) {
+		if err := gfs.RemoveId(old.Id); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+func (s *GridFSStorage) Open(name string) (io.ReadCloser, error) {
+	session := db.MasterSession.Copy()
+
+	file, err := session.DB(db.Mongo.Database).GridFS(s.Prefix).Open(name)
+	if err != nil {
+		session.Close()
+		if err == mgo.ErrNotFound {
+			return nil, ERR_FILE_NOT_FOUND
+		}
+		return nil, err
+	}
+	return &gridFile{GridFile: file, session: session}, nil
+}
+
+func (s *GridFSStorage) Delete(name string) error {
+	session := db.MasterSession.Copy()
+	defer session.Close()
+
+	return session.DB(db.Mongo.Database).GridFS(s.Prefix).Remove(name)
+}
+
+// gridFile closes the session it was read with along with the file
+type gridFile struct {
+	*mgo.GridFile
+	session *mgo.Session
+}
+
+func (f *gridFile) Close() error {
+	defer f.session.Close()
+	return f.GridFile.Close()
+}
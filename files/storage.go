@@ -0,0 +1,97 @@
+// Package files stores the contents of File fields. Uploads are named after their contents
+// and recorded in the _File collection, and files no object refers to anymore are removed
+// when the objects referring to them are deleted, see FileDataStore.
+package files
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var ERR_FILE_NOT_FOUND = errors.New("File not found.")
+
+// Storage keeps the contents of files by name.
+type Storage interface {
+	Put(name string, r io.Reader) error
+	Open(name string) (io.ReadCloser, error)
+	// Deleting a file that isn't stored is not an error
+	Delete(name string) error
+}
+
+// DefaultStorage is the Storage the file endpoints and FileDataStore use, chosen by the
+// FILE_STORAGE environment variable:
+//
+//	gridfs  the GridFS of the database, the default
+//	local   the directory FILE_DIR
+//	s3      the bucket S3_BUCKET at S3_ENDPOINT, with S3_REGION, S3_ACCESS_KEY and S3_SECRET_KEY
+var DefaultStorage = storageFromEnv()
+
+func storageFromEnv() Storage {
+	switch kind := os.Getenv("FILE_STORAGE"); kind {
+	case "local":
+		return NewLocalStorage(os.Getenv("FILE_DIR"))
+	case "s3":
+		return NewS3Storage(os.Getenv("S3_ENDPOINT"), os.Getenv("S3_BUCKET"), os.Getenv("S3_REGION"),
+			os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY"))
+	case "", "gridfs":
+	default:
+		fmt.Printf("Unknown FILE_STORAGE %s, storing files in GridFS \n", kind)
+	}
+	return NewGridFSStorage(DefaultGridFSPrefix)
+}
+
+// LocalStorage keeps files in a directory of the local disk.
+type LocalStorage struct {
+	Dir string
+}
+
+func NewLocalStorage(dir string) *LocalStorage {
+	return &LocalStorage{Dir: dir}
+}
+
+// Put writes to a temporary file first, so a file is either stored whole or not at all.
+func (s *LocalStorage) Put(name string, r io.Reader) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.Dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path(name))
+}
+
+func (s *LocalStorage) Open(name string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, ERR_FILE_NOT_FOUND
+	}
+	return f, err
+}
+
+func (s *LocalStorage) Delete(name string) error {
+	err := os.Remove(s.path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Names are checked before they get here, Base is only a safeguard
+func (s *LocalStorage) path(name string) string {
+	return filepath.Join(s.Dir, filepath.Base(name))
+}
@@ -0,0 +1,123 @@
+package files
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"gopkg.in/mgo.v2"
+)
+
+var ERR_FILE_TOO_LARGE = errors.New("File too large.")
+var ERR_EMPTY_FILE = errors.New("Empty file.")
+
+// The largest file Upload stores, in bytes
+var MaxFileSize int64 = 10 << 20
+
+var validExtension = regexp.MustCompile(`^\.[a-z0-9]{1,10}$`)
+
+// Upload stores the contents read from r and records them in the _File collection of ds,
+// which should not be restricted by ACLs. The file is named after the sha256 of its
+// contents, keeping the extension of filename, so the same contents are only stored once.
+// Its content type is sniffed from the contents rather than taken from the client.
+func Upload(ds db.DataStore, storage Storage, filename string, r io.Reader) (*models.FileInfo, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case int64(len(data)) > MaxFileSize:
+		return nil, ERR_FILE_TOO_LARGE
+	case len(data) == 0:
+		return nil, ERR_EMPTY_FILE
+	}
+
+	contentType := ContentType(data, filename)
+	name := sha256Hex(data) + extension(filename, contentType)
+
+	info, err := FindFile(ds, name)
+	switch err {
+	case nil:
+		// Stored before. Touched, so it isn't removed before it is attached, see Cleanup
+		return info, info.Save(ds)
+	case mgo.ErrNotFound:
+	default:
+		return nil, err
+	}
+
+	if err := storage.Put(name, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+
+	info = models.NewEmptyFileInfo()
+	info.Name = name
+	info.ContentType = contentType
+	info.Size = int64(len(data))
+	if err := info.Save(ds); err != nil {
+		// Uploaded at the same time by someone else
+		if mgo.IsDup(err) {
+			return FindFile(ds, name)
+		}
+		return nil, err
+	}
+	return info, nil
+}
+
+// FindFile returns the record of a stored file.
+func FindFile(ds db.DataStore, name string) (*models.FileInfo, error) {
+	info := models.NewEmptyFileInfo()
+	if err := ds.FindObject(models.CollectionFile, map[string]interface{}{"name": name}, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// ContentType sniffs the type of a file's contents. The extension of its name is only used
+// to tell text formats apart, like css or csv, which all sniff as plain text.
+func ContentType(data []byte, filename string) string {
+	sniffed := http.DetectContentType(data)
+	if !strings.HasPrefix(sniffed, "text/plain") {
+		return sniffed
+	}
+
+	byName := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename)))
+	switch {
+	case strings.HasPrefix(byName, "text/html"), strings.HasPrefix(byName, "text/xml"):
+		// Would let an upload run scripts when served, though it didn't sniff as such
+	case strings.HasPrefix(byName, "text/"), strings.HasPrefix(byName, "application/json"):
+		return byName
+	}
+	return sniffed
+}
+
+// Inline reports whether files of a content type are safe to show in a browser from the
+// server's origin. Others are served as attachments.
+func Inline(contentType string) bool {
+	for _, prefix := range []string{"image/", "video/", "audio/", "text/plain", "application/pdf"} {
+		if strings.HasPrefix(contentType, prefix) {
+			// Scripts run in svg images
+			return !strings.HasPrefix(contentType, "image/svg")
+		}
+	}
+	return false
+}
+
+func extension(filename string, contentType string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if validExtension.MatchString(ext) {
+		return ext
+	}
+
+	if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 && validExtension.MatchString(exts[0]) {
+		return exts[0]
+	}
+	return ""
+}
@@ -0,0 +1,372 @@
+// Package livequery pushes changes to objects to WebSocket clients as they are written.
+//
+// Clients subscribe with a class and a where clause, in the same form as the REST queries:
+//
+//	{"op": "subscribe", "requestId": 1, "query": {"className": "Task", "where": {"taskStatus": "NEW"}}}
+//	{"op": "unsubscribe", "requestId": 1}
+//
+// and are answered with "subscribed", "unsubscribed" or "error" messages. Afterwards every
+// write to an object the subscriber may read is sent as one of:
+//
+//	create  a new object matches the query
+//	update  an object that matched still matches
+//	enter   an existing object now matches
+//	leave   an object no longer matches
+//	delete  an object that matched was deleted
+//
+// for example {"op": "update", "requestId": 1, "object": {...}}. Queries are checked with the
+// subscriber's RestrictedMongoQueryBuilder, so class level permissions, ACLs and soft
+// deletion apply as they do to REST queries. Leave events only carry the object's id, since
+// the subscriber may not be able to read what it became.
+//
+// The builder holds the roles the subscriber had when connecting. When roles change (see
+// models.RoleChanges) the roles of each connected user are found again, and the clients of
+// users whose roles changed are disconnected, to connect again with their new roles.
+package livequery
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"github.com/nidhik/backend/query"
+	"golang.org/x/net/websocket"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	EventCreate = "create"
+	EventUpdate = "update"
+	EventDelete = "delete"
+	EventEnter  = "enter"
+	EventLeave  = "leave"
+)
+
+var ERR_UNKNOWN_OPERATION = errors.New("Unknown live query operation.")
+var ERR_DUPLICATE_REQUEST = errors.New("A subscription with this requestId already exists.")
+var ERR_SUBQUERY = errors.New("Live queries can't use $relatedTo, $inQuery or $select.")
+
+// How many messages may wait to be sent to a client. Clients that fall further behind are
+// disconnected, so they know to query again rather than silently miss changes.
+var SendBuffer = 256
+
+type Query struct {
+	ClassName string                 `json:"className"`
+	Where     map[string]interface{} `json:"where"`
+}
+
+type Request struct {
+	Op        string `json:"op"`
+	RequestId int    `json:"requestId"`
+	Query     Query  `json:"query"`
+}
+
+type Response struct {
+	Op        string      `json:"op"`
+	RequestId int         `json:"requestId,omitempty"`
+	Object    interface{} `json:"object,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// Server sends the changes published to a db.ChangeFeed to the clients that subscribed to
+// them.
+type Server struct {
+	mu      sync.RWMutex
+	clients map[*client]bool
+	stop    func()
+}
+
+func NewServer(feed *db.ChangeFeed) *Server {
+	s := &Server{clients: make(map[*client]bool)}
+	stopChanges := feed.Listen(s.dispatch)
+	// Finding the roles again queries the database, which the publisher shouldn't wait for
+	stopRoles := models.RoleChanges.Listen(func(db.ChangeEvent) { go s.recheckRoles() })
+	s.stop = func() {
+		stopChanges()
+		stopRoles()
+	}
+	return s
+}
+
+// Close stops listening for changes and disconnects every client.
+func (s *Server) Close() {
+	s.stop()
+	s.disconnect()
+}
+
+// disconnect closes the connection of every client, which stop being served
+func (s *Server) disconnect() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+}
+
+// recheckRoles disconnects the clients whose user's roles changed, and those whose roles
+// can't be found. The roles of each user are found once.
+func (s *Server) recheckRoles() {
+	s.mu.RLock()
+	clients := make([]*client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.RUnlock()
+
+	if len(clients) == 0 {
+		return
+	}
+
+	ds := db.GetDataStore(query.NewMongoQueryBuilder())
+	defer ds.Close()
+
+	versions := make(map[string]string)
+	for _, c := range clients {
+		user := c.qb.User
+		version, ok := versions[user.ObjectId()]
+		if !ok {
+			roles, err := models.CachedRolesForUser(user, ds)
+			if err != nil {
+				fmt.Printf("Error finding roles of live query user %s: %s \n", user.ObjectId(), err)
+				c.conn.Close()
+				continue
+			}
+			version = models.RoleVersion(roles)
+			versions[user.ObjectId()] = version
+		}
+
+		if version != models.RoleVersion(c.qb.Roles) {
+			c.conn.Close()
+		}
+	}
+}
+
+// Handler serves live queries over a WebSocket. It needs the restricted query builder the
+// auth middleware keeps as "qb"; browsers can't set headers on WebSockets, so mount it
+// behind AuthorizedLink, which reads the session token from the url.
+func (s *Server) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		qb, ok := c.Get("qb")
+		if !ok {
+			c.AbortWithStatus(403)
+			return
+		}
+
+		ws := websocket.Server{Handler: func(conn *websocket.Conn) {
+			s.serve(conn, qb.(*query.RestrictedMongoQueryBuilder))
+		}}
+		ws.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+func (s *Server) serve(conn *websocket.Conn, qb *query.RestrictedMongoQueryBuilder) {
+	c := &client{
+		conn:          conn,
+		qb:            qb,
+		subscriptions: make(map[int]*subscription),
+		out:           make(chan Response, SendBuffer),
+	}
+
+	s.mu.Lock()
+	s.clients[c] = true
+	s.mu.Unlock()
+
+	go c.write()
+
+	for {
+		var req Request
+		if err := websocket.JSON.Receive(conn, &req); err != nil {
+			break
+		}
+		c.handle(req)
+	}
+
+	// Once removed no more changes are dispatched to the client, so out can be closed
+	s.mu.Lock()
+	delete(s.clients, c)
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.closed = true
+	close(c.out)
+	c.mu.Unlock()
+
+	conn.Close()
+}
+
+func (s *Server) dispatch(e db.ChangeEvent) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for c := range s.clients {
+		c.dispatch(e)
+	}
+}
+
+// Clients
+
+type subscription struct {
+	className string
+	query     bson.M
+}
+
+type client struct {
+	conn          *websocket.Conn
+	qb            *query.RestrictedMongoQueryBuilder
+	mu            sync.Mutex
+	subscriptions map[int]*subscription
+	out           chan Response
+	closed        bool
+}
+
+func (c *client) write() {
+	for r := range c.out {
+		if err := websocket.JSON.Send(c.conn, r); err != nil {
+			c.conn.Close()
+		}
+	}
+}
+
+// send queues r, disconnecting clients that can't keep up. Callers hold c.mu.
+func (c *client) send(r Response) {
+	if c.closed {
+		return
+	}
+
+	select {
+	case c.out <- r:
+	default:
+		fmt.Println("Live query client is too slow, disconnecting.")
+		c.conn.Close()
+	}
+}
+
+func (c *client) handle(req Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+	switch req.Op {
+	case "subscribe":
+		if err = c.subscribe(req); err == nil {
+			c.send(Response{Op: "subscribed", RequestId: req.RequestId})
+		}
+	case "unsubscribe":
+		delete(c.subscriptions, req.RequestId)
+		c.send(Response{Op: "unsubscribed", RequestId: req.RequestId})
+	default:
+		err = ERR_UNKNOWN_OPERATION
+	}
+
+	if err != nil {
+		c.send(Response{Op: "error", RequestId: req.RequestId, Error: err.Error()})
+	}
+}
+
+func (c *client) subscribe(req Request) error {
+	if _, ok := c.subscriptions[req.RequestId]; ok {
+		return ERR_DUPLICATE_REQUEST
+	}
+
+	if _, err := db.LookupClass(req.Query.ClassName); err != nil {
+		return err
+	}
+
+	where := bson.M{}
+	if req.Query.Where != nil {
+		var err error
+		if where, err = query.ParseWhere(req.Query.Where); err != nil {
+			return err
+		}
+	}
+
+	// The objects sub-queries find change without events for the subscribed class
+	if query.HasSubQueries(where) {
+		return ERR_SUBQUERY
+	}
+
+	q, err := c.qb.MakeFindQuery(req.Query.ClassName, where)
+	if err != nil {
+		return err
+	}
+
+	c.subscriptions[req.RequestId] = &subscription{className: req.Query.ClassName, query: q}
+	return nil
+}
+
+func (c *client) dispatch(e db.ChangeEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, sub := range c.subscriptions {
+		if sub.className != e.Collection {
+			continue
+		}
+
+		event, doc := eventFor(sub.query, e)
+		if len(event) == 0 {
+			continue
+		}
+
+		object, err := decode(e.Collection, doc)
+		if err != nil {
+			fmt.Printf("Error decoding live query object: %s \n", err)
+			continue
+		}
+		c.qb.ProtectFields(object)
+
+		c.send(Response{Op: event, RequestId: id, Object: object})
+	}
+}
+
+// eventFor works out what a subscriber to q sees of a change, and the document to send.
+// The event is empty when the change doesn't concern the subscriber.
+func eventFor(q bson.M, e db.ChangeEvent) (string, bson.M) {
+	before := matches(e.Before, q)
+	after := matches(e.After, q)
+
+	switch {
+	case before && after:
+		return EventUpdate, e.After
+	case after && e.Type == db.ChangeCreate:
+		return EventCreate, e.After
+	case after:
+		return EventEnter, e.After
+	case before && (e.Type == db.ChangeDelete || softDeleted(e)):
+		return EventDelete, e.Before
+	case before:
+		return EventLeave, bson.M{"_id": e.After["_id"]}
+	}
+	return "", nil
+}
+
+func matches(doc bson.M, q bson.M) bool {
+	if doc == nil {
+		return false
+	}
+	ok, err := db.MatchDocument(doc, q)
+	return ok && err == nil
+}
+
+func softDeleted(e db.ChangeEvent) bool {
+	_, was := e.Before[db.DELETED_AT]
+	_, is := e.After[db.DELETED_AT]
+	return !was && is
+}
+
+func decode(className string, doc bson.M) (db.Model, error) {
+	model, err := db.NewObject(className, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.FromDocument(doc, model); err != nil {
+		return nil, err
+	}
+
+	model.CustomUnmarshall()
+	return model, nil
+}
@@ -0,0 +1,154 @@
+package livequery
+
+import (
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"github.com/nidhik/backend/query"
+	"golang.org/x/net/websocket"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestEventFor(t *testing.T) {
+	q := bson.M{"taskStatus": "NEW"}
+	matching := bson.M{"_id": "a", "taskStatus": "NEW"}
+	other := bson.M{"_id": "a", "taskStatus": "DONE"}
+	deleted := bson.M{"_id": "a", "taskStatus": "NEW", db.DELETED_AT: time.Now()}
+
+	tests := []struct {
+		change   db.ChangeEvent
+		expected string
+		doc      bson.M
+	}{
+		{db.ChangeEvent{Type: db.ChangeCreate, After: matching}, EventCreate, matching},
+		{db.ChangeEvent{Type: db.ChangeCreate, After: other}, "", nil},
+		{db.ChangeEvent{Type: db.ChangeUpdate, Before: matching, After: matching}, EventUpdate, matching},
+		{db.ChangeEvent{Type: db.ChangeUpdate, Before: other, After: matching}, EventEnter, matching},
+		// Leaving only tells which object left
+		{db.ChangeEvent{Type: db.ChangeUpdate, Before: matching, After: other}, EventLeave, bson.M{"_id": "a"}},
+		{db.ChangeEvent{Type: db.ChangeUpdate, Before: other, After: other}, "", nil},
+		{db.ChangeEvent{Type: db.ChangeDelete, Before: matching}, EventDelete, matching},
+		{db.ChangeEvent{Type: db.ChangeDelete, Before: other}, "", nil},
+		// Soft deletes are updates setting _deleted_at, which the query leaves out
+		{db.ChangeEvent{Type: db.ChangeUpdate, Before: matching, After: deleted}, EventDelete, matching},
+		// and restores are updates unsetting it
+		{db.ChangeEvent{Type: db.ChangeUpdate, Before: deleted, After: matching}, EventEnter, matching},
+	}
+
+	for i, test := range tests {
+		event, doc := eventFor(db.ExcludeDeleted(models.CollectionTask, q), test.change)
+		if event != test.expected || !reflect.DeepEqual(doc, test.doc) {
+			t.Fatal("Test", i, "Expected:", test.expected, test.doc, "Actual:", event, doc)
+		}
+	}
+}
+
+func receive(t *testing.T, conn *websocket.Conn) Response {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var r Response
+	query.AssertNoError(t, "Could not receive live query message:", websocket.JSON.Receive(conn, &r))
+	return r
+}
+
+func expect(t *testing.T, conn *websocket.Conn, op string, id string) {
+	r := receive(t, conn)
+
+	object, _ := r.Object.(map[string]interface{})
+	if r.Op != op || (len(id) > 0 && object["id"] != id) {
+		t.Fatal("Expected:", op, id, "Actual:", r)
+	}
+}
+
+func TestLiveQuery(t *testing.T) {
+	query.RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		owner := models.NewEmptyUser()
+		query.AssertNoError(t, "Could not set up user:", owner.Save(ds))
+		qb := query.NewRestrictedQueryBuilder(owner, nil)
+
+		server := NewServer(db.Changes)
+		defer server.Close()
+
+		gin.SetMode(gin.TestMode)
+		r := gin.New()
+		r.GET("/live", func(c *gin.Context) { c.Set("qb", qb) }, server.Handler())
+
+		ts := httptest.NewServer(r)
+		defer ts.Close()
+
+		conn, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/live", "", ts.URL)
+		query.AssertNoError(t, "Could not connect:", err)
+		defer conn.Close()
+
+		send := func(req Request) {
+			query.AssertNoError(t, "Could not send live query message:", websocket.JSON.Send(conn, req))
+		}
+
+		send(Request{Op: "subscribe", RequestId: 1, Query: Query{ClassName: "Unknown"}})
+		expect(t, conn, "error", "")
+
+		send(Request{Op: "subscribe", RequestId: 1, Query: Query{ClassName: models.CollectionTask, Where: map[string]interface{}{"taskStatus": "NEW"}}})
+		expect(t, conn, "subscribed", "")
+
+		task := models.NewTaskForUser(owner, models.TaskTypeEmail, models.HandleEmail)
+		task.SetAccessControlList(models.NewUserACL(owner.ObjectId()))
+		query.AssertNoError(t, "Could not save task:", task.Save(ds))
+		expect(t, conn, EventCreate, task.ObjectId())
+
+		task.Set("Status", "DONE")
+		query.AssertNoError(t, "Could not save task:", task.Save(ds))
+		expect(t, conn, EventLeave, task.ObjectId())
+
+		task.Set("Status", "NEW")
+		query.AssertNoError(t, "Could not save task:", task.Save(ds))
+		expect(t, conn, EventEnter, task.ObjectId())
+
+		task.Set("Message", "updated")
+		query.AssertNoError(t, "Could not save task:", task.Save(ds))
+		expect(t, conn, EventUpdate, task.ObjectId())
+
+		query.AssertNoError(t, "Could not delete task:", task.Delete(ds))
+		expect(t, conn, EventDelete, task.ObjectId())
+
+		// Objects the subscriber can't read are not sent
+		hidden := models.NewTaskForUser(owner, models.TaskTypeEmail, models.HandleEmail)
+		acl := db.NewACL()
+		acl.AddRead("someoneElse")
+		hidden.SetAccessControlList(acl)
+		query.AssertNoError(t, "Could not save task:", hidden.Save(ds))
+
+		public := models.NewTaskForUser(owner, models.TaskTypeEmail, models.HandleEmail)
+		query.AssertNoError(t, "Could not save task:", public.Save(ds))
+		expect(t, conn, EventCreate, public.ObjectId())
+
+		send(Request{Op: "unsubscribe", RequestId: 1})
+		expect(t, conn, "unsubscribed", "")
+
+		// Clients stay connected when roles change but their user's don't
+		models.ClearRoleCache()
+		server.recheckRoles()
+		send(Request{Op: "unsubscribe", RequestId: 2})
+		expect(t, conn, "unsubscribed", "")
+
+		// and are disconnected when their user's do, to connect again with their new roles
+		role := models.NewEmptyRole()
+		role.Set("Name", "live")
+		query.AssertNoError(t, "Could not save role:", role.Save(ds))
+		role.Users.Add(owner)
+		query.AssertNoError(t, "Could not save role:", ds.SaveRelatedObjects(role.Users))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var message Response
+		err = websocket.JSON.Receive(conn, &message)
+		if timeout, ok := err.(net.Error); err == nil || ok && timeout.Timeout() {
+			t.Fatal("Expected: disconnected", "Actual:", message, err)
+		}
+	})
+}
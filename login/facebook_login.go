@@ -53,7 +53,7 @@ func loginWithFacebook(authData FacebookAuthData, ds db.DataStore) (*models.User
 		}
 	}
 
-	token, err := createToken(user)
+	token, err := createToken(user, ds)
 	user.SetIsNew(isNew)
 	return user, token, err
 
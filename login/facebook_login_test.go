@@ -167,7 +167,15 @@ func setupFBLoginTests(t *testing.T, ds db.DataStore) (*gin.Engine, []*FBLoginTe
 
 	var tests []*FBLoginTest
 
+	// Profile ids are unique, so tests with the same profile share a user
+	users := make(map[string]string)
+
 	for _, test := range fbLoginTests {
+		if id, ok := users[test.profileId]; ok {
+			tests = append(tests, &FBLoginTest{id, test.token, test.profileId, test.expiry, test.payload, test.responseCode})
+			continue
+		}
+
 		user, err := models.NewUserFromFacebookAuth(test.token, test.profileId, test.expiry)
 
 		if err != nil {
@@ -178,6 +186,7 @@ func setupFBLoginTests(t *testing.T, ds db.DataStore) (*gin.Engine, []*FBLoginTe
 			t.Fatal("Could not setup test datastore:", err)
 		}
 		fmt.Printf("Created test user: %s: %s \n", user.ObjectId(), user.AuthData["id"])
+		users[test.profileId] = user.ObjectId()
 		tests = append(tests, &FBLoginTest{user.ObjectId(), test.token, test.profileId, test.expiry, test.payload, test.responseCode})
 	}
 
@@ -37,16 +37,23 @@ func authenticate(creds LoginCredentials, ds db.DataStore) (*models.User, error)
 	}
 }
 
-func createToken(user *models.User) (string, error) {
+// createToken signs the user's roles into the token, so requests made with it once they
+// changed are told apart
+func createToken(user *models.User, ds db.DataStore) (string, error) {
+	roles, err := models.CachedRolesForUser(user, ds)
+	if err != nil {
+		return "", err
+	}
+
 	expiry := time.Now().AddDate(1, 0, 0) // 1 year from now
-	return auth.CreateToken(user, expiry)
+	return auth.CreateTokenWithRoles(user, roles, expiry)
 }
 
 func login(creds LoginCredentials, ds db.DataStore) (*models.User, string, error) {
 	if user, err := authenticate(creds, ds); err != nil {
 		return nil, "", err
 	} else {
-		token, err := createToken(user)
+		token, err := createToken(user, ds)
 		return user, token, err
 	}
 }
@@ -168,6 +168,12 @@ func FinishResetPassword(c *gin.Context) {
 			return
 		}
 
+		// Saved at the version it was fetched at, see db.ERR_VERSION_CONFLICT
+		if err := user.Fetch(ds); err != nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
 		if user.ChangePassword(form.Password, ds) == nil {
 			fmt.Println("Changed password for user: " + form.Username)
 			c.HTML(http.StatusOK, "password_reset_success.tmpl", gin.H{
@@ -35,10 +35,10 @@ var loginTests = []LoginTest{
 	LoginTest{"", "erin@foo.com", "erin", "qwerlugkuytty", []byte(`{"username" : "erin", "password" : "abc"}`), http.StatusUnauthorized},
 	LoginTest{"", "amy@foo.com", "amy", "po6hkuygiuy", []byte(`{"username" : "not amy", "password": "po6hkuygiuy"}`), http.StatusUnauthorized},
 	LoginTest{"", "karen@foo.com", "karen", "127fj7%$", []byte(`{"username" : "    karen   ", "password" :"127fj7%$"}`), http.StatusOK},
-	LoginTest{"", "karen@foo.com", "karen2", "127fj7%$", []byte(`{"username" : "karen2", "password" :"127fj7%$"}`), http.StatusOK},
+	LoginTest{"", "karen2@foo.com", "karen2", "127fj7%$", []byte(`{"username" : "karen2", "password" :"127fj7%$"}`), http.StatusOK},
 	LoginTest{"", "derp@foo.com", "derp", "127fj7%$", []byte(`{"username" : "<derp", "password" :"127fj7%$"}`), http.StatusForbidden},
 	LoginTest{"", "derp2@foo.com", "derp2", "127fj7%$", []byte(`{"username" : "Hello <STYLE>.XSS{background-image:url(\"javascript:alert('XSS')\");}</STYLE><A CLASS=XSS></A>World", "password" :"127fj7%$"}`), http.StatusForbidden},
-	LoginTest{"", "evil@foo.com", "derp", "127fj7%$", []byte(`{"username" : ";var date=new Date(); do{curDate = new Date();}while(curDate-date<10000)", "password" :"127fj7%$"}`), http.StatusForbidden},
+	LoginTest{"", "evil@foo.com", "evil", "127fj7%$", []byte(`{"username" : ";var date=new Date(); do{curDate = new Date();}while(curDate-date<10000)", "password" :"127fj7%$"}`), http.StatusForbidden},
 	LoginTest{"", "real1@foo.com", "bummy", "abc", []byte(`{"username" : ">)bummy(<", "password" :"abc"}`), http.StatusForbidden},
 	LoginTest{"", "real2@foo.com", "kamy", "abc", []byte(`{"username" : "kamy<3", "password" :"abc"}`), http.StatusForbidden},
 }
@@ -10,28 +10,35 @@ import (
 // Email Signup
 var ERR_USER_EXISTS = errors.New("This email or username is already taken.")
 
+// createUser saves the user, its ACL and the sign up emails together, so a failure part way
+// through does not leave a user that cannot be edited or was never welcomed.
 func createUser(info SignupInfo, ds db.DataStore) (*models.User, error) {
-	if user, createErr := models.NewUserFromEmail(info.Email, info.Username, info.Password, info.FirstName); createErr != nil {
+	user, createErr := models.NewUserFromEmail(info.Email, info.Username, info.Password, info.FirstName)
+	if createErr != nil {
 		return nil, createErr
-	} else {
+	}
 
-		if saveErr := user.Save(ds); saveErr != nil {
-			return nil, saveErr
-		}
+	uow := db.NewUnitOfWork(ds)
+	uow.Insert(user)
 
-		acl := db.NewACL()
-		acl.SetPublicRead()
-		acl.AddRead(user.ObjectId())
-		acl.AddWrite(user.ObjectId())
-		user.SetAccessControlList(acl)
+	// The ACL needs the id the user gets once inserted
+	uow.Update(user, func() {
+		user.SetAccessControlList(models.NewUserACL(user.ObjectId()))
+	})
 
-		if saveErr := user.Save(ds); saveErr != nil {
-			return nil, saveErr
-		}
+	for _, email := range []string{"SIGN_UP_V2_GO", "PRO_AWARENESS_V2_GO"} {
+		email := email
+		uow.Create(func() db.Model {
+			return models.NewTaskForUser(user, models.TaskTypeEmail, models.HandleEmail, email, models.AsPointer(user))
+		})
+	}
 
-		user.SetIsNew(true)
-		return user, nil
+	if err := uow.Commit(); err != nil {
+		return nil, err
 	}
+
+	user.SetIsNew(true)
+	return user, nil
 }
 
 func validateUser(info SignupInfo, ds db.DataStore) (*models.User, error) {
@@ -58,11 +65,6 @@ func signup(info SignupInfo, ds db.DataStore) (*models.User, string, error) {
 		return nil, "", err
 	}
 
-	task0 := models.NewTaskForUser(user, models.TaskTypeEmail, models.HandleEmail, "SIGN_UP_V2_GO", models.AsPointer(user))
-	task1 := models.NewTaskForUser(user, models.TaskTypeEmail, models.HandleEmail, "PRO_AWARENESS_V2_GO", models.AsPointer(user))
-	task0.Save(ds)
-	task1.Save(ds)
-
-	token, err := createToken(user)
+	token, err := createToken(user, ds)
 	return user, token, err
 }
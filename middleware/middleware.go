@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 
 	"os"
@@ -9,6 +10,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/nidhik/backend/auth"
 	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/files"
 	"github.com/nidhik/backend/models"
 	"github.com/nidhik/backend/query"
 )
@@ -33,20 +35,48 @@ func Connect() gin.HandlerFunc {
 	return func(c *gin.Context) {
 
 		if c.Request.Method == http.MethodOptions {
-			fmt.Println("Preflight request, allowing through.")
 			c.Next()
 			return
 		}
 
-		datastore := db.GetDataStore(query.NewMongoQueryBuilder())
+		// The server's DataStore is never restricted, handlers use it for what only the
+		// server may read, like the records of stored files. The stores below share it for
+		// what they read and write on the requester's behalf, and it is closed once, here.
+		server := db.GetDataStore(query.NewMongoQueryBuilder())
+		defer server.Close()
+		shared := sharedDataStore{server}
+
+		// Writes are recorded by the user the request is authorized for, once it is known
+		actor := func() string {
+			if user, ok := c.Get("user"); ok {
+				return user.(*models.User).ObjectId()
+			}
+			return ""
+		}
+		audited := models.NewAuditedDataStore(db.GetDataStore(query.NewMongoQueryBuilder()), shared, actor)
+
+		// Deleting an object applies the delete rules of the objects referring to it, which
+		// the requester may not be able to read. What the rules write is recorded too, and the
+		// files of the objects deleted with it are removed.
+		rules := files.NewFileDataStore(models.NewAuditedDataStore(shared, shared, actor), shared, files.DefaultStorage)
+		referential := db.NewReferentialDataStore(audited, rules)
+		datastore := files.NewFileDataStore(referential, shared, files.DefaultStorage)
 
 		defer datastore.Close()
 		c.Set("ds", datastore)
+		c.Set("server", server)
 
 		c.Next()
 	}
 }
 
+// sharedDataStore is used by several of a request's stores, which leave closing it to Connect
+type sharedDataStore struct {
+	db.DataStore
+}
+
+func (s sharedDataStore) Close() {}
+
 // Approved API Consumers
 
 var CLIENT_KEY_HEADER = "X-Client-Key"
@@ -55,7 +85,6 @@ func API() gin.HandlerFunc {
 	return func(c *gin.Context) {
 
 		if c.Request.Method == http.MethodOptions {
-			fmt.Println("Preflight request, allowing through.")
 			c.Next()
 			return
 		}
@@ -66,7 +95,7 @@ func API() gin.HandlerFunc {
 			c.Next()
 
 		} else {
-			fmt.Printf("Error: %s", err)
+			log.Printf("Unapproved API consumer: %s", err)
 			c.AbortWithStatus(http.StatusNotFound)
 		}
 	}
@@ -76,8 +105,15 @@ func API() gin.HandlerFunc {
 
 var SESSION_HEADER = "X-Session-Token"
 
-func authenticateToken(ds db.DataStore, token string) (*models.User, []*models.Role, error) {
-	user, err := auth.VerifyToken(token)
+// Set on responses to requests made with a token signed for other roles than the user has,
+// so the client knows to sign in again
+var ROLES_CHANGED_HEADER = "X-Roles-Changed"
+
+// authenticateToken finds the token's user and their roles, from the role cache. When the
+// token was signed for other roles than the cache holds, the roles may have changed in
+// another process, so they are rechecked, see models.RecheckRolesForUser.
+func authenticateToken(c *gin.Context, ds db.DataStore, token string) (*models.User, []*models.Role, error) {
+	user, roleVersion, err := auth.VerifyTokenWithRoles(token)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -86,26 +122,62 @@ func authenticateToken(ds db.DataStore, token string) (*models.User, []*models.R
 		return nil, nil, err
 	}
 
-	roles, err := models.FindRolesForUser(user, ds)
+	roles, err := models.CachedRolesForUser(user, ds)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	if len(roleVersion) > 0 && roleVersion != models.RoleVersion(roles) {
+		if roles, err = models.RecheckRolesForUser(user, ds); err != nil {
+			return nil, nil, err
+		}
+
+		if roleVersion != models.RoleVersion(roles) {
+			models.RoleCacheStats.Add("staleTokens", 1)
+			c.Header(ROLES_CHANGED_HEADER, "true")
+		}
+	}
+
 	return user, roles, nil
 }
 
+// restrict limits ds to what user may see and do, checking class level permissions first.
+// The permissions and protected fields are read before the restricted builder is set, since
+// only the server may read them. The builder is kept in the context as "qb" for handlers
+// that check access without a query, like live queries.
+func restrict(c *gin.Context, ds db.DataStore, user *models.User, roles []*models.Role) error {
+	permissions, err := models.CachedClassPermissions(ds)
+	if err != nil {
+		return err
+	}
+
+	protected, err := models.CachedProtectedFields(ds)
+	if err != nil {
+		return err
+	}
+
+	qb := query.NewRestrictedQueryBuilder(user, roles)
+	qb.SetClassPermissions(permissions)
+	qb.SetProtectedFields(protected)
+	ds.SetQueryBuilder(qb)
+	c.Set("qb", qb)
+	return nil
+}
+
 func AuthorizedLink() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ds := c.MustGet("ds").(db.DataStore)
 		token := c.Query("token")
 
-		if user, roles, err := authenticateToken(ds, token); err == nil {
+		if user, roles, err := authenticateToken(c, ds, token); err == nil {
 			c.Set("user", user)
 			c.Set("roles", roles)
 
-			ds.SetQueryBuilder(query.NewRestrictedQueryBuilder(user, roles))
+			if err := restrict(c, ds, user, roles); err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+			}
 		} else {
-			fmt.Printf("Error: %s", err)
+			log.Printf("Could not authorize link: %s", err)
 			c.AbortWithStatus(http.StatusNotFound)
 		}
 	}
@@ -116,34 +188,51 @@ func AdminFunctionUserAuthRequired() gin.HandlerFunc {
 		ds := c.MustGet("ds").(db.DataStore)
 		token := c.Request.Header.Get(SESSION_HEADER)
 
-		if user, roles, err := authenticateToken(ds, token); err == nil {
+		if user, roles, err := authenticateToken(c, ds, token); err == nil {
 			c.Set("user", user)
 			c.Set("roles", roles)
 		} else {
-			fmt.Printf("Error: %s", err)
+			log.Printf("Could not authorize admin function: %s", err)
 			c.AbortWithStatus(http.StatusForbidden)
 		}
 	}
 }
 
+// RoleRequired only lets users that are members of the named role through. Use it after
+// one of the authorization handlers.
+func RoleRequired(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if roles, ok := c.Get("roles"); ok {
+			for _, role := range roles.([]*models.Role) {
+				if role.Name == name {
+					return
+				}
+			}
+		}
+
+		c.AbortWithStatus(http.StatusForbidden)
+	}
+}
+
 func AuthRequired() gin.HandlerFunc {
 	return func(c *gin.Context) {
 
 		if c.Request.Method == http.MethodOptions {
-			fmt.Println("Preflight request, allowing through.")
 			c.Next()
 			return
 		}
 
 		ds := c.MustGet("ds").(db.DataStore)
 		token := c.Request.Header.Get(SESSION_HEADER)
-		if user, roles, err := authenticateToken(ds, token); err == nil {
+		if user, roles, err := authenticateToken(c, ds, token); err == nil {
 			c.Set("user", user)
 			c.Set("roles", roles)
 
-			ds.SetQueryBuilder(query.NewRestrictedQueryBuilder(user, roles))
+			if err := restrict(c, ds, user, roles); err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+			}
 		} else {
-			fmt.Printf("Error: %s", err)
+			log.Printf("Could not authorize request: %s", err)
 			c.AbortWithStatus(http.StatusForbidden)
 		}
 	}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -86,6 +87,44 @@ func TestAuthRequired(t *testing.T) {
 
 }
 
+func TestRolesChanged(t *testing.T) {
+	query.RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		user, roles, validToken := setupUsersAndRoles(t, ds)
+		expiry := time.Now().AddDate(1, 0, 0)
+
+		current, err := auth.CreateTokenWithRoles(user, roles, expiry)
+		if err != nil {
+			t.Fatal("Could not set up test token.", err)
+		}
+
+		stale, err := auth.CreateTokenWithRoles(user, roles[:1], expiry)
+		if err != nil {
+			t.Fatal("Could not set up test token.", err)
+		}
+
+		tests := []struct {
+			token   string
+			changed string
+		}{
+			{validToken, ""},
+			{current, ""},
+			{stale, "true"},
+		}
+
+		for _, test := range tests {
+			router := setup("/", CheckForUserAndRoles(user, roles...), Connect(), AuthRequired())
+			resp := recordGet(router, "/", map[string]string{SESSION_HEADER: test.token})
+			if resp.Code != 200 {
+				t.Fatal("Expected response code", 200, "Got:", resp.Code, "Response:", resp)
+			}
+			if changed := resp.Header().Get(ROLES_CHANGED_HEADER); changed != test.changed {
+				t.Fatal("Expected:", test.changed, "Actual:", changed)
+			}
+		}
+	})
+}
+
 func TestAuthorizedLink(t *testing.T) {
 
 	query.RunTest(t, func(t *testing.T, ds db.DataStore) {
@@ -117,6 +156,62 @@ func TestAuthorizedLink(t *testing.T) {
 
 }
 
+func TestRoleRequired(t *testing.T) {
+
+	query.RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		_, _, validToken := setupUsersAndRoles(t, ds)
+
+		tests := []struct {
+			role     string
+			headers  map[string]string
+			respCode int
+		}{
+			{"role0", map[string]string{SESSION_HEADER: validToken}, 200},
+			{models.RoleAdmin, map[string]string{SESSION_HEADER: validToken}, 403},
+			{"role0", nil, 403},
+		}
+
+		for _, test := range tests {
+			router := setup("/", Get200(), Connect(), AuthRequired(), RoleRequired(test.role))
+			resp := recordGet(router, "/", test.headers)
+			if resp.Code != test.respCode {
+				t.Fatal("Expected response code", test.respCode, "Got:", resp.Code, "Response:", resp)
+			}
+		}
+	})
+
+}
+
+func TestAuditedWrites(t *testing.T) {
+
+	query.RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		user, _, validToken := setupUsersAndRoles(t, ds)
+
+		saveTask := func(c *gin.Context) {
+			task := models.NewTaskForUser(user, models.TaskTypeEmail, models.HandleEmail)
+			task.SetAccessControlList(models.NewUserACL(user.ObjectId()))
+			if err := task.Save(c.MustGet("ds").(db.DataStore)); err != nil {
+				c.JSON(http.StatusInternalServerError, err.Error())
+				return
+			}
+			c.JSON(http.StatusOK, "Ok")
+		}
+
+		router := setup("/", saveTask, Connect(), AuthRequired())
+		if resp := recordGet(router, "/", map[string]string{SESSION_HEADER: validToken}); resp.Code != 200 {
+			t.Fatal("Expected response code", 200, "Got:", resp.Code, "Response:", resp)
+		}
+
+		n, err := ds.Count(models.CollectionAudit, map[string]interface{}{"className": models.CollectionTask, "actor": user.ObjectId()})
+		if err != nil || n != 1 {
+			t.Fatal("Expected: 1 audit record", "Actual:", n, err)
+		}
+	})
+
+}
+
 func TestConnect(t *testing.T) {
 
 	query.RunTest(t, func(t *testing.T, ds db.DataStore) {
@@ -203,7 +298,8 @@ func setupUsersAndRoles(t *testing.T, ds db.DataStore) (*models.User, []*models.
 	}
 
 	var roles = []*models.Role{models.NewEmptyRole(), models.NewEmptyRole()}
-	for _, r := range roles {
+	for i, r := range roles {
+		r.Set("Name", fmt.Sprintf("role%d", i))
 
 		if err := r.Save(ds); err != nil {
 			t.Fatal("Could not set up test role.", err)
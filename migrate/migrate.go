@@ -0,0 +1,285 @@
+// Package migrate applies changes to stored documents, like backfilling a new field, in a
+// fixed order and at most once per database.
+//
+// Migrations register themselves from init and run in the order of their names, so name
+// them with a sortable prefix: "0001_user_acl", "0002_...". Applied migrations are recorded
+// in the _Migration collection. Up and Down hold a lock in that collection while they run,
+// so instances started together don't apply the same migration twice.
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var ERR_LOCKED = errors.New("Migrations are already running.")
+var ERR_NO_DOWN = errors.New("Migration can not be reverted.")
+var ERR_UNKNOWN_MIGRATION = errors.New("Applied migration is not registered.")
+
+// How long a lock is held before another instance may take it over, in case the instance
+// holding it died. The lock is renewed after every migration.
+var DefaultLockTimeout = 10 * time.Minute
+
+// Migration changes stored documents. Up and Down are given the DataStore passed to Up and
+// Down, which should not be restricted by ACLs. Down is optional; migrations without it
+// can not be reverted.
+type Migration struct {
+	Name string
+	Up   func(ds db.DataStore) error
+	Down func(ds db.DataStore) error
+}
+
+// Options change how Up and Down run. With DryRun they only report the migrations they
+// would apply or revert.
+type Options struct {
+	DryRun      bool
+	LockTimeout time.Duration
+}
+
+// Status describes a migration that is registered, applied or both.
+type Status struct {
+	Name       string
+	AppliedAt  *time.Time
+	Registered bool
+}
+
+var registered []Migration
+
+// Register adds a migration. Registering a name twice panics.
+func Register(m Migration) {
+	if len(m.Name) == 0 || m.Up == nil {
+		panic("migrate: Register without a name or an Up function")
+	}
+
+	for _, r := range registered {
+		if r.Name == m.Name {
+			panic("migrate: Register called twice for " + m.Name)
+		}
+	}
+
+	registered = append(registered, m)
+	sort.Slice(registered, func(i, j int) bool { return registered[i].Name < registered[j].Name })
+}
+
+func lookup(name string) (Migration, bool) {
+	for _, m := range registered {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return Migration{}, false
+}
+
+// Applied returns the applied migrations, by name.
+func Applied(ds db.DataStore) (map[string]*models.Migration, error) {
+	applied := make(map[string]*models.Migration)
+
+	err := ds.FindEach(models.CollectionMigration, bson.M{"name": bson.M{"$ne": models.MigrationLockName}}, func(model db.Model) {
+		record := *model.(*models.Migration)
+		applied[record.Name] = &record
+	}, models.NewEmptyMigration())
+
+	return applied, err
+}
+
+// Statuses lists the registered and applied migrations, sorted by name.
+func Statuses(ds db.DataStore) ([]Status, error) {
+	applied, err := Applied(ds)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []Status
+	for _, m := range registered {
+		s := Status{Name: m.Name, Registered: true}
+		if record, ok := applied[m.Name]; ok {
+			s.AppliedAt = record.CreatedAt
+		}
+		statuses = append(statuses, s)
+	}
+
+	for name, record := range applied {
+		if _, ok := lookup(name); !ok {
+			statuses = append(statuses, Status{Name: name, AppliedAt: record.CreatedAt})
+		}
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses, nil
+}
+
+// Up applies the migrations that have not been applied yet, in order, and returns their
+// names. It stops at the first migration that fails; the ones before it stay applied.
+func Up(ds db.DataStore, opts Options) ([]string, error) {
+	l, err := acquire(ds, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer l.release()
+
+	applied, err := Applied(ds)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, m := range registered {
+		if _, ok := applied[m.Name]; ok {
+			continue
+		}
+
+		if opts.DryRun {
+			names = append(names, m.Name)
+			continue
+		}
+
+		fmt.Printf("Applying migration %s \n", m.Name)
+		if err := m.Up(ds); err != nil {
+			fmt.Printf("Error applying migration %s: %s \n", m.Name, err)
+			return names, err
+		}
+
+		record := models.NewEmptyMigration()
+		record.Name = m.Name
+		if err := ds.InsertObject(record); err != nil {
+			return names, err
+		}
+
+		names = append(names, m.Name)
+		if err := l.renew(); err != nil {
+			return names, err
+		}
+	}
+
+	return names, nil
+}
+
+// Down reverts the last steps applied migrations, newest first, and returns their names.
+// Nothing is reverted unless all of them can be.
+func Down(ds db.DataStore, steps int, opts Options) ([]string, error) {
+	l, err := acquire(ds, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer l.release()
+
+	applied, err := Applied(ds)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range applied {
+		names = append(names, name)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	if steps < 0 {
+		steps = 0
+	}
+	if steps < len(names) {
+		names = names[:steps]
+	}
+
+	var reverting []Migration
+	for _, name := range names {
+		m, ok := lookup(name)
+		if !ok {
+			return nil, ERR_UNKNOWN_MIGRATION
+		}
+		if m.Down == nil {
+			return nil, ERR_NO_DOWN
+		}
+		reverting = append(reverting, m)
+	}
+
+	if opts.DryRun {
+		return names, nil
+	}
+
+	var reverted []string
+	for _, m := range reverting {
+		fmt.Printf("Reverting migration %s \n", m.Name)
+		if err := m.Down(ds); err != nil {
+			fmt.Printf("Error reverting migration %s: %s \n", m.Name, err)
+			return reverted, err
+		}
+
+		if err := ds.RemoveObject(applied[m.Name]); err != nil {
+			return reverted, err
+		}
+
+		reverted = append(reverted, m.Name)
+		if err := l.renew(); err != nil {
+			return reverted, err
+		}
+	}
+
+	return reverted, nil
+}
+
+// Lock
+
+type lock struct {
+	ds      db.DataStore
+	record  *models.Migration
+	timeout time.Duration
+}
+
+// acquire takes the lock, unless this is a dry run which changes nothing.
+func acquire(ds db.DataStore, opts Options) (*lock, error) {
+	l := &lock{ds: ds, timeout: opts.LockTimeout}
+	if l.timeout == 0 {
+		l.timeout = DefaultLockTimeout
+	}
+
+	if opts.DryRun {
+		return l, nil
+	}
+
+	// A lock left behind by an instance that died can be taken over once it expires
+	expired := bson.M{"name": models.MigrationLockName, "expiresAt": bson.M{"$lt": time.Now()}}
+	if err := ds.RemoveAll(models.CollectionMigration, expired); err != nil {
+		return nil, err
+	}
+
+	record := models.NewEmptyMigration()
+	record.Name = models.MigrationLockName
+	expiresAt := time.Now().Add(l.timeout)
+	record.ExpiresAt = &expiresAt
+
+	if err := ds.InsertObject(record); err != nil {
+		if mgo.IsDup(err) {
+			return nil, ERR_LOCKED
+		}
+		return nil, err
+	}
+
+	l.record = record
+	return l, nil
+}
+
+func (l *lock) renew() error {
+	if l.record == nil {
+		return nil
+	}
+	expiresAt := time.Now().Add(l.timeout)
+	l.record.Set("ExpiresAt", &expiresAt)
+	return l.ds.UpdateObject(l.record)
+}
+
+func (l *lock) release() {
+	if l.record == nil {
+		return
+	}
+	if err := l.ds.RemoveObject(l.record); err != nil {
+		fmt.Printf("Error releasing migration lock: %s \n", err)
+	}
+}
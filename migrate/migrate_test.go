@@ -0,0 +1,131 @@
+package migrate
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"github.com/nidhik/backend/query"
+)
+
+// withMigrations replaces the registered migrations for the duration of a test
+func withMigrations(t *testing.T, test query.DatastoreTest, migrations ...Migration) {
+	previous := registered
+	defer func() { registered = previous }()
+
+	registered = nil
+	for _, m := range migrations {
+		Register(m)
+	}
+
+	query.RunTest(t, test)
+}
+
+func TestUpAndDown(t *testing.T) {
+	var log []string
+	step := func(name string) func(ds db.DataStore) error {
+		return func(ds db.DataStore) error {
+			log = append(log, name)
+			return nil
+		}
+	}
+
+	// Registered out of order on purpose
+	second := Migration{Name: "0002_second", Up: step("up 2"), Down: step("down 2")}
+	first := Migration{Name: "0001_first", Up: step("up 1"), Down: step("down 1")}
+
+	withMigrations(t, func(t *testing.T, ds db.DataStore) {
+
+		names, err := Up(ds, Options{DryRun: true})
+		query.AssertNoError(t, "Could not dry run migrations:", err)
+		if !reflect.DeepEqual(names, []string{"0001_first", "0002_second"}) || len(log) > 0 {
+			t.Fatal("Expected: both migrations listed, none run", "Actual:", names, log)
+		}
+
+		names, err = Up(ds, Options{})
+		query.AssertNoError(t, "Could not run migrations:", err)
+		if !reflect.DeepEqual(log, []string{"up 1", "up 2"}) {
+			t.Fatal("Expected: [up 1 up 2]", "Actual:", log)
+		}
+
+		// Applied migrations are not run again
+		names, err = Up(ds, Options{})
+		query.AssertNoError(t, "Could not run migrations:", err)
+		if len(names) > 0 || len(log) != 2 {
+			t.Fatal("Expected: nothing to run", "Actual:", names, log)
+		}
+
+		names, err = Down(ds, 1, Options{})
+		query.AssertNoError(t, "Could not revert migrations:", err)
+		if !reflect.DeepEqual(names, []string{"0002_second"}) || log[2] != "down 2" {
+			t.Fatal("Expected: 0002_second reverted", "Actual:", names, log)
+		}
+
+		applied, err := Applied(ds)
+		query.AssertNoError(t, "Could not find applied migrations:", err)
+		if _, ok := applied["0001_first"]; !ok || len(applied) != 1 {
+			t.Fatal("Expected: only 0001_first applied", "Actual:", applied)
+		}
+
+	}, second, first)
+}
+
+func TestUpStopsOnError(t *testing.T) {
+	failure := errors.New("failed")
+
+	withMigrations(t, func(t *testing.T, ds db.DataStore) {
+
+		names, err := Up(ds, Options{})
+		if err != failure || !reflect.DeepEqual(names, []string{"0001_ok"}) {
+			t.Fatal("Expected:", failure, "[0001_ok]", "Actual:", err, names)
+		}
+
+		// The failed migration can't be reverted and holds back the ones before it
+		if _, err := Down(ds, 1, Options{}); err != ERR_NO_DOWN {
+			t.Fatal("Expected:", ERR_NO_DOWN, "Actual:", err)
+		}
+
+	},
+		Migration{Name: "0001_ok", Up: func(ds db.DataStore) error { return nil }},
+		Migration{Name: "0002_fails", Up: func(ds db.DataStore) error { return failure }},
+	)
+}
+
+func TestLock(t *testing.T) {
+	withMigrations(t, func(t *testing.T, ds db.DataStore) {
+
+		l, err := acquire(ds, Options{})
+		query.AssertNoError(t, "Could not lock:", err)
+
+		if _, err := Up(ds, Options{}); err != ERR_LOCKED {
+			t.Fatal("Expected:", ERR_LOCKED, "Actual:", err)
+		}
+
+		// Dry runs don't need the lock
+		if _, err := Up(ds, Options{DryRun: true}); err != nil {
+			t.Fatal("Expected: no error", "Actual:", err)
+		}
+
+		l.release()
+		if _, err := Up(ds, Options{}); err != nil {
+			t.Fatal("Expected: no error", "Actual:", err)
+		}
+
+		// Locks left behind are taken over once they expire
+		_, err = acquire(ds, Options{LockTimeout: -time.Minute})
+		query.AssertNoError(t, "Could not lock:", err)
+
+		if _, err := Up(ds, Options{}); err != nil {
+			t.Fatal("Expected: no error", "Actual:", err)
+		}
+
+		n, err := ds.Count(models.CollectionMigration, map[string]interface{}{"name": models.MigrationLockName})
+		if err != nil || n != 0 {
+			t.Fatal("Expected: lock released", "Actual:", n, err)
+		}
+
+	}, Migration{Name: "0001_noop", Up: func(ds db.DataStore) error { return nil }})
+}
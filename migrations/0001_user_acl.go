@@ -0,0 +1,41 @@
+// Package migrations holds the migrations of this backend. Import it for its side effects
+// before calling migrate.Up.
+package migrations
+
+import (
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/migrate"
+	"github.com/nidhik/backend/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func init() {
+	migrate.Register(migrate.Migration{Name: "0001_user_acl", Up: backfillUserACL})
+}
+
+// Users who signed up with facebook, or before sign up set ACLs, have no write permissions
+// so they can't change their own profile. Give them the ACL email sign ups get.
+func backfillUserACL(ds db.DataStore) error {
+	var ids []string
+	err := ds.FindEach(models.CollectionUser, bson.M{db.WRITE_PERM: bson.M{"$exists": false}}, func(model db.Model) {
+		ids = append(ids, model.ObjectId())
+	}, models.NewEmptyUser())
+
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		user := models.NewUser(id)
+		if err := user.Fetch(ds); err != nil {
+			return err
+		}
+
+		user.SetAccessControlList(models.NewUserACL(id))
+		if err := user.Save(ds); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,361 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nidhik/backend/db"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	CollectionAudit = "_Audit"
+)
+
+const (
+	AuditInsert   = "insert"
+	AuditUpdate   = "update"
+	AuditUpsert   = "upsert"
+	AuditRemove   = "remove"
+	AuditRestore  = "restore"
+	AuditPurge    = "purge"
+	AuditRelation = "relation"
+)
+
+func init() {
+	db.RegisterClass(db.ClassInfo{
+		Name: CollectionAudit,
+		New:  func(id string) db.Model { return NewAudit(id) },
+		Indexes: []db.Index{
+			{Key: []string{"className", "objectId"}},
+			{Key: []string{"actor"}},
+		},
+	})
+}
+
+// Audit records a write made through an AuditedDataStore: who made it, to which object and
+// what changed. The record's createdAt is when the write was made.
+type Audit struct {
+	Actor     string `json:"actor" bson:"actor"`
+	Operation string `json:"operation" bson:"operation"`
+	ClassName string `json:"className" bson:"className"`
+	Target    string `json:"objectId,omitempty" bson:"objectId,omitempty"`
+	// The fields written, in the form of an update
+	SetFields   bson.M   `json:"set,omitempty" bson:"set,omitempty"`
+	UnsetFields []string `json:"unset,omitempty" bson:"unset,omitempty"`
+	IncFields   bson.M   `json:"inc,omitempty" bson:"inc,omitempty"`
+	// Array changes, by field: the values added, added if missing or removed
+	PushFields     bson.M `json:"push,omitempty" bson:"push,omitempty"`
+	AddToSetFields bson.M `json:"addToSet,omitempty" bson:"addToSet,omitempty"`
+	PullFields     bson.M `json:"pull,omitempty" bson:"pull,omitempty"`
+	// Relation changes, by the id of the related objects
+	Relation     string   `json:"relation,omitempty" bson:"relation,omitempty"`
+	Added        []string `json:"added,omitempty" bson:"added,omitempty"`
+	Removed      []string `json:"removed,omitempty" bson:"removed,omitempty"`
+	db.BaseModel `bson:",inline"`
+}
+
+func NewEmptyAudit() *Audit {
+	return &Audit{BaseModel: db.BaseModel{CollectionName: CollectionAudit}}
+}
+
+func NewAudit(id string) *Audit {
+	return &Audit{BaseModel: db.BaseModel{
+		Id: id, CollectionName: CollectionAudit},
+	}
+}
+
+func (model *Audit) Fetch(ds db.DataStore) error {
+	return model.BaseModel.Fetch(model, ds)
+}
+
+func (model *Audit) Save(ds db.DataStore) error {
+	return model.BaseModel.Save(model, ds)
+}
+
+func (model *Audit) Delete(ds db.DataStore) error {
+	return model.BaseModel.Delete(model, ds)
+}
+
+func (model *Audit) Set(fieldName string, value interface{}) {
+	model.BaseModel.Set(model, fieldName, value)
+}
+
+func (model *Audit) Unset(fieldName string) {
+	model.BaseModel.Unset(model, fieldName)
+}
+
+func (model *Audit) Get(fieldName string) interface{} {
+	return model.BaseModel.Get(model, fieldName)
+}
+
+func (model *Audit) Increment(fieldName string, amount int) {
+	model.BaseModel.Increment(model, fieldName, amount)
+}
+
+func (model *Audit) Add(fieldName string, values ...interface{}) {
+	model.BaseModel.Add(model, fieldName, values...)
+}
+
+func (model *Audit) AddUnique(fieldName string, values ...interface{}) {
+	model.BaseModel.AddUnique(model, fieldName, values...)
+}
+
+func (model *Audit) Remove(fieldName string, values ...interface{}) {
+	model.BaseModel.Remove(model, fieldName, values...)
+}
+
+// Audit records are never changed once written
+func (model *Audit) UsesOptimisticLocking() bool {
+	return false
+}
+
+func (model *Audit) CustomUnmarshall() {
+	model.CollectionName = CollectionAudit
+}
+
+// Fields whose values are never written to the audit log, only that they changed
+var AuditRedacted = []string{"_hashed_password", "_auth_data_facebook"}
+
+const redacted = "(redacted)"
+
+// AuditedDataStore records every write made through it to the _Audit collection of log,
+// which should not be restricted by ACLs. actor returns the id of the user making the
+// writes, empty for anonymous writes like signups. Reads are passed straight through.
+//
+// Records are only written once the write succeeded; failing to record one is logged but
+// doesn't fail the write, which has already been made.
+type AuditedDataStore struct {
+	db.DataStore
+	log   db.DataStore
+	actor func() string
+}
+
+func NewAuditedDataStore(ds db.DataStore, log db.DataStore, actor func() string) *AuditedDataStore {
+	return &AuditedDataStore{DataStore: ds, log: log, actor: actor}
+}
+
+func (a *AuditedDataStore) Close() {
+	a.DataStore.Close()
+	a.log.Close()
+}
+
+func (a *AuditedDataStore) InsertObject(model db.Model) error {
+	if err := a.DataStore.InsertObject(model); err != nil {
+		return err
+	}
+
+	a.recordInsert(model)
+	return nil
+}
+
+func (a *AuditedDataStore) InsertAll(collectionName string, models []db.Model) error {
+	if err := a.DataStore.InsertAll(collectionName, models); err != nil {
+		return err
+	}
+
+	for _, model := range models {
+		a.recordInsert(model)
+	}
+	return nil
+}
+
+func (a *AuditedDataStore) UpdateObject(model db.Model) error {
+	record := a.diff(AuditUpdate, model)
+	if err := a.DataStore.UpdateObject(model); err != nil {
+		return err
+	}
+
+	a.record(record)
+	return nil
+}
+
+func (a *AuditedDataStore) UpsertObject(model db.Model, query map[string]interface{}) error {
+	record := a.diff(AuditUpsert, model)
+	if err := a.DataStore.UpsertObject(model, query); err != nil {
+		return err
+	}
+
+	// The id is only known once the object was found or created
+	record.Target = model.ObjectId()
+	a.record(record)
+	return nil
+}
+
+func (a *AuditedDataStore) RemoveObject(model db.Model) error {
+	if err := a.DataStore.RemoveObject(model); err != nil {
+		return err
+	}
+
+	a.record(a.newRecord(AuditRemove, model.Collection(), model.ObjectId()))
+	return nil
+}
+
+// RemoveAll records each removal by id. The objects the query matches are found through log
+// before and after, as the ones the requester may remove need not be ones they may read.
+func (a *AuditedDataStore) RemoveAll(collectionName string, query map[string]interface{}) error {
+	before, err := a.matching(collectionName, query)
+	if err != nil {
+		return err
+	}
+
+	if err := a.DataStore.RemoveAll(collectionName, query); err != nil {
+		return err
+	}
+
+	after, err := a.matching(collectionName, query)
+	if err != nil {
+		fmt.Printf("Error auditing removal from %s: %s \n", collectionName, err)
+		return nil
+	}
+
+	for id := range before {
+		if !after[id] {
+			a.record(a.newRecord(AuditRemove, collectionName, id))
+		}
+	}
+	return nil
+}
+
+// matching finds the ids of the objects a query matches, whoever may read them
+func (a *AuditedDataStore) matching(collectionName string, query map[string]interface{}) (map[string]bool, error) {
+	result, err := db.NewObject(collectionName, "")
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]bool)
+	err = a.log.FindEach(collectionName, copyQuery(query), func(model db.Model) {
+		ids[model.ObjectId()] = true
+	}, result)
+	return ids, err
+}
+
+func (a *AuditedDataStore) RestoreObject(model db.Model) error {
+	if err := a.DataStore.RestoreObject(model); err != nil {
+		return err
+	}
+
+	a.record(a.newRecord(AuditRestore, model.Collection(), model.ObjectId()))
+	return nil
+}
+
+func (a *AuditedDataStore) PurgeObjects(collectionName string, deletedBefore time.Time) (int, error) {
+	n, err := a.DataStore.PurgeObjects(collectionName, deletedBefore)
+	if err != nil || n == 0 {
+		return n, err
+	}
+
+	record := a.newRecord(AuditPurge, collectionName, "")
+	record.SetFields = bson.M{"deletedBefore": deletedBefore, "purged": n}
+	a.record(record)
+	return n, nil
+}
+
+func (a *AuditedDataStore) SaveRelatedObjects(relation db.Relation) error {
+	record := a.newRecord(AuditRelation, relation.Owner().Collection(), relation.Owner().ObjectId())
+	record.Relation = relation.JoinCollection()
+	for _, model := range relation.Inserting() {
+		record.Added = append(record.Added, model.ObjectId())
+	}
+	for _, model := range relation.Removing() {
+		record.Removed = append(record.Removed, model.ObjectId())
+	}
+
+	if err := a.DataStore.SaveRelatedObjects(relation); err != nil {
+		return err
+	}
+
+	if len(record.Added) > 0 || len(record.Removed) > 0 {
+		a.record(record)
+	}
+	return nil
+}
+
+// Records
+
+func (a *AuditedDataStore) newRecord(operation string, collectionName string, id string) *Audit {
+	record := NewEmptyAudit()
+	record.Actor = a.actor()
+	record.Operation = operation
+	record.ClassName = collectionName
+	record.Target = id
+	return record
+}
+
+func (a *AuditedDataStore) recordInsert(model db.Model) {
+	record := a.newRecord(AuditInsert, model.Collection(), model.ObjectId())
+
+	doc, err := db.ToDocument(model)
+	if err != nil {
+		fmt.Printf("Error auditing insert into %s: %s \n", model.Collection(), err)
+		return
+	}
+
+	record.SetFields = redact(doc)
+	a.record(record)
+}
+
+// diff records the $set, $unset, $inc and array changes the model is about to be written with. It is taken
+// before the write, so the model's changes are the ones that are applied, and leaves the model as it is.
+func (a *AuditedDataStore) diff(operation string, model db.Model) *Audit {
+	record := a.newRecord(operation, model.Collection(), model.ObjectId())
+
+	changes := model.Changes()
+	if set, ok := changes["$set"].(bson.M); ok {
+		record.SetFields = redact(set)
+	}
+	if unset, ok := changes["$unset"].(bson.M); ok {
+		for field := range unset {
+			record.UnsetFields = append(record.UnsetFields, field)
+		}
+	}
+	if inc, ok := changes["$inc"].(bson.M); ok {
+		record.IncFields = copyQuery(inc)
+	}
+	record.PushFields = arrayValues(changes["$push"], "$each")
+	record.AddToSetFields = arrayValues(changes["$addToSet"], "$each")
+	record.PullFields = arrayValues(changes["$pull"], "$in")
+	return record
+}
+
+func (a *AuditedDataStore) record(record *Audit) {
+	if err := record.Save(a.log); err != nil {
+		fmt.Printf("Error writing audit record for %s %s: %s \n", record.ClassName, record.Target, err)
+	}
+}
+
+// arrayValues lists the values of an array change by field
+func arrayValues(change interface{}, key string) bson.M {
+	fields, ok := change.(bson.M)
+	if !ok {
+		return nil
+	}
+
+	result := bson.M{}
+	for field, arg := range fields {
+		if m, ok := arg.(bson.M); ok {
+			result[field] = m[key]
+		}
+	}
+	return redact(result)
+}
+
+// redact copies doc, leaving out the values of AuditRedacted fields
+func redact(doc bson.M) bson.M {
+	result := copyQuery(doc)
+	for _, field := range AuditRedacted {
+		if _, ok := result[field]; ok {
+			result[field] = redacted
+		}
+	}
+	return result
+}
+
+func copyQuery(q map[string]interface{}) bson.M {
+	result := bson.M{}
+	for k, v := range q {
+		result[k] = v
+	}
+	return result
+}
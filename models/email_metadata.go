@@ -9,6 +9,17 @@ const (
 	CollectionEmailMetadata = "EmailMetadata"
 )
 
+func init() {
+	db.RegisterClass(db.ClassInfo{
+		Name:       CollectionEmailMetadata,
+		New:        func(id string) db.Model { return NewEmailMetadata(id) },
+		SoftDelete: true,
+		Indexes: []db.Index{
+			{Key: []string{"emailType"}},
+		},
+	})
+}
+
 type EmailMetadataParameter struct {
 	AttributeName  string `json:"attributeName" bson:"attributeName"`
 	Tag            string `json:"tag" bson:"tag"`
@@ -82,6 +93,18 @@ func (model *EmailMetadata) Increment(fieldName string, amount int) {
 	model.BaseModel.Increment(model, fieldName, amount)
 }
 
+func (model *EmailMetadata) Add(fieldName string, values ...interface{}) {
+	model.BaseModel.Add(model, fieldName, values...)
+}
+
+func (model *EmailMetadata) AddUnique(fieldName string, values ...interface{}) {
+	model.BaseModel.AddUnique(model, fieldName, values...)
+}
+
+func (model *EmailMetadata) Remove(fieldName string, values ...interface{}) {
+	model.BaseModel.Remove(model, fieldName, values...)
+}
+
 func (model *EmailMetadata) CustomUnmarshall() {
 	model.CollectionName = CollectionEmailMetadata
 }
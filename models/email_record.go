@@ -9,6 +9,21 @@ const (
 	CollectionEmailRecord = "EmailRecord"
 )
 
+func init() {
+	db.RegisterClass(db.ClassInfo{
+		Name:       CollectionEmailRecord,
+		New:        func(id string) db.Model { return NewEmailRecord(id) },
+		SoftDelete: true,
+		Indexes: []db.Index{
+			{Key: []string{db.TEXT_KEY + "subject"}},
+		},
+		// Records are addressed to the email of a user
+		DeleteRules: []db.DeleteRule{
+			{Field: "to", Class: CollectionUser, TargetField: "email", OnDelete: db.DeleteCascade},
+		},
+	})
+}
+
 type Substitution struct {
 	Tag   string `json:"tag" bson:"tag"`
 	Value string `json:"val" bson:"val"`
@@ -81,6 +96,18 @@ func (model *EmailRecord) Increment(fieldName string, amount int) {
 	model.BaseModel.Increment(model, fieldName, amount)
 }
 
+func (model *EmailRecord) Add(fieldName string, values ...interface{}) {
+	model.BaseModel.Add(model, fieldName, values...)
+}
+
+func (model *EmailRecord) AddUnique(fieldName string, values ...interface{}) {
+	model.BaseModel.AddUnique(model, fieldName, values...)
+}
+
+func (model *EmailRecord) Remove(fieldName string, values ...interface{}) {
+	model.BaseModel.Remove(model, fieldName, values...)
+}
+
 func (model *EmailRecord) CustomUnmarshall() {
 	model.CollectionName = CollectionEmailRecord
 }
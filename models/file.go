@@ -0,0 +1,151 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"regexp"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/routes"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var ERR_INVALID_FILE = errors.New("Invalid file.")
+
+const (
+	CollectionFile = "_File"
+)
+
+// The scheme and host file urls are given, like https://api.example.com. Without it urls
+// are relative to the server.
+var FileBaseURL = os.Getenv("FILE_BASE_URL")
+
+// Names of stored files: the hex sha256 of their contents and an extension
+var validFileName = regexp.MustCompile(`^[0-9a-f]{64}(\.[a-z0-9]{1,10})?$`)
+
+func ValidFileName(name string) bool {
+	return validFileName.MatchString(name)
+}
+
+func FileURL(name string) string {
+	return FileBaseURL + routes.V1_API + routes.FILES + "/" + name
+}
+
+func init() {
+	db.RegisterClass(db.ClassInfo{
+		Name: CollectionFile,
+		New:  func(id string) db.Model { return NewFileInfo(id) },
+		Indexes: []db.Index{
+			{Key: []string{"name"}, Unique: true},
+		},
+	})
+}
+
+// File is a field holding an uploaded file, see the files package. It is read and written
+// as Parse does, {"__type": "File", "name": "...", "url": "..."}, and stored as its name.
+// Declare fields as *File with omitempty.
+type File struct {
+	Name string
+}
+
+type fileJSON struct {
+	TypeName string `json:"__type"`
+	Name     string `json:"name"`
+	URL      string `json:"url,omitempty"`
+}
+
+func (f File) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fileJSON{TypeName: "File", Name: f.Name, URL: FileURL(f.Name)})
+}
+
+// UnmarshalJSON only accepts the names of uploaded files. The url is ignored.
+func (f *File) UnmarshalJSON(data []byte) error {
+	var j fileJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	if j.TypeName != "File" || !ValidFileName(j.Name) {
+		return ERR_INVALID_FILE
+	}
+
+	f.Name = j.Name
+	return nil
+}
+
+func (f File) GetBSON() (interface{}, error) {
+	return f.Name, nil
+}
+
+func (f *File) SetBSON(raw bson.Raw) error {
+	return raw.Unmarshal(&f.Name)
+}
+
+// FileInfo records a stored file. Files are named after their contents, so uploading the
+// same contents twice stores them once.
+type FileInfo struct {
+	Name         string `json:"name" bson:"name"`
+	ContentType  string `json:"contentType" bson:"contentType"`
+	Size         int64  `json:"size" bson:"size"`
+	db.BaseModel `bson:",inline"`
+}
+
+func NewEmptyFileInfo() *FileInfo {
+	return &FileInfo{BaseModel: db.BaseModel{CollectionName: CollectionFile}}
+}
+
+func NewFileInfo(id string) *FileInfo {
+	return &FileInfo{BaseModel: db.BaseModel{
+		Id: id, CollectionName: CollectionFile},
+	}
+}
+
+func (model *FileInfo) Fetch(ds db.DataStore) error {
+	return model.BaseModel.Fetch(model, ds)
+}
+
+func (model *FileInfo) Save(ds db.DataStore) error {
+	return model.BaseModel.Save(model, ds)
+}
+
+func (model *FileInfo) Delete(ds db.DataStore) error {
+	return model.BaseModel.Delete(model, ds)
+}
+
+func (model *FileInfo) Set(fieldName string, value interface{}) {
+	model.BaseModel.Set(model, fieldName, value)
+}
+
+func (model *FileInfo) Unset(fieldName string) {
+	model.BaseModel.Unset(model, fieldName)
+}
+
+func (model *FileInfo) Get(fieldName string) interface{} {
+	return model.BaseModel.Get(model, fieldName)
+}
+
+func (model *FileInfo) Increment(fieldName string, amount int) {
+	model.BaseModel.Increment(model, fieldName, amount)
+}
+
+func (model *FileInfo) Add(fieldName string, values ...interface{}) {
+	model.BaseModel.Add(model, fieldName, values...)
+}
+
+func (model *FileInfo) AddUnique(fieldName string, values ...interface{}) {
+	model.BaseModel.AddUnique(model, fieldName, values...)
+}
+
+func (model *FileInfo) Remove(fieldName string, values ...interface{}) {
+	model.BaseModel.Remove(model, fieldName, values...)
+}
+
+// The contents of a file never change once stored
+func (model *FileInfo) UsesOptimisticLocking() bool {
+	return false
+}
+
+func (model *FileInfo) CustomUnmarshall() {
+	model.CollectionName = CollectionFile
+}
@@ -0,0 +1,82 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/nidhik/backend/db"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var ERR_INVALID_GEOPOINT = errors.New("Invalid GeoPoint.")
+
+// GeoPoint is a location. It is read and written as Parse does,
+// {"__type": "GeoPoint", "latitude": 40.7, "longitude": -74.0}, and stored as a GeoJSON point
+// so a 2dsphere index can serve proximity queries. Declare fields as *GeoPoint with
+// omitempty, and index them with db.GEO_KEY.
+type GeoPoint struct {
+	Latitude  float64
+	Longitude float64
+}
+
+func NewGeoPoint(latitude float64, longitude float64) (*GeoPoint, error) {
+	p := &GeoPoint{Latitude: latitude, Longitude: longitude}
+	if !p.valid() {
+		return nil, ERR_INVALID_GEOPOINT
+	}
+	return p, nil
+}
+
+func (p *GeoPoint) valid() bool {
+	return p.Latitude >= -90 && p.Latitude <= 90 && p.Longitude >= -180 && p.Longitude <= 180
+}
+
+type geoPointJSON struct {
+	TypeName  string   `json:"__type"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+}
+
+func (p GeoPoint) MarshalJSON() ([]byte, error) {
+	return json.Marshal(geoPointJSON{TypeName: "GeoPoint", Latitude: &p.Latitude, Longitude: &p.Longitude})
+}
+
+func (p *GeoPoint) UnmarshalJSON(data []byte) error {
+	var j geoPointJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	if j.TypeName != "GeoPoint" || j.Latitude == nil || j.Longitude == nil {
+		return ERR_INVALID_GEOPOINT
+	}
+
+	point := GeoPoint{Latitude: *j.Latitude, Longitude: *j.Longitude}
+	if !point.valid() {
+		return ERR_INVALID_GEOPOINT
+	}
+
+	*p = point
+	return nil
+}
+
+func (p GeoPoint) GetBSON() (interface{}, error) {
+	return db.GeoJSON(p.Latitude, p.Longitude), nil
+}
+
+func (p *GeoPoint) SetBSON(raw bson.Raw) error {
+	var point struct {
+		Type        string    `bson:"type"`
+		Coordinates []float64 `bson:"coordinates"`
+	}
+	if err := raw.Unmarshal(&point); err != nil {
+		return err
+	}
+
+	if point.Type != "Point" || len(point.Coordinates) != 2 {
+		return ERR_INVALID_GEOPOINT
+	}
+
+	p.Longitude, p.Latitude = point.Coordinates[0], point.Coordinates[1]
+	return nil
+}
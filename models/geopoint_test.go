@@ -0,0 +1,58 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var geoPointTests = []struct {
+	json string
+	err  error
+}{
+	{`{"__type": "GeoPoint", "latitude": 40.7128, "longitude": -74.006}`, nil},
+	{`{"__type": "GeoPoint", "latitude": 0, "longitude": 0}`, nil},
+	{`{"__type": "Pointer", "latitude": 1, "longitude": 2}`, ERR_INVALID_GEOPOINT},
+	{`{"__type": "GeoPoint", "latitude": 1}`, ERR_INVALID_GEOPOINT},
+	{`{"__type": "GeoPoint", "latitude": 95, "longitude": 2}`, ERR_INVALID_GEOPOINT},
+	{`{"__type": "GeoPoint", "latitude": 1, "longitude": -181}`, ERR_INVALID_GEOPOINT},
+}
+
+func TestGeoPoint(t *testing.T) {
+	for _, test := range geoPointTests {
+		var p GeoPoint
+		err := json.Unmarshal([]byte(test.json), &p)
+		if err != test.err {
+			t.Fatal("Expected error for", test.json, "to be:", test.err, "Actual:", err)
+		}
+		if err != nil {
+			continue
+		}
+
+		// Through bson and back to the same JSON
+		data, err := bson.Marshal(bson.M{"location": p})
+		if err != nil {
+			t.Fatal("Could not marshal:", err)
+		}
+
+		var doc struct {
+			Location GeoPoint `bson:"location"`
+		}
+		if err := bson.Unmarshal(data, &doc); err != nil || doc.Location != p {
+			t.Fatal("Expected:", p, "Actual:", doc.Location, err)
+		}
+
+		var expected, actual map[string]interface{}
+		json.Unmarshal([]byte(test.json), &expected)
+		out, _ := json.Marshal(doc.Location)
+		json.Unmarshal(out, &actual)
+		if actual["latitude"] != expected["latitude"] || actual["longitude"] != expected["longitude"] || actual["__type"] != "GeoPoint" {
+			t.Fatal("Expected:", expected, "Actual:", actual)
+		}
+	}
+
+	if _, err := NewGeoPoint(-91, 0); err != ERR_INVALID_GEOPOINT {
+		t.Fatal("Expected:", ERR_INVALID_GEOPOINT, "Actual:", err)
+	}
+}
@@ -0,0 +1,85 @@
+package models
+
+import (
+	"time"
+
+	"github.com/nidhik/backend/db"
+)
+
+const (
+	CollectionMigration = "_Migration"
+)
+
+func init() {
+	db.RegisterClass(db.ClassInfo{
+		Name: CollectionMigration,
+		New:  func(id string) db.Model { return NewMigration(id) },
+		Indexes: []db.Index{
+			{Key: []string{"name"}, Unique: true},
+		},
+	})
+}
+
+// Migration records a migration that was applied, by name. The migrate package also stores
+// its lock here, as the record named MigrationLockName with an expiry.
+type Migration struct {
+	Name         string     `json:"name" bson:"name"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+	db.BaseModel `bson:",inline"`
+}
+
+const MigrationLockName = "_lock"
+
+func NewEmptyMigration() *Migration {
+	return &Migration{BaseModel: db.BaseModel{CollectionName: CollectionMigration}}
+}
+
+func NewMigration(id string) *Migration {
+	return &Migration{BaseModel: db.BaseModel{
+		Id: id, CollectionName: CollectionMigration},
+	}
+}
+
+func (model *Migration) Fetch(ds db.DataStore) error {
+	return model.BaseModel.Fetch(model, ds)
+}
+
+func (model *Migration) Save(ds db.DataStore) error {
+	return model.BaseModel.Save(model, ds)
+}
+
+func (model *Migration) Delete(ds db.DataStore) error {
+	return model.BaseModel.Delete(model, ds)
+}
+
+func (model *Migration) Set(fieldName string, value interface{}) {
+	model.BaseModel.Set(model, fieldName, value)
+}
+
+func (model *Migration) Unset(fieldName string) {
+	model.BaseModel.Unset(model, fieldName)
+}
+
+func (model *Migration) Get(fieldName string) interface{} {
+	return model.BaseModel.Get(model, fieldName)
+}
+
+func (model *Migration) Increment(fieldName string, amount int) {
+	model.BaseModel.Increment(model, fieldName, amount)
+}
+
+func (model *Migration) Add(fieldName string, values ...interface{}) {
+	model.BaseModel.Add(model, fieldName, values...)
+}
+
+func (model *Migration) AddUnique(fieldName string, values ...interface{}) {
+	model.BaseModel.AddUnique(model, fieldName, values...)
+}
+
+func (model *Migration) Remove(fieldName string, values ...interface{}) {
+	model.BaseModel.Remove(model, fieldName, values...)
+}
+
+func (model *Migration) CustomUnmarshall() {
+	model.CollectionName = CollectionMigration
+}
@@ -10,7 +10,7 @@ import (
 )
 
 var ERR_UNKNOWN_POINTER_TYPE = errors.New("Unknown object pointer type")
-var ERR_UNKNOWN_COLL_NAME = errors.New("Unknown object className")
+var ERR_UNKNOWN_COLL_NAME = db.ERR_UNKNOWN_CLASS
 
 type Pointer struct {
 	TypeName  string `json:"__type" bson:"__type"`
@@ -38,16 +38,7 @@ func PointerString(model db.Model) string {
 
 func (p *Pointer) model() (db.Model, error) {
 	if p.TypeName == "Pointer" {
-		switch p.ClassName {
-		case CollectionTask:
-			return NewTask(p.ObjectId), nil
-		case CollectionRole:
-			return NewRole(p.ObjectId), nil
-		case CollectionUser:
-			return NewUser(p.ObjectId), nil
-		default:
-			return nil, ERR_UNKNOWN_COLL_NAME
-		}
+		return db.NewObject(p.ClassName, p.ObjectId)
 	}
 
 	return nil, ERR_UNKNOWN_POINTER_TYPE
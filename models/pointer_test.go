@@ -16,6 +16,8 @@ var pointerTests = []struct {
 	{CollectionRole, "123", NewRole("123"), nil},
 	{CollectionUser, "789", NewUser("789"), nil},
 	{CollectionTask, "123456", NewTask("123456"), nil},
+	{CollectionEmailRecord, "abc", NewEmailRecord("abc"), nil},
+	{CollectionEmailMetadata, "def", NewEmailMetadata("def"), nil},
 }
 
 func TestPointer(t *testing.T) {
@@ -9,11 +9,46 @@ import (
 
 const (
 	CollectionRole = "_Role"
+
+	// Members of the admin role may use admin endpoints, like the audit log
+	RoleAdmin = "admin"
 )
 
+func init() {
+	db.RegisterClass(db.ClassInfo{
+		Name: CollectionRole,
+		New:  func(id string) db.Model { return NewRole(id) },
+		Relations: []db.RelationInfo{
+			{
+				Name:           "users",
+				JoinCollection: join_users_Role,
+				RelatedClass:   CollectionUser,
+				New:            func(owner db.Model) db.Relation { return newRelationRoleUsers(owner) },
+			},
+			{
+				Name:           "roles",
+				JoinCollection: join_roles_Role,
+				RelatedClass:   CollectionRole,
+				New:            func(owner db.Model) db.Relation { return newRelationRoleRoles(owner) },
+			},
+		},
+		Indexes: []db.Index{
+			{Key: []string{"name"}, Unique: true},
+		},
+		DeleteRules: []db.DeleteRule{
+			{Relation: "users", OnDelete: db.DeleteNullify},
+			{Relation: "roles", OnDelete: db.DeleteNullify},
+		},
+	})
+}
+
+// Role grants its users access to objects shared with "role:<name>". As in Parse, the
+// users of the roles in a role's Roles relation have the role too: adding admin to the
+// roles of coach makes every admin a coach.
 type Role struct {
 	Name         string      `json:"name" bson:"name"`
 	Users        db.Relation `json:"-" bson:"-"`
+	Roles        db.Relation `json:"-" bson:"-"`
 	db.BaseModel `bson:",inline"`
 }
 
@@ -30,6 +65,7 @@ func NewRole(id string) *Role {
 			CollectionName: CollectionRole},
 	}
 	role.Users = newRelationRoleUsers(role)
+	role.Roles = newRelationRoleRoles(role)
 	return role
 }
 
@@ -73,9 +109,22 @@ func (role *Role) Increment(fieldName string, amount int) {
 	role.BaseModel.Increment(role, fieldName, amount)
 }
 
+func (role *Role) Add(fieldName string, values ...interface{}) {
+	role.BaseModel.Add(role, fieldName, values...)
+}
+
+func (role *Role) AddUnique(fieldName string, values ...interface{}) {
+	role.BaseModel.AddUnique(role, fieldName, values...)
+}
+
+func (role *Role) Remove(fieldName string, values ...interface{}) {
+	role.BaseModel.Remove(role, fieldName, values...)
+}
+
 func (role *Role) CustomUnmarshall() {
 	role.CollectionName = CollectionRole
 	role.Users = newRelationRoleUsers(role)
+	role.Roles = newRelationRoleRoles(role)
 }
 
 // Queries
@@ -130,22 +179,86 @@ func (r *relationRoleUsers) Find(rds db.RelationalDataStore) ([]db.Model, error)
 	return models, err
 }
 
+// Roles Relation
+
+const (
+	join_roles_Role = "_Join:roles:_Role"
+)
+
+type relationRoleRoles struct {
+	db.BaseRelation
+}
+
+func newRelationRoleRoles(owner db.Model) *relationRoleRoles {
+	return &relationRoleRoles{BaseRelation: db.NewBaseRelation(owner, join_roles_Role, CollectionRole)}
+}
+
+func (r *relationRoleRoles) Find(rds db.RelationalDataStore) ([]db.Model, error) {
+	var models []db.Model
+	err := rds.FindRelatedObjects(r, func(model db.Model) {
+		models = append(models, copyRole(model))
+	}, NewEmptyRole())
+
+	return models, err
+}
+
 // General
 
+// FindRolesForUser finds the roles a user has: the roles the user belongs to and, through
+// the roles relations, every role that contains one of those, however indirectly.
 func FindRolesForUser(user *User, rds db.RelationalDataStore) ([]*Role, error) {
 	var roles []*Role
 	var role = NewEmptyRole()
 
 	err := rds.FindOwningObjects(join_users_Role, user, func(model db.Model) {
-		r := model.(*Role)
-
-		var ptr = NewEmptyRole()
-		*ptr = *r
-		roles = append(roles, ptr)
-
+		roles = append(roles, copyRole(model))
 	}, role)
 
+	if err == nil {
+		roles, err = inheritRoles(roles, rds)
+	}
+
 	fmt.Printf("Found %d roles for user %s\n", len(roles), user.ObjectId())
 	return roles, err
 
 }
+
+// inheritRoles adds the roles containing any of roles, one level of the role graph at a
+// time. Each role is added once, so cycles in the graph end the walk.
+func inheritRoles(roles []*Role, rds db.RelationalDataStore) ([]*Role, error) {
+	seen := make(map[string]bool)
+	for _, r := range roles {
+		seen[r.ObjectId()] = true
+	}
+
+	level := roles
+	for len(level) > 0 {
+		var next []*Role
+		for _, child := range level {
+			err := rds.FindOwningObjects(join_roles_Role, child, func(model db.Model) {
+				if seen[model.ObjectId()] {
+					return
+				}
+				seen[model.ObjectId()] = true
+				next = append(next, copyRole(model))
+			}, NewEmptyRole())
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		roles = append(roles, next...)
+		level = next
+	}
+
+	return roles, nil
+}
+
+// copyRole copies a role that was read into the shared result model
+func copyRole(model db.Model) *Role {
+	var ptr = NewEmptyRole()
+	*ptr = *model.(*Role)
+	ptr.CustomUnmarshall()
+	return ptr
+}
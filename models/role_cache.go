@@ -0,0 +1,131 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nidhik/backend/db"
+)
+
+// How long roles loaded by CachedRolesForUser are used before being found again
+var RoleCacheTTL = time.Minute
+
+// How long roles found again by RecheckRolesForUser are trusted, before a token signed for
+// other roles has them found again
+var RoleRecheckInterval = 10 * time.Second
+
+// Hits, misses and invalidations of the role cache, published with expvar at /debug/vars
+var RoleCacheStats = expvar.NewMap("roleCache")
+
+// RoleChanges is told whenever the role cache is cleared, as the roles of any user may have
+// changed. Whatever keeps the permissions of a user longer than a request, like live query
+// connections, listens to it.
+var RoleChanges = db.NewChangeFeed()
+
+type cachedRoles struct {
+	roles    []*Role
+	loadedAt time.Time
+}
+
+var roleCache = struct {
+	sync.Mutex
+	users map[string]cachedRoles
+	// Counts the times the cache was cleared, so roles found before are not kept
+	generation int
+}{users: make(map[string]cachedRoles)}
+
+// Saving the users or roles of a role may change the roles of any user, through inheritance
+func init() {
+	db.RelationChanges.Listen(func(e db.ChangeEvent) {
+		if e.Collection == join_users_Role || e.Collection == join_roles_Role {
+			ClearRoleCache()
+		}
+	})
+}
+
+// CachedRolesForUser is FindRolesForUser, finding the roles of each user at most once every
+// RoleCacheTTL. The cache is cleared whenever the users or roles of a role are saved in this
+// process. The roles returned are shared, don't change them.
+func CachedRolesForUser(user *User, rds db.RelationalDataStore) ([]*Role, error) {
+	roleCache.Lock()
+	cached, ok := roleCache.users[user.ObjectId()]
+	generation := roleCache.generation
+	roleCache.Unlock()
+
+	if ok && time.Since(cached.loadedAt) < RoleCacheTTL {
+		RoleCacheStats.Add("hits", 1)
+		return append([]*Role{}, cached.roles...), nil
+	}
+	RoleCacheStats.Add("misses", 1)
+
+	loadedAt := time.Now()
+	roles, err := FindRolesForUser(user, rds)
+	if err != nil {
+		return nil, err
+	}
+
+	roleCache.Lock()
+	if roleCache.generation == generation {
+		roleCache.users[user.ObjectId()] = cachedRoles{roles: roles, loadedAt: loadedAt}
+	}
+	roleCache.Unlock()
+	return append([]*Role{}, roles...), nil
+}
+
+// RecheckRolesForUser finds the user's roles again, for tokens signed for other roles than
+// the cache holds, unless they were found in the last RoleRecheckInterval. Tokens that stay
+// signed for old roles until their user signs in again then cost no more than others.
+func RecheckRolesForUser(user *User, rds db.RelationalDataStore) ([]*Role, error) {
+	roleCache.Lock()
+	cached, ok := roleCache.users[user.ObjectId()]
+	roleCache.Unlock()
+
+	if ok && time.Since(cached.loadedAt) < RoleRecheckInterval {
+		RoleCacheStats.Add("hits", 1)
+		return append([]*Role{}, cached.roles...), nil
+	}
+
+	ForgetRolesForUser(user)
+	return CachedRolesForUser(user, rds)
+}
+
+// ForgetRolesForUser makes the next CachedRolesForUser find the user's roles again.
+func ForgetRolesForUser(user *User) {
+	roleCache.Lock()
+	delete(roleCache.users, user.ObjectId())
+	roleCache.Unlock()
+}
+
+// ClearRoleCache makes CachedRolesForUser find the roles of every user again, for changes
+// to roles it isn't told of, like renames.
+func ClearRoleCache() {
+	roleCache.Lock()
+	roleCache.users = make(map[string]cachedRoles)
+	roleCache.generation++
+	roleCache.Unlock()
+	RoleCacheStats.Add("invalidations", 1)
+
+	RoleChanges.Publish(db.ChangeEvent{Type: db.ChangeUpdate, Collection: CollectionRole})
+}
+
+// RoleVersion identifies a set of roles, however they are ordered. Tokens carry the version
+// of the roles their user had, so requests made with them after the roles changed are told
+// apart, see auth.CreateTokenWithRoles.
+func RoleVersion(roles []*Role) string {
+	keys := make([]string, len(roles))
+	for i, r := range roles {
+		keys[i] = r.ObjectId() + ":" + r.Name
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
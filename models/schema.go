@@ -0,0 +1,235 @@
+package models
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nidhik/backend/db"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	CollectionSchema = "_SCHEMA"
+)
+
+func init() {
+	db.RegisterClass(db.ClassInfo{
+		Name: CollectionSchema,
+		New:  func(id string) db.Model { return NewSchema(id) },
+		Indexes: []db.Index{
+			{Key: []string{"className"}, Unique: true},
+		},
+	})
+}
+
+// Operations that class level permissions can restrict
+const (
+	OperationGet      = "get"
+	OperationFind     = "find"
+	OperationCount    = "count"
+	OperationCreate   = "create"
+	OperationUpdate   = "update"
+	OperationDelete   = "delete"
+	OperationAddField = "addField"
+)
+
+// ClassPermissions lists, for each operation, who may carry it out on a class: user ids,
+// "role:<name>" or "*" for everyone. An operation that is not listed is open to everyone,
+// an empty list closes it to everyone but the server.
+type ClassPermissions map[string][]string
+
+// Allows reports whether any of the access keys (a user id, "*" and the user's roles) may
+// carry out op.
+func (p ClassPermissions) Allows(op string, access []interface{}) bool {
+	allowed, ok := p[op]
+	if !ok {
+		return true
+	}
+
+	for _, a := range allowed {
+		for _, key := range access {
+			if a == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Schema holds what we know about a class beyond its Go type, stored in _SCHEMA.
+type Schema struct {
+	ClassName       string             `json:"className" bson:"className"`
+	Permissions     ClassPermissions   `json:"classLevelPermissions" bson:"classLevelPermissions"`
+	ProtectedFields db.ProtectedFields `json:"protectedFields,omitempty" bson:"protectedFields,omitempty"`
+	db.BaseModel    `bson:",inline"`
+}
+
+func NewEmptySchema() *Schema {
+	return &Schema{BaseModel: db.BaseModel{CollectionName: CollectionSchema}}
+}
+
+func NewSchema(id string) *Schema {
+	return &Schema{BaseModel: db.BaseModel{
+		Id: id, CollectionName: CollectionSchema},
+	}
+}
+
+func (model *Schema) Fetch(ds db.DataStore) error {
+	return model.BaseModel.Fetch(model, ds)
+}
+
+func (model *Schema) Save(ds db.DataStore) error {
+	return model.BaseModel.Save(model, ds)
+}
+
+func (model *Schema) Delete(ds db.DataStore) error {
+	return model.BaseModel.Delete(model, ds)
+}
+
+func (model *Schema) Set(fieldName string, value interface{}) {
+	model.BaseModel.Set(model, fieldName, value)
+}
+
+func (model *Schema) Unset(fieldName string) {
+	model.BaseModel.Unset(model, fieldName)
+}
+
+func (model *Schema) Get(fieldName string) interface{} {
+	return model.BaseModel.Get(model, fieldName)
+}
+
+func (model *Schema) Increment(fieldName string, amount int) {
+	model.BaseModel.Increment(model, fieldName, amount)
+}
+
+func (model *Schema) Add(fieldName string, values ...interface{}) {
+	model.BaseModel.Add(model, fieldName, values...)
+}
+
+func (model *Schema) AddUnique(fieldName string, values ...interface{}) {
+	model.BaseModel.AddUnique(model, fieldName, values...)
+}
+
+func (model *Schema) Remove(fieldName string, values ...interface{}) {
+	model.BaseModel.Remove(model, fieldName, values...)
+}
+
+func (model *Schema) CustomUnmarshall() {
+	model.CollectionName = CollectionSchema
+}
+
+// Class Level Permissions
+
+// How long permissions loaded by CachedClassPermissions are used before being read again
+var ClassPermissionsTTL = time.Minute
+
+var classPermissionsCache struct {
+	sync.Mutex
+	permissions map[string]ClassPermissions
+	protected   map[string]db.ProtectedFields
+	loadedAt    time.Time
+}
+
+// FindClassPermissions loads the permissions of every class that has any, by class name.
+func FindClassPermissions(ds db.DataStore) (map[string]ClassPermissions, error) {
+	permissions, _, err := findSchemas(ds)
+	return permissions, err
+}
+
+// FindProtectedFields loads the protected fields of every class whose schema sets them,
+// by class name. Classes without them fall back to the ProtectedFields they registered.
+func FindProtectedFields(ds db.DataStore) (map[string]db.ProtectedFields, error) {
+	_, protected, err := findSchemas(ds)
+	return protected, err
+}
+
+func findSchemas(ds db.DataStore) (map[string]ClassPermissions, map[string]db.ProtectedFields, error) {
+	permissions := make(map[string]ClassPermissions)
+	protected := make(map[string]db.ProtectedFields)
+
+	err := ds.FindEach(CollectionSchema, bson.M{}, func(model db.Model) {
+		s := model.(*Schema)
+		if s.Permissions != nil {
+			permissions[s.ClassName] = s.Permissions
+		}
+		if s.ProtectedFields != nil {
+			protected[s.ClassName] = s.ProtectedFields
+		}
+	}, NewEmptySchema())
+
+	return permissions, protected, err
+}
+
+// cachedSchemas reads the schema collection at most once every ClassPermissionsTTL.
+func cachedSchemas(ds db.DataStore) (map[string]ClassPermissions, map[string]db.ProtectedFields, error) {
+	classPermissionsCache.Lock()
+	defer classPermissionsCache.Unlock()
+
+	if classPermissionsCache.permissions != nil && time.Since(classPermissionsCache.loadedAt) < ClassPermissionsTTL {
+		return classPermissionsCache.permissions, classPermissionsCache.protected, nil
+	}
+
+	permissions, protected, err := findSchemas(ds)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	classPermissionsCache.permissions = permissions
+	classPermissionsCache.protected = protected
+	classPermissionsCache.loadedAt = time.Now()
+	return permissions, protected, nil
+}
+
+// CachedClassPermissions is FindClassPermissions, reading the schema collection at most once
+// every ClassPermissionsTTL.
+func CachedClassPermissions(ds db.DataStore) (map[string]ClassPermissions, error) {
+	permissions, _, err := cachedSchemas(ds)
+	return permissions, err
+}
+
+// CachedProtectedFields is FindProtectedFields, cached like CachedClassPermissions.
+func CachedProtectedFields(ds db.DataStore) (map[string]db.ProtectedFields, error) {
+	_, protected, err := cachedSchemas(ds)
+	return protected, err
+}
+
+func clearSchemaCache() {
+	classPermissionsCache.Lock()
+	classPermissionsCache.permissions = nil
+	classPermissionsCache.protected = nil
+	classPermissionsCache.Unlock()
+}
+
+// SetClassPermissions replaces the permissions of a class. Passing nil opens the class to
+// everyone again.
+func SetClassPermissions(ds db.DataStore, className string, permissions ClassPermissions) error {
+	schema := NewEmptySchema()
+	schema.Set("ClassName", className)
+	schema.Set("Permissions", permissions)
+
+	if err := ds.UpsertObject(schema, bson.M{"className": className}); err != nil {
+		return err
+	}
+
+	clearSchemaCache()
+	return nil
+}
+
+// SetProtectedFields replaces the protected fields of a class. Passing nil falls back to
+// the fields the class registered.
+func SetProtectedFields(ds db.DataStore, className string, protected db.ProtectedFields) error {
+	schema := NewEmptySchema()
+	schema.Set("ClassName", className)
+	if protected == nil {
+		schema.Unset("ProtectedFields")
+	} else {
+		schema.Set("ProtectedFields", protected)
+	}
+
+	if err := ds.UpsertObject(schema, bson.M{"className": className}); err != nil {
+		return err
+	}
+
+	clearSchemaCache()
+	return nil
+}
@@ -28,6 +28,28 @@ const (
 	CollectionTask = "Task"
 )
 
+func init() {
+	db.RegisterClass(db.ClassInfo{
+		Name:       CollectionTask,
+		New:        func(id string) db.Model { return NewTask(id) },
+		SoftDelete: true,
+		Indexes: []db.Index{
+			{Key: []string{"taskClaimed", "taskType"}},
+		},
+		Includes: []db.IncludeInfo{
+			{
+				Name:  "user",
+				Class: CollectionUser,
+				Field: "_p_user",
+				Set:   func(owner db.Model, user db.Model) { owner.(*Task).User = user.(*User) },
+			},
+		},
+		DeleteRules: []db.DeleteRule{
+			{Field: "_p_user", Class: CollectionUser, OnDelete: db.DeleteCascade},
+		},
+	})
+}
+
 type Task struct {
 	Message      string        `json:"taskMessage" bson:"taskMessage"`
 	Status       string        `json:"taskStatus" bson:"taskStatus"`
@@ -100,6 +122,24 @@ func (task *Task) Increment(fieldName string, amount int) {
 	task.BaseModel.Increment(task, fieldName, amount)
 }
 
+func (task *Task) Add(fieldName string, values ...interface{}) {
+	task.BaseModel.Add(task, fieldName, values...)
+}
+
+func (task *Task) AddUnique(fieldName string, values ...interface{}) {
+	task.BaseModel.AddUnique(task, fieldName, values...)
+}
+
+func (task *Task) Remove(fieldName string, values ...interface{}) {
+	task.BaseModel.Remove(task, fieldName, values...)
+}
+
+// Workers claim tasks with atomic increments from many copies of the same task at once, so
+// tasks are not version checked.
+func (task *Task) UsesOptimisticLocking() bool {
+	return false
+}
+
 func (model *Task) CustomUnmarshall() {
 
 	if ptr := UnmarshallPointer(model.UserPtr); ptr != nil {
@@ -1,7 +1,11 @@
 package models
 
 import (
+	"reflect"
 	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
 )
 
 func TestIncrement(t *testing.T) {
@@ -28,3 +32,33 @@ func TestUnset(t *testing.T) {
 		t.Fatal("Unset did not work.")
 	}
 }
+
+func TestArrayChanges(t *testing.T) {
+	task0 := NewTask("abcd")
+	task0.Add("Parameters", "a", "b")
+	task0.Add("Parameters", "a")
+
+	if !reflect.DeepEqual(task0.Parameters, []interface{}{"a", "b", "a"}) {
+		t.Fatal("Expected:", []interface{}{"a", "b", "a"}, "Actual:", task0.Parameters)
+	}
+
+	expected := bson.M{"taskParameters": bson.M{"$each": []interface{}{"a", "b", "a"}}}
+	if changes := task0.Update(time.Now()); !reflect.DeepEqual(changes["$push"], expected) {
+		t.Fatal("Expected:", expected, "Actual:", changes["$push"])
+	}
+
+	record := NewEmailRecord("abcd")
+	record.Set("Category", []string{"transactional"})
+	record.AddUnique("Category", "welcome", "transactional")
+	record.Remove("Category", "transactional")
+
+	if !reflect.DeepEqual(record.Category, []string{"welcome"}) {
+		t.Fatal("Expected:", []string{"welcome"}, "Actual:", record.Category)
+	}
+
+	// Changing a field in more than one way sets it
+	changes := record.Update(time.Now())
+	if changes["$addToSet"] != nil || changes["$pull"] != nil || !reflect.DeepEqual(changes["$set"].(bson.M)["category"], []string{"welcome"}) {
+		t.Fatal("Expected: category set", "Actual:", changes)
+	}
+}
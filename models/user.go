@@ -25,16 +25,47 @@ const (
 	CollectionUser = "_User"
 )
 
+func init() {
+	db.RegisterClass(db.ClassInfo{
+		Name: CollectionUser,
+		New:  func(id string) db.Model { return NewUser(id) },
+		Indexes: []db.Index{
+			{Key: []string{"username"}, Unique: true, Sparse: true},
+			{Key: []string{"email"}, Unique: true, Sparse: true},
+			{Key: []string{"_auth_data_facebook.id"}, Unique: true, Sparse: true},
+			{Key: []string{db.TEXT_KEY + "email", db.TEXT_KEY + "name", db.TEXT_KEY + "username"}},
+		},
+		// Users are publicly readable, their personal details are only shown to themselves
+		ProtectedFields: db.ProtectedFields{
+			db.PUBLIC_KEY: {"email", "gender", "customFields"},
+		},
+		Includes: []db.IncludeInfo{
+			{
+				Name:           "roles",
+				Class:          CollectionRole,
+				JoinCollection: join_users_Role,
+				Set: func(owner db.Model, role db.Model) {
+					user := owner.(*User)
+					user.Roles = append(user.Roles, role.(*Role))
+				},
+			},
+		},
+	})
+}
+
 type User struct {
-	Email          string                 `json:"email,omitempty" bson:"email"`
-	Username       string                 `json:"username,omitempty" binding:"required" bson:"username"`
+	Email          string                 `json:"email,omitempty" bson:"email,omitempty"`
+	Username       string                 `json:"username,omitempty" binding:"required" bson:"username,omitempty"`
 	HashedPassword []byte                 `json:"-" binding:"required" bson:"_hashed_password"`
 	Name           string                 `json:"name,omitempty" bson:"name"`
 	FirstName      string                 `json:"firstName,omitempty" bson:"firstName"`
 	Gender         string                 `json:"gender,omitempty" bson:"gender"`
 	AuthData       map[string]interface{} `json:"-" bson:"_auth_data_facebook,omitempty"`
 	CustomFields   map[string]interface{} `json:"customFields" bson:"customFields,omitempty"`
-	db.BaseModel   `bson:",inline"`
+	Avatar         *File                  `json:"avatar,omitempty" bson:"avatar,omitempty"`
+	// Only filled when included, see db.Include
+	Roles        []*Role `json:"roles,omitempty" bson:"-"`
+	db.BaseModel `bson:",inline"`
 }
 
 func NewUser(id string) *User {
@@ -168,6 +199,18 @@ func (user *User) Increment(fieldName string, amount int) {
 	user.BaseModel.Increment(user, fieldName, amount)
 }
 
+func (user *User) Add(fieldName string, values ...interface{}) {
+	user.BaseModel.Add(user, fieldName, values...)
+}
+
+func (user *User) AddUnique(fieldName string, values ...interface{}) {
+	user.BaseModel.AddUnique(user, fieldName, values...)
+}
+
+func (user *User) Remove(fieldName string, values ...interface{}) {
+	user.BaseModel.Remove(user, fieldName, values...)
+}
+
 func (user *User) CustomUnmarshall() {
 	user.CollectionName = CollectionUser
 }
@@ -176,6 +219,16 @@ func (user *User) IsFacebook() bool {
 	return user.AuthData["id"] != nil
 }
 
+// NewUserACL is the ACL users get when they sign up: everyone may read the user, only the
+// user may change it.
+func NewUserACL(userId string) *db.ACL {
+	acl := db.NewACL()
+	acl.SetPublicRead()
+	acl.AddRead(userId)
+	acl.AddWrite(userId)
+	return acl
+}
+
 func (user *User) SetCustomField(key string, val interface{}) {
 	dst, _ := Map(user.CustomFields)
 
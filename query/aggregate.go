@@ -0,0 +1,241 @@
+package query
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/nidhik/backend/db"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var ERR_INVALID_GROUP = errors.New("Invalid group.")
+var ERR_INVALID_PROJECT = errors.New("Invalid project.")
+var ERR_INVALID_EXPRESSION = errors.New("Invalid aggregation expression.")
+
+// Aggregation is a Parse style aggregation. Its stages run in the order match, group,
+// project, sort and limit, any of which can be left out:
+//
+//	match   a where clause
+//	group   {"objectId": "$taskStatus", "count": {"$sum": 1}}
+//	project {"status": "$objectId", "count": 1}
+//	sort    an order, like "-count"
+//	limit   the number of results
+type Aggregation struct {
+	Match   map[string]interface{}
+	Group   map[string]interface{}
+	Project map[string]interface{}
+	Sort    string
+	Limit   int
+}
+
+// Accumulators group may compute
+var accumulators = map[string]bool{
+	"$sum":      true,
+	"$avg":      true,
+	"$min":      true,
+	"$max":      true,
+	"$first":    true,
+	"$last":     true,
+	"$push":     true,
+	"$addToSet": true,
+}
+
+// Operators group and project expressions may use
+var expressionOperators = map[string]bool{
+	"$dateToString": true,
+	"$year":         true,
+	"$month":        true,
+	"$dayOfMonth":   true,
+	"$hour":         true,
+	"$literal":      true,
+}
+
+// Pipeline translates the aggregation into a mongo pipeline for DataStore.Aggregate. Like
+// ParseWhere, field names are checked and aliased, so fields starting with an underscore
+// can't be read.
+func (a *Aggregation) Pipeline() ([]bson.M, error) {
+	var pipeline []bson.M
+
+	if a.Match != nil {
+		match, err := ParseWhere(a.Match)
+		if err != nil {
+			return nil, err
+		}
+		pipeline = append(pipeline, bson.M{db.StageMatch: match})
+	}
+
+	if a.Group != nil {
+		group, err := parseGroup(a.Group)
+		if err != nil {
+			return nil, err
+		}
+		pipeline = append(pipeline, bson.M{db.StageGroup: group})
+	}
+
+	if a.Project != nil {
+		project, err := parseProject(a.Project)
+		if err != nil {
+			return nil, err
+		}
+		pipeline = append(pipeline, bson.M{db.StageProject: project})
+	}
+
+	if len(a.Sort) > 0 {
+		order, err := ParseOrder(a.Sort)
+		if err != nil {
+			return nil, err
+		}
+
+		var keys bson.D
+		for _, field := range order {
+			if strings.HasPrefix(field, "-") {
+				keys = append(keys, bson.DocElem{Name: field[1:], Value: -1})
+			} else {
+				keys = append(keys, bson.DocElem{Name: field, Value: 1})
+			}
+		}
+		if len(keys) > 0 {
+			pipeline = append(pipeline, bson.M{db.StageSort: keys})
+		}
+	}
+
+	if a.Limit > 0 {
+		pipeline = append(pipeline, bson.M{db.StageLimit: a.Limit})
+	}
+
+	return pipeline, nil
+}
+
+func parseGroup(group map[string]interface{}) (bson.M, error) {
+	result := bson.M{}
+	for key, value := range group {
+		field, err := parseFieldName(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if field == "_id" {
+			if result["_id"], err = parseExpression(value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		acc, ok := value.(map[string]interface{})
+		if !ok || len(acc) != 1 || strings.Contains(field, ".") {
+			return nil, ERR_INVALID_GROUP
+		}
+
+		for op, arg := range acc {
+			if !accumulators[op] {
+				return nil, ERR_INVALID_GROUP
+			}
+
+			expr, err := parseExpression(arg)
+			if err != nil {
+				return nil, err
+			}
+			result[field] = bson.M{op: expr}
+		}
+	}
+
+	if _, ok := result["_id"]; !ok {
+		return nil, ERR_INVALID_GROUP
+	}
+	return result, nil
+}
+
+func parseProject(project map[string]interface{}) (bson.M, error) {
+	result := bson.M{}
+	for key, value := range project {
+		field, err := parseFieldName(key)
+		if err != nil {
+			return nil, err
+		}
+
+		switch v := value.(type) {
+		case bool:
+			result[field] = v
+		case float64:
+			if v != 0 && v != 1 {
+				return nil, ERR_INVALID_PROJECT
+			}
+			result[field] = int(v)
+		default:
+			if result[field], err = parseExpression(value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// parseExpression checks an aggregation expression: "$field" references, documents of
+// expressions, the operators above and literals.
+func parseExpression(expr interface{}) (interface{}, error) {
+	switch e := expr.(type) {
+	case nil, bool, float64:
+		return e, nil
+
+	case string:
+		if !strings.HasPrefix(e, "$") {
+			return e, nil
+		}
+		field, err := parseFieldName(e[1:])
+		if err != nil {
+			return nil, err
+		}
+		return "$" + field, nil
+
+	case map[string]interface{}:
+		if isOperatorMap(e) {
+			if len(e) != 1 {
+				return nil, ERR_INVALID_EXPRESSION
+			}
+			for op, arg := range e {
+				if !expressionOperators[op] {
+					return nil, ERR_INVALID_EXPRESSION
+				}
+				if op == "$literal" {
+					if _, ok := arg.(string); !ok {
+						return nil, ERR_INVALID_EXPRESSION
+					}
+					return bson.M{op: arg}, nil
+				}
+
+				parsed, err := parseExpression(arg)
+				if err != nil {
+					return nil, err
+				}
+				return bson.M{op: parsed}, nil
+			}
+		}
+
+		// A document of expressions, like the arguments of $dateToString
+		result := bson.M{}
+		for k, sub := range e {
+			if !validFieldName.MatchString(k) {
+				return nil, ERR_INVALID_FIELD_NAME
+			}
+			v, err := parseExpression(sub)
+			if err != nil {
+				return nil, err
+			}
+			result[k] = v
+		}
+		return result, nil
+
+	case []interface{}:
+		list := []interface{}{}
+		for _, sub := range e {
+			v, err := parseExpression(sub)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	}
+
+	return nil, ERR_INVALID_EXPRESSION
+}
@@ -0,0 +1,130 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func aggregateResults(t *testing.T, ds db.DataStore, collection string, a *Aggregation) []bson.M {
+	pipeline, err := a.Pipeline()
+	AssertNoError(t, "Could not parse aggregation:", err)
+
+	var results []bson.M
+	AssertNoError(t, "Could not aggregate:", ds.Aggregate(collection, pipeline, func(doc bson.M) {
+		results = append(results, doc)
+	}))
+	return results
+}
+
+func TestAggregation(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		me := models.NewEmptyUser()
+		me.Set("Email", "me@foo.com")
+		AssertNoError(t, errSetup, me.Save(ds))
+		other := models.NewEmptyUser()
+		AssertNoError(t, errSetup, other.Save(ds))
+
+		for i, status := range []string{"NEW", "NEW", "ERROR", "NEW"} {
+			task := models.NewTaskForUser(me, models.TaskTypeEmail, models.HandleEmail)
+			task.Set("Status", status)
+
+			// The last task is only readable by the other user
+			if i == 3 {
+				acl := db.NewACL()
+				acl.AddRead(other.ObjectId())
+				task.SetAccessControlList(acl)
+			}
+			AssertNoError(t, errSetup, task.Save(ds))
+		}
+
+		byStatus := &Aggregation{
+			Group: map[string]interface{}{"objectId": "$taskStatus", "count": map[string]interface{}{"$sum": 1.0}},
+			Sort:  "-count",
+		}
+
+		// The server counts every task
+		results := aggregateResults(t, ds, models.CollectionTask, byStatus)
+		expected := []bson.M{{"_id": "NEW", "count": 3.0}, {"_id": "ERROR", "count": 1.0}}
+		if !reflect.DeepEqual(results, expected) {
+			t.Fatal("Expected:", expected, "Actual:", results)
+		}
+
+		// Users only count the tasks they may read
+		ds.SetQueryBuilder(NewRestrictedQueryBuilder(me, nil))
+		byStatus.Match = map[string]interface{}{"taskStatus": "NEW"}
+		results = aggregateResults(t, ds, models.CollectionTask, byStatus)
+		expected = []bson.M{{"_id": "NEW", "count": 2.0}}
+		if !reflect.DeepEqual(results, expected) {
+			t.Fatal("Expected:", expected, "Actual:", results)
+		}
+
+		denied := []bson.M{
+			// Whole documents, with their ACLs
+			{"$match": bson.M{}},
+			// Internal and protected fields
+			{"$group": bson.M{"_id": "$_hashed_password"}},
+			{"$group": bson.M{"_id": "$email"}},
+			{"$project": bson.M{"email": 1}},
+			// Exclusions, which return the rest of the documents
+			{"$project": bson.M{"nothing": 0}},
+			{"$project": bson.M{"_id": false}},
+			{"$project": bson.M{"_id": 0, "nothing": 0.0}},
+		}
+		for _, stage := range denied {
+			err := ds.Aggregate(models.CollectionUser, []bson.M{stage}, func(bson.M) {})
+			if err != ERR_ACCESS_DENIED {
+				t.Fatal("Stage:", stage, "Expected:", ERR_ACCESS_DENIED, "Actual:", err)
+			}
+		}
+
+		// Class level permissions apply as they do to finds
+		qb := NewRestrictedQueryBuilder(me, nil)
+		qb.SetClassPermissions(map[string]models.ClassPermissions{models.CollectionTask: {models.OperationFind: {}}})
+		ds.SetQueryBuilder(qb)
+		if err := ds.Aggregate(models.CollectionTask, []bson.M{{"$project": bson.M{"taskStatus": 1}}}, func(bson.M) {}); err != ERR_ACCESS_DENIED {
+			t.Fatal("Expected:", ERR_ACCESS_DENIED, "Actual:", err)
+		}
+	})
+}
+
+func TestAggregationPipeline(t *testing.T) {
+	a := &Aggregation{
+		Match:   map[string]interface{}{"taskStatus": "NEW"},
+		Group:   map[string]interface{}{"objectId": map[string]interface{}{"$dateToString": map[string]interface{}{"format": "%Y-%m-%d", "date": "$createdAt"}}, "count": map[string]interface{}{"$sum": 1.0}},
+		Project: map[string]interface{}{"day": "$objectId", "count": 1.0},
+		Sort:    "day",
+		Limit:   10,
+	}
+
+	pipeline, err := a.Pipeline()
+	AssertNoError(t, "Could not parse aggregation:", err)
+
+	expected := []bson.M{
+		{"$match": bson.M{"taskStatus": "NEW"}},
+		{"$group": bson.M{"_id": bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$_created_at"}}, "count": bson.M{"$sum": 1.0}}},
+		{"$project": bson.M{"day": "$_id", "count": 1}},
+		{"$sort": bson.D{{Name: "day", Value: 1}}},
+		{"$limit": 10},
+	}
+	if !reflect.DeepEqual(pipeline, expected) {
+		t.Fatal("Expected:", expected, "Actual:", pipeline)
+	}
+
+	invalid := []*Aggregation{
+		{Group: map[string]interface{}{"count": map[string]interface{}{"$sum": 1.0}}},
+		{Group: map[string]interface{}{"objectId": "$_hashed_password"}},
+		{Group: map[string]interface{}{"objectId": nil, "all": map[string]interface{}{"$function": "x"}}},
+		{Project: map[string]interface{}{"name": map[string]interface{}{"$where": "true"}}},
+		{Project: map[string]interface{}{"name": 2.0}},
+	}
+	for _, a := range invalid {
+		if _, err := a.Pipeline(); err == nil {
+			t.Fatal("Expected: an error", "Actual:", a)
+		}
+	}
+}
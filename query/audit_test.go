@@ -0,0 +1,126 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func findAudits(t *testing.T, ds db.DataStore, q bson.M) []*models.Audit {
+	var audits []*models.Audit
+	err := ds.FindEach(models.CollectionAudit, q, func(m db.Model) {
+		audits = append(audits, m.(*models.Audit))
+	}, models.NewEmptyAudit())
+	AssertNoError(t, "Could not find audit records:", err)
+	return audits
+}
+
+func TestAuditedDataStore(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		audited := models.NewAuditedDataStore(ds, ds, func() string { return "admin" })
+
+		user, err := models.NewUserFromEmail("audit@foo.com", "audit", "password", "")
+		AssertNoError(t, errSetup, err)
+		AssertNoError(t, "Could not save user:", user.Save(audited))
+
+		audits := findAudits(t, ds, bson.M{"className": models.CollectionUser})
+		if len(audits) != 1 || audits[0].Operation != models.AuditInsert || audits[0].Actor != "admin" || audits[0].Target != user.ObjectId() {
+			t.Fatal("Expected: an insert by admin", "Actual:", audits)
+		}
+		if audits[0].SetFields["email"] != "audit@foo.com" || audits[0].SetFields["_hashed_password"] != "(redacted)" {
+			t.Fatal("Expected: email recorded and password redacted", "Actual:", audits[0].SetFields)
+		}
+
+		// Updates record the changes they write
+		role := models.NewEmptyRole()
+		role.Set("Name", "audited")
+		AssertNoError(t, "Could not save role:", role.Save(audited))
+
+		acl := db.NewACL()
+		acl.AddWrite(user.ObjectId())
+		role.SetAccessControlList(acl)
+		role.Unset("Name")
+		AssertNoError(t, "Could not update role:", role.Save(audited))
+
+		role.Users.Add(user)
+		AssertNoError(t, "Could not add user to role:", audited.SaveRelatedObjects(role.Users))
+
+		q := bson.M{"className": models.CollectionRole, "objectId": role.ObjectId()}
+		if n, _ := ds.Count(models.CollectionAudit, q); n != 3 {
+			t.Fatal("Expected: 3 records", "Actual:", n)
+		}
+
+		q["operation"] = models.AuditUpdate
+		audits = findAudits(t, ds, q)
+		if _, ok := audits[0].SetFields["_acl"]; !ok || !reflect.DeepEqual(audits[0].UnsetFields, []string{"name"}) {
+			t.Fatal("Expected: an update of _acl, unsetting name", "Actual:", audits[0])
+		}
+
+		q["operation"] = models.AuditRelation
+		audits = findAudits(t, ds, q)
+		if !reflect.DeepEqual(audits[0].Added, []string{user.ObjectId()}) {
+			t.Fatal("Expected: user added to the role", "Actual:", audits[0])
+		}
+
+		// RemoveAll records every object it removes
+		for i := 0; i < 2; i++ {
+			task := models.NewTaskForUser(user, models.TaskTypeEmail, models.HandleEmail)
+			AssertNoError(t, errSetup, task.Save(ds))
+		}
+
+		AssertNoError(t, "Could not remove tasks:", audited.RemoveAll(models.CollectionTask, bson.M{"_p_user": models.PointerString(user)}))
+		audits = findAudits(t, ds, bson.M{"className": models.CollectionTask, "operation": models.AuditRemove})
+		if len(audits) != 2 {
+			t.Fatal("Expected: 2 removals", "Actual:", audits)
+		}
+
+		// Failed writes are not recorded
+		if err := models.NewTask("missing").Delete(audited); err == nil {
+			t.Fatal("Expected: an error", "Actual:", err)
+		}
+		if n, _ := ds.Count(models.CollectionAudit, bson.M{"objectId": "missing"}); n != 0 {
+			t.Fatal("Expected: 0", "Actual:", n)
+		}
+
+		// Only the server may read the audit log
+		ds.SetQueryBuilder(NewRestrictedQueryBuilder(user, nil))
+		if _, err := ds.Count(models.CollectionAudit, bson.M{}); err != ERR_ACCESS_DENIED {
+			t.Fatal("Expected:", ERR_ACCESS_DENIED, "Actual:", err)
+		}
+	})
+}
+
+// Removals are recorded for the objects removed, whether or not the requester may read them
+func TestAuditedRemoveAll(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		user := models.NewEmptyUser()
+		AssertNoError(t, errSetup, user.Save(ds))
+
+		writable := models.NewTaskForUser(user, models.TaskTypeEmail, models.HandleEmail)
+		acl := db.NewACL()
+		acl.AddRead("someoneElse")
+		acl.AddWrite(user.ObjectId())
+		writable.SetAccessControlList(acl)
+		AssertNoError(t, errSetup, writable.Save(ds))
+
+		kept := models.NewTaskForUser(user, models.TaskTypeEmail, models.HandleEmail)
+		kept.SetAccessControlList(models.NewUserACL("someoneElse"))
+		AssertNoError(t, errSetup, kept.Save(ds))
+
+		requester := db.GetDataStore(NewRestrictedQueryBuilder(user, nil))
+		defer requester.Close()
+		audited := models.NewAuditedDataStore(requester, ds, func() string { return user.ObjectId() })
+
+		AssertNoError(t, "Could not remove tasks:", audited.RemoveAll(models.CollectionTask, bson.M{"_p_user": models.PointerString(user)}))
+
+		audits := findAudits(t, ds, bson.M{"className": models.CollectionTask, "operation": models.AuditRemove})
+		if len(audits) != 1 || audits[0].Target != writable.ObjectId() {
+			t.Fatal("Expected: the removal of", writable.ObjectId(), "Actual:", audits)
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestClassPermissions(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		me := models.NewEmptyUser()
+		AssertNoError(t, errSetup, me.Save(ds))
+		other := models.NewEmptyUser()
+		AssertNoError(t, errSetup, other.Save(ds))
+
+		AssertNoError(t, errSetup, models.SetClassPermissions(ds, models.CollectionUser, models.ClassPermissions{
+			models.OperationFind:     {},
+			models.OperationCount:    {},
+			models.OperationAddField: {"role:admin"},
+		}))
+		AssertNoError(t, errSetup, models.SetClassPermissions(ds, models.CollectionEmailMetadata, models.ClassPermissions{
+			models.OperationCreate: {"role:admin"},
+		}))
+
+		permissions, err := models.FindClassPermissions(ds)
+		AssertNoError(t, "Could not load class permissions:", err)
+		if len(permissions) != 2 {
+			t.Fatal("Expected: permissions for 2 classes", "Actual:", permissions)
+		}
+
+		qb := NewRestrictedQueryBuilder(me, nil)
+		qb.SetClassPermissions(permissions)
+		ds.SetQueryBuilder(qb)
+
+		// Nobody may list users, but a user can still be fetched
+		if _, err := ds.Count(models.CollectionUser, bson.M{}); err != ERR_ACCESS_DENIED {
+			t.Fatal("Expected:", ERR_ACCESS_DENIED, "Actual:", err)
+		}
+		if err := ds.FindEach(models.CollectionUser, bson.M{}, func(db.Model) {}, models.NewEmptyUser()); err != ERR_ACCESS_DENIED {
+			t.Fatal("Expected:", ERR_ACCESS_DENIED, "Actual:", err)
+		}
+		AssertNoError(t, "Could not fetch user:", models.NewUser(other.ObjectId()).Fetch(ds))
+
+		// Declared fields can be changed, custom fields need addField
+		self := models.NewUser(me.ObjectId())
+		AssertNoError(t, "Could not fetch user:", self.Fetch(ds))
+		self.Set("Email", "me@foo.com")
+		AssertNoError(t, "Could not update user:", self.Save(ds))
+
+		self.SetCustomField("tier", "pro")
+		if err := self.Save(ds); err != ERR_ACCESS_DENIED {
+			t.Fatal("Expected:", ERR_ACCESS_DENIED, "Actual:", err)
+		}
+
+		// Only admins create email metadata
+		metadata := models.NewEmailMetadataFromTemplate("template", "welcome", "Hi", nil, true)
+		if err := metadata.Save(ds); err != ERR_ACCESS_DENIED {
+			t.Fatal("Expected:", ERR_ACCESS_DENIED, "Actual:", err)
+		}
+
+		admin := NewRestrictedQueryBuilder(me, []*models.Role{models.NewRoleWithName("1", "admin")})
+		admin.SetClassPermissions(permissions)
+		ds.SetQueryBuilder(admin)
+		AssertNoError(t, "Could not create email metadata:", metadata.Save(ds))
+
+		// The schema itself is off limits to everyone but the server
+		if _, err := models.FindClassPermissions(ds); err != ERR_ACCESS_DENIED {
+			t.Fatal("Expected:", ERR_ACCESS_DENIED, "Actual:", err)
+		}
+	})
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/nidhik/backend/db"
 	"github.com/nidhik/backend/models"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -71,3 +72,80 @@ func TestIsNew(t *testing.T) {
 
 	})
 }
+
+func TestOptimisticLocking(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		u1 := models.NewEmptyUser()
+		AssertNoError(t, errSetup, u1.Save(ds))
+
+		if u1.ObjectVersion() != 1 {
+			t.Fatal("Expected: 1", "Actual:", u1.ObjectVersion())
+		}
+
+		u2 := models.NewUser(u1.ObjectId())
+		AssertNoError(t, errSetup, u2.Fetch(ds))
+
+		u1.Set("Email", "first@foo.com")
+		AssertNoError(t, "Could not update user:", u1.Save(ds))
+
+		if u1.ObjectVersion() != 2 {
+			t.Fatal("Expected: 2", "Actual:", u1.ObjectVersion())
+		}
+
+		u2.Set("Email", "second@foo.com")
+		if err := u2.Save(ds); err != db.ERR_VERSION_CONFLICT {
+			t.Fatal("Expected:", db.ERR_VERSION_CONFLICT, "Actual:", err)
+		}
+
+		u3 := models.NewUser(u1.ObjectId())
+		AssertNoError(t, "Could not fetch user:", u3.Fetch(ds))
+		if u3.Email != "first@foo.com" {
+			t.Fatal("Expected: first@foo.com", "Actual:", u3.Email)
+		}
+
+		// Objects that were never there are not found rather than conflicting
+		missing := models.NewUser("doesnotexist")
+		missing.Set("Email", "nobody@foo.com")
+		if err := missing.Save(ds); err == db.ERR_VERSION_CONFLICT || err == nil {
+			t.Fatal("Expected: not found", "Actual:", err)
+		}
+
+		// Tasks opt out, so stale copies still update
+		task := models.NewEmptyTask()
+		AssertNoError(t, errSetup, task.Save(ds))
+		stale := models.NewTask(task.ObjectId())
+		task.Set("Status", "DONE")
+		AssertNoError(t, "Could not update task:", task.Save(ds))
+		stale.Set("Status", "ERROR")
+		AssertNoError(t, "Could not update stale task:", stale.Save(ds))
+	})
+}
+
+func TestUniqueIndexes(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		u1 := models.NewEmptyUser()
+		u1.Set("Email", "same@baz.com")
+		AssertNoError(t, "Could not save user:", u1.Save(ds))
+
+		// Users without an email or username don't clash
+		AssertNoError(t, "Could not save user:", models.NewEmptyUser().Save(ds))
+		AssertNoError(t, "Could not save user:", models.NewEmptyUser().Save(ds))
+
+		u2 := models.NewEmptyUser()
+		u2.Set("Email", "same@baz.com")
+		if err := u2.Save(ds); !mgo.IsDup(err) {
+			t.Fatal("Expected: duplicate key error", "Actual:", err)
+		}
+
+		u3 := models.NewEmptyUser()
+		u3.Set("Email", "other@baz.com")
+		AssertNoError(t, "Could not save user:", u3.Save(ds))
+
+		u3.Set("Email", "same@baz.com")
+		if err := u3.Save(ds); !mgo.IsDup(err) {
+			t.Fatal("Expected: duplicate key error", "Actual:", err)
+		}
+	})
+}
@@ -0,0 +1,181 @@
+package query
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// setupReferences saves a user with a task, an email record and a role
+func setupReferences(t *testing.T, ds db.DataStore, email string) (*models.User, *models.Role) {
+	user, err := models.NewUserFromEmail(email, email, "password", "")
+	AssertNoError(t, errSetup, err)
+	AssertNoError(t, errSetup, user.Save(ds))
+
+	AssertNoError(t, errSetup, models.NewTaskForUser(user, models.TaskTypeEmail, models.HandleEmail).Save(ds))
+	AssertNoError(t, errSetup, models.NewEmailRecordForUser(user, "welcome", "template", "Welcome", nil).Save(ds))
+
+	role := models.NewEmptyRole()
+	role.Set("Name", "references "+email)
+	AssertNoError(t, errSetup, role.Save(ds))
+	role.Users.Add(user)
+	AssertNoError(t, errSetup, ds.SaveRelatedObjects(role.Users))
+	return user, role
+}
+
+func assertReferences(t *testing.T, ds db.DataStore, user *models.User, role *models.Role, expected int) {
+	counts := map[string]bson.M{
+		models.CollectionTask:        {"_p_user": models.CollectionUser + "$" + user.ObjectId()},
+		models.CollectionEmailRecord: {"to": user.Email},
+	}
+	for className, q := range counts {
+		if n, err := ds.Count(className, q); err != nil || n != expected {
+			t.Fatal("Expected:", expected, className, "Actual:", n, err)
+		}
+	}
+
+	n := 0
+	AssertNoError(t, "Could not find joins:", ds.FindJoins(role.Users.JoinCollection(), bson.M{"owningId": role.ObjectId()}, func(j db.Join) { n++ }))
+	if n != expected {
+		t.Fatal("Expected:", expected, "users in role", "Actual:", n)
+	}
+}
+
+func TestDeleteRules(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		rules := models.NewAuditedDataStore(ds, ds, func() string { return "admin" })
+		referential := db.NewReferentialDataStore(ds, rules)
+
+		// Deleting a user deletes its tasks and email records, and takes it out of its roles
+		user, role := setupReferences(t, ds, "cascade@foo.com")
+		assertReferences(t, ds, user, role, 1)
+		AssertNoError(t, "Could not remove user:", referential.RemoveObject(user))
+		assertReferences(t, ds, user, role, 0)
+
+		// What the rules write is recorded
+		for _, operation := range []string{models.AuditRemove, models.AuditRelation} {
+			if n, _ := ds.Count(models.CollectionAudit, bson.M{"operation": operation, "actor": "admin"}); n == 0 {
+				t.Fatal("Expected:", operation, "records", "Actual:", n)
+			}
+		}
+
+		// Restrict refuses the delete before anything is changed
+		info, _ := db.LookupClass(models.CollectionTask)
+		taskRules := info.DeleteRules
+		info.DeleteRules = []db.DeleteRule{{Field: "_p_user", Class: models.CollectionUser, OnDelete: db.DeleteRestrict}}
+		defer func() { info.DeleteRules = taskRules }()
+
+		user, role = setupReferences(t, ds, "restrict@foo.com")
+		if err := referential.RemoveObject(user); err != db.ERR_DELETE_RESTRICTED {
+			t.Fatal("Expected:", db.ERR_DELETE_RESTRICTED, "Actual:", err)
+		}
+		if n, _ := ds.Count(models.CollectionUser, bson.M{"_id": user.ObjectId()}); n != 1 {
+			t.Fatal("Expected: user kept", "Actual:", n)
+		}
+		assertReferences(t, ds, user, role, 1)
+	})
+}
+
+// failingRemoves fails to remove objects of a class, after the writes before it were made
+type failingRemoves struct {
+	db.DataStore
+	className string
+}
+
+func (f *failingRemoves) RemoveObject(model db.Model) error {
+	if model.Collection() == f.className {
+		return errors.New("Could not remove " + f.className)
+	}
+	return f.DataStore.RemoveObject(model)
+}
+
+var errFetch = errors.New("Could not fetch")
+
+// failingFetches can't read anything, as when the database is unreachable
+type failingFetches struct {
+	db.DataStore
+}
+
+func (f *failingFetches) Fetch(model db.Model) error {
+	return errFetch
+}
+
+func TestDeleteRulesRollback(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		// The user is taken out of its roles before its tasks fail to be deleted
+		referential := db.NewReferentialDataStore(ds, &failingRemoves{ds, models.CollectionTask})
+
+		user, role := setupReferences(t, ds, "rollback@foo.com")
+		err := referential.RemoveObject(user)
+		if _, ok := err.(*db.CommitError); !ok {
+			t.Fatal("Expected: a commit error, as users can't be restored", "Actual:", err)
+		}
+
+		// Everything written for the rules is undone
+		assertReferences(t, ds, user, role, 1)
+
+		// Objects the rules can't be applied for aren't deleted
+		user, role = setupReferences(t, ds, "unreachable@foo.com")
+		referential = db.NewReferentialDataStore(ds, &failingFetches{ds})
+		if err := referential.RemoveObject(user); err != errFetch {
+			t.Fatal("Expected:", errFetch, "Actual:", err)
+		}
+		if n, err := ds.Count(models.CollectionUser, bson.M{"_id": user.ObjectId()}); err != nil || n != 1 {
+			t.Fatal("Expected: the user kept", "Actual:", n, err)
+		}
+		assertReferences(t, ds, user, role, 1)
+	})
+}
+
+func TestScanOrphans(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		user, _ := setupReferences(t, ds, "orphans@foo.com")
+		AssertNoError(t, "Could not remove user:", ds.RemoveObject(user))
+
+		orphans, err := db.ScanOrphans(ds, false)
+		AssertNoError(t, "Could not scan for orphans:", err)
+
+		// Email records are addressed to the user's email rather than by pointer
+		pointer := models.CollectionUser + "$" + user.ObjectId()
+		expected := map[string]string{
+			models.CollectionTask + "._p_user":   pointer,
+			models.CollectionRole + ".users":     pointer,
+			models.CollectionEmailRecord + ".to": models.CollectionUser + ".email=orphans@foo.com",
+		}
+		if len(orphans) != len(expected) {
+			t.Fatal("Expected:", expected, "Actual:", orphans)
+		}
+		for _, o := range orphans {
+			if o.Fixed || o.OwnerMissing || expected[o.ClassName+"."+o.Key] != o.Target {
+				t.Fatal("Expected: orphans of the user, unfixed", "Actual:", o)
+			}
+		}
+
+		orphans, err = db.ScanOrphans(ds, true)
+		AssertNoError(t, "Could not fix orphans:", err)
+		for _, o := range orphans {
+			if !o.Fixed {
+				t.Fatal("Expected: fixed", "Actual:", o)
+			}
+		}
+
+		if n, _ := ds.Count(models.CollectionTask, bson.M{"_p_user": pointer}); n != 0 {
+			t.Fatal("Expected: task deleted", "Actual:", n)
+		}
+		if n, _ := ds.Count(models.CollectionEmailRecord, bson.M{"to": "orphans@foo.com"}); n != 0 {
+			t.Fatal("Expected: email record deleted", "Actual:", n)
+		}
+
+		orphans, err = db.ScanOrphans(ds, false)
+		AssertNoError(t, "Could not scan for orphans:", err)
+		if len(orphans) != 0 {
+			t.Fatal("Expected: no orphans", "Actual:", orphans)
+		}
+	})
+}
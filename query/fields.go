@@ -0,0 +1,230 @@
+package query
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/nidhik/backend/db"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// bsonName parses the bson tag of a struct field. Skipped fields have no name.
+func bsonName(f reflect.StructField) (name string, inline bool) {
+	tag := f.Tag.Get("bson")
+	if tag == "-" {
+		return "", false
+	}
+
+	parts := strings.Split(tag, ",")
+	for _, p := range parts[1:] {
+		inline = inline || p == "inline"
+	}
+
+	name = parts[0]
+	if len(name) == 0 {
+		name = strings.ToLower(f.Name)
+	}
+	return name, inline && f.Type.Kind() == reflect.Struct
+}
+
+// bsonFields collects the bson keys of a struct type, including inlined structs.
+func bsonFields(t reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, inline := bsonName(f)
+
+		if inline {
+			bsonFields(f.Type, fields)
+			continue
+		}
+
+		if len(name) > 0 {
+			fields[name] = f.Type
+		}
+	}
+}
+
+// clearFields zeroes the fields of model stored under the given bson keys.
+func clearFields(model db.Model, keys []string) {
+	v := reflect.ValueOf(model)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+
+	clear := make(map[string]bool)
+	for _, k := range keys {
+		clear[k] = true
+	}
+	clearStructFields(v, clear)
+}
+
+func clearStructFields(v reflect.Value, keys map[string]bool) {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		name, inline := bsonName(f)
+
+		if inline {
+			clearStructFields(v.Field(i), keys)
+			continue
+		}
+
+		if keys[name] && v.Field(i).CanSet() {
+			v.Field(i).Set(reflect.Zero(f.Type))
+		}
+	}
+}
+
+// queriedFields lists the top level fields a query constrains, including inside $and, $or
+// and $nor.
+func queriedFields(query map[string]interface{}) []string {
+	var fields []string
+	for key, value := range query {
+		switch key {
+		case "$and", "$or", "$nor":
+			for _, clause := range appendClauses(value) {
+				fields = append(fields, queriedFields(clause)...)
+			}
+		default:
+			if !strings.HasPrefix(key, "$") {
+				fields = append(fields, strings.SplitN(key, ".", 2)[0])
+			}
+		}
+	}
+	return fields
+}
+
+// pipelineFields lists the top level fields an aggregation pipeline reads: the fields its
+// stages match, sort on, include or refer to as "$field".
+func pipelineFields(pipeline []bson.M) []string {
+	var fields []string
+	for _, stage := range pipeline {
+		for name, arg := range stage {
+			switch name {
+			case db.StageMatch:
+				if q, ok := arg.(bson.M); ok {
+					fields = append(fields, queriedFields(q)...)
+				} else if q, ok := arg.(map[string]interface{}); ok {
+					fields = append(fields, queriedFields(q)...)
+				}
+			case db.StageSort:
+				if keys, ok := arg.(bson.D); ok {
+					for _, key := range keys {
+						fields = append(fields, topField(key.Name))
+					}
+				} else if keys, ok := arg.(bson.M); ok {
+					for key := range keys {
+						fields = append(fields, topField(key))
+					}
+				}
+			case db.StageProject:
+				if spec, ok := arg.(bson.M); ok {
+					for key := range spec {
+						fields = append(fields, topField(key))
+					}
+				}
+				fields = append(fields, referencedFields(arg)...)
+			default:
+				fields = append(fields, referencedFields(arg)...)
+			}
+		}
+	}
+	return fields
+}
+
+// referencedFields lists the top level fields an aggregation expression refers to.
+func referencedFields(expr interface{}) []string {
+	var fields []string
+	switch e := expr.(type) {
+	case string:
+		if strings.HasPrefix(e, "$") {
+			fields = append(fields, topField(e[1:]))
+		}
+	case bson.M:
+		for _, sub := range e {
+			fields = append(fields, referencedFields(sub)...)
+		}
+	case map[string]interface{}:
+		for _, sub := range e {
+			fields = append(fields, referencedFields(sub)...)
+		}
+	case []interface{}:
+		for _, sub := range e {
+			fields = append(fields, referencedFields(sub)...)
+		}
+	}
+	return fields
+}
+
+func topField(key string) string {
+	return strings.SplitN(key, ".", 2)[0]
+}
+
+func modelFields(model db.Model) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	t := reflect.TypeOf(model)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Struct {
+		bsonFields(t, fields)
+	}
+	return fields
+}
+
+// addsField reports whether writing key can add a field the model's class does not
+// declare. Internal fields, starting with an underscore, never do.
+func addsField(model db.Model, key string) bool {
+	if strings.HasPrefix(key, "_") {
+		return false
+	}
+
+	top := strings.SplitN(key, ".", 2)[0]
+	t, ok := modelFields(model)[top]
+	if !ok {
+		return true
+	}
+	return t.Kind() == reflect.Map
+}
+
+// updatedKeys lists the keys an update document sets or increments.
+func updatedKeys(update interface{}) []string {
+	doc, ok := update.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	var keys []string
+	for op, fields := range doc {
+		if op == "$unset" {
+			continue
+		}
+		if m, ok := fields.(bson.M); ok {
+			for key := range m {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// setMapFields lists the map fields of a model that hold any keys.
+func setMapFields(model db.Model) []string {
+	doc, err := db.ToDocument(model)
+	if err != nil {
+		return nil
+	}
+
+	var keys []string
+	for key, t := range modelFields(model) {
+		if t.Kind() != reflect.Map {
+			continue
+		}
+		if m, ok := doc[key].(bson.M); ok && len(m) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
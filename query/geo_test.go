@@ -0,0 +1,100 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+)
+
+func init() {
+	// Proximity queries need a 2dsphere index in mongo
+	db.RegisterClass(db.ClassInfo{
+		Name: TestCollection,
+		New:  func(id string) db.Model { return NewTestModel(id) },
+		Indexes: []db.Index{
+			{Key: []string{db.GEO_KEY + "location"}},
+		},
+	})
+}
+
+func geoPoint(latitude float64, longitude float64) map[string]interface{} {
+	return map[string]interface{}{"__type": "GeoPoint", "latitude": latitude, "longitude": longitude}
+}
+
+// findNear returns the names of the places matching where.
+func findNear(t *testing.T, ds db.DataStore, where map[string]interface{}) []string {
+	q, err := ParseWhere(where)
+	AssertNoError(t, "Could not parse where:", err)
+
+	var names []string
+	err = ds.FindEach(TestCollection, q, func(m db.Model) {
+		names = append(names, m.(*TestModel).TestField)
+	}, EmptyTestModel())
+	AssertNoError(t, "Could not find:", err)
+	return names
+}
+
+func TestGeoQueries(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		var newark *TestModel
+		for _, place := range []struct {
+			name     string
+			lat, lng float64
+		}{
+			{"philadelphia", 39.9526, -75.1652},
+			{"newark", 40.7357, -74.1724},
+			{"brooklyn", 40.6782, -73.9442},
+		} {
+			m := NewTestModel("")
+			m.TestField = place.name
+			point, err := models.NewGeoPoint(place.lat, place.lng)
+			AssertNoError(t, errSetup, err)
+			m.Location = point
+			AssertNoError(t, errSetup, m.Save(ds))
+
+			if place.name == "newark" {
+				newark = m
+			}
+		}
+
+		nowhere := NewTestModel("")
+		nowhere.TestField = "nowhere"
+		AssertNoError(t, errSetup, nowhere.Save(ds))
+
+		// Closest first
+		ids := findNear(t, ds, map[string]interface{}{"location": map[string]interface{}{"$nearSphere": geoPoint(40.7128, -74.0060)}})
+		if len(ids) != 3 || ids[0] != "brooklyn" || ids[1] != "newark" || ids[2] != "philadelphia" {
+			t.Fatal("Expected: brooklyn, newark, philadelphia", "Actual:", ids)
+		}
+
+		ids = findNear(t, ds, map[string]interface{}{"location": map[string]interface{}{
+			"$nearSphere":         geoPoint(40.7128, -74.0060),
+			"$maxDistanceInMiles": 20.0,
+		}})
+		if len(ids) != 2 || ids[0] != "brooklyn" {
+			t.Fatal("Expected: brooklyn, newark", "Actual:", ids)
+		}
+
+		ids = findNear(t, ds, map[string]interface{}{"location": map[string]interface{}{
+			"$within": map[string]interface{}{"$box": []interface{}{geoPoint(40.5, -74.5), geoPoint(41, -74)}},
+		}})
+		if len(ids) != 1 || ids[0] != "newark" {
+			t.Fatal("Expected: newark", "Actual:", ids)
+		}
+
+		ids = findNear(t, ds, map[string]interface{}{"location": map[string]interface{}{
+			"$geoWithin": map[string]interface{}{"$polygon": []interface{}{geoPoint(39, -76), geoPoint(41, -76), geoPoint(41, -74.1), geoPoint(39.5, -74.1)}},
+		}})
+		if len(ids) != 2 {
+			t.Fatal("Expected: philadelphia and newark", "Actual:", ids)
+		}
+
+		found := EmptyTestModel()
+		AssertNoError(t, "Could not fetch:", ds.FindObject(TestCollection, map[string]interface{}{"_id": newark.ObjectId()}, found))
+		if found.Location == nil || found.Location.Latitude != 40.7357 || found.Location.Longitude != -74.1724 {
+			t.Fatal("Expected:", 40.7357, -74.1724, "Actual:", found.Location)
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+)
+
+// countingDataStore counts the queries made through FindEach
+type countingDataStore struct {
+	db.DataStore
+	finds map[string]int
+}
+
+func (c *countingDataStore) FindEach(collectionName string, query map[string]interface{}, f func(db.Model), result db.Model, sortFields ...string) error {
+	c.finds[collectionName]++
+	return c.DataStore.FindEach(collectionName, query, f, result, sortFields...)
+}
+
+func TestInclude(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		var users []*models.User
+		for _, name := range []string{"reader", "private"} {
+			user := models.NewEmptyUser()
+			user.Set("Username", name)
+			AssertNoError(t, errSetup, user.Save(ds))
+			users = append(users, user)
+		}
+		reader, private := users[0], users[1]
+
+		acl := db.NewACL()
+		acl.AddRead(private.ObjectId())
+		private.SetAccessControlList(acl)
+		AssertNoError(t, errSetup, private.Save(ds))
+
+		for _, name := range []string{"pro", "beta"} {
+			role := models.NewEmptyRole()
+			role.Set("Name", name)
+			AssertNoError(t, errSetup, role.Save(ds))
+			role.Users.Add(reader)
+			AssertNoError(t, errSetup, ds.SaveRelatedObjects(role.Users))
+		}
+
+		var tasks []db.Model
+		for _, user := range []*models.User{reader, reader, private} {
+			task := models.NewTaskForUser(user, models.TaskTypeEmail, models.HandleEmail)
+			AssertNoError(t, errSetup, task.Save(ds))
+			tasks = append(tasks, models.NewTask(task.ObjectId()))
+		}
+		for _, task := range tasks {
+			AssertNoError(t, "Could not fetch task:", task.Fetch(ds))
+		}
+
+		ds.SetQueryBuilder(NewRestrictedQueryBuilder(reader, nil))
+		counting := &countingDataStore{DataStore: ds, finds: make(map[string]int)}
+		AssertNoError(t, "Could not include users:", db.Include(counting, tasks, "user.roles"))
+
+		// One query per class, however many objects point to them
+		if counting.finds[models.CollectionUser] != 1 || counting.finds[models.CollectionRole] != 1 {
+			t.Fatal("Expected: one query for users and one for roles", "Actual:", counting.finds)
+		}
+
+		first, second := tasks[0].(*models.Task), tasks[1].(*models.Task)
+		if first.User.Username != "reader" || first.User != second.User || len(first.User.Roles) != 2 {
+			t.Fatal("Expected: the same reader with 2 roles on both tasks", "Actual:", first.User, second.User)
+		}
+
+		// Users the reader can't see are left as pointers
+		if user := tasks[2].(*models.Task).User; user.ObjectId() != private.ObjectId() || len(user.Username) > 0 {
+			t.Fatal("Expected: an unfetched user", "Actual:", user)
+		}
+
+		if err := db.Include(ds, tasks, "owner"); err != db.ERR_UNKNOWN_INCLUDE {
+			t.Fatal("Expected:", db.ERR_UNKNOWN_INCLUDE, "Actual:", err)
+		}
+	})
+}
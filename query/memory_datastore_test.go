@@ -0,0 +1,100 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMemoryDataStoreRestrictedReads(t *testing.T) {
+	RunMemoryTest(t, func(t *testing.T, ds db.DataStore) {
+
+		owner := models.NewEmptyUser()
+		AssertNoError(t, errSetup, owner.Save(ds))
+
+		private := NewTestModel("")
+		private.Set("TestField", "private")
+		acl := db.NewACL()
+		acl.AddRead(owner.ObjectId())
+		acl.AddWrite(owner.ObjectId())
+		private.SetAccessControlList(acl)
+		AssertNoError(t, errSetup, private.Save(ds))
+
+		public := NewTestModel("")
+		public.Set("TestField", "public")
+		publicACL := db.NewACL()
+		publicACL.SetPublicRead()
+		public.SetAccessControlList(publicACL)
+		AssertNoError(t, errSetup, public.Save(ds))
+
+		ds.SetQueryBuilder(NewRestrictedQueryBuilder(models.NewUser("someoneelse"), nil))
+
+		var found []string
+		err := ds.FindEach(TestCollection, bson.M{}, func(m db.Model) {
+			found = append(found, m.(*TestModel).TestField)
+		}, EmptyTestModel(), "testField")
+		AssertNoError(t, "Could not find test models:", err)
+
+		if len(found) != 1 || found[0] != "public" {
+			t.Fatal("Expected only the public model to be readable. Actual:", found)
+		}
+
+		if err := NewTestModel(private.ObjectId()).Fetch(ds); err != mgo.ErrNotFound {
+			t.Fatal("Expected:", mgo.ErrNotFound, "Actual:", err)
+		}
+
+		ds.SetQueryBuilder(NewRestrictedQueryBuilder(owner, nil))
+
+		n, err := ds.Count(TestCollection, bson.M{"testField": "private"})
+		AssertNoError(t, "Could not count test models:", err)
+		if n != 1 {
+			t.Fatal("Expected owner to see the private model. Actual count:", n)
+		}
+	})
+}
+
+func TestMemoryDataStoreRelations(t *testing.T) {
+	RunMemoryTest(t, func(t *testing.T, ds db.DataStore) {
+
+		role := models.NewEmptyRole()
+		role.Set("Name", "coaches")
+		AssertNoError(t, errSetup, role.Save(ds))
+
+		role = models.NewRole(role.ObjectId())
+		AssertNoError(t, errSetup, role.Fetch(ds))
+
+		u1 := models.NewEmptyUser()
+		u2 := models.NewEmptyUser()
+		AssertNoError(t, errSetup, u1.Save(ds))
+		AssertNoError(t, errSetup, u2.Save(ds))
+
+		role.Users.Add(u1)
+		role.Users.Add(u2)
+		AssertNoError(t, errSetup, ds.SaveRelatedObjects(role.Users))
+
+		users, err := role.Users.Find(ds)
+		AssertNoError(t, "Could not find related users:", err)
+		if len(users) != 2 {
+			t.Fatal("Expected 2 related users. Actual:", len(users))
+		}
+
+		roles, err := models.FindRolesForUser(u1, ds)
+		AssertNoError(t, "Could not find roles for user:", err)
+		if len(roles) != 1 || roles[0].Name != "coaches" {
+			t.Fatal("Expected user to be in role coaches. Actual:", roles)
+		}
+
+		role = models.NewRole(role.ObjectId())
+		role.Users.Remove(u1)
+		AssertNoError(t, "Could not remove related user:", ds.SaveRelatedObjects(role.Users))
+
+		roles, err = models.FindRolesForUser(u1, ds)
+		AssertNoError(t, "Could not find roles for user:", err)
+		if len(roles) != 0 {
+			t.Fatal("Expected user to have no roles. Actual:", roles)
+		}
+	})
+}
@@ -37,7 +37,7 @@ var modifyTests = []ModifyTest{
 			Update: toMap(bson.M{
 				"$set": bson.M{"_updated_at": utcModTime}}),
 			ReturnNew: true},
-		bson.M{"_id": "qwerty"},
+		bson.M{"_id": "qwerty", "_version": bson.M{"$exists": false}},
 		nil},
 
 	{unrestrictedQB, EmptyTestModel(), UPDATE_DOCUMENT, modTime, "", nil,
@@ -68,7 +68,7 @@ var modifyTests = []ModifyTest{
 					"_rperm":      []string{},
 					"_wperm":      []string{"*"}}}),
 			ReturnNew: true},
-		bson.M{"_id": publicWriteModel.ObjectId(), "_wperm": bson.M{"$in": []interface{}{user.ObjectId(), "*", "role:activeProUser", "role:admin"}}},
+		bson.M{"_id": publicWriteModel.ObjectId(), "_version": bson.M{"$exists": false}, "_wperm": bson.M{"$in": []interface{}{user.ObjectId(), "*", "role:activeProUser", "role:admin"}}},
 		nil},
 
 	{restrictedQB, userWriteModel, UPDATE_DOCUMENT, modTime, "", nil,
@@ -80,7 +80,7 @@ var modifyTests = []ModifyTest{
 					"_rperm":      []string{},
 					"_wperm":      []string{user.ObjectId()}}}),
 			ReturnNew: true},
-		bson.M{"_id": userWriteModel.ObjectId(), "_wperm": bson.M{"$in": []interface{}{user.ObjectId(), "*", "role:activeProUser", "role:admin"}}},
+		bson.M{"_id": userWriteModel.ObjectId(), "_version": bson.M{"$exists": false}, "_wperm": bson.M{"$in": []interface{}{user.ObjectId(), "*", "role:activeProUser", "role:admin"}}},
 		nil},
 
 	{restrictedQB, mixedPermModel, UPDATE_DOCUMENT, modTime, "", nil,
@@ -92,9 +92,26 @@ var modifyTests = []ModifyTest{
 					"_rperm":      []string{},
 					"_wperm":      []string{user.ObjectId(), "*"}}}),
 			ReturnNew: true},
-		bson.M{"_id": mixedPermModel.ObjectId(), "_wperm": bson.M{"$in": []interface{}{user.ObjectId(), "*", "role:activeProUser", "role:admin"}}},
+		bson.M{"_id": mixedPermModel.ObjectId(), "_version": bson.M{"$exists": false}, "_wperm": bson.M{"$in": []interface{}{user.ObjectId(), "*", "role:activeProUser", "role:admin"}}},
 		nil},
 
+	{restrictedQB, roleWriteModel, UPDATE_DOCUMENT, modTime, "", nil,
+		mgo.Change{
+			Update: toMap(bson.M{
+				"$set": bson.M{
+					"_updated_at": utcModTime,
+					"_acl":        map[string]db.Permission{"role:admin": db.Permission{Read: false, Write: true}},
+					"_rperm":      []string{},
+					"_wperm":      []string{"role:admin"}}}),
+			ReturnNew: true},
+		bson.M{"_id": roleWriteModel.ObjectId(), "_version": bson.M{"$exists": false}, "_wperm": bson.M{"$in": []interface{}{user.ObjectId(), "*", "role:activeProUser", "role:admin"}}},
+		nil},
+
+	{restrictedQB, otherRoleWriteModel, UPDATE_DOCUMENT, modTime, "", nil,
+		mgo.Change{},
+		nil,
+		ERR_ACCESS_DENIED},
+
 	{restrictedQB, EmptyTestModel(), UPSERT_DOCUMENT, modTime, upsertId, bson.M{"_auth_data_facebook.id": "1244567"},
 		mgo.Change{
 			Update: toMap(bson.M{
@@ -114,7 +131,7 @@ var modifyTests = []ModifyTest{
 			Update: toMap(bson.M{
 				"$set": bson.M{"_updated_at": utcModTime}}),
 			ReturnNew: true},
-		bson.M{"_id": user.ObjectId()},
+		bson.M{"_id": user.ObjectId(), "_version": bson.M{"$exists": false}},
 		nil},
 }
 
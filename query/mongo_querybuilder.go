@@ -21,12 +21,12 @@ func NewMongoQueryBuilder() *MongoQueryBuilder {
 
 // Query & Update Builders
 
-func (m *MongoQueryBuilder) MakeCountQuery(collectionName string, query map[string]interface{}) bson.M {
-	return query
+func (m *MongoQueryBuilder) MakeCountQuery(collectionName string, query map[string]interface{}) (bson.M, error) {
+	return db.ExcludeDeleted(collectionName, query), nil
 }
 
-func (m *MongoQueryBuilder) MakeFindQuery(collectionName string, query map[string]interface{}) bson.M {
-	return query
+func (m *MongoQueryBuilder) MakeFindQuery(collectionName string, query map[string]interface{}) (bson.M, error) {
+	return db.ExcludeDeleted(collectionName, query), nil
 }
 
 func (m *MongoQueryBuilder) MakeFindByIdQuery(model db.Model) (bson.M, error) {
@@ -34,7 +34,32 @@ func (m *MongoQueryBuilder) MakeFindByIdQuery(model db.Model) (bson.M, error) {
 		return nil, db.ERR_MISSING_ID
 	}
 
-	return bson.M{"_id": model.ObjectId()}, nil
+	return db.ExcludeDeleted(model.Collection(), bson.M{"_id": model.ObjectId()}), nil
+}
+
+func (m *MongoQueryBuilder) MakeSort(collectionName string, sort []string) ([]string, error) {
+	return sort, nil
+}
+
+// MakeAggregatePipeline leaves deleted objects out of the pipeline's first $match.
+func (m *MongoQueryBuilder) MakeAggregatePipeline(collectionName string, pipeline []bson.M) ([]bson.M, error) {
+	match, rest, err := db.SplitMatch(pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stage := range rest {
+		if _, _, err := db.Stage(stage); err != nil {
+			return nil, err
+		}
+	}
+
+	q := db.ExcludeDeleted(collectionName, match)
+	return append([]bson.M{bson.M{db.StageMatch: q}}, rest...), nil
+}
+
+// The server sees every field
+func (m *MongoQueryBuilder) ProtectFields(model db.Model) {
 }
 
 func (m *MongoQueryBuilder) MakeRemoveQuery(model db.Model) (bson.M, error) {
@@ -42,11 +67,23 @@ func (m *MongoQueryBuilder) MakeRemoveQuery(model db.Model) (bson.M, error) {
 		return nil, db.ERR_MISSING_ID
 	}
 
-	return bson.M{"_id": model.ObjectId()}, nil
+	return db.ExcludeDeleted(model.Collection(), bson.M{"_id": model.ObjectId()}), nil
 }
 
 func (m *MongoQueryBuilder) MakeRemoveAllQuery(collectionName string, query map[string]interface{}) (bson.M, error) {
-	return query, nil
+	return db.ExcludeDeleted(collectionName, query), nil
+}
+
+func (m *MongoQueryBuilder) MakeRestoreQuery(model db.Model) (bson.M, error) {
+	if len(model.ObjectId()) == 0 {
+		return nil, db.ERR_MISSING_ID
+	}
+
+	return bson.M{"_id": model.ObjectId(), db.DELETED_AT: bson.M{"$exists": true}}, nil
+}
+
+func (m *MongoQueryBuilder) MakePurgeQuery(collectionName string, deletedBefore time.Time) (bson.M, error) {
+	return bson.M{db.DELETED_AT: bson.M{"$lt": deletedBefore}}, nil
 }
 
 func (m *MongoQueryBuilder) MakeInsertDocument(model db.Model, t time.Time, id string) (db.Model, error) {
@@ -54,6 +91,9 @@ func (m *MongoQueryBuilder) MakeInsertDocument(model db.Model, t time.Time, id s
 	model.SetObjectId(id)
 	model.SetCreatedDate(t)
 	model.SetUpdatedDate(t)
+	if model.UsesOptimisticLocking() {
+		model.SetObjectVersion(1)
+	}
 
 	return model, nil
 
@@ -65,18 +105,31 @@ func (m *MongoQueryBuilder) MakeChangeDocument(model db.Model, t time.Time) (bso
 		return nil, mgo.Change{}, db.ERR_MISSING_ID
 	}
 
-	return bson.M{"_id": model.ObjectId()},
+	q := db.ExcludeDeleted(model.Collection(), bson.M{"_id": model.ObjectId()})
+	update := model.Update(t)
+
+	if model.UsesOptimisticLocking() {
+		q["_version"] = db.VersionCondition(model)
+		update = db.VersionedUpdate(update)
+	}
+
+	return q,
 		mgo.Change{
-			Update:    model.Update(t),
+			Update:    update,
 			ReturnNew: true,
 		}, nil
 }
 
 func (m *MongoQueryBuilder) MakeUpsertDocument(model db.Model, query map[string]interface{}, t time.Time, id string) (bson.M, mgo.Change, error) {
 
-	return query,
+	update := model.Upsert(t, id)
+	if model.UsesOptimisticLocking() {
+		update = db.VersionedUpdate(update)
+	}
+
+	return db.ExcludeDeleted(model.Collection(), query),
 		mgo.Change{
-			Update:    model.Upsert(t, id),
+			Update:    update,
 			Upsert:    true,
 			ReturnNew: true,
 		}, nil
@@ -101,7 +154,7 @@ func (m *MongoQueryBuilder) QueryByOwningModels(joinCollectionName string, ownin
 }
 
 func (m *MongoQueryBuilder) QueryByIds(collectionName string, ids []string) bson.M {
-	return inArray("_id", ids)
+	return db.ExcludeDeleted(collectionName, inArray("_id", ids))
 }
 
 func inArray(field string, vals []string) bson.M {
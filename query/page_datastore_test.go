@@ -0,0 +1,84 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestFindPage(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		for i := 0; i < 7; i++ {
+			task := models.NewEmptyTask()
+			task.Set("Claimed", 6-i)
+			AssertNoError(t, errSetup, task.Save(ds))
+		}
+
+		// Keyset pages, with an insert part way through that must not shift later pages
+		seen := map[string]bool{}
+		pages := 0
+		cursor := ""
+		for {
+			n := 0
+			next, err := ds.FindPage(models.CollectionTask, bson.M{}, db.Page{Limit: 3, Cursor: cursor}, func(m db.Model) {
+				if seen[m.ObjectId()] {
+					t.Fatal("Task returned twice:", m.ObjectId())
+				}
+				seen[m.ObjectId()] = true
+				n++
+			}, models.NewEmptyTask())
+			AssertNoError(t, "Could not find page:", err)
+
+			if n == 0 || n > 3 {
+				t.Fatal("Expected: 1 to 3 results per page", "Actual:", n)
+			}
+
+			pages++
+			if pages == 1 {
+				AssertNoError(t, errSetup, models.NewEmptyTask().Save(ds))
+			}
+
+			if len(next) == 0 {
+				break
+			}
+			cursor = next
+		}
+
+		if len(seen) != 8 || pages != 3 {
+			t.Fatal("Expected: 8 tasks in 3 pages", "Actual:", len(seen), "tasks in", pages, "pages")
+		}
+
+		// Offset pages for any other sort order
+		var claimed []int
+		cursor = ""
+		for {
+			next, err := ds.FindPage(models.CollectionTask, bson.M{"taskClaimed": bson.M{"$gt": 0}}, db.Page{Limit: 2, Skip: 1, Cursor: cursor, Sort: []string{"-taskClaimed"}}, func(m db.Model) {
+				claimed = append(claimed, m.(*models.Task).Claimed)
+			}, models.NewEmptyTask())
+			AssertNoError(t, "Could not find page:", err)
+
+			if len(next) == 0 {
+				break
+			}
+			cursor = next
+		}
+
+		if !reflect.DeepEqual(claimed, []int{5, 4, 3, 2, 1}) {
+			t.Fatal("Expected: [5 4 3 2 1]", "Actual:", claimed)
+		}
+
+		_, err := ds.FindPage(models.CollectionTask, bson.M{}, db.Page{Limit: db.DEFAULT_QUERY_LIMIT + 1}, func(m db.Model) {}, models.NewEmptyTask())
+		if err != db.ERR_LIMIT_EXCEEDED {
+			t.Fatal("Expected:", db.ERR_LIMIT_EXCEEDED, "Actual:", err)
+		}
+
+		_, err = ds.FindPage(models.CollectionTask, bson.M{}, db.Page{Cursor: "not a cursor"}, func(m db.Model) {}, models.NewEmptyTask())
+		if err != db.ERR_INVALID_CURSOR {
+			t.Fatal("Expected:", db.ERR_INVALID_CURSOR, "Actual:", err)
+		}
+	})
+}
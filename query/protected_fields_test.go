@@ -0,0 +1,94 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestProtectedFields(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		var users []*models.User
+		for _, email := range []string{"me@foo.com", "other@foo.com"} {
+			user, err := models.NewUserFromEmail(email, email, "password", "")
+			AssertNoError(t, errSetup, err)
+			user.Set("Gender", "f")
+			AssertNoError(t, errSetup, user.Save(ds))
+
+			user.SetAccessControlList(models.NewUserACL(user.ObjectId()))
+			AssertNoError(t, errSetup, user.Save(ds))
+			users = append(users, user)
+		}
+		me, other := users[0], users[1]
+
+		ds.SetQueryBuilder(NewRestrictedQueryBuilder(me, nil))
+
+		// Other users' personal details are hidden, whichever way they are read
+		fetched := models.NewUser(other.ObjectId())
+		AssertNoError(t, "Could not fetch user:", fetched.Fetch(ds))
+		if len(fetched.Email) > 0 || len(fetched.Gender) > 0 || len(fetched.Username) == 0 {
+			t.Fatal("Expected: email and gender hidden, username shown", "Actual:", fetched.Email, fetched.Gender, fetched.Username)
+		}
+
+		found := models.NewEmptyUser()
+		AssertNoError(t, "Could not find user:", ds.FindObject(models.CollectionUser, bson.M{"_id": other.ObjectId()}, found))
+		if len(found.Email) > 0 {
+			t.Fatal("Expected: email hidden", "Actual:", found.Email)
+		}
+
+		emails := 0
+		AssertNoError(t, "Could not find users:", ds.FindEach(models.CollectionUser, bson.M{}, func(m db.Model) {
+			if len(m.(*models.User).Email) > 0 {
+				emails++
+			}
+		}, models.NewEmptyUser()))
+		if emails != 1 {
+			t.Fatal("Expected: only my own email", "Actual:", emails)
+		}
+
+		// but users see their own
+		self := models.NewUser(me.ObjectId())
+		AssertNoError(t, "Could not fetch user:", self.Fetch(ds))
+		if self.Email != "me@foo.com" {
+			t.Fatal("Expected: me@foo.com", "Actual:", self.Email)
+		}
+
+		// Protected fields can't be queried on either
+		if _, err := ds.Count(models.CollectionUser, bson.M{"$or": []interface{}{bson.M{"email": "other@foo.com"}}}); err != ERR_ACCESS_DENIED {
+			t.Fatal("Expected:", ERR_ACCESS_DENIED, "Actual:", err)
+		}
+
+		// or sorted on, nor can internal fields, since the order reveals their values
+		for _, sort := range [][]string{{"email"}, {"-email"}, {"_hashed_password"}} {
+			page := db.Page{Limit: 10, Sort: sort}
+			if _, err := ds.FindPage(models.CollectionUser, bson.M{}, page, func(db.Model) {}, models.NewEmptyUser()); err != ERR_ACCESS_DENIED {
+				t.Fatal("Sort:", sort, "Expected:", ERR_ACCESS_DENIED, "Actual:", err)
+			}
+		}
+		page := db.Page{Limit: 10, Sort: []string{"-_created_at", "username"}}
+		_, err := ds.FindPage(models.CollectionUser, bson.M{}, page, func(db.Model) {}, models.NewEmptyUser())
+		AssertNoError(t, "Could not sort users:", err)
+
+		// The schema can show them to a role
+		ds.SetQueryBuilder(NewMongoQueryBuilder())
+		AssertNoError(t, errSetup, models.SetProtectedFields(ds, models.CollectionUser, db.ProtectedFields{
+			db.PUBLIC_KEY: {"email", "gender"},
+			"role:admin":  {"gender"},
+		}))
+		protected, err := models.FindProtectedFields(ds)
+		AssertNoError(t, "Could not load protected fields:", err)
+
+		admin := NewRestrictedQueryBuilder(me, []*models.Role{models.NewRoleWithName("1", "admin")})
+		admin.SetProtectedFields(protected)
+		ds.SetQueryBuilder(admin)
+
+		fetched = models.NewUser(other.ObjectId())
+		AssertNoError(t, "Could not fetch user:", fetched.Fetch(ds))
+		if fetched.Email != "other@foo.com" || len(fetched.Gender) > 0 {
+			t.Fatal("Expected: email shown and gender hidden", "Actual:", fetched.Email, fetched.Gender)
+		}
+	})
+}
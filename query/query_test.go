@@ -57,8 +57,12 @@ var queryTests = []QueryTest{
 		bson.M{"_rperm": bson.M{"$exists": false}},
 		bson.M{"_rperm": bson.M{"$in": []interface{}{user.ObjectId(), "*", "role:activeProUser", "role:admin"}}}}}, bson.M{"_created_at": bson.M{"$gt": "2016-02-08T06:33:04.074Z"}}, nil},
 
-	//	// FIXME: this won't work anymore
-	//	{restrictedQB, nil, COUNT_QUERY, bson.M{"_rperm": bson.M{"$in": []interface{}{user.ObjectId(), "*", "role:activeProUser", "role:admin"}}, "$or": []bson.M{bson.M{"username": "nidhi"}, bson.M{"email": "nidhi@foo.com"}}}, bson.M{"$or": []bson.M{bson.M{"username": "nidhi"}, bson.M{"email": "nidhi@foo.com"}}}, nil},
+	{restrictedQB, nil, COUNT_QUERY, bson.M{"$and": []bson.M{
+		bson.M{"$or": []bson.M{bson.M{"username": "nidhi"}, bson.M{"email": "nidhi@foo.com"}}},
+		bson.M{"$or": []bson.M{
+			bson.M{"_rperm": bson.M{"$exists": false}},
+			bson.M{"_rperm": bson.M{"$in": []interface{}{user.ObjectId(), "*", "role:activeProUser", "role:admin"}}}}}}},
+		bson.M{"$or": []bson.M{bson.M{"username": "nidhi"}, bson.M{"email": "nidhi@foo.com"}}}, nil},
 
 	{restrictedQB, NewTestModel("1234"), REMOVE_QUERY, nil, nil, ERR_ACCESS_DENIED},
 	{restrictedQB, EmptyTestModel(), REMOVE_QUERY, nil, nil, db.ERR_MISSING_ID},
@@ -86,10 +90,10 @@ func testQuery(t *testing.T, test QueryTest) {
 	var err error
 	switch test.queryType {
 	case COUNT_QUERY:
-		q = test.qb.MakeFindQuery("TestCollection", test.inputQuery)
+		q, err = test.qb.MakeCountQuery("TestCollection", test.inputQuery)
 		break
 	case FIND_QUERY:
-		q = test.qb.MakeFindQuery("TestCollection", test.inputQuery)
+		q, err = test.qb.MakeFindQuery("TestCollection", test.inputQuery)
 		break
 	case FIND_ID_QUERY:
 		q, err = test.qb.MakeFindByIdQuery(test.model)
@@ -0,0 +1,252 @@
+package query
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/nidhik/backend/db"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var ERR_SUBQUERY_TOO_LARGE = errors.New("Sub-query matches too many objects.")
+
+// The most objects a sub-query of $inQuery, $notInQuery, $select or $dontSelect may find
+var MaxSubQueryResults = db.DEFAULT_QUERY_LIMIT
+
+// The lists the relational operators resolve to
+var subQueryOperators = map[string]string{
+	"$inQuery":    "$in",
+	"$notInQuery": "$nin",
+	"$select":     "$in",
+	"$dontSelect": "$nin",
+}
+
+// ResolveWhere replaces the relational operators of a where clause parsed by ParseWhere
+// with the lists of ids and values they stand for, querying collectionName:
+//
+//	$relatedTo                 the objects related to an object through one of its relations
+//	$inQuery, $notInQuery      pointers to the objects a query on another class finds, or not
+//	$select, $dontSelect       the values of a key of the objects a query finds, or not
+//
+// Each operator is resolved with one query through ds, so a restricted DataStore resolves
+// them only to objects, and relations of objects, the requester may find.
+func ResolveWhere(ds db.DataStore, collectionName string, where bson.M) (bson.M, error) {
+	result := bson.M{}
+	var related bson.M
+
+	for key, value := range where {
+		switch key {
+		case "$or", "$and":
+			clauses, ok := value.([]bson.M)
+			if !ok {
+				result[key] = value
+				continue
+			}
+
+			var resolved []bson.M
+			for _, clause := range clauses {
+				r, err := ResolveWhere(ds, collectionName, clause)
+				if err != nil {
+					return nil, err
+				}
+				resolved = append(resolved, r)
+			}
+			result[key] = resolved
+		case "$relatedTo":
+			related, _ = value.(bson.M)
+		default:
+			cond, ok := value.(bson.M)
+			if !ok {
+				result[key] = value
+				continue
+			}
+
+			cond, err := resolveOperators(ds, cond)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = cond
+		}
+	}
+
+	if related != nil {
+		ids, err := relatedIds(ds, collectionName, related)
+		if err != nil {
+			return nil, err
+		}
+
+		in := bson.M{"_id": bson.M{"$in": ids}}
+		if id, ok := result["_id"]; ok {
+			delete(result, "_id")
+			result["$and"] = appendClauses(result["$and"], bson.M{"_id": id}, in)
+		} else {
+			result["_id"] = in["_id"]
+		}
+	}
+
+	return result, nil
+}
+
+// HasSubQueries reports whether a where clause parsed by ParseWhere uses relational
+// operators, which ResolveWhere has to resolve before it can be matched.
+func HasSubQueries(where bson.M) bool {
+	for key, value := range where {
+		if key == "$relatedTo" {
+			return true
+		}
+
+		switch v := value.(type) {
+		case []bson.M:
+			for _, clause := range v {
+				if HasSubQueries(clause) {
+					return true
+				}
+			}
+		case bson.M:
+			for op := range v {
+				if _, ok := subQueryOperators[op]; ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func resolveOperators(ds db.DataStore, cond bson.M) (bson.M, error) {
+	result := bson.M{}
+	for op, arg := range cond {
+		list, ok := subQueryOperators[op]
+		sub, isSub := arg.(bson.M)
+		if !ok || !isSub {
+			result[op] = arg
+			continue
+		}
+
+		var values []interface{}
+		var err error
+		if key, ok := sub["key"].(string); ok {
+			values, err = selectValues(ds, sub, key)
+		} else {
+			values, err = pointersTo(ds, sub)
+		}
+		if err != nil {
+			return nil, err
+		}
+		result[list] = values
+	}
+	return result, nil
+}
+
+// subQuery calls f with each object a sub-query finds, failing when there are more than
+// MaxSubQueryResults.
+func subQuery(ds db.DataStore, sub bson.M, f func(db.Model)) error {
+	className, _ := sub["className"].(string)
+	where, _ := sub["where"].(bson.M)
+
+	where, err := ResolveWhere(ds, className, where)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.NewObject(className, "")
+	if err != nil {
+		return ERR_INVALID_QUERY_VALUE
+	}
+
+	next, err := ds.FindPage(className, where, db.Page{Limit: MaxSubQueryResults}, f, result)
+	if err != nil {
+		return err
+	}
+	if len(next) > 0 {
+		return ERR_SUBQUERY_TOO_LARGE
+	}
+	return nil
+}
+
+// pointersTo lists pointers, "<className>$<objectId>", to the objects a sub-query finds
+func pointersTo(ds db.DataStore, sub bson.M) ([]interface{}, error) {
+	className, _ := sub["className"].(string)
+
+	values := []interface{}{}
+	err := subQuery(ds, sub, func(model db.Model) {
+		values = append(values, className+"$"+model.ObjectId())
+	})
+	return values, err
+}
+
+// selectValues lists the values of key of the objects a sub-query finds. Only objects with
+// the key are found, so keys protected from the requester can't be selected.
+func selectValues(ds db.DataStore, sub bson.M, key string) ([]interface{}, error) {
+	where := bson.M{key: bson.M{"$exists": true}}
+	if w, _ := sub["where"].(bson.M); len(w) > 0 {
+		where = bson.M{"$and": []bson.M{w, where}}
+	}
+	withKey := bson.M{"className": sub["className"], "where": where}
+
+	values := []interface{}{}
+	var docErr error
+	err := subQuery(ds, withKey, func(model db.Model) {
+		doc, err := db.ToDocument(model)
+		if err != nil {
+			docErr = err
+			return
+		}
+
+		if v, ok := fieldValue(doc, key); ok {
+			values = append(values, v)
+		}
+	})
+
+	if err == nil {
+		err = docErr
+	}
+	return values, err
+}
+
+func fieldValue(doc bson.M, key string) (interface{}, bool) {
+	var v interface{} = doc
+	for _, part := range strings.Split(key, ".") {
+		m, ok := v.(bson.M)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// relatedIds lists the ids of the objects of collectionName related to an object through
+// its relation. The object has to be readable, and the relation has to hold collectionName.
+func relatedIds(ds db.DataStore, collectionName string, related bson.M) ([]interface{}, error) {
+	className, _ := related["className"].(string)
+	objectId, _ := related["objectId"].(string)
+	key, _ := related["key"].(string)
+
+	info, err := db.LookupClass(className)
+	if err != nil {
+		return nil, ERR_INVALID_QUERY_VALUE
+	}
+
+	relation, err := info.Relation(key)
+	if err != nil || relation.RelatedClass != collectionName {
+		return nil, ERR_INVALID_QUERY_VALUE
+	}
+
+	ids := []interface{}{}
+
+	// Objects the requester can't read are related to nothing
+	if err := ds.Fetch(info.New(objectId)); err == mgo.ErrNotFound {
+		return ids, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = ds.FindJoins(relation.JoinCollection, bson.M{"owningId": objectId}, func(j db.Join) {
+		ids = append(ids, j.RelatedId())
+	})
+	return ids, err
+}
@@ -2,7 +2,8 @@ package query
 
 import (
 	"errors"
-
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/nidhik/backend/db"
@@ -14,39 +15,116 @@ import (
 var ERR_ACCESS_DENIED = errors.New("You don't have persmission to carry out this operation.")
 
 type RestrictedMongoQueryBuilder struct {
-	User    *models.User
-	Roles   []*models.Role
-	builder *MongoQueryBuilder
-	access  []interface{}
+	User        *models.User
+	Roles       []*models.Role
+	builder     *MongoQueryBuilder
+	access      *db.Access
+	permissions map[string]models.ClassPermissions
+	protected   map[string]db.ProtectedFields
 }
 
 func NewRestrictedQueryBuilder(user *models.User, roles []*models.Role) *RestrictedMongoQueryBuilder {
 	access := getAccess(user, roles)
-	return &RestrictedMongoQueryBuilder{user, roles, &MongoQueryBuilder{}, access}
+	return &RestrictedMongoQueryBuilder{User: user, Roles: roles, builder: &MongoQueryBuilder{}, access: access}
+}
+
+// SetClassPermissions sets the class level permissions checked before any object ACL.
+// Classes without permissions are open to everyone.
+func (m *RestrictedMongoQueryBuilder) SetClassPermissions(permissions map[string]models.ClassPermissions) {
+	m.permissions = permissions
+}
+
+// SetProtectedFields sets the protected fields of the classes whose schema sets them. Other
+// classes protect the fields they registered.
+func (m *RestrictedMongoQueryBuilder) SetProtectedFields(protected map[string]db.ProtectedFields) {
+	m.protected = protected
 }
 
 // Query & Update Builders
 
-func getAccess(user *models.User, roles []*models.Role) []interface{} {
-	access := []interface{}{user.ObjectId(), db.PUBLIC_KEY}
-	for _, r := range roles {
-		access = append(access, "role:"+r.Name)
+// getAccess is who the user reads and writes as. roles are all the roles the user has,
+// inherited ones included, see models.FindRolesForUser.
+func getAccess(user *models.User, roles []*models.Role) *db.Access {
+	names := make([]string, len(roles))
+	for i, r := range roles {
+		names[i] = r.Name
 	}
-	return access
+	return db.NewAccess(user.ObjectId(), names...)
 }
 
 func (m *RestrictedMongoQueryBuilder) addReadCheck(query bson.M) {
-	query["$or"] = []bson.M{
-		bson.M{db.READ_PERM: bson.M{"$exists": false}},
-		bson.M{db.READ_PERM: bson.M{"$in": m.access}},
+	check := m.access.ReadQuery()
+	if check == nil {
+		return
+	}
+
+	// Don't clobber an $or that is already part of the query
+	if or, ok := query["$or"]; ok {
+		delete(query, "$or")
+		query["$and"] = appendClauses(query["$and"], bson.M{"$or": or}, check)
+		return
 	}
 
+	query["$or"] = check["$or"]
+}
+
+func appendClauses(existing interface{}, clauses ...bson.M) []bson.M {
+	var result []bson.M
+	switch e := existing.(type) {
+	case []bson.M:
+		result = append(result, e...)
+	case []interface{}:
+		for _, c := range e {
+			if clause, ok := c.(bson.M); ok {
+				result = append(result, clause)
+			} else if clause, ok := c.(map[string]interface{}); ok {
+				result = append(result, clause)
+			}
+		}
+	}
+	return append(result, clauses...)
 }
 
 func (m *RestrictedMongoQueryBuilder) addWriteCheck(query bson.M) {
-	query[db.WRITE_PERM] = bson.M{
-		"$in": m.access,
+	for k, v := range m.access.WriteQuery() {
+		query[k] = v
+	}
+}
+
+func (m *RestrictedMongoQueryBuilder) checkClass(collectionName string, ops ...string) error {
+	// Only the server may read or change class level permissions, migrations, the audit log
+	// and the records of stored files
+	if collectionName == models.CollectionSchema || collectionName == models.CollectionMigration ||
+		collectionName == models.CollectionAudit || collectionName == models.CollectionFile {
+		return ERR_ACCESS_DENIED
+	}
+
+	permissions, ok := m.permissions[collectionName]
+	if !ok {
+		return nil
+	}
+
+	for _, op := range ops {
+		if !permissions.Allows(op, m.access.Keys()) {
+			return ERR_ACCESS_DENIED
+		}
 	}
+	return nil
+}
+
+// checkAddField requires the addField permission for writes that can add fields the class
+// does not declare: unknown keys, keys inside a map field like customFields, or map fields.
+func (m *RestrictedMongoQueryBuilder) checkAddField(model db.Model, keys []string) error {
+	if _, ok := m.permissions[model.Collection()]; !ok {
+		return nil
+	}
+
+	for _, key := range keys {
+		if addsField(model, key) {
+			return m.checkClass(model.Collection(), models.OperationAddField)
+		}
+	}
+	return nil
 }
 
 func (m *RestrictedMongoQueryBuilder) checkWrite(model db.Model) error {
@@ -59,31 +137,299 @@ func (m *RestrictedMongoQueryBuilder) checkWrite(model db.Model) error {
 		return nil
 	}
 
-	if model.AccessControlList() == nil || !model.AccessControlList().CanWrite(m.User.ObjectId()) {
+	if decision := m.access.CanWrite(model.AccessControlList()); !decision.Allowed {
+		fmt.Printf("Denied write to %s %s: %s \n", model.Collection(), model.ObjectId(), decision.Reason)
 		return ERR_ACCESS_DENIED
 	}
 
 	return nil
 }
 
-func (m *RestrictedMongoQueryBuilder) MakeCountQuery(collectionName string, query map[string]interface{}) bson.M {
-	result := m.builder.MakeCountQuery(collectionName, query)
+// protectedFields lists the fields of a class hidden from the requester
+func (m *RestrictedMongoQueryBuilder) protectedFields(collectionName string) []string {
+	protected, ok := m.protected[collectionName]
+	if !ok {
+		info, err := db.LookupClass(collectionName)
+		if err != nil {
+			return nil
+		}
+		protected = info.ProtectedFields
+	}
+	return protected.For(m.access.Keys())
+}
+
+// owns reports whether the requester sees every field of model: their own user and the
+// objects they may write by user id.
+func (m *RestrictedMongoQueryBuilder) owns(model db.Model) bool {
+	id := m.User.ObjectId()
+	if len(id) == 0 {
+		return false
+	}
+
+	if model.Collection() == models.CollectionUser && model.ObjectId() == id {
+		return true
+	}
+
+	for _, w := range model.AccessControlList().WriteAccess {
+		if w == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *RestrictedMongoQueryBuilder) ProtectFields(model db.Model) {
+	fields := m.protectedFields(model.Collection())
+	if len(fields) == 0 || m.owns(model) {
+		return
+	}
+	clearFields(model, fields)
+}
+
+// checkQueriedFields denies queries on protected fields, which would give their values away
+// without returning them.
+func (m *RestrictedMongoQueryBuilder) checkQueriedFields(collectionName string, query map[string]interface{}) error {
+	protected := m.protectedFields(collectionName)
+	if len(protected) == 0 {
+		return nil
+	}
+
+	for _, key := range queriedFields(query) {
+		for _, field := range protected {
+			if key == field {
+				return ERR_ACCESS_DENIED
+			}
+		}
+	}
+	return nil
+}
+
+// protectText searches with regexes on the fields of the class's text index the requester
+// may see, when some of them are protected. Mongo can't leave fields out of a text search.
+func (m *RestrictedMongoQueryBuilder) protectText(collectionName string, query map[string]interface{}) (map[string]interface{}, error) {
+	text := db.TextOf(query)
+	protected := m.protectedFields(collectionName)
+	if text == nil || len(protected) == 0 {
+		return query, nil
+	}
+
+	info, err := db.LookupClass(collectionName)
+	if err != nil {
+		return nil, db.ERR_NO_TEXT_INDEX
+	}
+
+	var fields []string
+	for _, field := range info.TextFields() {
+		if !contains(protected, strings.SplitN(field, ".", 2)[0]) {
+			fields = append(fields, field)
+		}
+	}
+
+	if len(fields) == len(info.TextFields()) {
+		return query, nil
+	}
+	if len(fields) == 0 {
+		return nil, ERR_ACCESS_DENIED
+	}
+	return db.WithoutText(query, text.Regex(fields)), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *RestrictedMongoQueryBuilder) MakeCountQuery(collectionName string, query map[string]interface{}) (bson.M, error) {
+	if perr := m.checkClass(collectionName, models.OperationCount); perr != nil {
+		return nil, perr
+	}
+
+	if perr := m.checkQueriedFields(collectionName, query); perr != nil {
+		return nil, perr
+	}
+
+	query, err := m.protectText(collectionName, query)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := m.builder.MakeCountQuery(collectionName, query)
+	if err != nil {
+		return nil, err
+	}
+
 	m.addReadCheck(result)
-	return result
+	return result, nil
 }
 
-func (m *RestrictedMongoQueryBuilder) MakeFindQuery(collectionName string, query map[string]interface{}) bson.M {
-	result := m.builder.MakeFindQuery(collectionName, query)
+func (m *RestrictedMongoQueryBuilder) MakeFindQuery(collectionName string, query map[string]interface{}) (bson.M, error) {
+	if perr := m.checkClass(collectionName, models.OperationFind); perr != nil {
+		return nil, perr
+	}
+
+	if perr := m.checkQueriedFields(collectionName, query); perr != nil {
+		return nil, perr
+	}
+
+	query, err := m.protectText(collectionName, query)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := m.builder.MakeFindQuery(collectionName, query)
+	if err != nil {
+		return nil, err
+	}
 
 	if collectionName == models.CollectionUser && m.User.ObjectId() == query["_id"] {
-		return result
+		return result, nil
 	}
 
 	m.addReadCheck(result)
-	return result
+	return result, nil
+}
+
+// MakeAggregatePipeline restricts the first $match of a pipeline to the objects the requester
+// may find. The pipeline has to $group or $project, rather than return whole documents, and
+// may not read protected or internal fields. $project may only include fields, since excluding
+// them returns the rest of the documents.
+func (m *RestrictedMongoQueryBuilder) MakeAggregatePipeline(collectionName string, pipeline []bson.M) ([]bson.M, error) {
+	if perr := m.checkClass(collectionName, models.OperationFind); perr != nil {
+		return nil, perr
+	}
+
+	if perr := m.checkPipelineFields(collectionName, pipeline); perr != nil {
+		return nil, perr
+	}
+
+	match, rest, err := db.SplitMatch(pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	protected, err := m.protectText(collectionName, match)
+	if err != nil {
+		return nil, err
+	}
+
+	// The read check is added to the query, which belongs to the caller
+	q := bson.M{}
+	for k, v := range protected {
+		q[k] = v
+	}
+
+	result, err := m.builder.MakeAggregatePipeline(collectionName, append([]bson.M{bson.M{db.StageMatch: q}}, rest...))
+	if err != nil {
+		return nil, err
+	}
+
+	m.addReadCheck(result[0][db.StageMatch].(bson.M))
+	return result, nil
+}
+
+func (m *RestrictedMongoQueryBuilder) checkPipelineFields(collectionName string, pipeline []bson.M) error {
+	summarized := false
+	for _, stage := range pipeline {
+		if _, ok := stage[db.StageGroup]; ok {
+			summarized = true
+		}
+		if spec, ok := stage[db.StageProject]; ok {
+			// Excluding fields returns whole documents, without them
+			if !includesOnly(spec) {
+				return ERR_ACCESS_DENIED
+			}
+			summarized = true
+		}
+	}
+	if !summarized {
+		return ERR_ACCESS_DENIED
+	}
+
+	return m.checkReadFields(collectionName, pipelineFields(pipeline))
+}
+
+// checkReadFields denies reading the values of protected and internal fields, which
+// grouping and sorting on them would reveal
+func (m *RestrictedMongoQueryBuilder) checkReadFields(collectionName string, keys []string) error {
+	protected := m.protectedFields(collectionName)
+	for _, key := range keys {
+		if strings.HasPrefix(key, "_") && !aggregatedInternalFields[key] && !strings.HasPrefix(key, "_p_") {
+			return ERR_ACCESS_DENIED
+		}
+		for _, field := range protected {
+			if key == field {
+				return ERR_ACCESS_DENIED
+			}
+		}
+	}
+	return nil
+}
+
+// MakeSort denies sorting on protected and internal fields, as pipelines may not: the order
+// of the results would reveal their values.
+func (m *RestrictedMongoQueryBuilder) MakeSort(collectionName string, sort []string) ([]string, error) {
+	keys := make([]string, len(sort))
+	for i, s := range sort {
+		keys[i] = topField(strings.TrimPrefix(s, "-"))
+	}
+
+	if perr := m.checkReadFields(collectionName, keys); perr != nil {
+		return nil, perr
+	}
+	return m.builder.MakeSort(collectionName, sort)
+}
+
+// includesOnly reports whether a $project spec includes fields, excluding none but _id
+func includesOnly(spec interface{}) bool {
+	fields, ok := spec.(bson.M)
+	if !ok {
+		if m, isMap := spec.(map[string]interface{}); isMap {
+			fields, ok = bson.M(m), true
+		}
+	}
+	if !ok {
+		return false
+	}
+
+	included := false
+	for key, value := range fields {
+		switch v := value.(type) {
+		case bool:
+			if !v && key != "_id" {
+				return false
+			}
+			included = included || v
+		case int, int64, float64:
+			if v == 0 || v == int64(0) || v == 0.0 {
+				if key != "_id" {
+					return false
+				}
+				continue
+			}
+			included = true
+		default:
+			included = true
+		}
+	}
+	return included
+}
+
+// Internal fields pipelines may read and finds may sort on, besides pointers
+var aggregatedInternalFields = map[string]bool{
+	"_id":         true,
+	"_created_at": true,
+	"_updated_at": true,
 }
 
 func (m *RestrictedMongoQueryBuilder) MakeFindByIdQuery(model db.Model) (bson.M, error) {
+	if perr := m.checkClass(model.Collection(), models.OperationGet); perr != nil {
+		return nil, perr
+	}
+
 	result, err := m.builder.MakeFindByIdQuery(model)
 
 	if model.Collection() == models.CollectionUser && m.User.ObjectId() == model.ObjectId() {
@@ -98,6 +444,9 @@ func (m *RestrictedMongoQueryBuilder) MakeFindByIdQuery(model db.Model) (bson.M,
 }
 
 func (m *RestrictedMongoQueryBuilder) MakeRemoveQuery(model db.Model) (bson.M, error) {
+	if perr := m.checkClass(model.Collection(), models.OperationDelete); perr != nil {
+		return nil, perr
+	}
 
 	if perr := m.checkWrite(model); perr != nil {
 		return nil, perr
@@ -119,6 +468,10 @@ func (m *RestrictedMongoQueryBuilder) MakeRemoveQuery(model db.Model) (bson.M, e
 }
 
 func (m *RestrictedMongoQueryBuilder) MakeRemoveAllQuery(collectionName string, query map[string]interface{}) (bson.M, error) {
+	if perr := m.checkClass(collectionName, models.OperationDelete); perr != nil {
+		return nil, perr
+	}
+
 	result, err := m.builder.MakeRemoveAllQuery(collectionName, query)
 	if err != nil {
 		return nil, err
@@ -138,6 +491,13 @@ func (m *RestrictedMongoQueryBuilder) MakeRemoveAllQuery(collectionName string,
 }
 
 func (m *RestrictedMongoQueryBuilder) MakeInsertDocument(model db.Model, t time.Time, id string) (db.Model, error) {
+	if perr := m.checkClass(model.Collection(), models.OperationCreate); perr != nil {
+		return nil, perr
+	}
+
+	if perr := m.checkAddField(model, setMapFields(model)); perr != nil {
+		return nil, perr
+	}
 
 	result, err := m.builder.MakeInsertDocument(model, t, id)
 
@@ -151,6 +511,10 @@ func (m *RestrictedMongoQueryBuilder) MakeInsertDocument(model db.Model, t time.
 
 // findAndModify() https://docs.mongodb.com/manual/reference/method/db.collection.findAndModify/
 func (m *RestrictedMongoQueryBuilder) MakeChangeDocument(model db.Model, t time.Time) (bson.M, mgo.Change, error) {
+	if perr := m.checkClass(model.Collection(), models.OperationUpdate); perr != nil {
+		return nil, mgo.Change{}, perr
+	}
+
 	if perr := m.checkWrite(model); perr != nil {
 		return nil, mgo.Change{}, perr
 	}
@@ -161,6 +525,10 @@ func (m *RestrictedMongoQueryBuilder) MakeChangeDocument(model db.Model, t time.
 		return nil, mgo.Change{}, err
 	}
 
+	if perr := m.checkAddField(model, updatedKeys(c.Update)); perr != nil {
+		return nil, mgo.Change{}, perr
+	}
+
 	if model.Collection() == models.CollectionUser && m.User.ObjectId() == q["_id"] {
 		return q, c, nil
 	}
@@ -171,6 +539,10 @@ func (m *RestrictedMongoQueryBuilder) MakeChangeDocument(model db.Model, t time.
 
 func (m *RestrictedMongoQueryBuilder) MakeUpsertDocument(model db.Model, query map[string]interface{}, t time.Time, id string) (bson.M, mgo.Change, error) {
 
+	if perr := m.checkClass(model.Collection(), models.OperationCreate, models.OperationUpdate); perr != nil {
+		return nil, mgo.Change{}, perr
+	}
+
 	if perr := m.checkWrite(model); perr != nil {
 		return nil, mgo.Change{}, perr
 	}
@@ -181,10 +553,37 @@ func (m *RestrictedMongoQueryBuilder) MakeUpsertDocument(model db.Model, query m
 		return nil, mgo.Change{}, err
 	}
 
+	if perr := m.checkAddField(model, updatedKeys(c.Update)); perr != nil {
+		return nil, mgo.Change{}, perr
+	}
+
 	m.addWriteCheck(q)
 	return q, c, nil
 }
 
+func (m *RestrictedMongoQueryBuilder) MakeRestoreQuery(model db.Model) (bson.M, error) {
+	if perr := m.checkClass(model.Collection(), models.OperationDelete); perr != nil {
+		return nil, perr
+	}
+
+	if perr := m.checkWrite(model); perr != nil {
+		return nil, perr
+	}
+
+	result, err := m.builder.MakeRestoreQuery(model)
+	if err != nil {
+		return nil, err
+	}
+
+	m.addWriteCheck(result)
+	return result, nil
+}
+
+// Only the server purges deleted objects
+func (m *RestrictedMongoQueryBuilder) MakePurgeQuery(collectionName string, deletedBefore time.Time) (bson.M, error) {
+	return nil, ERR_ACCESS_DENIED
+}
+
 func (m *RestrictedMongoQueryBuilder) QueryByRelatedModels(joinCollectionName string, related []db.Model) bson.M {
 	return m.builder.QueryByRelatedModels(joinCollectionName, related)
 }
@@ -200,6 +599,10 @@ func (m *RestrictedMongoQueryBuilder) QueryByIds(collectionName string, ids []st
 }
 
 func (m *RestrictedMongoQueryBuilder) MakeRelationUpdateDocuments(relation db.Relation) ([]interface{}, bson.M, error) {
+	if perr := m.checkClass(relation.Owner().Collection(), models.OperationUpdate); perr != nil {
+		return nil, nil, perr
+	}
+
 	if perr := m.checkWrite(relation.Owner()); perr != nil {
 		return nil, nil, perr
 	}
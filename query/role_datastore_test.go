@@ -0,0 +1,163 @@
+package query
+
+import (
+	"expvar"
+	"sort"
+	"testing"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRoleHierarchy(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		roles := make(map[string]*models.Role)
+		users := make(map[string]*models.User)
+		for _, name := range []string{"member", "coach", "admin"} {
+			role := models.NewEmptyRole()
+			role.Set("Name", name)
+			AssertNoError(t, errSetup, role.Save(ds))
+			roles[name] = role
+
+			user := models.NewEmptyUser()
+			user.Set("Name", name)
+			AssertNoError(t, errSetup, user.Save(ds))
+			users[name] = user
+
+			role.Users.Add(user)
+			AssertNoError(t, errSetup, ds.SaveRelatedObjects(role.Users))
+		}
+
+		// admin implies coach, which implies member
+		roles["coach"].Roles.Add(roles["admin"])
+		AssertNoError(t, errSetup, ds.SaveRelatedObjects(roles["coach"].Roles))
+		roles["member"].Roles.Add(roles["coach"])
+		AssertNoError(t, errSetup, ds.SaveRelatedObjects(roles["member"].Roles))
+
+		roleNames := func(user *models.User) []string {
+			found, err := models.FindRolesForUser(user, ds)
+			AssertNoError(t, "Could not find roles for user:", err)
+
+			var names []string
+			for _, r := range found {
+				names = append(names, r.Name)
+			}
+			sort.Strings(names)
+			return names
+		}
+
+		tests := []struct {
+			user     string
+			expected []string
+		}{
+			{"member", []string{"member"}},
+			{"coach", []string{"coach", "member"}},
+			{"admin", []string{"admin", "coach", "member"}},
+		}
+
+		for _, test := range tests {
+			if names := roleNames(users[test.user]); !equalStrings(names, test.expected) {
+				t.Fatal("Expected:", test.expected, "Actual:", names)
+			}
+		}
+
+		// Inherited roles grant access like direct ones
+		task := models.NewEmptyTask()
+		acl := db.NewACL()
+		acl.AddRead("role:member")
+		task.SetAccessControlList(acl)
+		AssertNoError(t, errSetup, task.Save(ds))
+
+		admins, err := models.FindRolesForUser(users["admin"], ds)
+		AssertNoError(t, "Could not find roles for user:", err)
+		ds.SetQueryBuilder(NewRestrictedQueryBuilder(users["admin"], admins))
+		if n, err := ds.Count(models.CollectionTask, bson.M{}); err != nil || n != 1 {
+			t.Fatal("Expected: admins to read what members may", "Actual:", n, err)
+		}
+		ds.SetQueryBuilder(NewMongoQueryBuilder())
+
+		// Cycles end the walk
+		roles["admin"].Roles.Add(roles["member"])
+		AssertNoError(t, errSetup, ds.SaveRelatedObjects(roles["admin"].Roles))
+		if names := roleNames(users["member"]); !equalStrings(names, []string{"admin", "coach", "member"}) {
+			t.Fatal("Expected:", []string{"admin", "coach", "member"}, "Actual:", names)
+		}
+	})
+}
+
+func TestRoleCache(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		user := models.NewEmptyUser()
+		AssertNoError(t, errSetup, user.Save(ds))
+
+		role := models.NewEmptyRole()
+		role.Set("Name", "cached")
+		AssertNoError(t, errSetup, role.Save(ds))
+
+		stat := func(name string) int64 {
+			if v, ok := models.RoleCacheStats.Get(name).(*expvar.Int); ok {
+				return v.Value()
+			}
+			return 0
+		}
+
+		cachedRoles := func() []*models.Role {
+			found, err := models.CachedRolesForUser(user, ds)
+			AssertNoError(t, "Could not find roles for user:", err)
+			return found
+		}
+
+		misses := stat("misses")
+		if found := cachedRoles(); len(found) != 0 {
+			t.Fatal("Expected: no roles", "Actual:", found)
+		}
+		if stat("misses") != misses+1 {
+			t.Fatal("Expected the first lookup to miss the cache")
+		}
+
+		hits := stat("hits")
+		cachedRoles()
+		if stat("hits") != hits+1 {
+			t.Fatal("Expected the second lookup to hit the cache")
+		}
+
+		// Saving the users of a role clears the cache
+		invalidations := stat("invalidations")
+		role.Users.Add(user)
+		AssertNoError(t, errSetup, ds.SaveRelatedObjects(role.Users))
+		if stat("invalidations") <= invalidations {
+			t.Fatal("Expected saving the users of a role to clear the cache")
+		}
+
+		found := cachedRoles()
+		if len(found) != 1 || found[0].Name != "cached" {
+			t.Fatal("Expected:", []string{"cached"}, "Actual:", found)
+		}
+
+		// Roles just found aren't found again for tokens signed for other roles
+		misses = stat("misses")
+		rechecked, err := models.RecheckRolesForUser(user, ds)
+		AssertNoError(t, "Could not recheck roles for user:", err)
+		if len(rechecked) != 1 || stat("misses") != misses {
+			t.Fatal("Expected: the cached roles", "Actual:", rechecked, stat("misses")-misses, "misses")
+		}
+
+		interval := models.RoleRecheckInterval
+		models.RoleRecheckInterval = 0
+		defer func() { models.RoleRecheckInterval = interval }()
+		if _, err := models.RecheckRolesForUser(user, ds); err != nil || stat("misses") != misses+1 {
+			t.Fatal("Expected: roles found again", "Actual:", err, stat("misses")-misses, "misses")
+		}
+
+		other := models.NewRoleWithName("other", "other")
+		if models.RoleVersion([]*models.Role{role, other}) != models.RoleVersion([]*models.Role{other, role}) {
+			t.Fatal("Expected role versions not to depend on order")
+		}
+		if models.RoleVersion(found) == models.RoleVersion([]*models.Role{role, other}) {
+			t.Fatal("Expected different roles to have different versions")
+		}
+	})
+}
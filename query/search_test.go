@@ -0,0 +1,100 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func search(t *testing.T, ds db.DataStore, collection string, text string, result db.Model) ([]db.Model, []float64) {
+	var found []db.Model
+	var scores []float64
+	err := ds.Search(collection, bson.M{"$text": bson.M{"$search": text}}, 0, func(m db.Model, score float64) {
+		found = append(found, m)
+		scores = append(scores, score)
+	}, result)
+	AssertNoError(t, "Could not search:", err)
+	return found, scores
+}
+
+func TestSearch(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		var users []*models.User
+		for _, u := range [][]string{
+			{"jane", "Jane Jane Austen", "jane@books.com"},
+			{"eyre", "Jane Eyre", "eyre@books.com"},
+			{"emily", "Emily Bronte", "emily@jane.com"},
+		} {
+			user := models.NewEmptyUser()
+			user.Set("Username", u[0])
+			user.Set("Name", u[1])
+			user.Set("Email", u[2])
+			AssertNoError(t, errSetup, user.Save(ds))
+			users = append(users, user)
+		}
+
+		// The best match comes first
+		found, scores := search(t, ds, models.CollectionUser, "jane", models.NewEmptyUser())
+		if len(found) != 3 || found[0].ObjectId() != users[0].ObjectId() || scores[0] <= scores[1] {
+			t.Fatal("Expected: 3 users, Jane Austen first", "Actual:", found, scores)
+		}
+
+		found, _ = search(t, ds, models.CollectionUser, "jane -eyre", models.NewEmptyUser())
+		if len(found) != 2 {
+			t.Fatal("Expected: 2 users", "Actual:", found)
+		}
+
+		// Text clauses can be used in any query
+		n, err := ds.Count(models.CollectionUser, bson.M{"$text": bson.M{"$search": "bronte austen"}})
+		if err != nil || n != 2 {
+			t.Fatal("Expected:", 2, "Actual:", n, err)
+		}
+
+		record := models.NewEmailRecordForUser(users[0], models.TaskTypeEmail, "template", "Your order has shipped", nil)
+		AssertNoError(t, errSetup, record.Save(ds))
+		found, _ = search(t, ds, models.CollectionEmailRecord, "shipped", models.NewEmptyEmailRecord())
+		if len(found) != 1 {
+			t.Fatal("Expected: 1 record", "Actual:", found)
+		}
+
+		if err := ds.Search(models.CollectionTask, bson.M{"$text": bson.M{"$search": "x"}}, 0, func(db.Model, float64) {}, models.NewEmptyTask()); err != db.ERR_NO_TEXT_INDEX {
+			t.Fatal("Expected:", db.ERR_NO_TEXT_INDEX, "Actual:", err)
+		}
+
+		// Users don't find others by their protected email, nor objects they can't read
+		acl := db.NewACL()
+		acl.AddRead(users[0].ObjectId())
+		users[1].SetAccessControlList(acl)
+		AssertNoError(t, errSetup, users[1].Save(ds))
+
+		ds.SetQueryBuilder(NewRestrictedQueryBuilder(users[2], nil))
+		found, _ = search(t, ds, models.CollectionUser, "jane", models.NewEmptyUser())
+		if len(found) != 1 || found[0].ObjectId() != users[0].ObjectId() {
+			t.Fatal("Expected: only Jane Austen", "Actual:", found)
+		}
+
+		found, _ = search(t, ds, models.CollectionUser, "books", models.NewEmptyUser())
+		if len(found) != 0 {
+			t.Fatal("Expected: no users", "Actual:", found)
+		}
+
+		// Nor on the pages after the first, where the query is combined with the cursor
+		ds.SetQueryBuilder(NewMongoQueryBuilder())
+		newest := db.Page{Limit: 1, Sort: []string{"-_created_at"}}
+		cursor, err := ds.FindPage(models.CollectionUser, bson.M{}, newest, func(db.Model) {}, models.NewEmptyUser())
+		AssertNoError(t, errSetup, err)
+
+		ds.SetQueryBuilder(NewRestrictedQueryBuilder(users[2], nil))
+		found = nil
+		newest.Cursor = cursor
+		_, err = ds.FindPage(models.CollectionUser, bson.M{"$text": bson.M{"$search": "books"}}, newest, func(m db.Model) {
+			found = append(found, m)
+		}, models.NewEmptyUser())
+		if err != nil || len(found) != 0 {
+			t.Fatal("Expected: no users", "Actual:", found, err)
+		}
+	})
+}
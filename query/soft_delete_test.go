@@ -0,0 +1,88 @@
+package query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSoftDelete(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		owner := models.NewEmptyUser()
+		AssertNoError(t, errSetup, owner.Save(ds))
+
+		var tasks []*models.Task
+		for i := 0; i < 3; i++ {
+			task := models.NewTaskForUser(owner, models.TaskTypeEmail, models.HandleEmail)
+			AssertNoError(t, errSetup, task.Save(ds))
+			tasks = append(tasks, task)
+		}
+
+		AssertNoError(t, "Could not delete task:", tasks[0].Delete(ds))
+		if tasks[0].DeletedAt == nil {
+			t.Fatal("Expected: deletedAt to be set", "Actual:", tasks[0])
+		}
+
+		// Deleted objects are left out of queries, fetches and updates
+		if n, err := ds.Count(models.CollectionTask, bson.M{}); err != nil || n != 2 {
+			t.Fatal("Expected: 2", "Actual:", n, err)
+		}
+		if err := models.NewTask(tasks[0].ObjectId()).Fetch(ds); err != mgo.ErrNotFound {
+			t.Fatal("Expected:", mgo.ErrNotFound, "Actual:", err)
+		}
+		if err := tasks[0].Delete(ds); err != mgo.ErrNotFound {
+			t.Fatal("Expected:", mgo.ErrNotFound, "Actual:", err)
+		}
+
+		// but can be found in the trash
+		if n, err := ds.Count(models.CollectionTask, db.TrashQuery()); err != nil || n != 1 {
+			t.Fatal("Expected: 1 deleted", "Actual:", n, err)
+		}
+
+		AssertNoError(t, "Could not restore task:", ds.RestoreObject(tasks[0]))
+		if tasks[0].DeletedAt != nil {
+			t.Fatal("Expected: deletedAt to be cleared", "Actual:", tasks[0].DeletedAt)
+		}
+		AssertNoError(t, "Could not fetch task:", models.NewTask(tasks[0].ObjectId()).Fetch(ds))
+
+		if err := ds.RestoreObject(tasks[1]); err != mgo.ErrNotFound {
+			t.Fatal("Expected:", mgo.ErrNotFound, "Actual:", err)
+		}
+
+		// RemoveAll soft deletes too
+		AssertNoError(t, "Could not delete tasks:", ds.RemoveAll(models.CollectionTask, bson.M{"_id": bson.M{"$in": []string{tasks[1].ObjectId(), tasks[2].ObjectId()}}}))
+		if n, err := ds.Count(models.CollectionTask, db.TrashQuery()); err != nil || n != 2 {
+			t.Fatal("Expected: 2 deleted", "Actual:", n, err)
+		}
+
+		// Only objects deleted before the retention window are purged
+		AssertNoError(t, "Could not purge tasks:", db.PurgeDeleted(ds, time.Now()))
+		if n, err := ds.Count(models.CollectionTask, db.TrashQuery()); err != nil || n != 2 {
+			t.Fatal("Expected: 2 deleted", "Actual:", n, err)
+		}
+
+		AssertNoError(t, "Could not purge tasks:", db.PurgeDeleted(ds, time.Now().Add(db.DefaultRetention+time.Minute)))
+		if n, err := ds.Count(models.CollectionTask, db.TrashQuery()); err != nil || n != 0 {
+			t.Fatal("Expected: 0 deleted", "Actual:", n, err)
+		}
+		if n, err := ds.Count(models.CollectionTask, bson.M{}); err != nil || n != 1 {
+			t.Fatal("Expected: 1", "Actual:", n, err)
+		}
+
+		// Classes without soft deletion are removed straight away
+		AssertNoError(t, "Could not delete user:", owner.Delete(ds))
+		if n, err := ds.Count(models.CollectionUser, db.TrashQuery()); err != nil || n != 0 {
+			t.Fatal("Expected: 0", "Actual:", n, err)
+		}
+
+		ds.SetQueryBuilder(NewRestrictedQueryBuilder(owner, nil))
+		if _, err := ds.PurgeObjects(models.CollectionTask, time.Now()); err != ERR_ACCESS_DENIED {
+			t.Fatal("Expected:", ERR_ACCESS_DENIED, "Actual:", err)
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package query
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+)
+
+func TestSubQueries(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		users := make(map[string]*models.User)
+		for _, name := range []string{"Jane", "Emily", "Charlotte", "Anne"} {
+			user := models.NewEmptyUser()
+			user.Set("Name", name)
+			AssertNoError(t, errSetup, user.Save(ds))
+			users[name] = user
+
+			task := models.NewTaskForUser(user, name, models.HandleEmail)
+			AssertNoError(t, errSetup, task.Save(ds))
+		}
+
+		coaches := models.NewEmptyRole()
+		coaches.Set("Name", "coaches")
+		AssertNoError(t, errSetup, coaches.Save(ds))
+		coaches.Users.Add(users["Jane"])
+		coaches.Users.Add(users["Emily"])
+		AssertNoError(t, errSetup, ds.SaveRelatedObjects(coaches.Users))
+
+		// Only Anne may read the hidden role, which also has a name users take
+		acl := db.NewACL()
+		acl.AddRead(users["Anne"].ObjectId())
+		hidden, err := models.UpsertRoleByName(ds, "Charlotte", acl)
+		AssertNoError(t, errSetup, err)
+		hidden.Users.Add(users["Charlotte"])
+		AssertNoError(t, errSetup, ds.SaveRelatedObjects(hidden.Users))
+
+		inCoaches := `{"$relatedTo": {"object": {"__type": "Pointer", "className": "_Role", "objectId": "` + coaches.ObjectId() + `"}, "key": "users"}}`
+		inHidden := `{"$relatedTo": {"object": {"__type": "Pointer", "className": "_Role", "objectId": "` + hidden.ObjectId() + `"}, "key": "users"}}`
+
+		tests := []struct {
+			collection string
+			where      string
+			expected   []string
+			err        error
+		}{
+			{models.CollectionUser, inCoaches, []string{"Emily", "Jane"}, nil},
+			{models.CollectionUser, `{"$and": [` + inCoaches + `, {"name": {"$regex": "^J"}}]}`, []string{"Jane"}, nil},
+			{models.CollectionTask, `{"user": {"$inQuery": {"className": "_User", "where": ` + inCoaches + `}}}`, []string{"Emily", "Jane"}, nil},
+			{models.CollectionTask, `{"user": {"$notInQuery": {"className": "_User", "where": ` + inCoaches + `}}}`, []string{"Anne", "Charlotte"}, nil},
+			{models.CollectionUser, `{"name": {"$select": {"query": {"className": "_Role"}, "key": "name"}}}`, []string{"Charlotte"}, nil},
+			{models.CollectionUser, `{"name": {"$dontSelect": {"query": {"className": "_Role"}, "key": "name"}}}`, []string{"Anne", "Emily", "Jane"}, nil},
+			{models.CollectionUser, inHidden, []string{"Charlotte"}, nil},
+			{models.CollectionTask, inCoaches, nil, ERR_INVALID_QUERY_VALUE},
+		}
+
+		run := func(collection string, where string) ([]string, error) {
+			var clause map[string]interface{}
+			if err := json.Unmarshal([]byte(where), &clause); err != nil {
+				t.Fatal("Invalid test where:", where)
+			}
+
+			q, err := ParseWhere(clause)
+			if err == nil {
+				q, err = ResolveWhere(ds, collection, q)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			result, _ := db.NewObject(collection, "")
+			var names []string
+			err = ds.FindEach(collection, q, func(m db.Model) {
+				switch object := m.(type) {
+				case *models.User:
+					names = append(names, object.Name)
+				case *models.Task:
+					names = append(names, object.Type)
+				}
+			}, result)
+			sort.Strings(names)
+			return names, err
+		}
+
+		for _, test := range tests {
+			names, err := run(test.collection, test.where)
+			if err != test.err {
+				t.Fatal("Expected:", test.err, "Actual:", err, "for", test.where)
+			}
+			if !equalStrings(names, test.expected) {
+				t.Fatal("Expected:", test.expected, "Actual:", names, "for", test.where)
+			}
+		}
+
+		// Sub-queries only find what the requester may read
+		ds.SetQueryBuilder(NewRestrictedQueryBuilder(users["Jane"], nil))
+
+		if names, err := run(models.CollectionUser, inHidden); err != nil || len(names) != 0 {
+			t.Fatal("Expected: no users of a role I can't read", "Actual:", names, err)
+		}
+		if names, err := run(models.CollectionUser, `{"name": {"$select": {"query": {"className": "_Role"}, "key": "name"}}}`); err != nil || len(names) != 0 {
+			t.Fatal("Expected: no names of roles I can't read", "Actual:", names, err)
+		}
+		if _, err := run(models.CollectionTask, `{"user": {"$inQuery": {"className": "_User", "where": {"email": {"$exists": true}}}}}`); err != ERR_ACCESS_DENIED {
+			t.Fatal("Expected:", ERR_ACCESS_DENIED, "Actual:", err)
+		}
+
+		previous := MaxSubQueryResults
+		defer func() { MaxSubQueryResults = previous }()
+		MaxSubQueryResults = 1
+		if _, err := run(models.CollectionTask, `{"user": {"$inQuery": {"className": "_User"}}}`); err != ERR_SUBQUERY_TOO_LARGE {
+			t.Fatal("Expected:", ERR_SUBQUERY_TOO_LARGE, "Actual:", err)
+		}
+	})
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -154,3 +154,62 @@ func TestTaskParams(t *testing.T) {
 	})
 
 }
+
+func TestConcurrentArrayChanges(t *testing.T) {
+
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		task := models.NewEmptyTask()
+		task.Set("Parameters", []interface{}{"first"})
+		if error := task.Save(ds); error != nil {
+			t.Fatal("Could not create task:", error)
+		}
+
+		done := make(chan error)
+		for i := 0; i < 20; i++ {
+			go func(i int) {
+				taskCopy := models.NewTask(task.ObjectId())
+				taskCopy.Add("Parameters", strconv.Itoa(i))
+				if err := taskCopy.Save(ds); err != nil {
+					done <- err
+					return
+				}
+				taskCopy.AddUnique("Parameters", "shared")
+				done <- taskCopy.Save(ds)
+			}(i)
+		}
+
+		for i := 0; i < 20; i++ {
+			if err := <-done; err != nil {
+				t.Fatal("Error saving task:", err)
+			}
+		}
+
+		task.Remove("Parameters", "first")
+		if error := task.Save(ds); error != nil {
+			t.Fatal("Could not save task:", error)
+		}
+
+		// refresh the task
+		if error := task.Fetch(ds); error != nil {
+			t.Fatal("Could not refresh task:", error)
+		}
+
+		if len(task.Parameters) != 21 {
+			t.Fatal("Expected every change to be kept. Expected 21 parameters. Actual:", task.Parameters)
+		}
+
+		shared := 0
+		for _, p := range task.Parameters {
+			if p == "first" {
+				t.Fatal("Expected first to be removed. Actual:", task.Parameters)
+			}
+			if p == "shared" {
+				shared++
+			}
+		}
+		if shared != 1 {
+			t.Fatal("Expected shared to be added once. Actual:", shared)
+		}
+	})
+}
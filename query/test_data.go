@@ -16,6 +16,8 @@ var restrictedQB = NewRestrictedQueryBuilder(user, roles)
 var publicWriteModel = NewTestModelWithWrite(",jfbjdbjdlfkn", db.PUBLIC_KEY)
 var userWriteModel = NewTestModelWithWrite("kdajfhiudj.clmzd;.", user.ObjectId())
 var mixedPermModel = NewTestModelWithWrite("lskdjfni;", user.ObjectId(), db.PUBLIC_KEY)
+var roleWriteModel = NewTestModelWithWrite("pqmznxbv", "role:admin")
+var otherRoleWriteModel = NewTestModelWithWrite("wlekrjth", "role:moderator")
 
 var modTime = time.Now()
 var utcModTime = modTime.UTC()
@@ -1,6 +1,7 @@
 package query
 
 import (
+	"os"
 	"testing"
 
 	"github.com/nidhik/backend/db"
@@ -15,6 +16,11 @@ type DatastoreTest func(t *testing.T, ds db.DataStore)
 const errSetup = "Could not set up mongo database:"
 
 func RunTest(t *testing.T, test DatastoreTest) {
+	if os.Getenv("TEST_DATASTORE") == "memory" {
+		RunMemoryTest(t, test)
+		return
+	}
+
 	// SetupMongoContainer may skip or fatal the test if docker isn't found or something goes
 	// wrong when setting up the container. Thus, no error is returned
 	containerID, _ := utils.SetupMongoContainer(t)
@@ -34,6 +40,9 @@ func RunTest(t *testing.T, test DatastoreTest) {
 	createCollection(t, database, models.CollectionRole)
 	createCollection(t, database, models.CollectionUser)
 
+	_, err := db.EnsureIndexes(database)
+	AssertNoError(t, errSetup, err)
+
 	ds := db.GetDataStore(NewMongoQueryBuilder())
 
 	defer db.MasterSession.Close()
@@ -42,6 +51,18 @@ func RunTest(t *testing.T, test DatastoreTest) {
 
 }
 
+// RunMemoryTest runs a datastore test against a fresh in-memory store, no docker required.
+func RunMemoryTest(t *testing.T, test DatastoreTest) {
+	previous := db.GetDataStore
+	defer func() { db.GetDataStore = previous }()
+
+	db.UseMemoryDataStore()
+	ds := db.GetDataStore(NewMongoQueryBuilder())
+	defer ds.Close()
+
+	test(t, ds)
+}
+
 func createCollection(t *testing.T, database *mgo.Database, name string) {
 	collection := database.C(name)
 	err := collection.Create(&mgo.CollectionInfo{})
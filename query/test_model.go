@@ -2,6 +2,7 @@ package query
 
 import (
 	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
 )
 
 const (
@@ -10,8 +11,9 @@ const (
 )
 
 type TestModel struct {
-	TestField    string      `json:"testField,omitempty" bson:"testField"`
-	Related      db.Relation `json:"-" bson:"-"`
+	TestField    string           `json:"testField,omitempty" bson:"testField"`
+	Location     *models.GeoPoint `json:"location,omitempty" bson:"location,omitempty"`
+	Related      db.Relation      `json:"-" bson:"-"`
 	db.BaseModel `bson:",inline"`
 }
 
@@ -68,6 +70,18 @@ func (model *TestModel) Increment(fieldName string, amount int) {
 	model.BaseModel.Increment(model, fieldName, amount)
 }
 
+func (model *TestModel) Add(fieldName string, values ...interface{}) {
+	model.BaseModel.Add(model, fieldName, values...)
+}
+
+func (model *TestModel) AddUnique(fieldName string, values ...interface{}) {
+	model.BaseModel.AddUnique(model, fieldName, values...)
+}
+
+func (model *TestModel) Remove(fieldName string, values ...interface{}) {
+	model.BaseModel.Remove(model, fieldName, values...)
+}
+
 func (model *TestModel) CustomUnmarshall() {
 	model.CollectionName = TestCollection
 	model.Related = newTestRelation(model)
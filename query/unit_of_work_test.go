@@ -0,0 +1,110 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Hides RunTransaction so a unit of work has to roll back by itself
+type nonTransactionalDataStore struct {
+	db.DataStore
+}
+
+func TestUnitOfWorkCommit(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+
+		role := models.NewEmptyRole()
+		role.Set("Name", "coaches")
+		AssertNoError(t, errSetup, role.Save(ds))
+		role = models.NewRole(role.ObjectId())
+		AssertNoError(t, errSetup, role.Fetch(ds))
+
+		// The user only gets an id once the unit of work inserts it
+		user := models.NewEmptyUser()
+		role.Users.Add(user)
+
+		uow := db.NewUnitOfWork(ds)
+		uow.Insert(user)
+		uow.SaveRelation(role.Users)
+		uow.Update(role, func() {
+			role.Set("Name", "coaches_"+user.ObjectId())
+		})
+		AssertNoError(t, "Could not commit:", uow.Commit())
+
+		roles, err := models.FindRolesForUser(user, ds)
+		AssertNoError(t, "Could not find roles:", err)
+		if len(roles) != 1 || roles[0].Name != "coaches_"+user.ObjectId() {
+			t.Fatal("Expected: role coaches_"+user.ObjectId(), "Actual:", roles)
+		}
+	})
+}
+
+func TestUnitOfWorkRollback(t *testing.T) {
+	RunTest(t, func(t *testing.T, ds db.DataStore) {
+		testUnitOfWorkRollback(t, ds)
+	})
+
+	// The memory store commits in a transaction, so also check compensating writes there
+	RunMemoryTest(t, func(t *testing.T, ds db.DataStore) {
+		testUnitOfWorkRollback(t, &nonTransactionalDataStore{ds})
+	})
+}
+
+func testUnitOfWorkRollback(t *testing.T, ds db.DataStore) {
+	role := models.NewEmptyRole()
+	role.Set("Name", "coaches")
+	AssertNoError(t, errSetup, role.Save(ds))
+	role = models.NewRole(role.ObjectId())
+	AssertNoError(t, errSetup, role.Fetch(ds))
+
+	member := models.NewEmptyUser()
+	AssertNoError(t, errSetup, member.Save(ds))
+	role.Users.Add(member)
+	AssertNoError(t, errSetup, ds.SaveRelatedObjects(role.Users))
+
+	// A copy that will be out of date by the time it is saved
+	stale := models.NewUser(member.ObjectId())
+	AssertNoError(t, errSetup, stale.Fetch(ds))
+	member.Set("Email", "member@foo.com")
+	AssertNoError(t, errSetup, member.Save(ds))
+
+	user := models.NewEmptyUser()
+	user.Set("Email", "new@foo.com")
+	role = models.NewRole(role.ObjectId())
+	AssertNoError(t, errSetup, role.Fetch(ds))
+
+	uow := db.NewUnitOfWork(ds)
+	uow.Insert(user)
+	uow.Update(role, func() {
+		role.Set("Name", "players")
+		role.Users.Add(user)
+		role.Users.Remove(member)
+	})
+	uow.SaveRelation(role.Users)
+	uow.Update(stale, func() {
+		stale.Set("Email", "stale@foo.com")
+	})
+
+	if err := uow.Commit(); err != db.ERR_VERSION_CONFLICT {
+		t.Fatal("Expected:", db.ERR_VERSION_CONFLICT, "Actual:", err)
+	}
+
+	if n, _ := ds.Count(models.CollectionUser, bson.M{"email": "new@foo.com"}); n != 0 {
+		t.Fatal("Expected inserted user to be removed. Actual count:", n)
+	}
+
+	check := models.NewRole(role.ObjectId())
+	AssertNoError(t, "Could not fetch role:", check.Fetch(ds))
+	if check.Name != "coaches" {
+		t.Fatal("Expected: coaches", "Actual:", check.Name)
+	}
+
+	users, err := check.Users.Find(ds)
+	AssertNoError(t, "Could not find role users:", err)
+	if len(users) != 1 || users[0].ObjectId() != member.ObjectId() {
+		t.Fatal("Expected only the original member in the role. Actual:", users)
+	}
+}
@@ -0,0 +1,115 @@
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/nidhik/backend/db"
+)
+
+var ERR_INVALID_UPDATE = errors.New("Invalid update.")
+
+// Parse update operators, {"__op": "Increment", "amount": 1} and the like
+type updateOperator struct {
+	Op      string          `json:"__op"`
+	Amount  *int            `json:"amount"`
+	Objects json.RawMessage `json:"objects"`
+}
+
+// ApplyUpdate applies a Parse style update to model, to be saved after. Fields are named by
+// their json keys and given either a new value or an operator:
+//
+//	{"__op": "Increment", "amount": n}
+//	{"__op": "Delete"}
+//	{"__op": "Add" | "AddUnique" | "Remove", "objects": [...]}
+//
+// The array operators change the stored array in place, so concurrent changes are kept.
+// Internal fields, stored with a leading underscore, cannot be updated.
+func ApplyUpdate(model db.Model, update map[string]json.RawMessage) error {
+	fields := updatableFields(model)
+
+	for key, raw := range update {
+		field, ok := fields[key]
+		if !ok {
+			return ERR_INVALID_FIELD_NAME
+		}
+
+		var op updateOperator
+		if json.Unmarshal(raw, &op) != nil || len(op.Op) == 0 {
+			value := reflect.New(field.Type)
+			if err := json.Unmarshal(raw, value.Interface()); err != nil {
+				return ERR_INVALID_UPDATE
+			}
+			model.Set(field.Name, value.Elem().Interface())
+			continue
+		}
+
+		switch op.Op {
+		case "Increment":
+			amount := 1
+			if op.Amount != nil {
+				amount = *op.Amount
+			}
+			switch field.Type.Kind() {
+			case reflect.Int, reflect.Int32, reflect.Int64:
+				model.Increment(field.Name, amount)
+			default:
+				return ERR_INVALID_UPDATE
+			}
+		case "Delete":
+			model.Unset(field.Name)
+		case "Add", "AddUnique", "Remove":
+			if field.Type.Kind() != reflect.Slice {
+				return ERR_INVALID_UPDATE
+			}
+
+			objects := reflect.New(field.Type)
+			if err := json.Unmarshal(op.Objects, objects.Interface()); err != nil || objects.Elem().Len() == 0 {
+				return ERR_INVALID_UPDATE
+			}
+
+			values := make([]interface{}, objects.Elem().Len())
+			for i := range values {
+				values[i] = objects.Elem().Index(i).Interface()
+			}
+
+			switch op.Op {
+			case "Add":
+				model.Add(field.Name, values...)
+			case "AddUnique":
+				model.AddUnique(field.Name, values...)
+			case "Remove":
+				model.Remove(field.Name, values...)
+			}
+		default:
+			return ERR_INVALID_UPDATE
+		}
+	}
+	return nil
+}
+
+// updatableFields maps the json keys of the model's own fields to the fields
+func updatableFields(model db.Model) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	t := reflect.TypeOf(model)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous || len(f.PkgPath) > 0 {
+			continue
+		}
+
+		key := strings.Split(f.Tag.Get("json"), ",")[0]
+		bsonKey := strings.Split(f.Tag.Get("bson"), ",")[0]
+		if len(key) == 0 || key == "-" || len(bsonKey) == 0 || bsonKey == "-" || strings.HasPrefix(bsonKey, "_") {
+			continue
+		}
+		fields[key] = f
+	}
+	return fields
+}
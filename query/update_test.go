@@ -0,0 +1,57 @@
+package query
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nidhik/backend/models"
+)
+
+func TestApplyUpdate(t *testing.T) {
+	tests := []struct {
+		update   string
+		err      error
+		field    string
+		expected interface{}
+	}{
+		{`{"taskStatus":"DONE"}`, nil, "$set", map[string]interface{}{"taskStatus": "DONE"}},
+		{`{"taskClaimed":{"__op":"Increment","amount":2}}`, nil, "$inc", map[string]interface{}{"taskClaimed": float64(2)}},
+		{`{"taskMessage":{"__op":"Delete"}}`, nil, "$unset", map[string]interface{}{"taskMessage": ""}},
+		{`{"taskParameters":{"__op":"Add","objects":["a",1]}}`, nil, "$push", map[string]interface{}{"taskParameters": map[string]interface{}{"$each": []interface{}{"a", float64(1)}}}},
+		{`{"taskParameters":{"__op":"AddUnique","objects":["a"]}}`, nil, "$addToSet", map[string]interface{}{"taskParameters": map[string]interface{}{"$each": []interface{}{"a"}}}},
+		{`{"taskParameters":{"__op":"Remove","objects":["a"]}}`, nil, "$pull", map[string]interface{}{"taskParameters": map[string]interface{}{"$in": []interface{}{"a"}}}},
+		{`{"taskStatus":{"__op":"Add","objects":["a"]}}`, ERR_INVALID_UPDATE, "", nil},
+		{`{"taskParameters":{"__op":"Add","objects":[]}}`, ERR_INVALID_UPDATE, "", nil},
+		{`{"taskStatus":{"__op":"Increment"}}`, ERR_INVALID_UPDATE, "", nil},
+		{`{"taskStatus":{"__op":"Batch"}}`, ERR_INVALID_UPDATE, "", nil},
+		{`{"taskClaimed":"many"}`, ERR_INVALID_UPDATE, "", nil},
+		{`{"_wperm":["*"]}`, ERR_INVALID_FIELD_NAME, "", nil},
+		{`{"id":"other"}`, ERR_INVALID_FIELD_NAME, "", nil},
+	}
+
+	for _, test := range tests {
+		var update map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(test.update), &update); err != nil {
+			t.Fatal("Invalid test update:", test.update)
+		}
+
+		task := models.NewTask("abcd")
+		if err := ApplyUpdate(task, update); err != test.err {
+			t.Fatal("Expected:", test.err, "Actual:", err, "for", test.update)
+		}
+		if test.err != nil {
+			continue
+		}
+
+		// Compare the change documents as json, since the values are typed by the fields
+		var changes map[string]interface{}
+		data, _ := json.Marshal(task.Update(time.Now())[test.field])
+		json.Unmarshal(data, &changes)
+		delete(changes, "_updated_at")
+		if !reflect.DeepEqual(changes, test.expected) {
+			t.Fatal("Expected:", test.expected, "Actual:", changes, "for", test.update)
+		}
+	}
+}
@@ -0,0 +1,536 @@
+package query
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nidhik/backend/db"
+	"github.com/nidhik/backend/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var ERR_INVALID_WHERE = errors.New("Invalid where clause.")
+var ERR_INVALID_FIELD_NAME = errors.New("Invalid field name in query.")
+var ERR_INVALID_QUERY_OPERATOR = errors.New("Invalid query operator.")
+var ERR_INVALID_QUERY_VALUE = errors.New("Invalid value for query operator.")
+
+// Parse field names that are stored under a different key
+var fieldAliases = map[string]string{
+	"objectId":  "_id",
+	"id":        "_id",
+	"createdAt": "_created_at",
+	"updatedAt": "_updated_at",
+}
+
+var validFieldName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+var validRegexOptions = regexp.MustCompile(`^[imxs]*$`)
+
+// ParseWhere translates a Parse style where clause into a mongo query. Only a known set of
+// comparison operators is accepted and fields starting with an underscore (ACLs, hashed
+// passwords, auth data...) cannot be queried, so the result is safe to hand to a
+// DataStoreQueryBuilder which then adds its own access checks. Queries using the relational
+// operators $relatedTo, $inQuery, $notInQuery, $select and $dontSelect have to be resolved
+// with ResolveWhere before they are run. Text searches are only accepted at the top level,
+// where mongo runs them and the builders check them.
+func ParseWhere(where map[string]interface{}) (bson.M, error) {
+	return parseWhere(where, true)
+}
+
+func parseWhere(where map[string]interface{}, top bool) (bson.M, error) {
+	result := bson.M{}
+
+	for key, value := range where {
+		switch key {
+		case "$or", "$and":
+			clauses, err := parseClauses(value)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = clauses
+			continue
+		case "$text":
+			if !top {
+				return nil, ERR_INVALID_QUERY_OPERATOR
+			}
+			text, err := parseText(value)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = text
+			continue
+		case "$relatedTo":
+			related, err := parseRelatedTo(value)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = related
+			continue
+		}
+
+		field, err := parseFieldName(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if ops, ok := value.(map[string]interface{}); ok && isOperatorMap(ops) {
+			cond, ptrField, err := parseOperators(ops)
+			if err != nil {
+				return nil, err
+			}
+			if ptrField {
+				field = pointerField(field)
+			}
+			result[field] = cond
+			continue
+		}
+
+		v, ptrField, err := parseValue(value)
+		if err != nil {
+			return nil, err
+		}
+		if ptrField {
+			field = pointerField(field)
+		}
+		result[field] = v
+	}
+
+	return result, nil
+}
+
+// ParseOrder translates a comma separated Parse order ("-createdAt,name") into sort fields.
+func ParseOrder(order string) ([]string, error) {
+	var fields []string
+	for _, f := range strings.Split(order, ",") {
+		f = strings.TrimSpace(f)
+		if len(f) == 0 {
+			continue
+		}
+
+		prefix := ""
+		if strings.HasPrefix(f, "-") {
+			prefix = "-"
+			f = f[1:]
+		}
+
+		field, err := parseFieldName(f)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, prefix+field)
+	}
+	return fields, nil
+}
+
+func parseClauses(value interface{}) ([]bson.M, error) {
+	list, ok := value.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, ERR_INVALID_WHERE
+	}
+
+	var clauses []bson.M
+	for _, e := range list {
+		sub, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, ERR_INVALID_WHERE
+		}
+
+		clause, err := parseWhere(sub, false)
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, clause)
+	}
+	return clauses, nil
+}
+
+// parseText checks a text search, {"$search": "words \"a phrase\" -excluded"}, see
+// db.TextSearch.
+func parseText(value interface{}) (bson.M, error) {
+	text, ok := value.(map[string]interface{})
+	if !ok || len(text) != 1 {
+		return nil, ERR_INVALID_QUERY_VALUE
+	}
+
+	search, ok := text["$search"].(string)
+	if !ok {
+		return nil, ERR_INVALID_QUERY_VALUE
+	}
+	return bson.M{"$search": search}, nil
+}
+
+func parseFieldName(key string) (string, error) {
+	if alias, ok := fieldAliases[key]; ok {
+		return alias, nil
+	}
+
+	for _, part := range strings.Split(key, ".") {
+		if !validFieldName.MatchString(part) {
+			return "", ERR_INVALID_FIELD_NAME
+		}
+	}
+	return key, nil
+}
+
+func pointerField(field string) string {
+	return "_p_" + field
+}
+
+func isOperatorMap(m map[string]interface{}) bool {
+	for k := range m {
+		if strings.HasPrefix(k, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+func parseOperators(ops map[string]interface{}) (bson.M, bool, error) {
+	cond := bson.M{}
+	ptrField := false
+	var maxDistance *float64
+
+	for op, arg := range ops {
+		switch op {
+		case "$lt", "$lte", "$gt", "$gte", "$ne":
+			v, isPtr, err := parseValue(arg)
+			if err != nil {
+				return nil, false, err
+			}
+			ptrField = ptrField || isPtr
+			cond[op] = v
+
+		case "$in", "$nin", "$all":
+			list, ok := arg.([]interface{})
+			if !ok {
+				return nil, false, ERR_INVALID_QUERY_VALUE
+			}
+
+			values := []interface{}{}
+			for _, e := range list {
+				v, isPtr, err := parseValue(e)
+				if err != nil {
+					return nil, false, err
+				}
+				ptrField = ptrField || isPtr
+				values = append(values, v)
+			}
+			cond[op] = values
+
+		case "$exists":
+			b, ok := arg.(bool)
+			if !ok {
+				return nil, false, ERR_INVALID_QUERY_VALUE
+			}
+			cond[op] = b
+
+		case "$regex":
+			s, ok := arg.(string)
+			if !ok {
+				return nil, false, ERR_INVALID_QUERY_VALUE
+			}
+			if _, err := regexp.Compile(s); err != nil {
+				return nil, false, ERR_INVALID_QUERY_VALUE
+			}
+			cond[op] = s
+
+		case "$options":
+			s, ok := arg.(string)
+			if !ok || !validRegexOptions.MatchString(s) {
+				return nil, false, ERR_INVALID_QUERY_VALUE
+			}
+			cond[op] = s
+
+		case "$nearSphere":
+			point, err := parseGeoPoint(arg)
+			if err != nil {
+				return nil, false, err
+			}
+			cond[op] = bson.M{"$geometry": db.GeoJSON(point.Latitude, point.Longitude)}
+
+		case "$maxDistance", "$maxDistanceInRadians", "$maxDistanceInKilometers", "$maxDistanceInMiles":
+			d, ok := arg.(float64)
+			if !ok || d < 0 || maxDistance != nil {
+				return nil, false, ERR_INVALID_QUERY_VALUE
+			}
+			meters := d * distanceUnits[op]
+			maxDistance = &meters
+
+		case "$within", "$geoWithin":
+			ring, err := parseWithin(arg)
+			if err != nil {
+				return nil, false, err
+			}
+			cond["$geoWithin"] = bson.M{"$geometry": bson.M{"type": "Polygon", "coordinates": []interface{}{ring}}}
+
+		case "$inQuery", "$notInQuery":
+			sub, err := parseSubQuery(arg)
+			if err != nil {
+				return nil, false, err
+			}
+			// Matches pointers to the objects the sub-query finds
+			ptrField = true
+			cond[op] = sub
+
+		case "$select", "$dontSelect":
+			sel, ok := arg.(map[string]interface{})
+			if !ok {
+				return nil, false, ERR_INVALID_QUERY_VALUE
+			}
+
+			sub, err := parseSubQuery(sel["query"])
+			if err != nil {
+				return nil, false, err
+			}
+
+			key, ok := sel["key"].(string)
+			if !ok {
+				return nil, false, ERR_INVALID_QUERY_VALUE
+			}
+			if sub["key"], err = parseFieldName(key); err != nil {
+				return nil, false, err
+			}
+			cond[op] = sub
+
+		default:
+			return nil, false, ERR_INVALID_QUERY_OPERATOR
+		}
+	}
+
+	if _, ok := cond["$options"]; ok {
+		if _, ok := cond["$regex"]; !ok {
+			return nil, false, ERR_INVALID_QUERY_OPERATOR
+		}
+	}
+
+	// Sub-queries resolve to $in and $nin lists, which may only be given once
+	for _, ops := range [][]string{{"$in", "$inQuery", "$select"}, {"$nin", "$notInQuery", "$dontSelect"}} {
+		n := 0
+		for _, op := range ops {
+			if _, ok := cond[op]; ok {
+				n++
+			}
+		}
+		if n > 1 {
+			return nil, false, ERR_INVALID_QUERY_OPERATOR
+		}
+	}
+
+	if maxDistance != nil {
+		near, ok := cond["$nearSphere"].(bson.M)
+		if !ok {
+			return nil, false, ERR_INVALID_QUERY_OPERATOR
+		}
+		near["$maxDistance"] = *maxDistance
+	}
+
+	return cond, ptrField, nil
+}
+
+// Meters per unit of the Parse distance operators, radians being on the earth's surface
+var distanceUnits = map[string]float64{
+	"$maxDistance":             db.EarthRadiusKilometers * 1000,
+	"$maxDistanceInRadians":    db.EarthRadiusKilometers * 1000,
+	"$maxDistanceInKilometers": 1000,
+	"$maxDistanceInMiles":      db.EarthRadiusKilometers * 1000 / db.EarthRadiusMiles,
+}
+
+// parseRelatedTo checks {"object": <pointer>, "key": "<relation>"}, which matches the
+// objects related to object through its relation.
+func parseRelatedTo(value interface{}) (bson.M, error) {
+	v, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, ERR_INVALID_QUERY_VALUE
+	}
+
+	object, ok := v["object"].(map[string]interface{})
+	key, ok2 := v["key"].(string)
+	if !ok || !ok2 || object["__type"] != "Pointer" {
+		return nil, ERR_INVALID_QUERY_VALUE
+	}
+
+	className, ok1 := object["className"].(string)
+	objectId, ok2 := object["objectId"].(string)
+	if !ok1 || !ok2 {
+		return nil, ERR_INVALID_QUERY_VALUE
+	}
+
+	info, err := db.LookupClass(className)
+	if err != nil {
+		return nil, ERR_INVALID_QUERY_VALUE
+	}
+	if _, err := info.Relation(key); err != nil {
+		return nil, ERR_INVALID_QUERY_VALUE
+	}
+
+	return bson.M{"className": className, "objectId": objectId, "key": key}, nil
+}
+
+// parseSubQuery checks {"className": "...", "where": {...}}, the where clause being optional.
+func parseSubQuery(value interface{}) (bson.M, error) {
+	v, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, ERR_INVALID_QUERY_VALUE
+	}
+
+	className, ok := v["className"].(string)
+	if !ok {
+		return nil, ERR_INVALID_QUERY_VALUE
+	}
+	if _, err := db.LookupClass(className); err != nil {
+		return nil, ERR_INVALID_QUERY_VALUE
+	}
+
+	where := bson.M{}
+	if w, ok := v["where"]; ok {
+		clause, ok := w.(map[string]interface{})
+		if !ok {
+			return nil, ERR_INVALID_QUERY_VALUE
+		}
+
+		var err error
+		if where, err = ParseWhere(clause); err != nil {
+			return nil, err
+		}
+	}
+
+	return bson.M{"className": className, "where": where}, nil
+}
+
+func parseGeoPoint(value interface{}) (*models.GeoPoint, error) {
+	v, ok := value.(map[string]interface{})
+	if !ok || v["__type"] != "GeoPoint" {
+		return nil, ERR_INVALID_QUERY_VALUE
+	}
+
+	latitude, ok1 := v["latitude"].(float64)
+	longitude, ok2 := v["longitude"].(float64)
+	if !ok1 || !ok2 {
+		return nil, ERR_INVALID_QUERY_VALUE
+	}
+
+	point, err := models.NewGeoPoint(latitude, longitude)
+	if err != nil {
+		return nil, ERR_INVALID_QUERY_VALUE
+	}
+	return point, nil
+}
+
+// parseWithin translates {"$box": [southwest, northeast]} or {"$polygon": [points...]} into
+// the closed ring of a GeoJSON polygon.
+func parseWithin(value interface{}) ([]interface{}, error) {
+	within, ok := value.(map[string]interface{})
+	if !ok || len(within) != 1 {
+		return nil, ERR_INVALID_QUERY_VALUE
+	}
+
+	var shape string
+	var points []*models.GeoPoint
+	for op, arg := range within {
+		list, ok := arg.([]interface{})
+		if !ok {
+			return nil, ERR_INVALID_QUERY_VALUE
+		}
+
+		for _, e := range list {
+			point, err := parseGeoPoint(e)
+			if err != nil {
+				return nil, err
+			}
+			points = append(points, point)
+		}
+		shape = op
+	}
+
+	switch shape {
+	case "$box":
+		if len(points) != 2 || points[0].Latitude > points[1].Latitude {
+			return nil, ERR_INVALID_QUERY_VALUE
+		}
+		sw, ne := points[0], points[1]
+		points = []*models.GeoPoint{
+			sw,
+			{Latitude: sw.Latitude, Longitude: ne.Longitude},
+			ne,
+			{Latitude: ne.Latitude, Longitude: sw.Longitude},
+		}
+	case "$polygon":
+		if len(points) < 3 {
+			return nil, ERR_INVALID_QUERY_VALUE
+		}
+	default:
+		return nil, ERR_INVALID_QUERY_OPERATOR
+	}
+
+	var ring []interface{}
+	for _, p := range append(points, points[0]) {
+		ring = append(ring, []interface{}{p.Longitude, p.Latitude})
+	}
+	return ring, nil
+}
+
+// parseValue decodes Parse typed values. isPtr is true when the value is a Pointer, in
+// which case the field is stored as "_p_<field>" holding "<className>$<objectId>".
+func parseValue(value interface{}) (interface{}, bool, error) {
+	switch v := value.(type) {
+	case nil, string, bool, float64:
+		return v, false, nil
+
+	case map[string]interface{}:
+		switch v["__type"] {
+		case "Pointer":
+			className, ok1 := v["className"].(string)
+			objectId, ok2 := v["objectId"].(string)
+			if !ok1 || !ok2 {
+				return nil, false, ERR_INVALID_QUERY_VALUE
+			}
+			return className + "$" + objectId, true, nil
+
+		case "Date":
+			iso, ok := v["iso"].(string)
+			if !ok {
+				return nil, false, ERR_INVALID_QUERY_VALUE
+			}
+			t, err := time.Parse(time.RFC3339, iso)
+			if err != nil {
+				return nil, false, ERR_INVALID_QUERY_VALUE
+			}
+			return t.UTC(), false, nil
+
+		case "GeoPoint":
+			point, err := parseGeoPoint(v)
+			if err != nil {
+				return nil, false, err
+			}
+			return db.GeoJSON(point.Latitude, point.Longitude), false, nil
+		}
+
+		// A literal sub document, which must not smuggle in operators
+		doc := bson.M{}
+		for k, e := range v {
+			if strings.HasPrefix(k, "$") {
+				return nil, false, ERR_INVALID_QUERY_OPERATOR
+			}
+			sub, _, err := parseValue(e)
+			if err != nil {
+				return nil, false, err
+			}
+			doc[k] = sub
+		}
+		return doc, false, nil
+
+	case []interface{}:
+		list := []interface{}{}
+		for _, e := range v {
+			sub, _, err := parseValue(e)
+			if err != nil {
+				return nil, false, err
+			}
+			list = append(list, sub)
+		}
+		return list, false, nil
+	}
+
+	return nil, false, ERR_INVALID_QUERY_VALUE
+}
@@ -0,0 +1,98 @@
+package query
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var whereTests = []struct {
+	where  string
+	output bson.M
+	err    error
+}{
+	{`{}`, bson.M{}, nil},
+	{`{"taskStatus": "NEW"}`, bson.M{"taskStatus": "NEW"}, nil},
+	{`{"objectId": "abc"}`, bson.M{"_id": "abc"}, nil},
+	{`{"taskClaimed": {"$gte": 1, "$lt": 5}}`, bson.M{"taskClaimed": bson.M{"$gte": 1.0, "$lt": 5.0}}, nil},
+	{`{"taskType": {"$in": ["A", "B"]}}`, bson.M{"taskType": bson.M{"$in": []interface{}{"A", "B"}}}, nil},
+	{`{"category": {"$all": ["transactional"]}, "to": {"$nin": ["a@b.com"]}}`, bson.M{"category": bson.M{"$all": []interface{}{"transactional"}}, "to": bson.M{"$nin": []interface{}{"a@b.com"}}}, nil},
+	{`{"email": {"$exists": true}}`, bson.M{"email": bson.M{"$exists": true}}, nil},
+	{`{"name": {"$regex": "^Nid", "$options": "i"}}`, bson.M{"name": bson.M{"$regex": "^Nid", "$options": "i"}}, nil},
+	{`{"user": {"__type": "Pointer", "className": "_User", "objectId": "xyz"}}`, bson.M{"_p_user": "_User$xyz"}, nil},
+	{`{"user": {"$ne": {"__type": "Pointer", "className": "_User", "objectId": "xyz"}}}`, bson.M{"_p_user": bson.M{"$ne": "_User$xyz"}}, nil},
+	{`{"createdAt": {"$gt": {"__type": "Date", "iso": "2016-02-08T06:33:04Z"}}}`, bson.M{"_created_at": bson.M{"$gt": time.Date(2016, 2, 8, 6, 33, 4, 0, time.UTC)}}, nil},
+	{`{"$or": [{"username": "nidhi"}, {"email": "nidhi@foo.com"}]}`, bson.M{"$or": []bson.M{bson.M{"username": "nidhi"}, bson.M{"email": "nidhi@foo.com"}}}, nil},
+	{`{"customFields.tier": "pro"}`, bson.M{"customFields.tier": "pro"}, nil},
+	{`{"location": {"__type": "GeoPoint", "latitude": 40.5, "longitude": -74}}`, bson.M{"location": bson.M{"type": "Point", "coordinates": []interface{}{-74.0, 40.5}}}, nil},
+	{`{"location": {"$nearSphere": {"__type": "GeoPoint", "latitude": 40.5, "longitude": -74}, "$maxDistanceInKilometers": 10}}`,
+		bson.M{"location": bson.M{"$nearSphere": bson.M{"$geometry": bson.M{"type": "Point", "coordinates": []interface{}{-74.0, 40.5}}, "$maxDistance": 10000.0}}}, nil},
+	{`{"location": {"$within": {"$box": [{"__type": "GeoPoint", "latitude": 0, "longitude": 0}, {"__type": "GeoPoint", "latitude": 1, "longitude": 2}]}}}`,
+		bson.M{"location": bson.M{"$geoWithin": bson.M{"$geometry": bson.M{"type": "Polygon", "coordinates": []interface{}{[]interface{}{
+			[]interface{}{0.0, 0.0}, []interface{}{2.0, 0.0}, []interface{}{2.0, 1.0}, []interface{}{0.0, 1.0}, []interface{}{0.0, 0.0}}}}}}}, nil},
+	{`{"$relatedTo": {"object": {"__type": "Pointer", "className": "_Role", "objectId": "r1"}, "key": "users"}}`,
+		bson.M{"$relatedTo": bson.M{"className": "_Role", "objectId": "r1", "key": "users"}}, nil},
+	{`{"user": {"$inQuery": {"className": "_User", "where": {"name": "Jane"}}}}`,
+		bson.M{"_p_user": bson.M{"$inQuery": bson.M{"className": "_User", "where": bson.M{"name": "Jane"}}}}, nil},
+	{`{"name": {"$dontSelect": {"query": {"className": "_Role"}, "key": "name"}}}`,
+		bson.M{"name": bson.M{"$dontSelect": bson.M{"className": "_Role", "where": bson.M{}, "key": "name"}}}, nil},
+	{`{"$text": {"$search": "jane"}, "$or": [{"name": "Jane"}]}`, bson.M{"$text": bson.M{"$search": "jane"}, "$or": []bson.M{bson.M{"name": "Jane"}}}, nil},
+
+	// Things that must not get through
+	{`{"name": {"$where": "sleep(1000)"}}`, nil, ERR_INVALID_QUERY_OPERATOR},
+	{`{"$where": "sleep(1000)"}`, nil, ERR_INVALID_FIELD_NAME},
+	{`{"_rperm": "*"}`, nil, ERR_INVALID_FIELD_NAME},
+	{`{"_hashed_password": {"$exists": true}}`, nil, ERR_INVALID_FIELD_NAME},
+	{`{"_auth_data_facebook.id": "123"}`, nil, ERR_INVALID_FIELD_NAME},
+	{`{"customFields": {"tier": {"$gt": ""}}}`, nil, ERR_INVALID_QUERY_OPERATOR},
+	{`{"email": {"$exists": "yes"}}`, nil, ERR_INVALID_QUERY_VALUE},
+	{`{"taskType": {"$in": "A"}}`, nil, ERR_INVALID_QUERY_VALUE},
+	{`{"name": {"$options": "i"}}`, nil, ERR_INVALID_QUERY_OPERATOR},
+	{`{"$or": [{"_wperm": "*"}]}`, nil, ERR_INVALID_FIELD_NAME},
+	{`{"$or": {}}`, nil, ERR_INVALID_WHERE},
+	{`{"$and": [{"$text": {"$search": "jane"}}]}`, nil, ERR_INVALID_QUERY_OPERATOR},
+	{`{"$or": [{"name": "Jane"}, {"$and": [{"$text": {"$search": "jane"}}]}]}`, nil, ERR_INVALID_QUERY_OPERATOR},
+	{`{"location": {"$nearSphere": {"__type": "GeoPoint", "latitude": 91, "longitude": 0}}}`, nil, ERR_INVALID_QUERY_VALUE},
+	{`{"location": {"$maxDistance": 1}}`, nil, ERR_INVALID_QUERY_OPERATOR},
+	{`{"location": {"$within": {"$polygon": [{"__type": "GeoPoint", "latitude": 0, "longitude": 0}]}}}`, nil, ERR_INVALID_QUERY_VALUE},
+	{`{"$relatedTo": {"object": {"__type": "Pointer", "className": "_Role", "objectId": "r1"}, "key": "owners"}}`, nil, ERR_INVALID_QUERY_VALUE},
+	{`{"user": {"$inQuery": {"className": "NotAClass"}}}`, nil, ERR_INVALID_QUERY_VALUE},
+	{`{"user": {"$inQuery": {"className": "_User", "where": {"_hashed_password": {"$exists": true}}}}}`, nil, ERR_INVALID_FIELD_NAME},
+	{`{"name": {"$select": {"query": {"className": "_Role"}, "key": "_rperm"}}}`, nil, ERR_INVALID_FIELD_NAME},
+	{`{"name": {"$in": ["a"], "$select": {"query": {"className": "_Role"}, "key": "name"}}}`, nil, ERR_INVALID_QUERY_OPERATOR},
+}
+
+func TestParseWhere(t *testing.T) {
+	for _, test := range whereTests {
+		var where map[string]interface{}
+		if err := json.Unmarshal([]byte(test.where), &where); err != nil {
+			t.Fatal("Invalid test input:", test.where, err)
+		}
+
+		q, err := ParseWhere(where)
+
+		if err != test.err {
+			t.Fatal("Expected error for", test.where, "to be:", test.err, "Actual:", err)
+		}
+
+		if err == nil && !reflect.DeepEqual(q, test.output) {
+			t.Fatal("Expected", test.where, "to parse to:", test.output, "Actual:", q)
+		}
+	}
+}
+
+func TestParseOrder(t *testing.T) {
+	fields, err := ParseOrder("-createdAt, name")
+	AssertNoError(t, "Could not parse order:", err)
+
+	if !reflect.DeepEqual(fields, []string{"-_created_at", "name"}) {
+		t.Fatal("Unexpected sort fields:", fields)
+	}
+
+	if _, err := ParseOrder("_rperm"); err != ERR_INVALID_FIELD_NAME {
+		t.Fatal("Expected:", ERR_INVALID_FIELD_NAME, "Actual:", err)
+	}
+}
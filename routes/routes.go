@@ -4,10 +4,21 @@ const V1_API = "/api/v1"
 
 const GET_MODEL = "/model/:collection/:id"
 const GET_COLLECTION = "/model/:collection"
+const RESTORE_MODEL = "/model/:collection/:id/restore"
+const RELATION = "/model/:collection/:id/relation/:name"
+
+const AGGREGATE = "/aggregate/:collection"
+
+const FILES = "/files"
+const FILE = "/files/:name"
 
 const GET_ROLE = "/role/:id"
 const ROLES = "/role"
 
+const LIVE_QUERY = "/live"
+
+const AUDIT = "/audit"
+
 const FORGOT = "/forgot"
 const RESET = "/reset"
 const FINISH = "/finish"